@@ -0,0 +1,72 @@
+// Command request_header is an example plugin which adds a header to every
+// request before it's proxied. Build it with
+//
+//	go build -buildmode=plugin -o request_header.so
+//
+// and put request_header.so into the plugin_dir of the gateway:
+//
+//	plugins:
+//	  - name: request_header
+//	    priority: 975
+//	    config:
+//	      header: X-Gateway
+//	      value: bifrost
+//
+// A gateway built from the Godeps workspace uses its vendored napnap, so the
+// Plugin variable doesn't match its interface. The gateway uses the
+// Middleware function then, which only needs the standard library.
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/jasonsoft/napnap"
+)
+
+type requestHeader struct {
+	header string
+	value  string
+}
+
+// Plugin is looked up by the gateway, its address implements the plugin
+// interface.
+var Plugin requestHeader
+
+func (p *requestHeader) Name() string {
+	return "request_header"
+}
+
+func (p *requestHeader) Init(config map[string]interface{}) error {
+	header, _ := config["header"].(string)
+	if len(header) == 0 {
+		return errors.New("header can't be empty")
+	}
+	p.header = header
+	p.value, _ = config["value"].(string)
+	return nil
+}
+
+func (p *requestHeader) Handler() napnap.MiddlewareHandler {
+	return napnap.MiddlewareFunc(func(c *napnap.Context, next napnap.HandlerFunc) {
+		c.Request.Header.Set(p.header, p.value)
+		next(c)
+	})
+}
+
+// Middleware is used by gateways whose napnap differs from the plugin's.
+func Middleware(config map[string]interface{}) (func(http.Handler) http.Handler, error) {
+	p := &requestHeader{}
+	if err := p.Init(config); err != nil {
+		return nil, err
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Header.Set(p.header, p.value)
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// main is ignored when the package is built as a plugin.
+func main() {}
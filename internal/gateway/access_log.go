@@ -0,0 +1,147 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http/httputil"
+	"strings"
+	"time"
+
+	"github.com/jasonsoft/bifrost/internal/logging"
+	"github.com/jasonsoft/bifrost/internal/store"
+	"github.com/jasonsoft/napnap"
+)
+
+type accessLogMiddleware struct {
+	gateway *Gateway
+}
+
+func newAccessLogMiddleware(g *Gateway) *accessLogMiddleware {
+	return &accessLogMiddleware{gateway: g}
+}
+
+// Name, Init and Handler make the access log a built-in plugin, it doesn't
+// have any config.
+func (am *accessLogMiddleware) Name() string {
+	return "access_log"
+}
+
+func (am *accessLogMiddleware) Init(config map[string]interface{}) error {
+	return nil
+}
+
+func (am *accessLogMiddleware) Handler() napnap.MiddlewareHandler {
+	return am
+}
+
+func (am *accessLogMiddleware) Invoke(c *napnap.Context, next napnap.HandlerFunc) {
+	startTime := time.Now()
+	bodyPreview, truncated := am.peekJSONBody(c)
+	// an aborted response is logged too, then the panic goes on to the server
+	defer func() {
+		r := recover()
+		am.log(c, startTime, bodyPreview, truncated)
+		if r != nil {
+			panic(r)
+		}
+	}()
+	next(c)
+}
+
+func (am *accessLogMiddleware) log(c *napnap.Context, startTime time.Time, bodyPreview []byte, truncated bool) {
+	duration := int64(time.Since(startTime) / time.Millisecond)
+	accessLog := logging.NewMessage(am.gateway.app.hostname, am.gateway.app.name, "access", 6)
+	accessLog.CustomFields["request_id"] = c.MustGet("request-id").(string)
+	accessLog.ShortMessage = fmt.Sprintf("%s %s [%d] %dms", c.Request.Method, c.Request.URL.Path, c.Writer.Status(), duration)
+	accessLog.CustomFields["request_host"] = c.Request.Host
+	accessLog.CustomFields["path"] = c.Request.URL.Path
+	accessLog.CustomFields["status"] = c.Writer.Status()
+	accessLog.CustomFields["content_length"] = c.Writer.ContentLength()
+	accessLog.CustomFields["client_ip"] = am.gateway.clientIP(c)
+	accessLog.CustomFields["user_agent"] = c.RequestHeader("User-Agent")
+	accessLog.CustomFields["duration"] = duration
+
+	if upstream, exist := c.Get("upstream"); exist {
+		accessLog.CustomFields["upstream"] = upstream
+	}
+	if variant, exist := c.Get("variant"); exist {
+		accessLog.CustomFields["variant"] = variant
+	}
+	read, tooLarge := c.Get("request_body_read")
+	if tooLarge {
+		accessLog.CustomFields["request_body_read"] = read
+	}
+	if _, exist := c.Get("response_too_large"); exist {
+		accessLog.CustomFields["response_too_large"] = true
+	}
+	if timeout, exist := c.Get("upstream_timeout"); exist {
+		accessLog.CustomFields["upstream_timeout"] = int64(timeout.(time.Duration) / time.Millisecond)
+	}
+
+	cs, exist := c.Get("consumer")
+	if exist {
+		if consumer, ok := cs.(store.Consumer); ok && len(consumer.ID) > 0 {
+			accessLog.CustomFields["consumer_id"] = consumer.ID
+		}
+	}
+
+	// bodies with encrypted fields are never logged
+	_, sensitive := c.Get("field_encryption")
+	if sensitive {
+		zero(bodyPreview)
+	}
+
+	if !(c.Writer.Status() >= 200 && c.Writer.Status() < 400) {
+		if len(bodyPreview) > 0 && !truncated && !sensitive {
+			var fields map[string]interface{}
+			if json.Unmarshal(bodyPreview, &fields) == nil {
+				for k, v := range fields {
+					accessLog.CustomFields["req_body_"+k] = v
+				}
+			}
+		}
+		// the rest of a body which was too large isn't read
+		requestDump, _ := httputil.DumpRequest(c.Request, !sensitive && !tooLarge)
+		respMsg, _ := c.Get("error")
+		if respMsg != nil {
+			respMessage := respMsg.(string)
+			accessLog.FullMessage = fmt.Sprintf("Upsteam response: %s \n\nRequest info: %s \n ", respMessage, string(requestDump))
+		}
+	}
+
+	am.gateway.logger.queueGelfMessage(accessLog)
+}
+
+// peekJSONBody reads at most MaxBodyLogBytes of a json request body and puts
+// the bytes back, so the proxy still forwards the whole body.
+func (am *accessLogMiddleware) peekJSONBody(c *napnap.Context) ([]byte, bool) {
+	if c.Request.Body == nil || !strings.HasPrefix(c.ContentType(), "application/json") {
+		return nil, false
+	}
+	limit := int64(am.gateway.currentConfig().Logs.MaxBodyLogBytes)
+	if limit <= 0 {
+		return nil, false
+	}
+	preview, err := ioutil.ReadAll(io.LimitReader(c.Request.Body, limit+1))
+	c.Request.Body = readCloser{
+		Reader: io.MultiReader(bytes.NewReader(preview), c.Request.Body),
+		Closer: c.Request.Body,
+	}
+	if err != nil {
+		return nil, false
+	}
+	if int64(len(preview)) > limit {
+		return preview[:limit], true
+	}
+	return preview, false
+}
+
+func (l *logger) listQueueCount() {
+	for {
+		l.debug(fmt.Sprintf("count: %d", l.queue.Len()))
+		time.Sleep(1 * time.Second)
+	}
+}
@@ -0,0 +1,121 @@
+package gateway
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/jasonsoft/napnap"
+)
+
+// CORSConfig is the cors setting of an api, it's used instead of the global
+// cors setting for the api. Preflight requests are answered by the gateway
+// and never reach the upstream.
+type CORSConfig struct {
+	AllowedOrigins   []string `json:"allowed_origins" bson:"allowed_origins"` // "*" allows every origin
+	AllowedMethods   []string `json:"allowed_methods" bson:"allowed_methods"` // default GET, HEAD and POST
+	AllowedHeaders   []string `json:"allowed_headers" bson:"allowed_headers"` // "*" allows the requested headers
+	AllowCredentials bool     `json:"allow_credentials" bson:"allow_credentials"`
+	MaxAge           int      `json:"max_age" bson:"max_age"` // seconds the preflight is cached
+}
+
+func (cc *CORSConfig) isValid() error {
+	if cc.AllowCredentials && contains(cc.AllowedOrigins, "*") {
+		return errors.New("cors can't allow credentials for every origin")
+	}
+	if cc.MaxAge < 0 {
+		return errors.New("cors max_age can't be negative")
+	}
+	return nil
+}
+
+func (cc *CORSConfig) isOriginAllowed(origin string) bool {
+	for _, allowed := range cc.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (cc *CORSConfig) allowedMethods() string {
+	if len(cc.AllowedMethods) == 0 {
+		return "GET, HEAD, POST"
+	}
+	return strings.ToUpper(strings.Join(cc.AllowedMethods, ", "))
+}
+
+// preflight answers the OPTIONS request, a disallowed origin gets no
+// Access-Control-* headers so the browser blocks the request.
+func (cc *CORSConfig) preflight(c *napnap.Context) {
+	header := c.Writer.Header()
+	header.Add("Vary", "Origin")
+	header.Add("Vary", "Access-Control-Request-Method")
+	header.Add("Vary", "Access-Control-Request-Headers")
+
+	origin := c.RequestHeader("Origin")
+	if cc.isOriginAllowed(origin) {
+		cc.setOrigin(c, origin)
+		header.Set("Access-Control-Allow-Methods", cc.allowedMethods())
+		if contains(cc.AllowedHeaders, "*") {
+			if requested := c.RequestHeader("Access-Control-Request-Headers"); len(requested) > 0 {
+				header.Set("Access-Control-Allow-Headers", requested)
+			}
+		} else if len(cc.AllowedHeaders) > 0 {
+			header.Set("Access-Control-Allow-Headers", strings.Join(cc.AllowedHeaders, ", "))
+		}
+		if cc.MaxAge > 0 {
+			header.Set("Access-Control-Max-Age", strconv.Itoa(cc.MaxAge))
+		}
+	}
+	c.SetStatus(204)
+}
+
+func (cc *CORSConfig) setOrigin(c *napnap.Context, origin string) {
+	header := c.Writer.Header()
+	if contains(cc.AllowedOrigins, "*") {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		header.Set("Access-Control-Allow-Origin", origin)
+	}
+	if cc.AllowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// corsMiddleware applies the cors setting of the api and falls back to the
+// global cors middleware, which is nil when cors isn't enabled.
+type corsMiddleware struct {
+	routes RouteTable
+	global napnap.MiddlewareHandler
+}
+
+func newCorsMiddleware(routes RouteTable, global napnap.MiddlewareHandler) *corsMiddleware {
+	return &corsMiddleware{
+		routes: routes,
+		global: global,
+	}
+}
+
+func (m *corsMiddleware) Invoke(c *napnap.Context, next napnap.HandlerFunc) {
+	apiEntry := m.routes.Match(c.Request.Host, c.Request.URL.Path, c.Request.Header)
+	if apiEntry == nil || apiEntry.CORS == nil {
+		if m.global != nil {
+			m.global.Invoke(c, next)
+			return
+		}
+		next(c)
+		return
+	}
+
+	origin := c.RequestHeader("Origin")
+	if c.Request.Method == "OPTIONS" && len(origin) > 0 && len(c.RequestHeader("Access-Control-Request-Method")) > 0 {
+		apiEntry.CORS.preflight(c)
+		return
+	}
+	c.Writer.Header().Add("Vary", "Origin")
+	if len(origin) > 0 && apiEntry.CORS.isOriginAllowed(origin) {
+		apiEntry.CORS.setOrigin(c, origin)
+	}
+	next(c)
+}
@@ -0,0 +1,112 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func serveCORSGateway(t *testing.T, cors *CORSConfig) (*httptest.Server, *int32) {
+	reached := new(int32)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(reached, 1)
+	}))
+	t.Cleanup(upstream.Close)
+	apiEntry := newTestAPI(t, "shop", upstream.URL)
+	apiEntry.CORS = cors
+	if err := apiEntry.isValid(testGateway.currentConfig()); err != nil {
+		t.Fatal(err)
+	}
+	gateway, _ := serveTestGateway(t, []*api{apiEntry}, newCorsMiddleware(newAPIRouteTable([]*api{apiEntry}), nil))
+	return gateway, reached
+}
+
+func sendCORS(t *testing.T, method string, url string, header map[string]string) *http.Response {
+	req, _ := http.NewRequest(method, url, nil)
+	for key, val := range header {
+		req.Header.Set(key, val)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestCORSPreflight(t *testing.T) {
+	gateway, reached := serveCORSGateway(t, &CORSConfig{
+		AllowedOrigins: []string{"https://shop.example.com"},
+		AllowedMethods: []string{"get", "put"},
+		AllowedHeaders: []string{"*"},
+		MaxAge:         600,
+	})
+
+	resp := sendCORS(t, "OPTIONS", gateway.URL+"/shop", map[string]string{
+		"Origin":                         "https://shop.example.com",
+		"Access-Control-Request-Method":  "PUT",
+		"Access-Control-Request-Headers": "X-Cart, Content-Type",
+	})
+	if resp.StatusCode != 204 || resp.Header.Get("Access-Control-Allow-Origin") != "https://shop.example.com" {
+		t.Fatalf("status = %d, header = %v", resp.StatusCode, resp.Header)
+	}
+	if resp.Header.Get("Access-Control-Allow-Methods") != "GET, PUT" || resp.Header.Get("Access-Control-Allow-Headers") != "X-Cart, Content-Type" {
+		t.Fatalf("header = %v, want the methods and the requested headers", resp.Header)
+	}
+	if resp.Header.Get("Access-Control-Max-Age") != "600" || len(resp.Header["Vary"]) != 3 {
+		t.Fatalf("header = %v", resp.Header)
+	}
+
+	resp = sendCORS(t, "OPTIONS", gateway.URL+"/shop", map[string]string{
+		"Origin":                        "https://evil.example.com",
+		"Access-Control-Request-Method": "PUT",
+	})
+	if resp.StatusCode != 204 || len(resp.Header.Get("Access-Control-Allow-Origin")) > 0 || len(resp.Header.Get("Access-Control-Allow-Methods")) > 0 {
+		t.Fatalf("status = %d, header = %v, a disallowed origin must get no cors headers", resp.StatusCode, resp.Header)
+	}
+	if n := atomic.LoadInt32(reached); n > 0 {
+		t.Fatalf("the preflight reached the upstream %d times", n)
+	}
+}
+
+func TestCORSSimpleRequest(t *testing.T) {
+	gateway, reached := serveCORSGateway(t, &CORSConfig{AllowedOrigins: []string{"*"}})
+
+	resp := sendCORS(t, "GET", gateway.URL+"/shop", map[string]string{"Origin": "https://shop.example.com"})
+	if resp.StatusCode != 200 || resp.Header.Get("Access-Control-Allow-Origin") != "*" || resp.Header.Get("Vary") != "Origin" {
+		t.Fatalf("status = %d, header = %v", resp.StatusCode, resp.Header)
+	}
+	if len(resp.Header.Get("Access-Control-Allow-Credentials")) > 0 {
+		t.Fatal("credentials aren't allowed")
+	}
+
+	// an OPTIONS request without Access-Control-Request-Method isn't a preflight
+	resp = sendCORS(t, "OPTIONS", gateway.URL+"/shop", map[string]string{"Origin": "https://shop.example.com"})
+	if resp.StatusCode != 200 || atomic.LoadInt32(reached) != 2 {
+		t.Fatalf("status = %d, the request must be proxied", resp.StatusCode)
+	}
+}
+
+func TestCORSCredentialedRequest(t *testing.T) {
+	if err := (&CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true}).isValid(); err == nil {
+		t.Fatal("credentials must not be allowed for every origin")
+	}
+	gateway, _ := serveCORSGateway(t, &CORSConfig{
+		AllowedOrigins:   []string{"https://shop.example.com"},
+		AllowCredentials: true,
+	})
+
+	resp := sendCORS(t, "GET", gateway.URL+"/shop", map[string]string{
+		"Origin": "https://SHOP.example.com",
+		"Cookie": "session=1",
+	})
+	if resp.Header.Get("Access-Control-Allow-Origin") != "https://SHOP.example.com" || resp.Header.Get("Access-Control-Allow-Credentials") != "true" {
+		t.Fatalf("header = %v, the origin must be echoed with the credentials", resp.Header)
+	}
+
+	resp = sendCORS(t, "GET", gateway.URL+"/shop", map[string]string{"Origin": "https://evil.example.com"})
+	if len(resp.Header.Get("Access-Control-Allow-Origin")) > 0 || len(resp.Header.Get("Access-Control-Allow-Credentials")) > 0 {
+		t.Fatalf("header = %v, a disallowed origin must get no cors headers", resp.Header)
+	}
+}
@@ -0,0 +1,884 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	upstream "github.com/jasonsoft/bifrost/internal/proxy"
+	"github.com/jasonsoft/bifrost/internal/store"
+	"github.com/satori/go.uuid"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	redis "gopkg.in/redis.v4"
+)
+
+type policy struct {
+	Allow string `json:"allow,omitempty" bson:"allow,omitempty"`
+	Deny  string `json:"deny,omitempty" bson:"deny,omitempty"`
+}
+
+type apiCollection struct {
+	Count int    `json:"count"`
+	APIs  []*api `json:"apis"`
+}
+
+func newAPICollection() *apiCollection {
+	return &apiCollection{
+		Count: 0,
+		APIs:  []*api{},
+	}
+}
+
+type apiSwitch struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type ByAPIWeight []*api
+
+func (source ByAPIWeight) Len() int {
+	return len(source)
+}
+func (source ByAPIWeight) Swap(i, j int) {
+	source[i], source[j] = source[j], source[i]
+}
+func (source ByAPIWeight) Less(i, j int) bool {
+	if source[i].Weight == source[j].Weight {
+		return source[i].CreatedAt.Before(source[j].CreatedAt)
+	}
+	return source[i].Weight > source[j].Weight
+}
+
+type api struct {
+	sync.RWMutex            `json:"-" bson:"-"`
+	ID                      string                 `json:"id" bson:"_id"`
+	Name                    string                 `json:"name" bson:"name" capability:"name"`
+	RequestHost             string                 `json:"request_host" bson:"request_host"`
+	RequestPath             string                 `json:"request_path" bson:"request_path" capability:"request_path"`
+	MatchHeaders            map[string]string      `json:"match_headers" bson:"match_headers"`                 // exact value, or a regex after "~"
+	RequestPathTemplate     string                 `json:"request_path_template" bson:"request_path_template"` // e.g. /users/{id}/profile
+	TargetPathTemplate      string                 `json:"target_path_template" bson:"target_path_template"`   // e.g. /v2/users/{id}
+	MatchMode               string                 `json:"match_mode" bson:"match_mode"`                       // prefix (default) or exact
+	Priority                int                    `json:"priority" bson:"priority"`                           // a higher priority is matched before a longer path
+	StripRequestPath        bool                   `json:"strip_request_path" bson:"strip_request_path"`
+	RewritePattern          string                 `json:"rewrite_pattern" bson:"rewrite_pattern"` // e.g. ^/v1/users/([0-9]+)/orders$
+	RewriteTarget           string                 `json:"rewrite_target" bson:"rewrite_target"`   // e.g. /internal/orders?user=$1
+	PreserveHost            bool                   `json:"preserve_host" bson:"preserve_host"`
+	DecompressResponse      bool                   `json:"decompress_response" bson:"decompress_response"`
+	DecompressRequest       bool                   `json:"decompress_request" bson:"decompress_request"` // gzip request bodies are unpacked for the upstream
+	StreamResponse          bool                   `json:"stream_response" bson:"stream_response"`
+	TargetURL               string                 `json:"target_url" bson:"target_url"`
+	TargetURLs              []string               `json:"target_urls" bson:"target_urls"`
+	Targets                 []*apiTarget           `json:"targets" bson:"targets"`
+	HealthCheck             *healthCheck           `json:"health_check,omitempty" bson:"health_check,omitempty"`
+	CircuitBreaker          *CircuitBreakerSetting `json:"circuit_breaker,omitempty" bson:"circuit_breaker,omitempty"`
+	FieldEncryption         *fieldEncryption       `json:"field_encryption,omitempty" bson:"field_encryption,omitempty"`
+	UpstreamTLS             *upstream.TLS          `json:"upstream_tls,omitempty" bson:"upstream_tls,omitempty"`
+	EgressProxy             *egressProxy           `json:"egress_proxy,omitempty" bson:"egress_proxy,omitempty"`
+	Cache                   CacheConfig            `json:"cache" bson:"cache"`
+	Mirror                  *mirrorSetting         `json:"mirror,omitempty" bson:"mirror,omitempty"`
+	Capture                 *captureSetting        `json:"capture,omitempty" bson:"capture,omitempty"`
+	Idempotency             *idempotencySetting    `json:"idempotency,omitempty" bson:"idempotency,omitempty"`
+	Retry                   *RetryConfig           `json:"retry,omitempty" bson:"retry,omitempty"`
+	Canary                  *canarySetting         `json:"canary,omitempty" bson:"canary,omitempty"`
+	StickySession           *stickySession         `json:"sticky_session,omitempty" bson:"sticky_session,omitempty"`
+	CORS                    *CORSConfig            `json:"cors,omitempty" bson:"cors,omitempty"`
+	Redirect                bool                   `json:"redirect" bson:"redirect"`
+	FollowRedirects         bool                   `json:"follow_redirects" bson:"follow_redirects"` // redirects of the upstream are passed to the client by default
+	H2C                     bool                   `json:"h2c" bson:"h2c"`                           // the upstream speaks http/2 without tls
+	UpstreamHTTP2           bool                   `json:"upstream_http2" bson:"upstream_http2"`     // needs https targets, http/2 is negotiated over tls
+	Protocol                string                 `json:"protocol" bson:"protocol"`                 // empty for http, or grpc
+	Methods                 []string               `json:"methods" bson:"methods" capability:"methods"`
+	Discovery               bool                   `json:"discovery" bson:"discovery"`
+	Authorization           bool                   `json:"authorization" bson:"authorization" capability:"authorization"`
+	AuthMode                string                 `json:"auth_mode" bson:"auth_mode" capability:"auth_mode"` // bearer (default), apikey or any
+	VerifySignature         bool                   `json:"verify_signature" bson:"verify_signature"`
+	Whitelist               []string               `json:"whitelist" bson:"whitelist"`
+	TrustForwardedFor       bool                   `json:"trust_forwarded_for" bson:"trust_forwarded_for"`
+	IPWhitelist             []string               `json:"ip_whitelist" bson:"ip_whitelist"` // ips or cidrs, empty allows every ip
+	IPBlacklist             []string               `json:"ip_blacklist" bson:"ip_blacklist"` // ips or cidrs, checked before the whitelist
+	Service                 string                 `json:"service" bson:"service"`
+	Weight                  int                    `json:"weight" bson:"weight"`
+	Timeout                 int                    `json:"timeout,omitempty" bson:"timeout,omitempty"` // deprecated seconds, moved to timeout_ms by isValid
+	TimeoutMs               int64                  `json:"timeout_ms" bson:"timeout_ms" capability:"timeout_ms"`
+	MaxRequestBodyBytes     int64                  `json:"max_request_body_bytes" bson:"max_request_body_bytes"`   // zero uses the global limit, -1 means no limit
+	MaxResponseBytes        int64                  `json:"max_response_bytes" bson:"max_response_bytes"`           // zero means no limit
+	MaxConcurrentRequests   int                    `json:"max_concurrent_requests" bson:"max_concurrent_requests"` // zero means no limit
+	MaxQueueWaitMs          int64                  `json:"max_queue_wait_ms" bson:"max_queue_wait_ms"`             // wait for a slot, zero rejects at once
+	RateLimitTier           string                 `json:"rate_limit_tier" bson:"rate_limit_tier" capability:"rate_limit_tier"`
+	Deprecation             *deprecation           `json:"deprecation,omitempty" bson:"deprecation,omitempty"`
+	RequestHeadersToRemove  []string               `json:"request_headers_to_remove" bson:"request_headers_to_remove"`
+	ResponseHeadersToRemove []string               `json:"response_headers_to_remove" bson:"response_headers_to_remove"`
+	RequestHeadersToAdd     map[string]string      `json:"request_headers_to_add" bson:"request_headers_to_add"`
+	ResponseHeadersToAdd    map[string]string      `json:"response_headers_to_add" bson:"response_headers_to_add"`
+	Revision                int64                  `json:"revision" bson:"revision"`
+	ManagedBy               string                 `json:"managed_by" bson:"managed_by"`       // config_sync when the api comes from config sync
+	SyncRevision            int64                  `json:"sync_revision" bson:"sync_revision"` // revision written by the last config sync
+	CreatedAt               time.Time              `json:"created_at" bson:"created_at"`
+	UpdatedAt               time.Time              `json:"updated_at" bson:"updated_at"`
+	balancer                *balancer
+	rewrite                 *regexp.Regexp
+	headerPatterns          map[string]*regexp.Regexp
+	pathTemplate            *regexp.Regexp
+	ipAllow                 ipRangeSet
+	ipDeny                  ipRangeSet
+}
+
+func (a *api) switchSource(b *api) {
+	// swith
+	originalTarget := a.TargetURL
+	originalService := a.Service
+	originalTargetURLs := a.TargetURLs
+	originalTargets := a.Targets
+	a.TargetURL = b.TargetURL
+	b.TargetURL = originalTarget
+	a.TargetURLs = b.TargetURLs
+	b.TargetURLs = originalTargetURLs
+	a.Targets = b.Targets
+	b.Targets = originalTargets
+	a.Service = b.Service
+	b.Service = originalService
+}
+
+// upstreamTimeout returns how long the proxy waits for the upstream.
+// timeout_ms of the api wins, otherwise upstream_timeout of the config is
+// used. Zero means the proxy waits as long as the upstream takes. The
+// deprecated timeout in seconds was moved to timeout_ms by isValid.
+func (a *api) upstreamTimeout(config *Configuration) time.Duration {
+	if a.TimeoutMs > 0 {
+		return time.Duration(a.TimeoutMs) * time.Millisecond
+	}
+	return time.Duration(config.UpstreamTimeout) * time.Second
+}
+
+// matchHeaders reports whether the request has every header of MatchHeaders,
+// a missing header never matches.
+func (a *api) matchHeaders(header http.Header) bool {
+	for name, val := range a.MatchHeaders {
+		actual, ok := header[http.CanonicalHeaderKey(name)]
+		if !ok || len(actual) == 0 {
+			return false
+		}
+		if re, ok := a.headerPatterns[name]; ok {
+			if !re.MatchString(actual[0]) {
+				return false
+			}
+			continue
+		}
+		if actual[0] != val {
+			return false
+		}
+	}
+	return true
+}
+
+// maxRequestBodyBytes returns the api's limit of the request body, or the
+// one of the config when the api doesn't have its own. Zero means no limit,
+// an api opts out of the global limit with -1.
+func (a *api) maxRequestBodyBytes(config *Configuration) int64 {
+	switch {
+	case a.MaxRequestBodyBytes > 0:
+		return a.MaxRequestBodyBytes
+	case a.MaxRequestBodyBytes < 0:
+		return 0
+	}
+	return config.MaxRequestBodyBytes
+}
+
+// tlsSetting returns the api's upstream tls setting or the one of the config.
+func (a *api) tlsSetting(config *Configuration) *upstream.TLS {
+	if a.UpstreamTLS != nil {
+		return a.UpstreamTLS
+	}
+	return config.UpstreamTLS
+}
+
+// rewriteHeader removes the headers first and then sets the added ones,
+// so a header can be replaced by listing it in both. A name ending with "*"
+// removes every header with that prefix, e.g. "X-Internal-*". Set-Cookie is
+// only removed when it's listed by name, then all of its values are dropped.
+func rewriteHeader(header http.Header, toRemove []string, toAdd map[string]string, vars *strings.Replacer) {
+	for _, name := range toRemove {
+		if strings.HasSuffix(name, "*") {
+			prefix := http.CanonicalHeaderKey(strings.TrimSuffix(name, "*"))
+			for key := range header {
+				if key == "Set-Cookie" {
+					continue
+				}
+				if strings.HasPrefix(key, prefix) {
+					header.Del(key)
+				}
+			}
+			continue
+		}
+		header.Del(name)
+	}
+	for name, val := range toAdd {
+		if vars != nil {
+			val = vars.Replace(val)
+		}
+		header.Set(name, val)
+	}
+}
+
+// rewriteRequestHeader applies the api's request header rules. The added
+// values can use %(consumer_id), %(request_id) and %(client_ip).
+func (a *api) rewriteRequestHeader(header http.Header, consumerID, requestID, clientIP string) {
+	vars := strings.NewReplacer(
+		"%(consumer_id)", consumerID,
+		"%(request_id)", requestID,
+		"%(client_ip)", clientIP,
+	)
+	rewriteHeader(header, a.RequestHeadersToRemove, a.RequestHeadersToAdd, vars)
+}
+
+func (a *api) rewriteResponseHeader(header http.Header) {
+	rewriteHeader(header, a.ResponseHeadersToRemove, a.ResponseHeadersToAdd, nil)
+	if a.Deprecation != nil {
+		a.Deprecation.setHeader(header)
+	}
+}
+
+// deprecation tells clients that the api goes away, every response carries
+// the Deprecation header and the Sunset header when the date is known.
+type deprecation struct {
+	Sunset *time.Time `json:"sunset,omitempty" bson:"sunset,omitempty"`
+	Link   string     `json:"link,omitempty" bson:"link,omitempty"` // documentation of the migration
+}
+
+func (d *deprecation) setHeader(header http.Header) {
+	header.Set("Deprecation", "true")
+	if d.Sunset != nil {
+		header.Set("Sunset", d.Sunset.UTC().Format(http.TimeFormat))
+	}
+	if len(d.Link) > 0 {
+		header.Add("Link", "<"+d.Link+`>; rel="deprecation"`)
+	}
+}
+
+// rewritePath replaces the path with RewriteTarget when RewritePattern
+// matches, $1, $2 and so on refer to the capture groups. The query of the
+// target is returned separately, the captures in it are query escaped so
+// they can't add parameters.
+func (a *api) rewritePath(path string) (string, string, bool) {
+	if len(a.RewritePattern) == 0 {
+		return path, "", false
+	}
+	re := a.rewrite
+	if re == nil {
+		var err error
+		re, err = regexp.Compile(a.RewritePattern)
+		if err != nil {
+			return path, "", false
+		}
+	}
+	match := re.FindStringSubmatchIndex(path)
+	if match == nil {
+		return path, "", false
+	}
+	target, queryTarget := a.RewriteTarget, ""
+	if i := strings.IndexByte(target, '?'); i >= 0 {
+		target, queryTarget = target[:i], target[i+1:]
+	}
+	result := string(re.ExpandString(nil, target, path, match))
+	query := ""
+	if len(queryTarget) > 0 {
+		escaped, escapedMatch := queryEscapeMatch(path, match)
+		query = string(re.ExpandString(nil, queryTarget, escaped, escapedMatch))
+	}
+	return result, query, true
+}
+
+// queryEscapeMatch returns the query escaped captures of the match and their
+// indexes, which can be passed to ExpandString in place of the path.
+func queryEscapeMatch(path string, match []int) (string, []int) {
+	var b strings.Builder
+	result := make([]int, len(match))
+	for i := 0; i+1 < len(match); i += 2 {
+		if match[i] < 0 {
+			result[i], result[i+1] = -1, -1
+			continue
+		}
+		// the path is escaped already, unescape it first so it isn't escaped twice
+		value := path[match[i]:match[i+1]]
+		if unescaped, err := url.PathUnescape(value); err == nil {
+			value = unescaped
+		}
+		result[i] = b.Len()
+		b.WriteString(url.QueryEscape(value))
+		result[i+1] = b.Len()
+	}
+	return b.String(), result
+}
+
+// isValid verifies the api, the rate limit tier must be one of the config.
+func (a *api) isValid(config *Configuration) error {
+	if len(a.Service) == 0 && len(a.targets()) == 0 {
+		return AppError{ErrorCode: "invalid_input", Message: "api '" + a.Name + "' needs a service or at least one target url."}
+	}
+	if a.HealthCheck != nil {
+		if err := a.HealthCheck.isValid(); err != nil {
+			return AppError{ErrorCode: "invalid_input", Message: "api '" + a.Name + "': " + err.Error()}
+		}
+	}
+	if a.CircuitBreaker != nil {
+		switch a.CircuitBreaker.Scope {
+		case "", "target", "api":
+		default:
+			return AppError{ErrorCode: "invalid_input", Message: "api '" + a.Name + "' has an invalid circuit breaker scope."}
+		}
+	}
+	if len(a.RewritePattern) > 0 {
+		re, err := regexp.Compile(a.RewritePattern)
+		if err != nil {
+			return AppError{ErrorCode: "invalid_input", Message: "api '" + a.Name + "' has an invalid rewrite pattern: " + err.Error()}
+		}
+		a.rewrite = re
+	}
+	if err := a.isIPFilterValid(); err != nil {
+		return AppError{ErrorCode: "invalid_input", Message: "api '" + a.Name + "': " + err.Error()}
+	}
+	if err := a.isPathTemplateValid(); err != nil {
+		return AppError{ErrorCode: "invalid_input", Message: "api '" + a.Name + "': " + err.Error()}
+	}
+	a.headerPatterns = map[string]*regexp.Regexp{}
+	for name, val := range a.MatchHeaders {
+		if len(name) == 0 {
+			return AppError{ErrorCode: "invalid_input", Message: "api '" + a.Name + "' has an empty match header name."}
+		}
+		if strings.HasPrefix(val, "~") {
+			re, err := regexp.Compile(val[1:])
+			if err != nil {
+				return AppError{ErrorCode: "invalid_input", Message: "api '" + a.Name + "' has an invalid match header pattern: " + err.Error()}
+			}
+			a.headerPatterns[name] = re
+		}
+	}
+	if a.Timeout < 0 || a.TimeoutMs < 0 {
+		return AppError{ErrorCode: "invalid_input", Message: "api '" + a.Name + "' has a negative timeout."}
+	}
+	if a.Timeout > 0 {
+		if a.TimeoutMs > 0 {
+			return AppError{ErrorCode: "invalid_input", Message: "api '" + a.Name + "' sets both timeout and timeout_ms, timeout is deprecated."}
+		}
+		a.TimeoutMs = int64(a.Timeout) * 1000
+		a.Timeout = 0
+	}
+	for _, target := range a.TargetURLs {
+		if len(target) == 0 {
+			return AppError{ErrorCode: "invalid_input", Message: "api '" + a.Name + "' has an empty target url."}
+		}
+	}
+	for _, target := range a.Targets {
+		if target == nil || len(target.URL) == 0 {
+			return AppError{ErrorCode: "invalid_input", Message: "api '" + a.Name + "' has an empty target url."}
+		}
+		if target.Weight < 0 {
+			return AppError{ErrorCode: "invalid_input", Message: "api '" + a.Name + "' has a negative target weight."}
+		}
+	}
+	if a.FieldEncryption != nil {
+		if err := a.FieldEncryption.isValid(config); err != nil {
+			return err
+		}
+	}
+	if a.MaxRequestBodyBytes < -1 {
+		return AppError{ErrorCode: "invalid_input", Message: "api '" + a.Name + "' has an invalid max_request_body_bytes, use -1 for no limit."}
+	}
+	if a.MaxConcurrentRequests < 0 || a.MaxQueueWaitMs < 0 {
+		return AppError{ErrorCode: "invalid_input", Message: "api '" + a.Name + "' has a negative concurrency limit."}
+	}
+	if a.Cache.DefaultTTL < 0 || a.Cache.MaxBodySize < 0 {
+		return AppError{ErrorCode: "invalid_input", Message: "api '" + a.Name + "' has a negative cache setting."}
+	}
+	if a.StickySession != nil {
+		if err := a.StickySession.isValid(); err != nil {
+			return AppError{ErrorCode: "invalid_input", Message: "api '" + a.Name + "': " + err.Error()}
+		}
+	}
+	if a.Canary != nil {
+		if err := a.Canary.isValid(); err != nil {
+			return AppError{ErrorCode: "invalid_input", Message: "api '" + a.Name + "': " + err.Error()}
+		}
+	}
+	if a.Mirror != nil {
+		if err := a.Mirror.isValid(); err != nil {
+			return AppError{ErrorCode: "invalid_input", Message: "api '" + a.Name + "': " + err.Error()}
+		}
+	}
+	if a.Capture != nil {
+		if err := a.Capture.isValid(); err != nil {
+			return AppError{ErrorCode: "invalid_input", Message: "api '" + a.Name + "': " + err.Error()}
+		}
+	}
+	if a.Idempotency != nil {
+		if err := a.Idempotency.isValid(); err != nil {
+			return AppError{ErrorCode: "invalid_input", Message: "api '" + a.Name + "': " + err.Error()}
+		}
+	}
+	if a.Retry != nil {
+		if err := a.Retry.isValid(); err != nil {
+			return AppError{ErrorCode: "invalid_input", Message: "api '" + a.Name + "': " + err.Error()}
+		}
+	}
+	if a.CORS != nil {
+		if err := a.CORS.isValid(); err != nil {
+			return AppError{ErrorCode: "invalid_input", Message: "api '" + a.Name + "': " + err.Error()}
+		}
+	}
+	switch a.MatchMode {
+	case "", matchModePrefix, matchModeExact:
+	default:
+		return AppError{ErrorCode: "invalid_input", Message: "api '" + a.Name + "' has an invalid match_mode."}
+	}
+	switch a.AuthMode {
+	case "", authModeBearer, authModeAPIKey, authModeAny:
+	default:
+		return AppError{ErrorCode: "invalid_input", Message: "api '" + a.Name + "' has an invalid auth_mode."}
+	}
+	if len(a.RateLimitTier) > 0 {
+		if _, ok := config.RateLimit.Tiers[a.RateLimitTier]; !ok {
+			return AppError{ErrorCode: "invalid_input", Message: "api '" + a.Name + "' has a rate_limit_tier which isn't in the config."}
+		}
+	}
+	switch a.Protocol {
+	case "", "http":
+	case protocolGRPC:
+		if setting := a.grpcUnsupported(); len(setting) > 0 {
+			return AppError{ErrorCode: "invalid_input", Message: "api '" + a.Name + "' can't use " + setting + " with the grpc protocol."}
+		}
+	default:
+		return AppError{ErrorCode: "invalid_input", Message: "api '" + a.Name + "' has an invalid protocol."}
+	}
+	if a.UpstreamHTTP2 {
+		if a.H2C {
+			return AppError{ErrorCode: "invalid_input", Message: "api '" + a.Name + "' can't use upstream_http2 with h2c."}
+		}
+		urls := []string{}
+		for _, target := range a.targets() {
+			urls = append(urls, target.URL)
+		}
+		if a.Canary != nil {
+			urls = append(urls, a.Canary.TargetURL)
+		}
+		for _, targetURL := range urls {
+			if !strings.HasPrefix(strings.ToLower(targetURL), "https://") {
+				return AppError{ErrorCode: "invalid_input", Message: "api '" + a.Name + "' needs https target urls for upstream_http2."}
+			}
+		}
+	}
+	if a.H2C && a.UpstreamTLS != nil {
+		return AppError{ErrorCode: "invalid_input", Message: "api '" + a.Name + "' can't use h2c with upstream_tls."}
+	}
+	if a.UpstreamTLS != nil {
+		if err := a.UpstreamTLS.IsValid(); err != nil {
+			return AppError{ErrorCode: "invalid_input", Message: "api '" + a.Name + "': " + err.Error()}
+		}
+	}
+	if a.EgressProxy != nil {
+		if err := a.EgressProxy.isValid(); err != nil {
+			return AppError{ErrorCode: "invalid_input", Message: "api '" + a.Name + "': " + err.Error()}
+		}
+	}
+	for name := range a.RequestHeadersToAdd {
+		if len(name) == 0 {
+			return AppError{ErrorCode: "invalid_input", Message: "api '" + a.Name + "' has an empty request header name."}
+		}
+	}
+	for name := range a.ResponseHeadersToAdd {
+		if len(name) == 0 {
+			return AppError{ErrorCode: "invalid_input", Message: "api '" + a.Name + "' has an empty response header name."}
+		}
+	}
+	return nil
+}
+
+func (a api) isAllow(consumer store.Consumer) bool {
+	if a.Authorization == true && consumer.IsAuthenticated() == false {
+		return false
+	}
+	if len(a.Whitelist) == 0 {
+		return true
+	}
+	if len(consumer.Roles) == 0 {
+		return false
+	}
+	for _, role := range consumer.Roles {
+		if contains(a.Whitelist, role) {
+			return true
+		}
+	}
+	return false
+	/*
+		for _, policy := range a.Policies {
+			if policy.isAllowPolicy() == false {
+				if policy.isMatch("deny", consumer) {
+					return false
+				}
+			} else {
+				if policy.isMatch("allow", consumer) {
+					return true
+				}
+			}
+		}
+		// if there isn't any policies, return true
+		return true
+	*/
+}
+
+/*
+func (p policy) isAllowPolicy() bool {
+	if len(p.Allow) > 0 {
+		return true
+	}
+	return false
+}
+
+func (p policy) isMatch(kind string, consumer Consumer) bool {
+	var rule string
+	if kind == "deny" {
+		rule = strings.ToLower(p.Deny)
+	}
+
+	if kind == "allow" {
+		rule = strings.ToLower(p.Allow)
+	}
+
+	if rule == "all" {
+		return true
+	}
+	terms := strings.Split(rule, ":")
+	if terms[0] == "g" {
+		for _, group := range consumer.Groups {
+			if group == terms[1] {
+				return true
+			}
+		}
+	}
+	return false
+}*/
+
+type APIRepository interface {
+	Get(id string) (*api, error)
+	GetAll() ([]*api, error)
+	Insert(api *api) error
+	Update(api *api) error
+	Delete(id string) error
+}
+
+/*********************
+	Mongo Database
+*********************/
+
+type apiMongo struct {
+	connectionString string
+}
+
+func newAPIMongo(connectionString string) (*apiMongo, error) {
+	session, err := mgo.Dial(connectionString)
+	if err != nil {
+		panic(err)
+	}
+	defer session.Close()
+	c := session.DB("bifrost").C("apis")
+
+	// create index
+	nameIdx := mgo.Index{
+		Name:       "api_name_idx",
+		Key:        []string{"name"},
+		Unique:     true,
+		Background: true,
+		Sparse:     true,
+	}
+	err = c.EnsureIndex(nameIdx)
+	if err != nil {
+		return nil, err
+	}
+
+	weightIdx := mgo.Index{
+		Name:       "api_weight_idx",
+		Key:        []string{"-weight", "created_at"},
+		Background: true,
+		Sparse:     true,
+	}
+	err = c.EnsureIndex(weightIdx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &apiMongo{
+		connectionString: connectionString,
+	}, nil
+}
+
+func (ams *apiMongo) newSession() (*mgo.Session, error) {
+	return mgo.Dial(ams.connectionString)
+}
+
+func (ams *apiMongo) Get(id string) (*api, error) {
+	session, err := ams.newSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	c := session.DB("bifrost").C("apis")
+	api := api{}
+	err = c.FindId(id).One(&api)
+	if err != nil {
+		if err.Error() == "not found" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &api, nil
+}
+
+func (ams *apiMongo) GetByName(name string) (*api, error) {
+	session, err := ams.newSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	c := session.DB("bifrost").C("apis")
+	api := api{}
+	err = c.Find(bson.M{"name": name}).One(&api)
+	if err != nil {
+		if err.Error() == "not found" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &api, nil
+}
+
+func (ams *apiMongo) GetAll() ([]*api, error) {
+	session, err := ams.newSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	c := session.DB("bifrost").C("apis")
+	apis := []*api{}
+	err = c.Find(bson.M{}).Sort("-weight", "+created_at").All(&apis)
+	if err != nil {
+		if err.Error() == "not found" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return apis, nil
+}
+
+func (ams *apiMongo) Insert(api *api) error {
+	session, err := ams.newSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	c := session.DB("bifrost").C("apis")
+	api.ID = uuid.NewV4().String()
+	api.Revision = 1
+	now := time.Now().UTC()
+	api.CreatedAt = now
+	api.UpdatedAt = now
+	err = c.Insert(api)
+
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "E11000") {
+			return AppError{ErrorCode: "invalid_input", Message: "The api already exits"}
+		}
+		return err
+	}
+	return nil
+}
+
+func (ams *apiMongo) Update(api *api) error {
+	if len(api.ID) == 0 {
+		return AppError{ErrorCode: "invalid_input", Message: "id can't be empty or null."}
+	}
+	now := time.Now().UTC()
+	api.UpdatedAt = now
+
+	session, err := ams.newSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	c := session.DB("bifrost").C("apis")
+	expected := api.Revision
+	colQuerier := bson.M{"_id": api.ID, "revision": store.RevisionQuery(expected)}
+	api.Revision = expected + 1
+	err = c.Update(colQuerier, api)
+	if err != nil {
+		api.Revision = expected
+		if err == mgo.ErrNotFound {
+			return store.ErrRevisionConflict
+		}
+		return err
+	}
+	return nil
+}
+
+func (ams *apiMongo) Delete(id string) error {
+	session, err := ams.newSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	c := session.DB("bifrost").C("apis")
+	colQuerier := bson.M{"_id": id}
+	err = c.Remove(colQuerier)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+/*********************
+	Redis Database
+*********************/
+
+type apiRedis struct {
+	client *redis.Client
+}
+
+func newAPIRedis(client *redis.Client) (*apiRedis, error) {
+	apiRedis := &apiRedis{
+		client: client,
+	}
+	return apiRedis, nil
+}
+
+func (source *apiRedis) Get(id string) (*api, error) {
+	key := "api:id:" + id
+	s, err := source.client.Get(key).Result()
+	if err != nil {
+		if err.Error() == "redis: nil" {
+			return nil, nil
+		}
+		panicIf(err)
+	}
+	var api api
+	err = json.Unmarshal([]byte(s), &api)
+	panicIf(err)
+
+	return &api, nil
+}
+
+func (source *apiRedis) GetAll() ([]*api, error) {
+	apiIDs, err := source.client.SMembers("apis").Result()
+	if err != nil {
+		if err.Error() == "redis: nil" {
+			return nil, nil
+		}
+		panicIf(err)
+	}
+
+	result := []*api{}
+	for _, val := range apiIDs {
+		api, err := source.Get(val)
+		panicIf(err)
+		if api != nil {
+			result = append(result, api)
+		}
+	}
+	sort.Sort(ByAPIWeight(result))
+	return result, nil
+}
+
+func (source *apiRedis) Insert(api *api) error {
+	api.ID = uuid.NewV4().String()
+	api.Revision = 1
+	now := time.Now().UTC()
+	api.CreatedAt = now
+	api.UpdatedAt = now
+
+	// insert api:id
+	val, err := json.Marshal(api)
+	panicIf(err)
+	key := "api:id:" + api.ID
+	err = source.client.Set(key, val, 0).Err()
+	panicIf(err)
+
+	// insert apis
+	key = "apis"
+	err = source.client.SAdd(key, api.ID).Err()
+	panicIf(err)
+
+	return nil
+}
+
+func (source *apiRedis) Update(api *api) error {
+	if len(api.ID) == 0 {
+		return AppError{ErrorCode: "invalid_input", Message: "id can't be empty or null."}
+	}
+	now := time.Now().UTC()
+	api.UpdatedAt = now
+
+	// check and set the revision in a transaction
+	key := "api:id:" + api.ID
+	expected := api.Revision
+	err := source.client.Watch(func(tx *redis.Tx) error {
+		s, err := tx.Get(key).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		var current struct {
+			Revision int64 `json:"revision"`
+		}
+		if err == nil {
+			err = json.Unmarshal([]byte(s), &current)
+			if err != nil {
+				return err
+			}
+		}
+		if current.Revision != expected {
+			return store.ErrRevisionConflict
+		}
+
+		api.Revision = expected + 1
+		val, err := json.Marshal(api)
+		if err != nil {
+			return err
+		}
+		_, err = tx.MultiExec(func() error {
+			tx.Set(key, val, 0)
+			return nil
+		})
+		return err
+	}, key)
+	if err != nil {
+		api.Revision = expected
+		if err == redis.TxFailedErr {
+			return store.ErrRevisionConflict
+		}
+		return err
+	}
+	return nil
+}
+
+func (source *apiRedis) Delete(id string) error {
+	// delete api:id
+	key := "api:id:" + id
+	err := source.client.Del(key).Err()
+	panicIf(err)
+
+	// delete apis
+	err = source.client.SRem("apis", id).Err()
+	panicIf(err)
+
+	return nil
+}
@@ -0,0 +1,194 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRewritePathEscapesQueryCaptures(t *testing.T) {
+	apiEntry := newTestAPI(t, "orders", "http://orders:8080")
+	apiEntry.RewritePattern = `^/v1/users/([^/]+)/orders/(?P<order>[^/]+)$`
+	apiEntry.RewriteTarget = "/internal/$1/orders?user=$1&order=${order}"
+	if err := apiEntry.isValid(testGateway.currentConfig()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path  string
+		want  string
+		query string
+	}{
+		{"/v1/users/42/orders/7", "/internal/42/orders", "user=42&order=7"},
+		{"/v1/users/42&admin=true/orders/7", "/internal/42&admin=true/orders", "user=42%26admin%3Dtrue&order=7"},
+		{"/v1/users/a%20b/orders/x%2Fy", "/internal/a%20b/orders", "user=a+b&order=x%2Fy"},
+	}
+	for _, test := range tests {
+		path, query, ok := apiEntry.rewritePath(test.path)
+		if !ok {
+			t.Fatalf("%s: the pattern must match", test.path)
+		}
+		if path != test.want || query != test.query {
+			t.Errorf("%s: got %s?%s, want %s?%s", test.path, path, query, test.want, test.query)
+		}
+	}
+}
+
+func TestRewritePathWithoutQuery(t *testing.T) {
+	apiEntry := newTestAPI(t, "orders", "http://orders:8080")
+	apiEntry.RewritePattern = `^/v1/(.*)$`
+	apiEntry.RewriteTarget = "/v2/$1"
+	path, query, ok := apiEntry.rewritePath("/v1/a&b")
+	if !ok || path != "/v2/a&b" || query != "" {
+		t.Fatalf("got %s?%s %v", path, query, ok)
+	}
+	if _, _, ok := apiEntry.rewritePath("/v3/orders"); ok {
+		t.Fatal("the pattern must not match")
+	}
+}
+
+func TestRewriteHeaderRemovesBeforeAdding(t *testing.T) {
+	header := http.Header{
+		"X-Internal-Id":    {"1"},
+		"X-Internal-Trace": {"2"},
+		"X-Tenant":         {"client"},
+		"Set-Cookie":       {"a=1", "b=2"},
+		"Accept":           {"*/*"},
+	}
+	rewriteHeader(header, []string{"x-internal-*", "X-Tenant", "Set-*"}, map[string]string{"X-Tenant": "shop"}, nil)
+	if len(header["X-Internal-Id"]) > 0 || len(header["X-Internal-Trace"]) > 0 {
+		t.Fatal("the headers with the prefix must be removed")
+	}
+	if header.Get("X-Tenant") != "shop" || len(header["X-Tenant"]) != 1 {
+		t.Fatalf("X-Tenant = %v, want it replaced", header["X-Tenant"])
+	}
+	if len(header["Set-Cookie"]) != 2 || header.Get("Accept") != "*/*" {
+		t.Fatalf("header = %v, Set-Cookie is only removed by its name", header)
+	}
+	rewriteHeader(header, []string{"Set-Cookie"}, nil, nil)
+	if len(header["Set-Cookie"]) != 0 {
+		t.Fatal("Set-Cookie listed by name must be removed")
+	}
+}
+
+func TestRequestHeadersAreRewrittenBeforeForwarding(t *testing.T) {
+	received := make(chan http.Header, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header
+	}))
+	defer upstream.Close()
+
+	apiEntry := newTestAPI(t, "orders", upstream.URL)
+	apiEntry.RequestHeadersToRemove = []string{"Cookie", "X-Debug-*"}
+	apiEntry.RequestHeadersToAdd = map[string]string{
+		"X-Gateway":    "bifrost",
+		"X-Caller":     "%(request_id)@%(client_ip)",
+		"X-Debug-Mode": "off",
+	}
+	if err := apiEntry.isValid(testGateway.currentConfig()); err != nil {
+		t.Fatal(err)
+	}
+	server, _ := serveTestGateway(t, []*api{apiEntry})
+
+	req, _ := http.NewRequest("GET", server.URL+"/orders", nil)
+	req.Header.Set("Cookie", "session=1")
+	req.Header.Set("X-Debug-Level", "9")
+	req.Header.Set("X-Gateway", "spoofed")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	header := <-received
+	if len(header.Get("Cookie")) > 0 || len(header.Get("X-Debug-Level")) > 0 {
+		t.Fatalf("removed headers were forwarded: %v", header)
+	}
+	if header.Get("X-Gateway") != "bifrost" || header.Get("X-Debug-Mode") != "off" {
+		t.Fatalf("added headers = %v", header)
+	}
+	if header.Get("X-Caller") != "test@127.0.0.1" {
+		t.Fatalf("X-Caller = %s, want the variables replaced", header.Get("X-Caller"))
+	}
+
+	apiEntry.RequestHeadersToAdd = map[string]string{"": "empty"}
+	if apiEntry.isValid(testGateway.currentConfig()) == nil {
+		t.Fatal("an empty request header name must be invalid")
+	}
+}
+
+func TestResponseHeadersAreRewrittenBeforeReturning(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "upstream/1.0")
+		w.Header().Set("X-Internal-Host", "10.0.0.7")
+		w.Header().Add("Set-Cookie", "session=1")
+		w.Header().Set("X-Frame-Options", "ALLOW")
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	for _, stream := range []bool{false, true} {
+		apiEntry := newTestAPI(t, "orders", upstream.URL)
+		apiEntry.StreamResponse = stream
+		apiEntry.ResponseHeadersToRemove = []string{"Server", "X-Internal-*"}
+		apiEntry.ResponseHeadersToAdd = map[string]string{"X-Frame-Options": "DENY", "X-Served-By": "bifrost"}
+		if err := apiEntry.isValid(testGateway.currentConfig()); err != nil {
+			t.Fatal(err)
+		}
+		server, _ := serveTestGateway(t, []*api{apiEntry})
+
+		resp, err := http.Get(server.URL + "/orders")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		header := resp.Header
+		if len(header.Get("Server")) > 0 || len(header.Get("X-Internal-Host")) > 0 {
+			t.Errorf("stream %v: removed headers were returned: %v", stream, header)
+		}
+		if header.Get("X-Frame-Options") != "DENY" || header.Get("X-Served-By") != "bifrost" {
+			t.Errorf("stream %v: added headers = %v", stream, header)
+		}
+		if header.Get("Set-Cookie") != "session=1" {
+			t.Errorf("stream %v: Set-Cookie must be kept", stream)
+		}
+	}
+
+	apiEntry := newTestAPI(t, "orders", upstream.URL)
+	apiEntry.ResponseHeadersToAdd = map[string]string{"": "empty"}
+	if apiEntry.isValid(testGateway.currentConfig()) == nil {
+		t.Fatal("an empty response header name must be invalid")
+	}
+}
+
+func TestTimeoutIsMovedToTimeoutMs(t *testing.T) {
+	withConfig(t, func(config *Configuration) {
+		config.UpstreamTimeout = 30
+	})
+	legacy := newTestAPI(t, "legacy", "http://legacy:8080")
+	legacy.Timeout = 5
+	if err := legacy.isValid(testGateway.currentConfig()); err != nil {
+		t.Fatal(err)
+	}
+	if legacy.Timeout != 0 || legacy.TimeoutMs != 5000 || legacy.upstreamTimeout(testGateway.currentConfig()) != 5*time.Second {
+		t.Fatalf("timeout = %d, timeout_ms = %d, want only timeout_ms", legacy.Timeout, legacy.TimeoutMs)
+	}
+	if b, _ := json.Marshal(legacy); strings.Contains(string(b), `"timeout"`) {
+		t.Fatalf("json = %s, the deprecated timeout must not be written back", b)
+	}
+
+	both := newTestAPI(t, "both", "http://both:8080")
+	both.Timeout = 5
+	both.TimeoutMs = 2000
+	if err := both.isValid(testGateway.currentConfig()); err == nil {
+		t.Fatal("an api with timeout and timeout_ms must be rejected")
+	}
+
+	global := newTestAPI(t, "global", "http://global:8080")
+	if global.upstreamTimeout(testGateway.currentConfig()) != 30*time.Second {
+		t.Fatalf("timeout = %v, want the upstream_timeout of the config", global.upstreamTimeout(testGateway.currentConfig()))
+	}
+}
@@ -0,0 +1,132 @@
+package gateway
+
+import (
+	"crypto/subtle"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/jasonsoft/bifrost/internal/store"
+	"github.com/jasonsoft/napnap"
+)
+
+type status struct {
+	Hostname       string    `json:"hostname"`
+	ServerTime           time.Time `json:"server_time"`
+	NumCPU         int       `json:"cpu_core"`
+	TotalRequests  uint64    `json:"total_requests"`
+	NetworkIn      int64     `json:"network_in"`
+	NetworkOut     int64     `json:"network_out"`
+	MemoryAcquired uint64    `json:"memory_acquired"`
+	MemoryUsed     uint64    `json:"memory_used"`
+	StartAt        time.Time `json:"start_at"`
+	Uptime         string    `json:"uptime"`
+	InFlight       map[string]int `json:"in_flight"` // requests in flight of apis with max_concurrent_requests
+	Server         ServerSetting  `json:"server"`    // timeouts of the running servers
+}
+
+type application struct {
+	sync.Mutex
+	name          string
+	hostname      string
+	totalRequests uint64
+	networkIn     int64
+	networkOut    int64
+	startAt       time.Time
+}
+
+func newApplication() *application {
+	name, err := os.Hostname()
+	panicIf(err)
+
+	return &application{
+		name:     "bifrost",
+		hostname: name,
+		startAt:  time.Now().UTC(),
+	}
+}
+
+func (a *application) Invoke(c *napnap.Context, next napnap.HandlerFunc) {
+	a.Lock()
+	a.totalRequests++
+	if c.Request.ContentLength > 0 {
+		a.networkIn += c.Request.ContentLength
+	}
+	a.Unlock()
+
+	next(c)
+
+	a.Lock()
+	a.networkOut += int64(c.Writer.ContentLength())
+	a.Unlock()
+}
+
+func (g *Gateway) notFound(c *napnap.Context, next napnap.HandlerFunc) {
+	g.logger.debugf("route not found: %s %s", c.Request.Method, c.Request.URL.Path)
+	g.recordUnmatched(c)
+	g.writeError(c, 404, AppError{ErrorCode: "route_not_found", Message: "No api matches the request."})
+}
+
+func (g *Gateway) auth(c *napnap.Context, next napnap.HandlerFunc) {
+	config := g.currentConfig()
+	if len(config.AdminTokens) == 0 && len(config.AdminUsername) == 0 {
+		next(c)
+		return
+	} else {
+		key := c.RequestHeader("Authorization")
+		if len(key) == 0 {
+			g.unauthorizedAdmin(c)
+			return
+		}
+
+		var isFound bool
+		for _, token := range config.AdminTokens {
+			if token == key {
+				isFound = true
+				break
+			}
+		}
+
+		if isFound {
+			c.Set("admin", "token:"+maskTokenID(key))
+			next(c)
+		} else if g.isAdminPassword(c) {
+			username, _, _ := c.Request.BasicAuth()
+			c.Set("admin", "user:"+username)
+			next(c)
+		} else {
+			g.unauthorizedAdmin(c)
+		}
+	}
+}
+
+// isAdminPassword verifies the basic auth credentials against admin_username
+// and the bcrypt hash in admin_password_hash.
+func (g *Gateway) isAdminPassword(c *napnap.Context) bool {
+	config := g.currentConfig()
+	if len(config.AdminUsername) == 0 {
+		return false
+	}
+	username, password, ok := c.Request.BasicAuth()
+	if !ok || subtle.ConstantTimeCompare([]byte(username), []byte(config.AdminUsername)) != 1 {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(config.AdminPasswordHash), []byte(password)) == nil
+}
+
+func (g *Gateway) unauthorizedAdmin(c *napnap.Context) {
+	if len(g.currentConfig().AdminUsername) > 0 {
+		c.RespHeader("WWW-Authenticate", `Basic realm="bifrost admin"`)
+	}
+	c.SetStatus(401)
+}
+
+// AppError is the error of the store, so the errors of the repositories
+// are answered like the ones of the gateway.
+type AppError = store.AppError
+
+type ApiCount struct {
+	Count int `json:"count"`
+}
@@ -0,0 +1,85 @@
+package gateway
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jasonsoft/napnap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAdminAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withConfig(t, func(config *Configuration) {
+		config.AdminTokens = []string{"admin-token"}
+		config.AdminUsername = "admin"
+		config.AdminPasswordHash = string(hash)
+	})
+	nap := napnap.New()
+	nap.UseFunc(testGateway.auth)
+	nap.UseFunc(func(c *napnap.Context, next napnap.HandlerFunc) {
+		c.SetStatus(200)
+	})
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		token    string
+		status   int
+	}{
+		{"no credentials", "", "", "", 401},
+		{"password", "admin", "s3cret", "", 200},
+		{"wrong password", "admin", "wrong", "", 401},
+		{"wrong username", "root", "s3cret", "", 401},
+		{"admin token", "", "", "admin-token", 200},
+		{"unknown token", "", "", "other", 401},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/status", nil)
+		if len(test.username) > 0 {
+			req.SetBasicAuth(test.username, test.password)
+		}
+		if len(test.token) > 0 {
+			req.Header.Set("Authorization", test.token)
+		}
+		w := httptest.NewRecorder()
+		nap.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("%s: status = %d, want %d", test.name, w.Code, test.status)
+		}
+		if w.Code == 401 && !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Basic ") {
+			t.Errorf("%s: the basic auth challenge is missing", test.name)
+		}
+	}
+}
+
+func TestAdminAuthIsOffWithoutCredentials(t *testing.T) {
+	withConfig(t, func(config *Configuration) {
+		config.AdminTokens = nil
+		config.AdminUsername = ""
+	})
+	nap := napnap.New()
+	nap.UseFunc(testGateway.auth)
+	nap.UseFunc(func(c *napnap.Context, next napnap.HandlerFunc) {
+		c.SetStatus(200)
+	})
+	w := httptest.NewRecorder()
+	nap.ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+	if w.Code != 200 {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+}
+
+func TestAdminPasswordHashIsValidated(t *testing.T) {
+	config := newConfiguration()
+	config.AdminUsername = "admin"
+	config.AdminPasswordHash = "s3cret"
+	if err := config.isValid(); err == nil || !strings.Contains(err.Error(), ErrAdminPassword.Error()) {
+		t.Fatalf("err = %v, a plain password must be rejected", err)
+	}
+}
@@ -0,0 +1,449 @@
+package gateway
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jasonsoft/bifrost/internal/store"
+	"github.com/jasonsoft/napnap"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// AuditEntry records one request which was authenticated by a token, or one
+// revision of an entity which was changed through the admin api or config
+// sync. Only revision entries have an Entity.
+type AuditEntry struct {
+	TokenID      string    `json:"token_id" bson:"token_id"`
+	ConsumerID   string    `json:"consumer_id" bson:"consumer_id"`
+	Timestamp    time.Time `json:"timestamp" bson:"timestamp"`
+	ClientIP     string    `json:"client_ip" bson:"client_ip"`
+	Method       string    `json:"method" bson:"method"`
+	Path         string    `json:"path" bson:"path"`
+	APIName      string    `json:"api_name" bson:"api_name"`
+	Entity       string    `json:"entity,omitempty" bson:"entity,omitempty"` // api or consumer
+	EntityID     string    `json:"entity_id,omitempty" bson:"entity_id,omitempty"`
+	Actor        string    `json:"actor,omitempty" bson:"actor,omitempty"`
+	FromRevision int64     `json:"from_revision,omitempty" bson:"from_revision,omitempty"`
+	ToRevision   int64     `json:"to_revision,omitempty" bson:"to_revision,omitempty"`
+	Changes      []string  `json:"changes,omitempty" bson:"changes,omitempty"`
+}
+
+// auditQuery filters the audit entries, empty fields match everything.
+type auditQuery struct {
+	ConsumerID string
+	From       time.Time
+	To         time.Time
+	Limit      int
+}
+
+func (q auditQuery) matches(entry *AuditEntry) bool {
+	if len(q.ConsumerID) > 0 && entry.ConsumerID != q.ConsumerID {
+		return false
+	}
+	if !q.From.IsZero() && entry.Timestamp.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && entry.Timestamp.After(q.To) {
+		return false
+	}
+	return true
+}
+
+// AuditStore keeps the audit entries. Find returns the newest entries first.
+type AuditStore interface {
+	Append(entry AuditEntry) error
+	Find(query auditQuery) ([]AuditEntry, error)
+}
+
+// maskTokenID keeps the token out of the audit log, the token id is the
+// credential itself.
+func maskTokenID(id string) string {
+	if len(id) > 6 {
+		return id[:6] + "..."
+	}
+	return id
+}
+
+/*********************
+	Audit log
+*********************/
+
+// auditLog hands the entries to the store on its own goroutine, so the
+// request never waits for the store. Entries are dropped when the queue is
+// full.
+type auditLog struct {
+	store   AuditStore
+	entries chan AuditEntry
+	done    chan struct{}
+	logger  *logger
+	metrics *metrics
+}
+
+func newAuditLog(store AuditStore, queueSize int, logger *logger, metrics *metrics) *auditLog {
+	l := &auditLog{
+		store:   store,
+		entries: make(chan AuditEntry, queueSize),
+		done:    make(chan struct{}),
+		logger:  logger,
+		metrics: metrics,
+	}
+	go l.run()
+	return l
+}
+
+func (l *auditLog) add(entry AuditEntry) {
+	select {
+	case l.entries <- entry:
+	default:
+		l.metrics.incCounter("bifrost_audit_dropped_total", "Audit entries dropped because the queue was full.")
+	}
+}
+
+func (l *auditLog) run() {
+	defer close(l.done)
+	for entry := range l.entries {
+		if err := l.store.Append(entry); err != nil {
+			l.metrics.incCounter("bifrost_audit_errors_total", "Audit entries the store failed to write.")
+			l.logger.errorf("failed to write the audit entry: %v", err)
+		}
+	}
+}
+
+// Close writes the queued entries and closes the store.
+func (l *auditLog) Close() error {
+	close(l.entries)
+	<-l.done
+	if closer, ok := l.store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// recordAudit queues an audit entry for the token which authenticated the
+// request to apiEntry, it's a no-op when the audit log is off. apiEntry is
+// nil when the request matches no api.
+func (g *Gateway) recordAudit(c *napnap.Context, token *store.Token, apiEntry *api) {
+	if g.auditLog == nil {
+		return
+	}
+	entry := AuditEntry{
+		TokenID:    maskTokenID(token.ID),
+		ConsumerID: token.ConsumerID,
+		Timestamp:  time.Now().UTC(),
+		ClientIP:   g.clientIP(c),
+		Method:     c.Request.Method,
+		Path:       c.Request.URL.Path,
+	}
+	if apiEntry != nil {
+		entry.APIName = apiEntry.Name
+	}
+	g.auditLog.add(entry)
+}
+
+/*********************
+	Mongo Database
+*********************/
+
+type auditMongo struct {
+	// every operation copies the session, so the sockets are pooled
+	session *mgo.Session
+	logger  *logger
+}
+
+// newAuditMongo keeps the entries in the capped collection audits, mongodb
+// removes the oldest entries once the collection reaches maxBytes. An
+// existing collection keeps its size.
+func newAuditMongo(connectionString string, poolSize int, dialTimeout time.Duration, socketTimeout time.Duration, maxBytes int64, logger *logger) (*auditMongo, error) {
+	session, err := store.DialMongo(connectionString, poolSize, dialTimeout, socketTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := session.DB("bifrost").C("audits")
+	err = c.Create(&mgo.CollectionInfo{
+		Capped:   true,
+		MaxBytes: int(maxBytes),
+	})
+	if err != nil && !strings.Contains(err.Error(), "already exists") {
+		session.Close()
+		return nil, err
+	}
+
+	// create index
+	consumerIdx := mgo.Index{
+		Name:       "audit_consumer_idx",
+		Key:        []string{"consumer_id", "-timestamp"},
+		Background: true,
+	}
+	err = c.EnsureIndex(consumerIdx)
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	return &auditMongo{
+		session: session,
+		logger:  logger,
+	}, nil
+}
+
+func (am *auditMongo) Append(entry AuditEntry) error {
+	session := am.session.Copy()
+	defer session.Close()
+
+	c := session.DB("bifrost").C("audits")
+	err := c.Insert(entry)
+	if err != nil {
+		return store.RefreshMongo(am.session, err, am.logger.debugf)
+	}
+	return nil
+}
+
+func (am *auditMongo) Find(query auditQuery) ([]AuditEntry, error) {
+	session := am.session.Copy()
+	defer session.Close()
+
+	c := session.DB("bifrost").C("audits")
+	filter := bson.M{}
+	if len(query.ConsumerID) > 0 {
+		filter["consumer_id"] = query.ConsumerID
+	}
+	timestamp := bson.M{}
+	if !query.From.IsZero() {
+		timestamp["$gte"] = query.From
+	}
+	if !query.To.IsZero() {
+		timestamp["$lte"] = query.To
+	}
+	if len(timestamp) > 0 {
+		filter["timestamp"] = timestamp
+	}
+	entries := []AuditEntry{}
+	err := c.Find(filter).Sort("-timestamp").Limit(query.Limit).All(&entries)
+	if err != nil {
+		return nil, store.RefreshMongo(am.session, err, am.logger.debugf)
+	}
+	return entries, nil
+}
+
+func (am *auditMongo) Close() error {
+	am.session.Close()
+	return nil
+}
+
+/*********************
+	File
+*********************/
+
+// auditFile appends the entries to a file as json lines. The file is
+// renamed to <path>.1 once it reaches maxBytes, older files move up to
+// <path>.<maxBackups> and the oldest one is removed.
+type auditFile struct {
+	sync.Mutex
+	path       string
+	maxBytes   int64
+	maxBackups int
+	file       *os.File
+	size       int64
+	logger     *logger
+}
+
+func newAuditFile(path string, maxBytes int64, maxBackups int, logger *logger) (*auditFile, error) {
+	af := &auditFile{
+		path:       path,
+		maxBytes:   maxBytes,
+		maxBackups: maxBackups,
+		logger:     logger,
+	}
+	if err := af.open(); err != nil {
+		return nil, err
+	}
+	return af, nil
+}
+
+func (af *auditFile) open() error {
+	file, err := os.OpenFile(af.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	af.file = file
+	af.size = info.Size()
+	return nil
+}
+
+func (af *auditFile) backup(n int) string {
+	return af.path + "." + strconv.Itoa(n)
+}
+
+// rotate moves the file to the first backup and opens a new one. The file
+// is opened again when it can't be moved, so the entries are still appended
+// to it.
+func (af *auditFile) rotate() error {
+	err := af.file.Close()
+	if err == nil {
+		err = af.shift()
+	}
+	if err != nil {
+		af.logger.errorf("failed to rotate %s: %v", af.path, err)
+	}
+	return af.open()
+}
+
+func (af *auditFile) shift() error {
+	os.Remove(af.backup(af.maxBackups))
+	for n := af.maxBackups - 1; n >= 1; n-- {
+		os.Rename(af.backup(n), af.backup(n+1))
+	}
+	if af.maxBackups > 0 {
+		return os.Rename(af.path, af.backup(1))
+	}
+	return os.Remove(af.path)
+}
+
+func (af *auditFile) Append(entry AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	af.Lock()
+	defer af.Unlock()
+	if af.size > 0 && af.size+int64(len(line)) > af.maxBytes {
+		if err := af.rotate(); err != nil {
+			return fmt.Errorf("failed to open %s: %v", af.path, err)
+		}
+	}
+	n, err := af.file.Write(line)
+	af.size += int64(n)
+	return err
+}
+
+// Find reads the file and its backups, it's meant for occasional lookups by
+// an operator.
+func (af *auditFile) Find(query auditQuery) ([]AuditEntry, error) {
+	af.Lock()
+	defer af.Unlock()
+
+	entries := []AuditEntry{}
+	paths := []string{af.path}
+	for n := 1; n <= af.maxBackups; n++ {
+		paths = append(paths, af.backup(n))
+	}
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var entry AuditEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				continue
+			}
+			if query.matches(&entry) {
+				entries = append(entries, entry)
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Timestamp.After(entries[j].Timestamp)
+	})
+	if len(entries) > query.Limit {
+		entries = entries[:query.Limit]
+	}
+	return entries, nil
+}
+
+func (af *auditFile) Close() error {
+	af.Lock()
+	defer af.Unlock()
+	return af.file.Close()
+}
+
+/*********************
+	Endpoint
+*********************/
+
+const maxAuditLimit = 1000
+
+type auditCollection struct {
+	Count   int          `json:"count"`
+	Entries []AuditEntry `json:"entries"`
+}
+
+func parseAuditTime(c *napnap.Context, name string) time.Time {
+	val := c.Query(name)
+	if len(val) == 0 {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, val)
+	if err != nil {
+		panic(AppError{ErrorCode: "invalid_input", Message: name + " field must be a rfc3339 time."})
+	}
+	return t.UTC()
+}
+
+func (g *Gateway) listAuditEndpoint(c *napnap.Context) {
+	if g.auditLog == nil {
+		c.SetStatus(501)
+		return
+	}
+
+	query := auditQuery{
+		ConsumerID: c.Query("consumer_id"),
+		From:       parseAuditTime(c, "from"),
+		To:         parseAuditTime(c, "to"),
+		Limit:      100,
+	}
+	if val := c.Query("limit"); len(val) > 0 {
+		n, err := strconv.Atoi(val)
+		if err != nil || n <= 0 || n > maxAuditLimit {
+			panic(AppError{ErrorCode: "invalid_input", Message: "limit field is invalid."})
+		}
+		query.Limit = n
+	}
+	if !query.From.IsZero() && !query.To.IsZero() && query.To.Before(query.From) {
+		panic(AppError{ErrorCode: "invalid_input", Message: "to field can't be before from."})
+	}
+
+	entries, err := g.auditLog.store.Find(query)
+	panicIf(err)
+	c.JSON(200, auditCollection{
+		Count:   len(entries),
+		Entries: entries,
+	})
+}
+
+// newAuditStore opens the store of the audit setting.
+func newAuditStore(config *Configuration, logger *logger) (AuditStore, error) {
+	switch config.Audit.Store {
+	case "mongodb":
+		return newAuditMongo(config.Data.ConnectionString, config.Data.PoolSize, time.Duration(config.Data.DialTimeout)*time.Second, time.Duration(config.Data.SocketTimeout)*time.Second, config.Audit.MaxBytes, logger)
+	case "file":
+		return newAuditFile(config.Audit.File, config.Audit.MaxBytes, config.Audit.MaxBackups, logger)
+	}
+	return nil, errors.New("audit store " + config.Audit.Store + " isn't supported")
+}
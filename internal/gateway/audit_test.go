@@ -0,0 +1,198 @@
+package gateway
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jasonsoft/bifrost/internal/store"
+)
+
+// memoryAuditStore keeps the appended entries for the assertions.
+type memoryAuditStore struct {
+	sync.Mutex
+	entries []AuditEntry
+}
+
+func (s *memoryAuditStore) Append(entry AuditEntry) error {
+	s.Lock()
+	defer s.Unlock()
+	s.entries = append(s.entries, entry)
+	return nil
+}
+
+func (s *memoryAuditStore) Find(query auditQuery) ([]AuditEntry, error) {
+	s.Lock()
+	defer s.Unlock()
+	entries := []AuditEntry{}
+	for i := len(s.entries) - 1; i >= 0 && len(entries) < query.Limit; i-- {
+		if query.matches(&s.entries[i]) {
+			entries = append(entries, s.entries[i])
+		}
+	}
+	return entries, nil
+}
+
+func useTestAuditLog(t *testing.T, store AuditStore) {
+	previous := testGateway.auditLog
+	testGateway.auditLog = newAuditLog(store, 100, testGateway.logger, testGateway.metrics)
+	t.Cleanup(func() {
+		testGateway.auditLog = previous
+	})
+}
+
+func auditEntryAt(consumerID string, at time.Time) AuditEntry {
+	return AuditEntry{TokenID: "abcdef...", ConsumerID: consumerID, Timestamp: at, Method: "GET", Path: "/orders"}
+}
+
+func TestAuditFileRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	line, _ := json.Marshal(auditEntryAt("c1", time.Now().UTC()))
+	// every file holds two entries
+	af, err := newAuditFile(path, int64(2*(len(line)+1)), 2, testGateway.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer af.Close()
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 8; i++ {
+		if err := af.Append(auditEntryAt("c1", start.Add(time.Duration(i)*time.Second))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{path, af.backup(1), af.backup(2)} {
+		if _, err := os.Stat(name); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(af.backup(3)); !os.IsNotExist(err) {
+		t.Fatal("the oldest backup must be removed")
+	}
+
+	entries, err := af.Find(auditQuery{Limit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 6 {
+		t.Fatalf("got %d entries, want 6", len(entries))
+	}
+	if !entries[0].Timestamp.Equal(start.Add(7*time.Second)) || !entries[5].Timestamp.Equal(start.Add(2*time.Second)) {
+		t.Fatalf("entries aren't the newest first: %v ... %v", entries[0].Timestamp, entries[5].Timestamp)
+	}
+}
+
+func TestAuditFileKeepsWritingWhenRotationFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	af, err := newAuditFile(path, 1, 1, testGateway.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer af.Close()
+	// a directory which isn't empty can't be replaced by the rename
+	if err := os.MkdirAll(filepath.Join(af.backup(1), "keep"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC()
+	for i := 0; i < 3; i++ {
+		if err := af.Append(auditEntryAt("c1", now)); err != nil {
+			t.Fatalf("append %d: %v", i, err)
+		}
+	}
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(body), "\n"); lines != 3 {
+		t.Fatalf("got %d entries, want 3", lines)
+	}
+}
+
+func TestListAuditEndpoint(t *testing.T) {
+	store := &memoryAuditStore{}
+	useTestAuditLog(t, store)
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		store.Append(auditEntryAt("c1", start.Add(time.Duration(i)*time.Hour)))
+		store.Append(auditEntryAt("c2", start.Add(time.Duration(i)*time.Hour)))
+	}
+
+	req := httptest.NewRequest("GET", "/v1/audit?consumer_id=c1&from=2020-01-01T01:00:00Z&to=2020-01-01T03:00:00Z&limit=2", nil)
+	w := serveAdmin("GET", "/v1/audit", testGateway.listAuditEndpoint, req)
+	if w.Code != 200 {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var result auditCollection
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Count != 2 || len(result.Entries) != 2 {
+		t.Fatalf("count = %d, want 2", result.Count)
+	}
+	for _, entry := range result.Entries {
+		if entry.ConsumerID != "c1" {
+			t.Fatalf("consumer = %s, want c1", entry.ConsumerID)
+		}
+	}
+	if !result.Entries[0].Timestamp.Equal(start.Add(3 * time.Hour)) {
+		t.Fatalf("the newest entry = %v", result.Entries[0].Timestamp)
+	}
+
+	for _, query := range []string{"limit=0", "limit=1001", "from=yesterday", "from=2020-01-02T00:00:00Z&to=2020-01-01T00:00:00Z"} {
+		req := httptest.NewRequest("GET", "/v1/audit?"+query, nil)
+		if w := serveAdmin("GET", "/v1/audit", testGateway.listAuditEndpoint, req); w.Code != 400 {
+			t.Errorf("%s: status = %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestListAuditEndpointWhenTheAuditLogIsOff(t *testing.T) {
+	previous := testGateway.auditLog
+	testGateway.auditLog = nil
+	defer func() { testGateway.auditLog = previous }()
+	w := serveAdmin("GET", "/v1/audit", testGateway.listAuditEndpoint, httptest.NewRequest("GET", "/v1/audit", nil))
+	if w.Code != 501 {
+		t.Fatalf("status = %d, want 501", w.Code)
+	}
+}
+
+func TestIdentityAuditsTheMatchedAPI(t *testing.T) {
+	withConfig(t, func(config *Configuration) {
+		config.Token.Timeout = 3600
+	})
+	consumers := store.NewConsumerMemStore()
+	consumer := &store.Consumer{App: "shop"}
+	consumers.Insert(consumer)
+	tokens := newTestTokenStore()
+	useTestRepos(t, tokens, consumers)
+	token := testGateway.newToken(consumer.ID)
+	if err := tokens.Insert(token); err != nil {
+		t.Fatal(err)
+	}
+	orders := newTestAPI(t, "orders", "http://orders:8080")
+	orders.RequestPath = "/orders"
+	useTestRoutes(t, orders)
+	store := &memoryAuditStore{}
+	useTestAuditLog(t, store)
+
+	authenticateWith(t, "/orders/1", map[string]string{"Authorization": token.ID})
+	authenticateWith(t, "/unknown", map[string]string{"Authorization": token.ID})
+	testGateway.auditLog.Close()
+
+	if len(store.entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(store.entries))
+	}
+	if store.entries[0].APIName != "orders" || store.entries[1].APIName != "" {
+		t.Fatalf("api names = %q, %q", store.entries[0].APIName, store.entries[1].APIName)
+	}
+	if store.entries[0].ConsumerID != consumer.ID || store.entries[0].TokenID != maskTokenID(token.ID) {
+		t.Fatalf("entry = %+v", store.entries[0])
+	}
+}
@@ -0,0 +1,378 @@
+package gateway
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jasonsoft/bifrost/internal/store"
+	"github.com/jasonsoft/napnap"
+	redis "gopkg.in/redis.v4"
+)
+
+// CacheConfig turns on response caching of an api. Only GET requests and
+// 200 responses are cached.
+type CacheConfig struct {
+	Enabled     bool  `json:"enabled" bson:"enabled"`
+	DefaultTTL  int   `json:"default_ttl" bson:"default_ttl"`     // seconds, used when the response has no max-age
+	MaxBodySize int64 `json:"max_body_size" bson:"max_body_size"` // bytes, zero means no limit
+}
+
+type cachedResponse struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+	StoredAt   time.Time   `json:"stored_at"`
+	// Vary is only set on the record which lists the vary headers of an url.
+	Vary []string `json:"vary,omitempty"`
+}
+
+// CacheStore keeps the cached responses until their ttl passes.
+type CacheStore interface {
+	Get(key string) (*cachedResponse, bool)
+	Set(key string, val *cachedResponse, ttl time.Duration)
+}
+
+// headers which belong to one response only and are never replayed
+var uncachedHeaders = []string{"Set-Cookie", "X-Request-Id", "X-Cache", "Age"}
+
+type cacheControl struct {
+	noStore  bool
+	noCache  bool
+	private  bool
+	maxAge   int // -1 when not set
+	sMaxAge  int // -1 when not set
+	hasValue bool
+}
+
+func parseCacheControl(header http.Header) cacheControl {
+	result := cacheControl{maxAge: -1, sMaxAge: -1}
+	for _, val := range header["Cache-Control"] {
+		for _, directive := range strings.Split(val, ",") {
+			name := strings.ToLower(strings.TrimSpace(directive))
+			arg := ""
+			if i := strings.IndexByte(name, '='); i >= 0 {
+				arg = strings.Trim(name[i+1:], `"`)
+				name = name[:i]
+			}
+			result.hasValue = true
+			switch name {
+			case "no-store":
+				result.noStore = true
+			case "no-cache":
+				result.noCache = true
+			case "private":
+				result.private = true
+			case "max-age":
+				if n, err := strconv.Atoi(arg); err == nil && n >= 0 {
+					result.maxAge = n
+				}
+			case "s-maxage":
+				if n, err := strconv.Atoi(arg); err == nil && n >= 0 {
+					result.sMaxAge = n
+				}
+			}
+		}
+	}
+	return result
+}
+
+// CacheMiddleware answers GET requests of apis with cache enabled from the
+// store and saves 200 responses of the proxy. It runs right before the
+// proxy so a consumer which may not call the api never gets a cached copy.
+type CacheMiddleware struct {
+	routes RouteTable
+	store  CacheStore
+}
+
+func newCacheMiddleware(routes RouteTable, store CacheStore) *CacheMiddleware {
+	return &CacheMiddleware{
+		routes: routes,
+		store:  store,
+	}
+}
+
+func (m *CacheMiddleware) Invoke(c *napnap.Context, next napnap.HandlerFunc) {
+	if c.Request.Method != "GET" || isWebSocketRequest(c.Request) {
+		next(c)
+		return
+	}
+	apiEntry := m.routes.Match(c.Request.Host, c.Request.URL.Path, c.Request.Header)
+	if apiEntry == nil || !apiEntry.Cache.Enabled {
+		next(c)
+		return
+	}
+	consumer := c.MustGet("consumer").(store.Consumer)
+	if !apiEntry.isAllow(consumer) {
+		// the proxy rejects the request
+		next(c)
+		return
+	}
+
+	reqControl := parseCacheControl(c.Request.Header)
+	if reqControl.noStore {
+		next(c)
+		return
+	}
+
+	baseKey := c.Request.Method + ":" + c.Request.Host + c.Request.URL.RequestURI()
+	if len(apiEntry.MatchHeaders) > 0 {
+		// the same url can be routed to another api by its headers
+		baseKey += ":" + apiEntry.ID
+	}
+	if apiEntry.Authorization {
+		// responses of protected apis can differ per consumer
+		baseKey += ":" + consumer.ID
+	}
+	vary := []string{}
+	if record, ok := m.store.Get("vary:" + baseKey); ok {
+		vary = record.Vary
+	}
+
+	if !reqControl.noCache {
+		if cached, ok := m.store.Get(cacheKey(baseKey, vary, c.Request.Header)); ok {
+			age := int(time.Since(cached.StoredAt).Seconds())
+			if reqControl.maxAge < 0 || age <= reqControl.maxAge {
+				m.writeCached(c, cached, age)
+				return
+			}
+		}
+	}
+
+	c.RespHeader("X-Cache", "MISS")
+	recorder := &cacheRecorder{
+		ResponseWriter: c.Writer,
+		maxBodySize:    apiEntry.Cache.MaxBodySize,
+	}
+	c.Writer = recorder
+	next(c)
+	c.Writer = recorder.ResponseWriter
+
+	ttl, ok := recorder.ttl(apiEntry)
+	if !ok {
+		return
+	}
+	header := http.Header{}
+	for name, values := range recorder.Header() {
+		if !containsFold(uncachedHeaders, name) {
+			header[name] = values
+		}
+	}
+	vary = varyHeaders(header)
+	m.store.Set("vary:"+baseKey, &cachedResponse{Vary: vary}, ttl)
+	m.store.Set(cacheKey(baseKey, vary, c.Request.Header), &cachedResponse{
+		StatusCode: recorder.Status(),
+		Header:     header,
+		Body:       recorder.body.Bytes(),
+		StoredAt:   time.Now().UTC(),
+	}, ttl)
+}
+
+func (m *CacheMiddleware) writeCached(c *napnap.Context, cached *cachedResponse, age int) {
+	for name, values := range cached.Header {
+		c.Writer.Header()[name] = values
+	}
+	c.RespHeader("X-Cache", "HIT")
+	c.RespHeader("Age", strconv.Itoa(age))
+	c.Set("cache", "hit")
+	c.SetStatus(cached.StatusCode)
+	c.Writer.Write(cached.Body)
+}
+
+// cacheKey is "{method}:{full_url}:{vary_header_values}".
+func cacheKey(baseKey string, vary []string, header http.Header) string {
+	values := make([]string, len(vary))
+	for i, name := range vary {
+		values[i] = strings.Join(header[http.CanonicalHeaderKey(name)], ",")
+	}
+	return baseKey + ":" + strings.Join(values, "|")
+}
+
+func varyHeaders(header http.Header) []string {
+	result := []string{}
+	for _, val := range header["Vary"] {
+		for _, name := range strings.Split(val, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if len(name) > 0 && !contains(result, name) {
+				result = append(result, name)
+			}
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func containsFold(source []string, val string) bool {
+	for _, element := range source {
+		if strings.EqualFold(element, val) {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheRecorder copies the body while the proxy writes it.
+type cacheRecorder struct {
+	napnap.ResponseWriter
+	body        bytes.Buffer
+	maxBodySize int64
+	overflow    bool
+}
+
+func (r *cacheRecorder) Write(b []byte) (int, error) {
+	if !r.overflow {
+		if r.maxBodySize > 0 && int64(r.body.Len()+len(b)) > r.maxBodySize {
+			r.overflow = true
+			r.body.Reset()
+		} else {
+			r.body.Write(b)
+		}
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *cacheRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// ttl returns how long the response may be cached and whether it may be cached at all.
+func (r *cacheRecorder) ttl(apiEntry *api) (time.Duration, bool) {
+	header := r.Header()
+	if r.Status() != 200 || r.overflow || len(header["Set-Cookie"]) > 0 {
+		return 0, false
+	}
+	if strings.Contains(header.Get("Vary"), "*") {
+		return 0, false
+	}
+	if strings.EqualFold(filterContentType(header.Get("Content-Type")), "text/event-stream") {
+		return 0, false
+	}
+	control := parseCacheControl(header)
+	if control.noStore || control.noCache || control.private {
+		return 0, false
+	}
+	seconds := apiEntry.Cache.DefaultTTL
+	if control.sMaxAge >= 0 {
+		seconds = control.sMaxAge
+	} else if control.maxAge >= 0 {
+		seconds = control.maxAge
+	}
+	if seconds <= 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+/*********************
+	Memory
+*********************/
+
+type cacheMemEntry struct {
+	key       string
+	val       *cachedResponse
+	expiredAt time.Time
+}
+
+// cacheMemStore evicts the least recently used response when it is full.
+type cacheMemStore struct {
+	sync.Mutex
+	maxEntries int
+	entries    map[string]*list.Element
+	lru        *list.List
+}
+
+func newCacheMemStore(maxEntries int) *cacheMemStore {
+	return &cacheMemStore{
+		maxEntries: maxEntries,
+		entries:    map[string]*list.Element{},
+		lru:        list.New(),
+	}
+}
+
+func (s *cacheMemStore) Get(key string) (*cachedResponse, bool) {
+	s.Lock()
+	defer s.Unlock()
+	element, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cacheMemEntry)
+	if time.Now().After(entry.expiredAt) {
+		s.lru.Remove(element)
+		delete(s.entries, key)
+		return nil, false
+	}
+	s.lru.MoveToFront(element)
+	return entry.val, true
+}
+
+func (s *cacheMemStore) Set(key string, val *cachedResponse, ttl time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	entry := &cacheMemEntry{
+		key:       key,
+		val:       val,
+		expiredAt: time.Now().Add(ttl),
+	}
+	if element, ok := s.entries[key]; ok {
+		element.Value = entry
+		s.lru.MoveToFront(element)
+		return
+	}
+	if len(s.entries) >= s.maxEntries {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.entries, oldest.Value.(*cacheMemEntry).key)
+	}
+	s.entries[key] = s.lru.PushFront(entry)
+}
+
+/*********************
+	Redis Database
+*********************/
+
+type cacheRedis struct {
+	client *redis.Client
+	logger *logger
+}
+
+func newCacheRedis(client *redis.Client, logger *logger) *cacheRedis {
+	return &cacheRedis{
+		client: client,
+		logger: logger,
+	}
+}
+
+// Get treats a redis error as a miss so the request still reaches the upstream.
+func (s *cacheRedis) Get(key string) (*cachedResponse, bool) {
+	b, err := s.client.Get("cache:" + key).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			s.logger.errorf("cache error: %v", err)
+		}
+		return nil, false
+	}
+	result := &cachedResponse{}
+	if err := json.Unmarshal(b, result); err != nil {
+		return nil, false
+	}
+	return result, true
+}
+
+func (s *cacheRedis) Set(key string, val *cachedResponse, ttl time.Duration) {
+	b, err := json.Marshal(val)
+	if err != nil {
+		return
+	}
+	if err := s.client.Set("cache:"+key, b, ttl).Err(); err != nil {
+		s.logger.errorf("cache error: %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package gateway
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCacheSkipsPrivateResponses(t *testing.T) {
+	var calls int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&calls, 1)
+		w.Header().Set("Cache-Control", "private, max-age=60")
+		fmt.Fprintf(w, "call %d", n)
+	}))
+	defer upstream.Close()
+
+	apiEntry := newTestAPI(t, "private", upstream.URL)
+	apiEntry.Cache = CacheConfig{Enabled: true, DefaultTTL: 60}
+	routes := newAPIRouteTable([]*api{apiEntry})
+	gateway, _ := serveTestGateway(t, []*api{apiEntry}, newCacheMiddleware(routes, newCacheMemStore(100)))
+
+	for i := 1; i <= 2; i++ {
+		resp, err := http.Get(gateway.URL + "/profile")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if got := resp.Header.Get("Cache-Control"); got != "private, max-age=60" {
+			t.Fatalf("Cache-Control = %q, the upstream header must reach the client", got)
+		}
+		if got := resp.Header.Get("X-Cache"); got != "MISS" {
+			t.Fatalf("request %d: X-Cache = %q, want MISS", i, got)
+		}
+		if want := fmt.Sprintf("call %d", i); string(body) != want {
+			t.Fatalf("request %d: body = %q, want %q", i, body, want)
+		}
+	}
+}
+
+func TestCacheStoresPublicResponses(t *testing.T) {
+	var calls int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	apiEntry := newTestAPI(t, "public", upstream.URL)
+	apiEntry.Cache = CacheConfig{Enabled: true}
+	routes := newAPIRouteTable([]*api{apiEntry})
+	gateway, _ := serveTestGateway(t, []*api{apiEntry}, newCacheMiddleware(routes, newCacheMemStore(100)))
+
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(gateway.URL + "/catalog")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if n := atomic.LoadInt64(&calls); n != 1 {
+		t.Fatalf("upstream was called %d times, want 1", n)
+	}
+}
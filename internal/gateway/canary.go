@@ -0,0 +1,60 @@
+package gateway
+
+import (
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	neturl "net/url"
+
+	"github.com/jasonsoft/bifrost/internal/store"
+)
+
+// canarySetting sends a percentage of the requests to another target. With
+// StickyBy "consumer_id" or "client_ip" the same caller always gets the same
+// variant as long as the percentage doesn't change.
+type canarySetting struct {
+	TargetURL  string  `json:"target_url" bson:"target_url"`
+	Percentage float64 `json:"percentage" bson:"percentage"` // 0 - 100
+	StickyBy   string  `json:"sticky_by" bson:"sticky_by"`
+}
+
+func (cs *canarySetting) isValid() error {
+	target, err := neturl.Parse(cs.TargetURL)
+	if err != nil || len(target.Scheme) == 0 || len(target.Host) == 0 {
+		return errors.New("canary target_url is invalid")
+	}
+	if cs.Percentage < 0 || cs.Percentage > 100 {
+		return errors.New("canary percentage must be between 0 and 100")
+	}
+	switch cs.StickyBy {
+	case "", "consumer_id", "client_ip":
+	default:
+		return errors.New("canary sticky_by must be consumer_id or client_ip")
+	}
+	return nil
+}
+
+// isCanary picks the variant of the request. Sticky callers are placed by a
+// hash, so raising the percentage only moves primary callers to the canary.
+func (cs *canarySetting) isCanary(apiEntry *api, consumer store.Consumer, clientIP string) bool {
+	if cs.Percentage <= 0 {
+		return false
+	}
+	key := ""
+	switch cs.StickyBy {
+	case "consumer_id":
+		key = consumer.ID
+		if len(key) == 0 {
+			// anonymous callers fall back to the client ip
+			key = clientIP
+		}
+	case "client_ip":
+		key = clientIP
+	}
+	if len(key) == 0 {
+		return rand.Float64()*100 < cs.Percentage
+	}
+	h := fnv.New32a()
+	h.Write([]byte(apiEntry.ID + ":" + key))
+	return float64(h.Sum32()%10000) < cs.Percentage*100
+}
@@ -0,0 +1,158 @@
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// captureSetting writes a percentage of the requests of an api to the
+// capture dir, so the requests which fail can be looked into and replayed.
+type captureSetting struct {
+	Percentage float64 `json:"percentage" bson:"percentage"` // 0 - 100
+}
+
+func (cs *captureSetting) isValid() error {
+	if cs.Percentage < 0 || cs.Percentage > 100 {
+		return errors.New("capture percentage must be between 0 and 100")
+	}
+	return nil
+}
+
+func (cs *captureSetting) sample() bool {
+	return cs.Percentage > 0 && rand.Float64()*100 < cs.Percentage
+}
+
+// headers which carry credentials of the client are never written to disk
+var uncapturedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "X-Api-Key"}
+
+// captureWriter writes the captured requests in the background, one file per
+// request in the http/1.1 wire format, which http.ReadRequest reads back.
+// As many requests as fit into the queue wait, more are dropped so a slow
+// disk can't pile up goroutines.
+type captureWriter struct {
+	dir     string
+	jobs    chan func()
+	seq     int64
+	logger  *logger
+	metrics *metrics
+}
+
+func newCaptureWriter(dir string, queueSize int, logger *logger, metrics *metrics) (*captureWriter, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &captureWriter{
+		dir:     dir,
+		jobs:    make(chan func(), queueSize),
+		logger:  logger,
+		metrics: metrics,
+	}, nil
+}
+
+func (cw *captureWriter) run() {
+	for job := range cw.jobs {
+		job()
+	}
+}
+
+// captureRequest queues the request which was sent to the upstream. The body
+// is read from spill instead of being copied when it was spilled, the
+// capture takes over the file and removes it.
+func (cw *captureWriter) captureRequest(apiEntry *api, method string, requestURI string, host string, header http.Header, body []byte, spill *spillFile) {
+	if spill != nil && spill.err != nil {
+		spill.remove()
+		cw.skipCapture(apiEntry, method, spill.err)
+		return
+	}
+	captureHeader := http.Header{}
+	for name, values := range header {
+		if !containsFold(uncapturedHeaders, name) {
+			captureHeader[name] = append([]string(nil), values...)
+		}
+	}
+	// the length of the body which was read is written instead
+	captureHeader.Del("Content-Length")
+	captureHeader.Del("Transfer-Encoding")
+	var captureBody []byte
+	length := int64(len(body))
+	if spill == nil {
+		captureBody = make([]byte, len(body))
+		copy(captureBody, body)
+	} else {
+		length = spill.size
+	}
+	name := fmt.Sprintf("capture-%d-%d.http", time.Now().UnixNano(), atomic.AddInt64(&cw.seq, 1))
+
+	job := func() {
+		if spill != nil {
+			defer spill.remove()
+		}
+		var reader io.Reader = bytes.NewReader(captureBody)
+		if spill != nil {
+			reader = spill.reader()
+		}
+		result := "ok"
+		if err := cw.write(name, method, requestURI, host, captureHeader, length, reader); err != nil {
+			result = "error"
+			cw.logger.errorf("captured request can't be written: %v", err)
+		}
+		cw.metrics.incCounter("bifrost_capture_requests_total", "Captured requests by api and result.", "api", apiEntry.Name, "result", result)
+	}
+	select {
+	case cw.jobs <- job:
+	default:
+		if spill != nil {
+			spill.remove()
+		}
+		cw.metrics.incCounter("bifrost_capture_requests_total", "Captured requests by api and result.", "api", apiEntry.Name, "result", "dropped")
+	}
+}
+
+// skipCapture counts and logs a capture which can't be written because the
+// body isn't available.
+func (cw *captureWriter) skipCapture(apiEntry *api, method string, err error) {
+	cw.metrics.incCounter("bifrost_capture_requests_total", "Captured requests by api and result.", "api", apiEntry.Name, "result", "skipped")
+	cw.logger.writeWarnLog("capture was skipped", map[string]interface{}{
+		"api":    apiEntry.Name,
+		"method": method,
+		"error":  err.Error(),
+	})
+}
+
+// write writes a temp file first and renames it, so a capture file is
+// never read while it's written.
+func (cw *captureWriter) write(name string, method string, requestURI string, host string, header http.Header, length int64, body io.Reader) error {
+	path := filepath.Join(cw.dir, name)
+	file, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	fmt.Fprintf(w, "%s %s HTTP/1.1\r\nHost: %s\r\n", method, requestURI, host)
+	header.Write(w)
+	fmt.Fprintf(w, "Content-Length: %s\r\n\r\n", strconv.FormatInt(length, 10))
+	_, err = io.Copy(w, body)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+	}
+	return err
+}
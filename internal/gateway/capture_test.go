@@ -0,0 +1,186 @@
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useTestCaptureWriter captures requests to a temp dir for one test.
+func useTestCaptureWriter(t *testing.T) *captureWriter {
+	writer, err := newCaptureWriter(t.TempDir(), 10, testGateway.logger, testGateway.metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go writer.run()
+	previous := testGateway.captureWriter
+	testGateway.captureWriter = writer
+	t.Cleanup(func() {
+		testGateway.captureWriter = previous
+	})
+	return writer
+}
+
+// readCapture waits for the capture file and reads the request back.
+func readCapture(t *testing.T, writer *captureWriter) (*http.Request, []byte) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		files, _ := filepath.Glob(filepath.Join(writer.dir, "*.http"))
+		if len(files) == 1 {
+			file, err := os.Open(files[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			req, err := http.ReadRequest(bufio.NewReader(file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return req, body
+		}
+		if len(files) > 1 {
+			t.Fatalf("%d capture files, want 1", len(files))
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the request wasn't captured")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCaptureWritesTheRequestWithoutCredentials(t *testing.T) {
+	writer := useTestCaptureWriter(t)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+	}))
+	defer upstream.Close()
+	apiEntry := newTestAPI(t, "capture", upstream.URL)
+	apiEntry.Capture = &captureSetting{Percentage: 100}
+	gateway, _ := serveTestGateway(t, []*api{apiEntry})
+
+	req, _ := http.NewRequest("POST", gateway.URL+"/orders/7?expand=items", strings.NewReader(`{"qty":2}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Cookie", "session=secret")
+	req.Header.Set("X-Trace", "abc")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	captured, body := readCapture(t, writer)
+	if captured.Method != "POST" || captured.RequestURI != "/orders/7?expand=items" {
+		t.Fatalf("captured %s %s", captured.Method, captured.RequestURI)
+	}
+	if string(body) != `{"qty":2}` {
+		t.Fatalf("body = %q", body)
+	}
+	if captured.Header.Get("X-Trace") != "abc" || captured.Header.Get("X-Request-Id") != "test" {
+		t.Fatalf("header = %v, the upstream headers must be captured", captured.Header)
+	}
+	for _, name := range uncapturedHeaders {
+		if len(captured.Header.Get(name)) > 0 {
+			t.Fatalf("%s must not be written to disk", name)
+		}
+	}
+	if ok := metricValue(`bifrost_capture_requests_total{api="capture",result="ok"}`); ok != "1" {
+		t.Fatalf("ok = %s, want 1", ok)
+	}
+}
+
+func TestCaptureAndMirrorShareTheSpillFile(t *testing.T) {
+	const size = 8 << 20
+	store := useTestMirrorSpill(t, 1<<20, 100<<20, 200<<20)
+	writer := useTestCaptureWriter(t)
+	mirrored := make(chan [sha256.Size]byte, 1)
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var sum [sha256.Size]byte
+		hash := sha256.New()
+		io.Copy(hash, r.Body)
+		copy(sum[:], hash.Sum(nil))
+		mirrored <- sum
+	}))
+	defer mirror.Close()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+	}))
+	defer upstream.Close()
+	apiEntry := newTestAPI(t, "capture-spill", upstream.URL)
+	apiEntry.Mirror = &mirrorSetting{TargetURL: mirror.URL, Percentage: 100}
+	apiEntry.Capture = &captureSetting{Percentage: 100}
+	gateway, _ := serveTestGateway(t, []*api{apiEntry})
+
+	req, _ := http.NewRequest("PUT", gateway.URL+"/upload", io.LimitReader(rand.New(rand.NewSource(2)), size))
+	req.ContentLength = size
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	want := sha256.New()
+	io.Copy(want, io.LimitReader(rand.New(rand.NewSource(2)), size))
+	_, body := readCapture(t, writer)
+	if got := sha256.Sum256(body); len(body) != size || !bytes.Equal(got[:], want.Sum(nil)) {
+		t.Fatalf("captured %d bytes which aren't the upload", len(body))
+	}
+	select {
+	case sum := <-mirrored:
+		if !bytes.Equal(sum[:], want.Sum(nil)) {
+			t.Fatal("the mirror didn't get the upload")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the mirror wasn't called")
+	}
+	waitForNoSpillFiles(t, store)
+}
+
+func TestCaptureIsSkippedWhenTheSpillFails(t *testing.T) {
+	useTestMirrorSpill(t, 10, 50, 1000)
+	writer := useTestCaptureWriter(t)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+	}))
+	defer upstream.Close()
+	apiEntry := newTestAPI(t, "capture-skip", upstream.URL)
+	apiEntry.Capture = &captureSetting{Percentage: 100}
+	gateway, _ := serveTestGateway(t, []*api{apiEntry})
+
+	resp, err := http.Post(gateway.URL+"/upload", "text/plain", strings.NewReader(strings.Repeat("x", 100)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("status = %d, a failed capture must not fail the request", resp.StatusCode)
+	}
+	if skipped := metricValue(`bifrost_capture_requests_total{api="capture-skip",result="skipped"}`); skipped != "1" {
+		t.Fatalf("skipped = %s, want 1", skipped)
+	}
+	if files, _ := ioutil.ReadDir(writer.dir); len(files) != 0 {
+		t.Fatalf("%d capture files, a body above max_bytes must not be captured", len(files))
+	}
+}
+
+func TestCaptureSetting(t *testing.T) {
+	if err := (&captureSetting{Percentage: 101}).isValid(); err == nil {
+		t.Fatal("a percentage above 100 must be rejected")
+	}
+	if err := (&captureSetting{Percentage: 10}).isValid(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,224 @@
+package gateway
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jasonsoft/napnap"
+)
+
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half_open"
+)
+
+// CircuitBreakerSetting is the global setting which can be overridden per api.
+type CircuitBreakerSetting struct {
+	Enable    bool `yaml:"enable" json:"enable" bson:"enable"`
+	Threshold int  `yaml:"threshold" json:"threshold" bson:"threshold"` // consecutive failures which open the circuit
+	Window    int  `yaml:"window" json:"window" bson:"window"`          // seconds, failures older than the window are forgotten
+	CoolDown  int  `yaml:"cool_down" json:"cool_down" bson:"cool_down"` // seconds before a probe request is let through
+	// Scope is "target" (default) to keep a circuit per target url or "api"
+	// to keep one circuit for all targets of the api.
+	Scope string `yaml:"scope" json:"scope" bson:"scope"`
+}
+
+// circuitBreakerSetting merges the api override into the setting of the
+// config.
+func (a *api) circuitBreakerSetting(config *Configuration) CircuitBreakerSetting {
+	result := config.CircuitBreaker
+	override := a.CircuitBreaker
+	if override == nil {
+		return result
+	}
+	result.Enable = override.Enable
+	if override.Threshold > 0 {
+		result.Threshold = override.Threshold
+	}
+	if override.Window > 0 {
+		result.Window = override.Window
+	}
+	if override.CoolDown > 0 {
+		result.CoolDown = override.CoolDown
+	}
+	if len(override.Scope) > 0 {
+		result.Scope = override.Scope
+	}
+	return result
+}
+
+// circuitBreaker returns the circuit of breakers which guards the request
+// to the target.
+func (a *api) circuitBreaker(breakers *circuitBreakers, setting CircuitBreakerSetting, targetURL string) *circuitBreaker {
+	if setting.Scope == "api" {
+		return breakers.getForAPI(a.Name)
+	}
+	return breakers.get(targetURL)
+}
+
+type circuitBreaker struct {
+	sync.Mutex
+	TargetURL      string    `json:"target_url,omitempty"`
+	API            string    `json:"api,omitempty"`
+	State          string    `json:"state"`
+	Failures       int       `json:"failures"`
+	FirstFailureAt time.Time `json:"first_failure_at"`
+	OpenedAt       time.Time `json:"opened_at"`
+	probing        bool
+	setting        CircuitBreakerSetting
+	logger         *logger
+}
+
+// allow reports whether a request may be sent to the target.
+// Only one probe request is let through while the circuit is half open.
+func (cb *circuitBreaker) allow(setting CircuitBreakerSetting) bool {
+	cb.Lock()
+	defer cb.Unlock()
+	cb.setting = setting
+
+	switch cb.State {
+	case circuitOpen:
+		if time.Since(cb.OpenedAt) < time.Duration(setting.CoolDown)*time.Second {
+			return false
+		}
+		cb.transit(circuitHalfOpen)
+		cb.probing = true
+		return true
+	case circuitHalfOpen:
+		if cb.probing {
+			return false
+		}
+		cb.probing = true
+		return true
+	}
+	return true
+}
+
+func (cb *circuitBreaker) record(success bool) {
+	cb.Lock()
+	defer cb.Unlock()
+	now := time.Now().UTC()
+
+	if success {
+		cb.Failures = 0
+		cb.probing = false
+		if cb.State != circuitClosed {
+			cb.transit(circuitClosed)
+		}
+		return
+	}
+
+	if cb.State == circuitHalfOpen {
+		cb.probing = false
+		cb.OpenedAt = now
+		cb.transit(circuitOpen)
+		return
+	}
+
+	window := time.Duration(cb.setting.Window) * time.Second
+	if cb.Failures == 0 || (window > 0 && now.Sub(cb.FirstFailureAt) > window) {
+		cb.Failures = 0
+		cb.FirstFailureAt = now
+	}
+	cb.Failures++
+	if cb.State == circuitClosed && cb.Failures >= cb.setting.Threshold {
+		cb.OpenedAt = now
+		cb.transit(circuitOpen)
+	}
+}
+
+func (cb *circuitBreaker) transit(state string) {
+	name := cb.TargetURL
+	if len(cb.API) > 0 {
+		name = "api " + cb.API
+	}
+	cb.logger.infof("circuit of %s: %s -> %s", name, cb.State, state)
+	cb.logger.writeEventLog("circuit_breaker.state_changed", map[string]interface{}{
+		"target_url": cb.TargetURL,
+		"api":        cb.API,
+		"from":       cb.State,
+		"to":         state,
+		"failures":   cb.Failures,
+	})
+	cb.State = state
+}
+
+type circuitBreakers struct {
+	sync.Mutex
+	data   map[string]*circuitBreaker
+	logger *logger
+}
+
+func newCircuitBreakers(logger *logger) *circuitBreakers {
+	return &circuitBreakers{
+		data:   map[string]*circuitBreaker{},
+		logger: logger,
+	}
+}
+
+func (cbs *circuitBreakers) get(targetURL string) *circuitBreaker {
+	cbs.Lock()
+	defer cbs.Unlock()
+	cb, ok := cbs.data[targetURL]
+	if !ok {
+		cb = &circuitBreaker{
+			TargetURL: targetURL,
+			State:     circuitClosed,
+			logger:    cbs.logger,
+		}
+		cbs.data[targetURL] = cb
+	}
+	return cb
+}
+
+func (cbs *circuitBreakers) getForAPI(name string) *circuitBreaker {
+	cbs.Lock()
+	defer cbs.Unlock()
+	key := "api:" + name
+	cb, ok := cbs.data[key]
+	if !ok {
+		cb = &circuitBreaker{
+			API:    name,
+			State:  circuitClosed,
+			logger: cbs.logger,
+		}
+		cbs.data[key] = cb
+	}
+	return cb
+}
+
+func (cbs *circuitBreakers) all() []*circuitBreaker {
+	cbs.Lock()
+	defer cbs.Unlock()
+	result := []*circuitBreaker{}
+	for _, cb := range cbs.data {
+		result = append(result, cb)
+	}
+	return result
+}
+
+type circuitBreakerCollection struct {
+	Count           int               `json:"count"`
+	CircuitBreakers []*circuitBreaker `json:"circuit_breakers"`
+}
+
+func (g *Gateway) listCircuitBreakersEndpoint(c *napnap.Context) {
+	result := circuitBreakerCollection{
+		CircuitBreakers: []*circuitBreaker{},
+	}
+	for _, cb := range g.circuitBreakers.all() {
+		cb.Lock()
+		result.CircuitBreakers = append(result.CircuitBreakers, &circuitBreaker{
+			TargetURL:      cb.TargetURL,
+			API:            cb.API,
+			State:          cb.State,
+			Failures:       cb.Failures,
+			FirstFailureAt: cb.FirstFailureAt,
+			OpenedAt:       cb.OpenedAt,
+		})
+		cb.Unlock()
+	}
+	result.Count = len(result.CircuitBreakers)
+	c.JSON(200, result)
+}
@@ -0,0 +1,111 @@
+package gateway
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// concurrencyLimit is the semaphore of an api with max_concurrent_requests.
+type concurrencyLimit struct {
+	max   int
+	slots chan struct{}
+}
+
+// acquire takes a slot, waiting at most wait for one. It gives up when the
+// client goes away while waiting.
+func (cl *concurrencyLimit) acquire(ctx context.Context, wait time.Duration) bool {
+	select {
+	case cl.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if wait <= 0 {
+		return false
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case cl.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (cl *concurrencyLimit) release() {
+	<-cl.slots
+}
+
+// concurrencySlot is the slot a request holds. It's given back while the
+// request waits to be retried, so a backoff doesn't block other requests.
+type concurrencySlot struct {
+	limit *concurrencyLimit
+	wait  time.Duration
+	held  bool
+}
+
+// release gives the slot back unless it was released already, a nil slot
+// means the api has no limit.
+func (s *concurrencySlot) release() {
+	if s == nil || !s.held {
+		return
+	}
+	s.limit.release()
+	s.held = false
+}
+
+// reacquire takes the slot again after release.
+func (s *concurrencySlot) reacquire(ctx context.Context) bool {
+	if s == nil || s.held {
+		return true
+	}
+	s.held = s.limit.acquire(ctx, s.wait)
+	return s.held
+}
+
+func (cl *concurrencyLimit) inFlight() int {
+	return len(cl.slots)
+}
+
+// concurrencyLimits are keyed by api name so the requests in flight are
+// still counted after the apis are reloaded.
+type concurrencyLimits struct {
+	sync.Mutex
+	data map[string]*concurrencyLimit
+}
+
+func newConcurrencyLimits() *concurrencyLimits {
+	return &concurrencyLimits{
+		data: map[string]*concurrencyLimit{},
+	}
+}
+
+// get returns the limit of the api. When the maximum changed a new
+// semaphore is used, requests holding a slot of the old one release it there.
+func (cls *concurrencyLimits) get(name string, max int) *concurrencyLimit {
+	cls.Lock()
+	defer cls.Unlock()
+	cl, ok := cls.data[name]
+	if !ok || cl.max != max {
+		cl = &concurrencyLimit{
+			max:   max,
+			slots: make(chan struct{}, max),
+		}
+		cls.data[name] = cl
+	}
+	return cl
+}
+
+// inFlight returns the requests in flight per api name.
+func (cls *concurrencyLimits) inFlight() map[string]int {
+	cls.Lock()
+	defer cls.Unlock()
+	result := map[string]int{}
+	for name, cl := range cls.data {
+		result[name] = cl.inFlight()
+	}
+	return result
+}
@@ -0,0 +1,474 @@
+package gateway
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jasonsoft/napnap"
+	"gopkg.in/yaml.v2"
+)
+
+// managedByConfigSync marks apis which were created by config sync.
+const managedByConfigSync = "config_sync"
+
+// maxBundleSize limits the bundle and a file unpacked from a tarball.
+const maxBundleSize = 16 << 20
+
+var errSyncBlocked = errors.New("config sync: blocked by manual changes")
+
+// ConfigSyncSetting pulls the apis from a source of truth periodically.
+type ConfigSyncSetting struct {
+	Enable bool   `yaml:"enable"`
+	Type   string `yaml:"type"`   // url or git
+	Source string `yaml:"source"` // https url of a json/yaml document, of a tarball or of a git repository
+	Branch string `yaml:"branch"` // git only
+	Path   string `yaml:"path"`   // file of the bundle in the git repository or in the tarball
+	// Interval between two syncs in seconds.
+	Interval int `yaml:"interval"`
+	// DriftPolicy decides what happens to apis changed via the admin api:
+	// "overwrite", "preserve" (keep and warn) or "block" (stop syncing until resolved).
+	DriftPolicy string `yaml:"drift_policy"`
+	// AlertAfter is the number of consecutive failures before an alert is logged.
+	AlertAfter int `yaml:"alert_after"`
+}
+
+type configBundle struct {
+	APIs []*api `json:"apis"`
+}
+
+type configSyncStatus struct {
+	Type                string    `json:"type"`
+	Source              string    `json:"source"`
+	Version             string    `json:"version"`
+	LastAttempt         time.Time `json:"last_attempt"`
+	LastSuccess         time.Time `json:"last_success"`
+	LastError           string    `json:"last_error"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	Drift               []string  `json:"drift"`
+}
+
+// configSync writes the apis of the bundle to the api repository of the
+// gateway and reloads its routes.
+type configSync struct {
+	sync.RWMutex
+	setting ConfigSyncSetting
+	status  configSyncStatus
+	gateway *Gateway
+}
+
+func newConfigSync(g *Gateway, setting ConfigSyncSetting) *configSync {
+	cs := &configSync{
+		setting: setting,
+		gateway: g,
+		status: configSyncStatus{
+			Type:   setting.Type,
+			Source: setting.Source,
+			Drift:  []string{},
+		},
+	}
+	g.metrics.gaugeFunc("bifrost_config_sync_drift", "Apis which were changed outside of config sync.", func() float64 {
+		cs.RLock()
+		defer cs.RUnlock()
+		return float64(len(cs.status.Drift))
+	})
+	return cs
+}
+
+func (cs *configSync) run() {
+	for {
+		cs.syncOnce(cs.setting.DriftPolicy, false)
+		time.Sleep(time.Duration(cs.setting.Interval) * time.Second)
+	}
+}
+
+// syncOnce fetches and applies the bundle. force downloads the bundle even
+// if the source hasn't changed, which is used to resolve drift.
+func (cs *configSync) syncOnce(policy string, force bool) {
+	cs.RLock()
+	version := cs.status.Version
+	cs.RUnlock()
+	if force {
+		version = ""
+	}
+
+	var drift []string
+	body, newVersion, err := cs.fetch(version)
+	if err == nil && body != nil {
+		drift, err = cs.apply(body, policy)
+	}
+
+	cs.Lock()
+	defer cs.Unlock()
+	cs.status.LastAttempt = time.Now().UTC()
+	if err != nil && err != errSyncBlocked {
+		cs.status.LastError = err.Error()
+		cs.status.ConsecutiveFailures++
+		cs.gateway.metrics.incCounter("bifrost_config_sync_total", "Config sync attempts by result.", "result", "error")
+		cs.gateway.logger.errorf("config sync failed: %v", err)
+		if cs.status.ConsecutiveFailures == cs.setting.AlertAfter {
+			cs.gateway.metrics.incCounter("bifrost_config_sync_alerts_total", "Alerts raised after alert_after consecutive config sync failures.")
+			cs.gateway.logger.writeEventLog("config_sync.failing", map[string]interface{}{
+				"source":   cs.setting.Source,
+				"failures": cs.status.ConsecutiveFailures,
+				"error":    err.Error(),
+			})
+		}
+		return
+	}
+	if drift != nil {
+		cs.status.Drift = drift
+	}
+	if err == errSyncBlocked {
+		// the bundle is fine but can't be applied until someone resolves the drift
+		cs.status.LastError = err.Error()
+		cs.gateway.metrics.incCounter("bifrost_config_sync_total", "Config sync attempts by result.", "result", "blocked")
+		return
+	}
+	if body == nil {
+		cs.gateway.metrics.incCounter("bifrost_config_sync_total", "Config sync attempts by result.", "result", "not_modified")
+	} else {
+		cs.status.Version = newVersion
+		cs.gateway.metrics.incCounter("bifrost_config_sync_total", "Config sync attempts by result.", "result", "applied")
+	}
+	cs.status.LastSuccess = cs.status.LastAttempt
+	cs.status.LastError = ""
+	cs.status.ConsecutiveFailures = 0
+}
+
+// fetch returns nil body when the source hasn't changed since version.
+func (cs *configSync) fetch(version string) ([]byte, string, error) {
+	if cs.setting.Type == "git" {
+		return cs.fetchGit(version)
+	}
+	return cs.fetchURL(version)
+}
+
+func (cs *configSync) fetchURL(etag string) ([]byte, string, error) {
+	req, err := http.NewRequest("GET", cs.setting.Source, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(etag) > 0 {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := cs.gateway.httpClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer respClose(resp.Body)
+	if resp.StatusCode == 304 {
+		return nil, etag, nil
+	}
+	if resp.StatusCode != 200 {
+		return nil, "", fmt.Errorf("config sync: source returned %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBundleSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(body) > maxBundleSize {
+		return nil, "", fmt.Errorf("config sync: bundle is larger than %d bytes", maxBundleSize)
+	}
+	if isTarball(body) {
+		body, err = readTarball(body, cs.setting.Path)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	return body, resp.Header.Get("ETag"), nil
+}
+
+// isTarball recognizes a gzip or a plain tar archive by its magic bytes, the
+// content type of object stores isn't reliable.
+func isTarball(body []byte) bool {
+	if len(body) >= 2 && body[0] == 0x1f && body[1] == 0x8b {
+		return true
+	}
+	return len(body) >= 262 && string(body[257:262]) == "ustar"
+}
+
+// readTarball returns the file at name, entries may start with "./".
+func readTarball(body []byte, name string) ([]byte, error) {
+	if len(name) == 0 {
+		return nil, errors.New("config sync: path of the bundle in the tarball is missing")
+	}
+	var reader io.Reader = bytes.NewReader(body)
+	if body[0] == 0x1f {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, fmt.Errorf("config sync: invalid tarball: %v", err)
+		}
+		defer gz.Close()
+		reader = gz
+	}
+	name = path.Clean("/" + name)
+	archive := tar.NewReader(reader)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("config sync: %s isn't in the tarball", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("config sync: invalid tarball: %v", err)
+		}
+		if header.Typeflag != tar.TypeReg || path.Clean("/"+header.Name) != name {
+			continue
+		}
+		if header.Size > maxBundleSize {
+			return nil, fmt.Errorf("config sync: %s is larger than %d bytes", name, maxBundleSize)
+		}
+		return ioutil.ReadAll(archive)
+	}
+}
+
+// fetchGit uses the head commit of the branch as version and only clones
+// the repository when the commit has changed.
+func (cs *configSync) fetchGit(commit string) ([]byte, string, error) {
+	branch := cs.setting.Branch
+	if len(branch) == 0 {
+		branch = "master"
+	}
+	out, err := exec.Command("git", "ls-remote", cs.setting.Source, "refs/heads/"+branch).Output()
+	if err != nil {
+		return nil, "", fmt.Errorf("config sync: git ls-remote failed: %v", err)
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return nil, "", fmt.Errorf("config sync: branch %s was not found", branch)
+	}
+	head := fields[0]
+	if head == commit {
+		return nil, commit, nil
+	}
+
+	dir, err := ioutil.TempDir("", "bifrost-sync")
+	if err != nil {
+		return nil, "", err
+	}
+	defer os.RemoveAll(dir)
+	err = exec.Command("git", "clone", "--quiet", "--depth", "1", "--branch", branch, cs.setting.Source, dir).Run()
+	if err != nil {
+		return nil, "", fmt.Errorf("config sync: git clone failed: %v", err)
+	}
+	body, err := ioutil.ReadFile(filepath.Join(dir, filepath.Clean("/"+cs.setting.Path)))
+	if err != nil {
+		return nil, "", err
+	}
+	return body, head, nil
+}
+
+// parseBundle accepts json or yaml, the yaml is converted to json so both use the json field names.
+// The apis are verified against config.
+func parseBundle(body []byte, config *Configuration) (*configBundle, error) {
+	var doc interface{}
+	err := yaml.Unmarshal(body, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("config sync: invalid bundle: %v", err)
+	}
+	b, err := json.Marshal(yamlToJSON(doc))
+	if err != nil {
+		return nil, fmt.Errorf("config sync: invalid bundle: %v", err)
+	}
+	bundle := &configBundle{}
+	err = json.Unmarshal(b, bundle)
+	if err != nil {
+		return nil, fmt.Errorf("config sync: invalid bundle: %v", err)
+	}
+
+	names := map[string]bool{}
+	for _, target := range bundle.APIs {
+		if target == nil || len(target.Name) == 0 {
+			return nil, errors.New("config sync: api name can't be empty")
+		}
+		if target.Whitelist == nil {
+			target.Whitelist = []string{}
+		}
+		if names[target.Name] {
+			return nil, fmt.Errorf("config sync: api '%s' is duplicated", target.Name)
+		}
+		names[target.Name] = true
+		if err := target.isValid(config); err != nil {
+			return nil, err
+		}
+	}
+	return bundle, nil
+}
+
+func yamlToJSON(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[interface{}]interface{}:
+		result := map[string]interface{}{}
+		for key, element := range v {
+			result[fmt.Sprint(key)] = yamlToJSON(element)
+		}
+		return result
+	case []interface{}:
+		for i, element := range v {
+			v[i] = yamlToJSON(element)
+		}
+	}
+	return val
+}
+
+// isDrifted reports whether the api was created or changed via the admin api.
+func isDrifted(current *api) bool {
+	return current.ManagedBy != managedByConfigSync || current.Revision != current.SyncRevision
+}
+
+// apply validates the whole bundle before anything is written, an invalid
+// bundle leaves the running config untouched. It returns the drifted apis.
+func (cs *configSync) apply(body []byte, policy string) ([]string, error) {
+	bundle, err := parseBundle(body, cs.gateway.currentConfig())
+	if err != nil {
+		return nil, err
+	}
+	apis, err := cs.gateway.apiRepo.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	current := map[string]*api{}
+	for _, apiEntry := range apis {
+		current[apiEntry.Name] = apiEntry
+	}
+
+	drift := []string{}
+	inserts := []*api{}
+	updates := []*api{}
+	deletes := []*api{}
+	desired := map[string]bool{}
+	for _, target := range bundle.APIs {
+		desired[target.Name] = true
+		existing, ok := current[target.Name]
+		if !ok {
+			inserts = append(inserts, target)
+			continue
+		}
+		target.ID = existing.ID
+		target.CreatedAt = existing.CreatedAt
+		target.Revision = existing.Revision
+		target.ManagedBy = existing.ManagedBy
+		target.SyncRevision = existing.SyncRevision
+		if isDrifted(existing) {
+			drift = append(drift, existing.Name)
+			if policy != "overwrite" {
+				continue
+			}
+		} else if len(diffFields(target, existing)) == 0 {
+			continue
+		}
+		updates = append(updates, target)
+	}
+	for _, existing := range apis {
+		if existing.ManagedBy != managedByConfigSync || desired[existing.Name] {
+			continue
+		}
+		if isDrifted(existing) {
+			drift = append(drift, existing.Name)
+			if policy != "overwrite" {
+				continue
+			}
+		}
+		deletes = append(deletes, existing)
+	}
+
+	if len(drift) > 0 {
+		cs.gateway.logger.infof("config sync: apis were changed manually: %s", strings.Join(drift, ", "))
+		if policy == "block" {
+			return drift, errSyncBlocked
+		}
+	}
+
+	if len(inserts)+len(updates)+len(deletes) == 0 {
+		return drift, nil
+	}
+
+	// the running apis are built from the bundle before anything is written
+	// and swapped in one step, requests never see a half applied bundle.
+	replaced := map[string]*api{}
+	for _, target := range updates {
+		replaced[target.ID] = target
+	}
+	for _, target := range deletes {
+		replaced[target.ID] = nil
+	}
+	config := cs.gateway.currentConfig()
+	next := []*api{}
+	next = append(next, config.APIs...)
+	for _, existing := range apis {
+		target, ok := replaced[existing.ID]
+		if !ok {
+			target = existing
+		}
+		if target != nil {
+			next = append(next, target)
+		}
+	}
+	next = append(next, inserts...)
+	if err := validateAPIs(next, config); err != nil {
+		return drift, err
+	}
+
+	for _, target := range inserts {
+		target.ManagedBy = managedByConfigSync
+		target.SyncRevision = 1
+		if err := cs.gateway.apiRepo.Insert(target); err != nil {
+			return drift, err
+		}
+	}
+	for _, target := range updates {
+		target.ManagedBy = managedByConfigSync
+		target.SyncRevision = target.Revision + 1
+		from := target.Revision
+		changes := diffFields(target, current[target.Name])
+		if err := cs.gateway.apiRepo.Update(target); err != nil {
+			return drift, err
+		}
+		cs.gateway.auditRevision(managedByConfigSync, "api", target.ID, from, target.Revision, changes)
+	}
+	for _, target := range deletes {
+		if err := cs.gateway.apiRepo.Delete(target.ID); err != nil {
+			return drift, err
+		}
+	}
+
+	cs.gateway.logger.infof("config sync: %d created, %d updated, %d deleted", len(inserts), len(updates), len(deletes))
+	cs.gateway.loadRoutes(next)
+	return drift, nil
+}
+
+func (g *Gateway) getConfigSyncEndpoint(c *napnap.Context) {
+	if g.configSync == nil {
+		panic(AppError{ErrorCode: "not_found", Message: "config sync isn't enabled"})
+	}
+	g.configSync.RLock()
+	defer g.configSync.RUnlock()
+	c.JSON(200, g.configSync.status)
+}
+
+// syncConfigEndpoint syncs immediately. With ?overwrite=true manual changes
+// are overwritten, which resolves a blocked sync.
+func (g *Gateway) syncConfigEndpoint(c *napnap.Context) {
+	if g.configSync == nil {
+		panic(AppError{ErrorCode: "not_found", Message: "config sync isn't enabled"})
+	}
+	policy := g.configSync.setting.DriftPolicy
+	if c.Query("overwrite") == "true" {
+		policy = "overwrite"
+	}
+	g.configSync.syncOnce(policy, true)
+	g.getConfigSyncEndpoint(c)
+}
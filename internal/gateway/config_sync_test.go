@@ -0,0 +1,363 @@
+package gateway
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/jasonsoft/bifrost/internal/store"
+)
+
+// cloneAPI copies the stored fields through json like the redis store does,
+// the lock and the compiled fields of the api aren't copied.
+func cloneAPI(apiEntry *api) *api {
+	b, err := json.Marshal(apiEntry)
+	if err != nil {
+		panic(err)
+	}
+	copied := &api{}
+	if err := json.Unmarshal(b, copied); err != nil {
+		panic(err)
+	}
+	return copied
+}
+
+// apiTestRepo keeps the apis in memory, the write with failAt fails.
+type apiTestRepo struct {
+	sync.Mutex
+	apis   []*api
+	writes int
+	failAt int
+}
+
+func (r *apiTestRepo) write() error {
+	r.writes++
+	if r.writes == r.failAt {
+		return errors.New("write failed")
+	}
+	return nil
+}
+
+func (r *apiTestRepo) Get(id string) (*api, error) {
+	r.Lock()
+	defer r.Unlock()
+	for _, apiEntry := range r.apis {
+		if apiEntry.ID == id {
+			return apiEntry, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *apiTestRepo) GetAll() ([]*api, error) {
+	r.Lock()
+	defer r.Unlock()
+	result := []*api{}
+	for _, apiEntry := range r.apis {
+		result = append(result, cloneAPI(apiEntry))
+	}
+	return result, nil
+}
+
+func (r *apiTestRepo) Insert(apiEntry *api) error {
+	r.Lock()
+	defer r.Unlock()
+	if err := r.write(); err != nil {
+		return err
+	}
+	apiEntry.ID = fmt.Sprintf("api-%d", r.writes)
+	apiEntry.Revision = 1
+	r.apis = append(r.apis, cloneAPI(apiEntry))
+	return nil
+}
+
+func (r *apiTestRepo) Update(apiEntry *api) error {
+	r.Lock()
+	defer r.Unlock()
+	if err := r.write(); err != nil {
+		return err
+	}
+	for i, existing := range r.apis {
+		if existing.ID == apiEntry.ID {
+			if existing.Revision != apiEntry.Revision {
+				return store.ErrRevisionConflict
+			}
+			apiEntry.Revision++
+			r.apis[i] = cloneAPI(apiEntry)
+		}
+	}
+	return nil
+}
+
+func (r *apiTestRepo) Delete(id string) error {
+	r.Lock()
+	defer r.Unlock()
+	if err := r.write(); err != nil {
+		return err
+	}
+	for i, existing := range r.apis {
+		if existing.ID == id {
+			r.apis = append(r.apis[:i], r.apis[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func useTestAPIRepo(t *testing.T, repo APIRepository) {
+	previous, previousRoutes := testGateway.apiRepo, testGateway.routes.All()
+	testGateway.apiRepo = repo
+	t.Cleanup(func() {
+		testGateway.apiRepo = previous
+		testGateway.loadRoutes(previousRoutes)
+	})
+}
+
+func routeNames() map[string]string {
+	result := map[string]string{}
+	for _, apiEntry := range testGateway.routes.All() {
+		result[apiEntry.Name] = apiEntry.TargetURL
+	}
+	return result
+}
+
+const syncBundle = `
+apis:
+  - name: orders
+    request_path: /orders
+    target_url: http://orders:8080
+  - name: users
+    request_path: /users
+    target_url: http://users-v2:8080
+`
+
+func TestConfigSyncSwapsTheRoutes(t *testing.T) {
+	repo := &apiTestRepo{}
+	useTestAPIRepo(t, repo)
+	repo.Insert(&api{Name: "users", RequestPath: "/users", TargetURL: "http://users:8080", ManagedBy: managedByConfigSync, SyncRevision: 1})
+	repo.Insert(&api{Name: "legacy", RequestPath: "/legacy", TargetURL: "http://legacy:8080", ManagedBy: managedByConfigSync, SyncRevision: 1})
+	repo.Insert(&api{Name: "manual", RequestPath: "/manual", TargetURL: "http://manual:8080"})
+	testGateway.loadRoutes(nil)
+
+	cs := newConfigSync(testGateway, ConfigSyncSetting{})
+	if _, err := cs.apply([]byte(syncBundle), "preserve"); err != nil {
+		t.Fatal(err)
+	}
+	routes := routeNames()
+	expected := map[string]string{
+		"orders": "http://orders:8080",
+		"users":  "http://users-v2:8080",
+		"manual": "http://manual:8080",
+	}
+	if fmt.Sprint(routes) != fmt.Sprint(expected) {
+		t.Fatalf("routes are %v, want %v", routes, expected)
+	}
+	stored, _ := repo.GetAll()
+	if len(stored) != 3 {
+		t.Fatalf("%d apis are stored, want 3", len(stored))
+	}
+}
+
+func TestConfigSyncKeepsTheRoutesWhenAWriteFails(t *testing.T) {
+	repo := &apiTestRepo{}
+	useTestAPIRepo(t, repo)
+	repo.Insert(&api{Name: "users", RequestPath: "/users", TargetURL: "http://users:8080", ManagedBy: managedByConfigSync, SyncRevision: 1})
+	apis, _ := repo.GetAll()
+	testGateway.loadRoutes(apis)
+	// the insert of orders works, the update of users fails
+	repo.failAt = repo.writes + 2
+
+	cs := newConfigSync(testGateway, ConfigSyncSetting{})
+	if _, err := cs.apply([]byte(syncBundle), "preserve"); err == nil {
+		t.Fatal("the failed write must be reported")
+	}
+	routes := routeNames()
+	if len(routes) != 1 || routes["users"] != "http://users:8080" {
+		t.Fatalf("routes are %v, the running apis must stay untouched", routes)
+	}
+}
+
+// driftedRepo has users which was changed via the admin api after the last
+// sync, and legacy which was removed from the bundle.
+func driftedRepo(t *testing.T) *apiTestRepo {
+	repo := &apiTestRepo{}
+	useTestAPIRepo(t, repo)
+	repo.Insert(&api{Name: "users", RequestPath: "/users", TargetURL: "http://users:8080", ManagedBy: managedByConfigSync, SyncRevision: 1})
+	repo.Insert(&api{Name: "legacy", RequestPath: "/legacy", TargetURL: "http://legacy:8080", ManagedBy: managedByConfigSync, SyncRevision: 1})
+	users, _ := repo.GetAll()
+	users[0].TargetURL = "http://users-manual:8080"
+	repo.Update(users[0])
+	apis, _ := repo.GetAll()
+	testGateway.loadRoutes(apis)
+	return repo
+}
+
+func TestConfigSyncDriftPolicies(t *testing.T) {
+	cases := []struct {
+		policy string
+		err    error
+		routes map[string]string
+	}{
+		{"overwrite", nil, map[string]string{
+			"orders": "http://orders:8080",
+			"users":  "http://users-v2:8080",
+		}},
+		{"preserve", nil, map[string]string{
+			"orders": "http://orders:8080",
+			"users":  "http://users-manual:8080",
+		}},
+		{"block", errSyncBlocked, map[string]string{
+			"users":  "http://users-manual:8080",
+			"legacy": "http://legacy:8080",
+		}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.policy, func(t *testing.T) {
+			driftedRepo(t)
+			cs := newConfigSync(testGateway, ConfigSyncSetting{})
+			drift, err := cs.apply([]byte(syncBundle), tc.policy)
+			if err != tc.err {
+				t.Fatalf("err = %v, want %v", err, tc.err)
+			}
+			if fmt.Sprint(drift) != "[users]" {
+				t.Fatalf("drift = %v, want [users]", drift)
+			}
+			if routes := routeNames(); fmt.Sprint(routes) != fmt.Sprint(tc.routes) {
+				t.Fatalf("routes are %v, want %v", routes, tc.routes)
+			}
+		})
+	}
+}
+
+// serveBundle serves body with an etag and answers 304 when it matches.
+func serveBundle(t *testing.T, status int, body []byte) (*httptest.Server, *int64) {
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(304)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.WriteHeader(status)
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func newTarball(t *testing.T, gzipped bool, files map[string]string) []byte {
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var gz *gzip.Writer
+	if gzipped {
+		gz = gzip.NewWriter(&buf)
+		w = gz
+	}
+	archive := tar.NewWriter(w)
+	for name, content := range files {
+		archive.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		archive.Write([]byte(content))
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gz != nil {
+		gz.Close()
+	}
+	return buf.Bytes()
+}
+
+func TestConfigSyncReadsTheBundleFromATarball(t *testing.T) {
+	for _, gzipped := range []bool{true, false} {
+		repo := &apiTestRepo{}
+		useTestAPIRepo(t, repo)
+		testGateway.loadRoutes(nil)
+		tarball := newTarball(t, gzipped, map[string]string{
+			"./README.md":           "not the bundle",
+			"./gateway/bifrost.yml": syncBundle,
+		})
+		server, requests := serveBundle(t, 200, tarball)
+
+		cs := newConfigSync(testGateway, ConfigSyncSetting{Type: "url", Source: server.URL, Path: "gateway/bifrost.yml"})
+		cs.syncOnce("preserve", false)
+		if len(cs.status.LastError) > 0 || cs.status.Version != `"v1"` {
+			t.Fatalf("gzip %v: error = %s, version = %s", gzipped, cs.status.LastError, cs.status.Version)
+		}
+		if routes := routeNames(); len(routes) != 2 || routes["users"] != "http://users-v2:8080" {
+			t.Fatalf("gzip %v: routes are %v", gzipped, routes)
+		}
+		// the etag is sent, the unchanged tarball isn't applied again
+		cs.syncOnce("preserve", false)
+		if n := atomic.LoadInt64(requests); n != 2 || repo.writes != 2 {
+			t.Fatalf("gzip %v: %d requests and %d writes, want 2 and 2", gzipped, n, repo.writes)
+		}
+	}
+
+	if _, err := readTarball(newTarball(t, true, map[string]string{"bifrost.yml": syncBundle}), "missing.yml"); err == nil {
+		t.Fatal("a tarball without the path must be rejected")
+	}
+}
+
+func TestConfigSyncKeepsTheRoutesWhenTheBundleIsInvalid(t *testing.T) {
+	repo := &apiTestRepo{}
+	useTestAPIRepo(t, repo)
+	repo.Insert(&api{Name: "users", RequestPath: "/users", TargetURL: "http://users:8080", ManagedBy: managedByConfigSync, SyncRevision: 1})
+	apis, _ := repo.GetAll()
+	testGateway.loadRoutes(apis)
+	// orders is fine, the duplicated users makes the whole bundle invalid
+	invalid := syncBundle + `
+  - name: users
+    request_path: /users-again
+    target_url: http://users-v3:8080
+`
+	server, _ := serveBundle(t, 200, []byte(invalid))
+
+	cs := newConfigSync(testGateway, ConfigSyncSetting{Type: "url", Source: server.URL, AlertAfter: 3})
+	cs.syncOnce("overwrite", false)
+	if cs.status.ConsecutiveFailures != 1 || len(cs.status.LastError) == 0 {
+		t.Fatalf("failures = %d, error = %q, the invalid bundle must be reported", cs.status.ConsecutiveFailures, cs.status.LastError)
+	}
+	if routes := routeNames(); len(routes) != 1 || routes["users"] != "http://users:8080" {
+		t.Fatalf("routes are %v, the running apis must stay untouched", routes)
+	}
+	if repo.writes != 1 {
+		t.Fatalf("%d writes, nothing of the invalid bundle must be stored", repo.writes)
+	}
+}
+
+func TestConfigSyncAlertsAfterConsecutiveFailures(t *testing.T) {
+	repo := &apiTestRepo{}
+	useTestAPIRepo(t, repo)
+	server, _ := serveBundle(t, 500, nil)
+	alerts := func() float64 {
+		return metricCount(t, "bifrost_config_sync_alerts_total")
+	}
+
+	cs := newConfigSync(testGateway, ConfigSyncSetting{Type: "url", Source: server.URL, AlertAfter: 3})
+	before := alerts()
+	for i := 1; i <= 2; i++ {
+		cs.syncOnce("preserve", false)
+		if got := alerts(); got != before {
+			t.Fatalf("an alert after %d failures, want it after 3", i)
+		}
+	}
+	cs.syncOnce("preserve", false)
+	if got := alerts(); got != before+1 {
+		t.Fatalf("alerts = %v, want %v after 3 failures", got, before+1)
+	}
+	// the alert isn't repeated while the source keeps failing
+	cs.syncOnce("preserve", false)
+	if got := alerts(); got != before+1 {
+		t.Fatalf("alerts = %v, the alert must be raised once", got)
+	}
+}
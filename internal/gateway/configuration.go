@@ -0,0 +1,532 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	upstream "github.com/jasonsoft/bifrost/internal/proxy"
+	"github.com/jasonsoft/bifrost/internal/store"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	ErrDataAddr            = errors.New("config: data address can't be empty")
+	ErrAdminBind           = errors.New("config: admin_bind can't be one of binds")
+	ErrEvictionPolicy      = errors.New("config: token eviction_policy must be reject or evict-oldest")
+	ErrExpirationMode      = errors.New("config: token expiration_mode must be sliding or absolute and max_lifetime can't be negative")
+	ErrTokenSweep          = errors.New("config: token sweep_interval must be greater than zero")
+	ErrMirrorWorkers       = errors.New("config: mirror_worker_count must be greater than zero")
+	ErrMirrorSpill         = errors.New("config: mirror_spill needs memory_bytes below max_bytes, max_bytes up to quota_bytes and a sweep_interval greater than zero")
+	ErrCapture             = errors.New("config: capture queue_size must be greater than zero")
+	ErrPlugin              = errors.New("config: plugins need a name and a priority greater than zero")
+	ErrRateLimit           = errors.New("config: rate_limit rps and burst must be greater than zero")
+	ErrRateLimitTier       = errors.New("config: rps and burst of every rate_limit tier must be greater than zero")
+	ErrCircuitBreakerScope = errors.New("config: circuit_breaker scope must be target or api")
+	ErrConfigSync          = errors.New("config: config_sync needs a source, an interval, type url or git and drift_policy overwrite, preserve or block")
+	ErrCache               = errors.New("config: cache max_entries must be greater than 0")
+	ErrIdempotency         = errors.New("config: idempotency max_entries must be greater than 0")
+	ErrTLS                 = errors.New("config: tls needs an addr and both cert_file and key_file or neither")
+	ErrTLSRedirect         = errors.New("config: tls redirect_addr can't be one of the binds")
+	ErrShutdownTimeout     = errors.New("config: shutdown_timeout must be greater than zero")
+	ErrHMACWindow          = errors.New("config: hmac window must be greater than zero")
+	ErrMaxRequestBody      = errors.New("config: max_request_body_bytes can't be negative")
+	ErrSentinel            = errors.New("config: data sentinel needs sentinel_addrs with a master_name")
+	ErrTrustedRequestID    = errors.New("config: trusted_request_id_cidrs has an invalid cidr")
+	ErrTrustedProxies      = errors.New("config: trusted_proxies has an invalid cidr")
+	ErrServerTimeout       = errors.New("config: server timeouts can't be negative")
+	ErrUpstreamTimeout     = errors.New("config: upstream_timeout can't be negative")
+	ErrAdminPassword       = errors.New("config: admin_password_hash must be a bcrypt hash when admin_username is set")
+	ErrDeadLetterQueue     = errors.New("config: logs retry_interval and max_retries must be positive with a dead_letter_queue_size")
+	ErrUnmatched           = errors.New("config: unmatched max_signatures must be greater than zero")
+	ErrAudit               = errors.New("config: audit needs store mongodb with a mongodb data type or store file with a file, max_bytes and queue_size must be greater than zero")
+)
+
+type Header struct {
+	AddHeader string
+}
+
+// ServerSetting holds the timeouts of the http servers in seconds, zero
+// turns a timeout off. The write timeout would also cut streaming responses
+// and websockets, so it's off by default and idle connections are closed by
+// the idle timeout instead.
+type ServerSetting struct {
+	ReadHeaderTimeout int64 `yaml:"read_header_timeout" json:"read_header_timeout"`
+	ReadTimeout       int64 `yaml:"read_timeout" json:"read_timeout"`
+	WriteTimeout      int64 `yaml:"write_timeout" json:"write_timeout"`
+	IdleTimeout       int64 `yaml:"idle_timeout" json:"idle_timeout"`
+}
+
+type Logs struct {
+	ErrorLog string
+}
+
+type Configuration struct {
+	Debug bool `yaml:"debug"`
+	Logs  struct {
+		Target struct {
+			Name             string `yaml:"name"`
+			Type             string `yaml:"type"`
+			ConnectionString string `yaml:"connection_string"`
+			// tcp connections use tls with a client certificate when all three are set
+			TLSCertFile string `yaml:"tls_cert_file"`
+			TLSKeyFile  string `yaml:"tls_key_file"`
+			TLSCAFile   string `yaml:"tls_ca_file"`
+		} `yaml:"target"`
+		AccessLog       bool `yaml:"access_log"`
+		ApplicationLog  bool `yaml:"application_log"`
+		MaxBodyLogBytes int  `yaml:"max_body_log_bytes"`
+		// messages which don't fit into the message queue are retried every
+		// retry_interval seconds, after max_retries they go to fallback_file
+		DeadLetterQueueSize int    `yaml:"dead_letter_queue_size"`
+		RetryInterval       int64  `yaml:"retry_interval"`
+		MaxRetries          int    `yaml:"max_retries"`
+		FallbackFile        string `yaml:"fallback_file"`
+	}
+	CustomErrors     bool          `yaml:"custom_errors"`
+	Binds            []string      `yaml:"binds"`
+	AdminBind        string        `yaml:"admin_bind"`
+	AdminTokens      []string      `yaml:"admin_tokens"`
+	SkipIfMatch      bool          `yaml:"skip_if_match"`      // allow admin updates without If-Match header
+	ForwardRequestIP bool          `yaml:"forward_request_ip"` // deprecated: X-Forwarded-For is always sent
+	ForwardRequestID bool          `yaml:"forward_request_id"` // deprecated: X-Request-Id is always sent
+	UpstreamTimeout  int64         `yaml:"upstream_timeout"`   // seconds, timeout_ms of an api wins, zero means no timeout
+	ShutdownTimeout  int64         `yaml:"shutdown_timeout"`   // seconds to drain requests on SIGTERM
+	UpstreamTLS      *upstream.TLS `yaml:"upstream_tls"`       // default of apis without upstream_tls
+	EgressProxy      *egressProxy  `yaml:"egress_proxy"`       // default of apis without egress_proxy
+	Data             store.DataSetting
+	Cors             struct {
+		Enable bool `yaml:"enable"`
+	}
+	Gzip struct {
+		Enable bool `yaml:"enable"`
+	}
+	Token          store.TokenSetting
+	CircuitBreaker CircuitBreakerSetting `yaml:"circuit_breaker"`
+	RateLimit      struct {
+		Enable bool    `yaml:"enable"`
+		RPS    float64 `yaml:"rps"`
+		Burst  int     `yaml:"burst"`
+		Store  string  `yaml:"store"` // memory or redis
+		// Tiers are the rates an api can choose with rate_limit_tier
+		// instead of rps and burst, e.g. gold: {rps: 100, burst: 200}.
+		Tiers map[string]RateLimitTier `yaml:"tiers"`
+	} `yaml:"rate_limit"`
+	Unmatched struct {
+		Enable          bool     `yaml:"enable"`
+		MaxSignatures   int      `yaml:"max_signatures"`
+		SummaryInterval int      `yaml:"summary_interval"` // seconds
+		SpikeThreshold  int      `yaml:"spike_threshold"`  // requests per minute of one signature
+		IgnoreListeners []string `yaml:"ignore_listeners"`
+	} `yaml:"unmatched"`
+	FieldEncryption struct {
+		Keys         []EncryptionKey `yaml:"keys"` // the first key encrypts, all keys decrypt
+		MaxBodyBytes int64           `yaml:"max_body_bytes"`
+	} `yaml:"field_encryption"`
+	keyRing *keyRing
+	// APIs are served in addition to the apis of the repository.
+	APIs       configAPIs        `yaml:"apis"`
+	ConfigSync ConfigSyncSetting `yaml:"config_sync"`
+	HMAC       struct {
+		Window int `yaml:"window"` // seconds a signed request is valid
+	} `yaml:"hmac"`
+	Cache struct {
+		Enable     bool   `yaml:"enable"`
+		Store      string `yaml:"store"` // memory or redis
+		MaxEntries int    `yaml:"max_entries"`
+	} `yaml:"cache"`
+	// Idempotency keeps the responses of requests with an Idempotency-Key
+	// for the apis with an idempotency setting, at most max_entries.
+	Idempotency struct {
+		MaxEntries int `yaml:"max_entries"`
+	} `yaml:"idempotency"`
+	TLS struct {
+		Enable               bool     `yaml:"enable"`
+		Addr                 string   `yaml:"addr"`
+		ApplyCertDomainNames []string `yaml:"apply_cert_domain_names"`
+		// CertFile and KeyFile are used instead of let's encrypt when they are set.
+		CertFile string `yaml:"cert_file"`
+		KeyFile  string `yaml:"key_file"`
+		// RedirectAddr starts a plaintext listener which redirects to https.
+		RedirectAddr string `yaml:"redirect_addr"`
+	}
+	// StickySessionSecret signs the sticky session cookies, gateways behind
+	// the same load balancer need the same secret.
+	StickySessionSecret string `yaml:"sticky_session_secret"`
+	// DNSRefreshInterval is how often the hostnames of the upstream
+	// connections are resolved again in seconds, zero turns it off.
+	DNSRefreshInterval int64 `yaml:"dns_refresh_interval"`
+	// TrustIncomingRequestID keeps the client's X-Request-Id when it's a uuid v4.
+	TrustIncomingRequestID bool `yaml:"trust_incoming_request_id"`
+	// TrustedRequestIDCIDRs keeps the X-Request-Id only for clients connecting
+	// from these networks, e.g. another gateway or the load balancer.
+	TrustedRequestIDCIDRs []string `yaml:"trusted_request_id_cidrs"`
+	// TrustedProxies are the networks of the load balancers in front of the
+	// gateway, X-Forwarded-For of other peers is ignored for the client ip.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	// AdminUsername and the bcrypt AdminPasswordHash allow basic auth on the
+	// admin listener, next to the admin tokens.
+	AdminUsername     string `yaml:"admin_username"`
+	AdminPasswordHash string `yaml:"admin_password_hash"`
+	// MaxRequestBodyBytes limits the request body of apis without their own
+	// max_request_body_bytes, zero means no limit.
+	MaxRequestBodyBytes int64 `yaml:"max_request_body_bytes"`
+	// Server is read at startup, a reload doesn't change the timeouts.
+	Server ServerSetting `yaml:"server"`
+	// ErrorPage is an html/template file for the errors of the gateway itself,
+	// it's used when the client accepts text/html instead of json.
+	ErrorPage string `yaml:"error_page"`
+	errorPage *template.Template
+	// FallThroughUnmatched passes requests which match no api to the
+	// middlewares and routes after the proxy instead of answering 404 at once.
+	FallThroughUnmatched bool `yaml:"fall_through_unmatched"`
+	// MirrorWorkerCount is the number of goroutines which send mirrored
+	// requests, it's read at startup.
+	MirrorWorkerCount int `yaml:"mirror_worker_count"`
+	// MirrorSpill writes mirrored and captured bodies larger than memory_bytes
+	// to files in dir instead of copying them in memory. Bodies larger than
+	// max_bytes, or while the files use up quota_bytes, aren't mirrored or
+	// captured. It's read at startup.
+	MirrorSpill struct {
+		Dir           string `yaml:"dir"` // empty copies every body in memory
+		MemoryBytes   int64  `yaml:"memory_bytes"`
+		MaxBytes      int64  `yaml:"max_bytes"`
+		QuotaBytes    int64  `yaml:"quota_bytes"`
+		SweepInterval int    `yaml:"sweep_interval"` // seconds between removing orphaned files
+	} `yaml:"mirror_spill"`
+	// Capture writes the requests of the apis with a capture setting to files
+	// in dir, queue_size requests wait to be written. It's read at startup.
+	Capture struct {
+		Dir       string `yaml:"dir"` // empty turns capturing off
+		QueueSize int    `yaml:"queue_size"`
+	} `yaml:"capture"`
+	// ConsumerCacheTTL keeps the consumers found by id in memory for these
+	// seconds, zero turns the cache off.
+	ConsumerCacheTTL int64 `yaml:"consumer_cache_ttl"`
+	// PluginDir holds the plugins built as shared objects, Plugins turns on
+	// plugins by name. See Plugin for the contract.
+	PluginDir string          `yaml:"plugin_dir"`
+	Plugins   []PluginSetting `yaml:"plugins"`
+	// Audit records every request authenticated by a token. max_bytes caps
+	// the mongodb collection or rotates the file, it's read at startup.
+	Audit struct {
+		Enable     bool   `yaml:"enable"`
+		Store      string `yaml:"store"` // mongodb or file
+		File       string `yaml:"file"`
+		MaxBytes   int64  `yaml:"max_bytes"`
+		MaxBackups int    `yaml:"max_backups"` // rotated files which are kept
+		QueueSize  int    `yaml:"queue_size"`
+	} `yaml:"audit"`
+}
+
+func newConfiguration() Configuration {
+	config := Configuration{
+		Binds:           []string{":8080"},
+		AdminBind:       ":10081",
+		UpstreamTimeout: 30, // seconds
+		ShutdownTimeout: 5,  // seconds
+		Data: store.DataSetting{
+			Type: "memory",
+		},
+		Token: store.TokenSetting{
+			Timeout:       1200, // 20 mins
+			SweepInterval: 60,
+		},
+		CircuitBreaker: CircuitBreakerSetting{
+			Threshold: 5,
+			Window:    60,
+			CoolDown:  30,
+		},
+	}
+	config.Logs.MaxBodyLogBytes = 4096
+	config.Server.ReadHeaderTimeout = 10
+	config.Server.IdleTimeout = 120
+	config.Logs.DeadLetterQueueSize = 10000
+	config.Logs.RetryInterval = 5
+	config.Logs.MaxRetries = 3
+	config.Unmatched.MaxSignatures = 1000
+	config.FieldEncryption.MaxBodyBytes = 1 << 20
+	config.ConfigSync.Type = "url"
+	config.ConfigSync.Interval = 60
+	config.ConfigSync.DriftPolicy = "preserve"
+	config.ConfigSync.AlertAfter = 3
+	config.Unmatched.SummaryInterval = 300
+	config.Cache.MaxEntries = 10000
+	config.Idempotency.MaxEntries = 10000
+	config.HMAC.Window = 300
+	config.DNSRefreshInterval = 30
+	config.MirrorWorkerCount = 100
+	config.MirrorSpill.MemoryBytes = 1 << 20
+	config.MirrorSpill.MaxBytes = 1 << 30
+	config.MirrorSpill.QuotaBytes = 10 << 30
+	config.MirrorSpill.SweepInterval = 300
+	config.Capture.QueueSize = 100
+	config.Token.LastUsedInterval = 60
+	config.Audit.MaxBytes = 100 << 20
+	config.Audit.MaxBackups = 5
+	config.Audit.QueueSize = 10000
+	config.Unmatched.IgnoreListeners = []string{":10081"}
+	return config
+}
+
+// ValidationError lists every problem of the config file at once.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e ValidationError) Error() string {
+	return strings.Join(e.Problems, "; ")
+}
+
+func (c *Configuration) isValid() error {
+	problems := []string{}
+	if contains(c.Binds, c.AdminBind) {
+		problems = append(problems, ErrAdminBind.Error())
+	}
+	if len(c.AdminUsername) > 0 {
+		if _, err := bcrypt.Cost([]byte(c.AdminPasswordHash)); err != nil {
+			problems = append(problems, ErrAdminPassword.Error())
+		}
+	}
+	if c.Unmatched.Enable && c.Unmatched.MaxSignatures <= 0 {
+		problems = append(problems, ErrUnmatched.Error())
+	}
+	if c.RateLimit.Enable && (c.RateLimit.RPS <= 0 || c.RateLimit.Burst <= 0) {
+		problems = append(problems, ErrRateLimit.Error())
+	}
+	for _, tier := range c.RateLimit.Tiers {
+		if tier.RPS <= 0 || tier.Burst <= 0 {
+			problems = append(problems, ErrRateLimitTier.Error())
+			break
+		}
+	}
+	switch c.CircuitBreaker.Scope {
+	case "", "target", "api":
+	default:
+		problems = append(problems, ErrCircuitBreakerScope.Error())
+	}
+	if c.ConfigSync.Enable {
+		valid := len(c.ConfigSync.Source) > 0 && c.ConfigSync.Interval > 0
+		valid = valid && (c.ConfigSync.Type == "url" || c.ConfigSync.Type == "git")
+		switch c.ConfigSync.DriftPolicy {
+		case "overwrite", "preserve", "block":
+		default:
+			valid = false
+		}
+		if !valid {
+			problems = append(problems, ErrConfigSync.Error())
+		}
+	}
+	if c.UpstreamTLS != nil {
+		if err := c.UpstreamTLS.IsValid(); err != nil {
+			problems = append(problems, "config: "+err.Error())
+		}
+	}
+	if c.EgressProxy != nil {
+		if err := c.EgressProxy.isValid(); err != nil {
+			problems = append(problems, "config: "+err.Error())
+		}
+	}
+	if c.TLS.Enable {
+		if len(c.TLS.Addr) == 0 || (len(c.TLS.CertFile) == 0) != (len(c.TLS.KeyFile) == 0) {
+			problems = append(problems, ErrTLS.Error())
+		}
+		if len(c.TLS.RedirectAddr) > 0 && contains(c.Binds, c.TLS.RedirectAddr) {
+			problems = append(problems, ErrTLSRedirect.Error())
+		}
+	}
+	if c.HMAC.Window <= 0 {
+		problems = append(problems, ErrHMACWindow.Error())
+	}
+	if c.Server.ReadHeaderTimeout < 0 || c.Server.ReadTimeout < 0 || c.Server.WriteTimeout < 0 || c.Server.IdleTimeout < 0 {
+		problems = append(problems, ErrServerTimeout.Error())
+	}
+	if c.MaxRequestBodyBytes < 0 {
+		problems = append(problems, ErrMaxRequestBody.Error())
+	}
+	if c.MirrorWorkerCount <= 0 {
+		problems = append(problems, ErrMirrorWorkers.Error())
+	}
+	if spill := c.MirrorSpill; len(spill.Dir) > 0 {
+		if spill.MemoryBytes < 0 || spill.MaxBytes <= spill.MemoryBytes || spill.QuotaBytes < spill.MaxBytes || spill.SweepInterval <= 0 {
+			problems = append(problems, ErrMirrorSpill.Error())
+		}
+	}
+	if len(c.Capture.Dir) > 0 && c.Capture.QueueSize <= 0 {
+		problems = append(problems, ErrCapture.Error())
+	}
+	for _, setting := range c.Plugins {
+		if len(setting.Name) == 0 || setting.Priority <= 0 {
+			problems = append(problems, ErrPlugin.Error())
+			break
+		}
+	}
+	if c.Audit.Enable {
+		validStore := (c.Audit.Store == "mongodb" && c.Data.Type == "mongodb") || (c.Audit.Store == "file" && len(c.Audit.File) > 0)
+		if !validStore || c.Audit.MaxBytes <= 0 || c.Audit.QueueSize <= 0 || c.Audit.MaxBackups < 0 {
+			problems = append(problems, ErrAudit.Error())
+		}
+	}
+	if c.Logs.DeadLetterQueueSize > 0 && (c.Logs.RetryInterval <= 0 || c.Logs.MaxRetries <= 0) {
+		problems = append(problems, ErrDeadLetterQueue.Error())
+	}
+	for _, cidr := range c.TrustedRequestIDCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			problems = append(problems, ErrTrustedRequestID.Error())
+			break
+		}
+	}
+	for _, cidr := range c.TrustedProxies {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			problems = append(problems, ErrTrustedProxies.Error())
+			break
+		}
+	}
+	if c.UpstreamTimeout < 0 {
+		problems = append(problems, ErrUpstreamTimeout.Error())
+	}
+	if c.ShutdownTimeout <= 0 {
+		problems = append(problems, ErrShutdownTimeout.Error())
+	}
+	if c.Cache.Enable && c.Cache.MaxEntries <= 0 {
+		problems = append(problems, ErrCache.Error())
+	}
+	if c.Idempotency.MaxEntries <= 0 {
+		problems = append(problems, ErrIdempotency.Error())
+	}
+	switch c.Token.EvictionPolicy {
+	case "", "reject", "evict-oldest":
+	default:
+		problems = append(problems, ErrEvictionPolicy.Error())
+	}
+	switch c.Token.ExpirationMode {
+	case "", "sliding", "absolute":
+		if c.Token.MaxLifetime < 0 {
+			problems = append(problems, ErrExpirationMode.Error())
+		}
+	default:
+		problems = append(problems, ErrExpirationMode.Error())
+	}
+	if c.Data.Type == "memory" && c.Token.SweepInterval <= 0 {
+		problems = append(problems, ErrTokenSweep.Error())
+	}
+	if c.Data.Type == "redis" {
+		if len(c.Data.Address) == 0 && len(c.Data.Sentinel.MasterName) == 0 {
+			problems = append(problems, ErrDataAddr.Error())
+		}
+		if len(c.Data.Sentinel.MasterName) > 0 && len(c.Data.Sentinel.SentinelAddrs) == 0 {
+			problems = append(problems, ErrSentinel.Error())
+		}
+	}
+	names := map[string]bool{}
+	for i, apiEntry := range c.APIs {
+		if apiEntry == nil || len(apiEntry.Name) == 0 {
+			problems = append(problems, fmt.Sprintf("config: apis[%d] name can't be empty", i))
+			continue
+		}
+		if names[apiEntry.Name] {
+			problems = append(problems, fmt.Sprintf("config: api '%s' is duplicated", apiEntry.Name))
+		}
+		names[apiEntry.Name] = true
+		if len(apiEntry.RequestPathTemplate) == 0 && apiEntry.RequestPath != "*" && !strings.HasPrefix(apiEntry.RequestPath, "/") {
+			problems = append(problems, fmt.Sprintf("config: api '%s' request_path must start with /", apiEntry.Name))
+		}
+	}
+	if len(problems) > 0 {
+		return ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// configAPIs are the apis of the config file. They use the same field
+// names as the admin api.
+type configAPIs []*api
+
+func (apis *configAPIs) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var doc interface{}
+	err := unmarshal(&doc)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(yamlToJSON(doc))
+	if err != nil {
+		return err
+	}
+	result := []*api{}
+	err = json.Unmarshal(b, &result)
+	if err != nil {
+		return err
+	}
+	for _, apiEntry := range result {
+		if apiEntry == nil {
+			continue
+		}
+		if len(apiEntry.ID) == 0 {
+			apiEntry.ID = apiEntry.Name
+		}
+		if apiEntry.Whitelist == nil {
+			apiEntry.Whitelist = []string{}
+		}
+	}
+	*apis = result
+	return nil
+}
+
+// loadConfig reads and validates the config file.
+func loadConfig(path string) (*Configuration, error) {
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := newConfiguration()
+	err = yaml.Unmarshal(file, &config)
+	if err != nil {
+		return nil, err
+	}
+	err = config.isValid()
+	if err != nil {
+		return nil, err
+	}
+	err = config.loadFiles()
+	if err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// loadFiles reads the files which the config refers to, it runs after the
+// validation and before the config is used.
+func (c *Configuration) loadFiles() error {
+	if len(c.ErrorPage) > 0 {
+		page, err := loadErrorPage(c.ErrorPage)
+		if err != nil {
+			return fmt.Errorf("config: error_page is invalid: %v", err)
+		}
+		c.errorPage = page
+	}
+	if len(c.FieldEncryption.Keys) > 0 {
+		ring, err := newKeyRing(c.FieldEncryption.Keys)
+		if err != nil {
+			return fmt.Errorf("config: %v", err)
+		}
+		c.keyRing = ring
+	}
+	return nil
+}
+
+// currentConfig returns the config which is in use, it is swapped when the
+// config file is reloaded.
+func (g *Gateway) currentConfig() *Configuration {
+	return g.config.Load().(*Configuration)
+}
+
+// currentTokenSetting is read by the token repositories for every
+// operation, so a reload applies to the stored tokens at once.
+func (g *Gateway) currentTokenSetting() store.TokenSetting {
+	return g.currentConfig().Token
+}
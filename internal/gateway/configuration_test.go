@@ -0,0 +1,73 @@
+package gateway
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jasonsoft/bifrost/internal/store"
+)
+
+func TestRedisDataSetting(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    store.DataSetting
+		problem error
+	}{
+		{"address", store.DataSetting{Type: "redis", Address: "127.0.0.1:6379"}, nil},
+		{"sentinel", store.DataSetting{Type: "redis", Sentinel: store.RedisSentinelConfig{MasterName: "bifrost", SentinelAddrs: []string{"10.0.0.1:26379"}}}, nil},
+		{"nothing", store.DataSetting{Type: "redis"}, ErrDataAddr},
+		{"sentinel without addrs", store.DataSetting{Type: "redis", Sentinel: store.RedisSentinelConfig{MasterName: "bifrost"}}, ErrSentinel},
+	}
+	for _, test := range tests {
+		config := newConfiguration()
+		config.Data = test.data
+		err := config.isValid()
+		if test.problem == nil {
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.problem.Error()) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.problem)
+		}
+	}
+}
+
+func TestErrorPageIsLoadedAfterTheValidation(t *testing.T) {
+	dir := t.TempDir()
+	config := newConfiguration()
+	config.ErrorPage = filepath.Join(dir, "missing.html")
+	if err := config.isValid(); err != nil {
+		t.Fatalf("the validation must not read files: %v", err)
+	}
+	if config.errorPage != nil {
+		t.Fatal("the validation must not change the config")
+	}
+
+	configPath := filepath.Join(dir, "config.yml")
+	write := func(content string) {
+		if err := os.WriteFile(configPath, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("error_page: " + config.ErrorPage + "\n")
+	if _, err := loadConfig(configPath); err == nil || !strings.Contains(err.Error(), "error_page") {
+		t.Fatalf("a missing error page must be reported, got %v", err)
+	}
+
+	pagePath := filepath.Join(dir, "error.html")
+	if err := os.WriteFile(pagePath, []byte("<p>{{.Message}}</p>"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	write("error_page: " + pagePath + "\n")
+	loaded, err := loadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.errorPage == nil {
+		t.Fatal("the error page must be loaded")
+	}
+}
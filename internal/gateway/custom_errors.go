@@ -1,12 +1,13 @@
-package main
+package gateway
 
 import "github.com/jasonsoft/napnap"
 
 type customErrorsMiddleware struct {
+	gateway *Gateway
 }
 
-func newCustomErrorsMiddleware() *customErrorsMiddleware {
-	return &customErrorsMiddleware{}
+func newCustomErrorsMiddleware(g *Gateway) *customErrorsMiddleware {
+	return &customErrorsMiddleware{gateway: g}
 }
 
 func (cem *customErrorsMiddleware) Invoke(c *napnap.Context, next napnap.HandlerFunc) {
@@ -19,7 +20,7 @@ func (cem *customErrorsMiddleware) Invoke(c *napnap.Context, next napnap.Handler
 				ErrorCode: "unknown_error",
 				Message:   "An unknown error has occurred.",
 			}
-			c.JSON(500, appError)
+			cem.gateway.writeError(c, 500, appError)
 		}
 	}
 
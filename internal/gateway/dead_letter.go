@@ -0,0 +1,158 @@
+package gateway
+
+import (
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/jasonsoft/bifrost/internal/logging"
+)
+
+// deadLetter is a gelf message which didn't fit into the message queue.
+type deadLetter struct {
+	message  *logging.Message
+	attempts int
+}
+
+// deadLetterQueue keeps the gelf messages which didn't fit into the message
+// queue and puts them back later. A message which still doesn't fit after
+// maxRetries is appended to the fallback file instead of being dropped.
+type deadLetterQueue struct {
+	letters      chan *deadLetter
+	maxRetries   int
+	fallbackFile string
+	retried      int64
+	dropped      int64
+	fallback     int64
+	// logger owns the message queue the dead letters are put back into
+	logger *logger
+}
+
+func newDeadLetterQueue(size, maxRetries int, fallbackFile string, logger *logger) *deadLetterQueue {
+	return &deadLetterQueue{
+		letters:      make(chan *deadLetter, size),
+		maxRetries:   maxRetries,
+		fallbackFile: fallbackFile,
+		logger:       logger,
+	}
+}
+
+// add queues the message, it's written to the fallback file when the dead
+// letter queue is full as well.
+func (q *deadLetterQueue) add(message *logging.Message) {
+	select {
+	case q.letters <- &deadLetter{message: message}:
+	default:
+		q.writeFallback([]*logging.Message{message})
+	}
+}
+
+func (q *deadLetterQueue) len() int {
+	return len(q.letters)
+}
+
+func (q *deadLetterQueue) run(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		q.retry()
+		q.report()
+	}
+}
+
+// retry puts the dead letters back into the message queue, the ones queued
+// during the retry wait for the next round.
+func (q *deadLetterQueue) retry() {
+	failed := []*logging.Message{}
+	for i, n := 0, len(q.letters); i < n; i++ {
+		letter := <-q.letters
+		if q.logger.queue.TryPut(letter.message) {
+			atomic.AddInt64(&q.retried, 1)
+			continue
+		}
+		letter.attempts++
+		if letter.attempts >= q.maxRetries {
+			failed = append(failed, letter.message)
+			continue
+		}
+		select {
+		case q.letters <- letter:
+		default:
+			failed = append(failed, letter.message)
+		}
+	}
+	q.writeFallback(failed)
+}
+
+// flush writes the dead letters to the fallback file at shutdown.
+func (q *deadLetterQueue) flush() {
+	messages := []*logging.Message{}
+	for i, n := 0, len(q.letters); i < n; i++ {
+		messages = append(messages, (<-q.letters).message)
+	}
+	q.writeFallback(messages)
+}
+
+// writeFallback appends the messages to the fallback file, one json message
+// per line. They are dropped when there is no fallback file.
+func (q *deadLetterQueue) writeFallback(messages []*logging.Message) {
+	if len(messages) == 0 {
+		return
+	}
+	if len(q.fallbackFile) == 0 {
+		atomic.AddInt64(&q.dropped, int64(len(messages)))
+		q.logger.debugf("message queue was full, %d messages were dropped", len(messages))
+		return
+	}
+	file, err := os.OpenFile(q.fallbackFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		atomic.AddInt64(&q.dropped, int64(len(messages)))
+		q.logger.errorf("failed to open the log fallback file: %v", err)
+		return
+	}
+	defer file.Close()
+	for i, message := range messages {
+		payload, err := message.Marshal()
+		if err != nil {
+			atomic.AddInt64(&q.dropped, 1)
+			q.logger.errorf("failed to marshal the gelf message: %v", err)
+			continue
+		}
+		if _, err := file.Write(append(payload, '\n')); err != nil {
+			atomic.AddInt64(&q.dropped, int64(len(messages)-i))
+			q.logger.errorf("failed to write the log fallback file: %v", err)
+			return
+		}
+		atomic.AddInt64(&q.fallback, 1)
+	}
+}
+
+// report sends the counters as a gelf message, it's skipped when the
+// message queue is full so the report doesn't become a dead letter itself.
+func (q *deadLetterQueue) report() {
+	retried := atomic.SwapInt64(&q.retried, 0)
+	dropped := atomic.SwapInt64(&q.dropped, 0)
+	fallback := atomic.SwapInt64(&q.fallback, 0)
+	if retried == 0 && dropped == 0 && fallback == 0 {
+		return
+	}
+	msg := logging.NewMessage(q.logger.app.hostname, q.logger.app.name, "metrics", 6)
+	msg.ShortMessage = "log dead letters"
+	msg.CustomFields["dead_letter_retried"] = retried
+	msg.CustomFields["dead_letter_dropped"] = dropped
+	msg.CustomFields["dead_letter_fallback"] = fallback
+	msg.CustomFields["dead_letter_queued"] = q.len()
+	q.logger.queue.TryPut(msg)
+}
+
+// queueGelfMessage sends the message to the log target, it goes to the dead
+// letter queue when the message queue is full.
+func (l *logger) queueGelfMessage(message *logging.Message) {
+	if l.queue.TryPut(message) {
+		return
+	}
+	if l.deadLetters == nil {
+		l.debug("message queue was full")
+		return
+	}
+	l.deadLetters.add(message)
+}
@@ -0,0 +1,137 @@
+package gateway
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/jasonsoft/napnap"
+)
+
+// capabilitySchemaVersion must be increased when the capability document changes incompatibly.
+// Version 2 names the auth scheme after the auth_mode and adds the scopes.
+const capabilitySchemaVersion = 2
+
+var allMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+
+// capabilityDocument describes the constraints the gateway enforces for an api.
+// Only fields of the api struct tagged with `capability` are published, the
+// rest is computed the way the proxy computes it. Anything else (targets,
+// headers and so on) never leaks.
+type capabilityDocument struct {
+	SchemaVersion int                    `json:"schema_version"`
+	AuthScheme    string                 `json:"auth_scheme,omitempty"` // bearer, apikey or any
+	Scopes        []string               `json:"scopes,omitempty"`      // roles of the whitelist, one of them is required
+	Constraints   map[string]interface{} `json:"constraints"`
+	Deprecation   *deprecation           `json:"deprecation,omitempty"`
+}
+
+// isMethodAllowed compares case insensitively, no methods means every method is allowed.
+func (a *api) isMethodAllowed(method string) bool {
+	if len(a.Methods) == 0 {
+		return true
+	}
+	return contains(a.allowedMethods(), strings.ToUpper(method))
+}
+
+// allowedMethods returns the methods which are accepted by the api.
+func (a *api) allowedMethods() []string {
+	if len(a.Methods) == 0 {
+		return allMethods
+	}
+	result := []string{}
+	for _, method := range a.Methods {
+		method = strings.ToUpper(method)
+		if !contains(result, method) {
+			result = append(result, method)
+		}
+	}
+	if !contains(result, "OPTIONS") {
+		result = append(result, "OPTIONS")
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (a *api) capabilities(config *Configuration) capabilityDocument {
+	doc := capabilityDocument{
+		SchemaVersion: capabilitySchemaVersion,
+		Constraints:   map[string]interface{}{},
+	}
+	if a.Authorization || len(a.Whitelist) > 0 {
+		doc.AuthScheme = a.AuthMode
+		if len(doc.AuthScheme) == 0 {
+			doc.AuthScheme = authModeBearer
+		}
+		doc.Scopes = a.Whitelist
+	}
+
+	val := reflect.ValueOf(a).Elem()
+	typ := val.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		name := typ.Field(i).Tag.Get("capability")
+		if len(name) == 0 {
+			continue
+		}
+		doc.Constraints[name] = val.Field(i).Interface()
+	}
+	doc.Constraints["methods"] = a.allowedMethods()
+	// zero means the body isn't limited
+	doc.Constraints["max_request_body_bytes"] = a.maxRequestBodyBytes(config)
+	if rateLimit := config.RateLimit; rateLimit.Enable {
+		rate := RateLimitTier{RPS: rateLimit.RPS, Burst: rateLimit.Burst}
+		if tier, ok := rateLimit.Tiers[a.RateLimitTier]; ok {
+			rate = tier
+		}
+		doc.Constraints["rate_limit"] = rate
+	}
+	doc.Constraints["idempotency"] = a.Idempotency != nil
+	doc.Deprecation = a.Deprecation
+	return doc
+}
+
+// renderCapabilities returns the document with an etag which is the hash of
+// the document, so it changes with every change of the api or the config
+// which the client can see.
+func (a *api) renderCapabilities(config *Configuration) ([]byte, string) {
+	body, err := json.Marshal(a.capabilities(config))
+	if err != nil {
+		panic(err)
+	}
+	sum := sha256.Sum256(body)
+	return body, `"cap-` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// isDiscoveryRequest reports whether the gateway should answer the OPTIONS
+// request itself. CORS preflight requests are left to the cors middleware.
+func isDiscoveryRequest(c *napnap.Context, apiEntry *api) bool {
+	if !apiEntry.Discovery || c.Request.Method != "OPTIONS" {
+		return false
+	}
+	return len(c.RequestHeader("Access-Control-Request-Method")) == 0
+}
+
+func writeDiscovery(c *napnap.Context, apiEntry *api, config *Configuration) {
+	c.RespHeader("Allow", strings.Join(apiEntry.allowedMethods(), ", "))
+
+	if !strings.Contains(c.RequestHeader("Accept"), "application/json") {
+		c.SetStatus(http.StatusNoContent)
+		return
+	}
+
+	body, etag := apiEntry.renderCapabilities(config)
+	c.RespHeader("ETag", etag)
+	c.RespHeader("Cache-Control", "max-age=60")
+	c.RespHeader("Vary", "Accept")
+	if c.RequestHeader("If-None-Match") == etag {
+		c.SetStatus(http.StatusNotModified)
+		return
+	}
+	c.RespHeader("Content-Type", "application/json; charset=utf-8")
+	c.SetStatus(200)
+	c.Writer.Write(body)
+}
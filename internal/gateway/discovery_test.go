@@ -0,0 +1,195 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAllowedMethods(t *testing.T) {
+	restricted := &api{Methods: []string{"post", "GET", "get"}}
+	if got := strings.Join(restricted.allowedMethods(), ", "); got != "GET, OPTIONS, POST" {
+		t.Fatalf("restricted: Allow = %s", got)
+	}
+	if !restricted.isMethodAllowed("Post") || restricted.isMethodAllowed("DELETE") {
+		t.Fatal("restricted: the methods must be compared case insensitively")
+	}
+	unrestricted := &api{}
+	if got := strings.Join(unrestricted.allowedMethods(), ", "); got != strings.Join(allMethods, ", ") {
+		t.Fatalf("unrestricted: Allow = %s", got)
+	}
+	if !unrestricted.isMethodAllowed("PATCH") {
+		t.Fatal("unrestricted: every method must be allowed")
+	}
+}
+
+func TestDiscoveryAnswersWithTheAllowHeader(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("%s reached the upstream", r.Method)
+	}))
+	defer upstream.Close()
+	restricted := newTestAPI(t, "restricted", upstream.URL)
+	restricted.RequestPath = "/restricted"
+	restricted.Methods = []string{"GET", "POST"}
+	restricted.Discovery = true
+	unrestricted := newTestAPI(t, "unrestricted", upstream.URL)
+	unrestricted.RequestPath = "/unrestricted"
+	unrestricted.Discovery = true
+	gateway, _ := serveTestGateway(t, []*api{restricted, unrestricted})
+
+	cases := []struct {
+		method, path, allow string
+		status              int
+	}{
+		{"OPTIONS", "/restricted", "GET, OPTIONS, POST", 204},
+		{"OPTIONS", "/unrestricted", strings.Join(allMethods, ", "), 204},
+		{"DELETE", "/restricted", "GET, OPTIONS, POST", 405},
+	}
+	for _, tc := range cases {
+		req, _ := http.NewRequest(tc.method, gateway.URL+tc.path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status || resp.Header.Get("Allow") != tc.allow {
+			t.Errorf("%s %s: status = %d, Allow = %q, want %d and %q", tc.method, tc.path, resp.StatusCode, resp.Header.Get("Allow"), tc.status, tc.allow)
+		}
+	}
+}
+
+// discover asks for the capability document with the etag of the last one.
+func discover(t *testing.T, url string, etag string) (*http.Response, map[string]interface{}) {
+	req, _ := http.NewRequest("OPTIONS", url, nil)
+	req.Header.Set("Accept", "application/json")
+	if len(etag) > 0 {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	doc := map[string]interface{}{}
+	if resp.StatusCode == 200 {
+		if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp, doc
+}
+
+func TestCapabilityDocumentTracksARuntimeChange(t *testing.T) {
+	withConfig(t, func(config *Configuration) {
+		config.RateLimit.Enable = true
+		config.RateLimit.RPS = 10
+		config.RateLimit.Burst = 20
+		config.RateLimit.Tiers = map[string]RateLimitTier{"gold": {RPS: 100, Burst: 200}}
+	})
+	orders := newTestAPI(t, "orders", "http://orders:8080")
+	orders.Discovery = true
+	gateway, routes := serveTestGateway(t, []*api{orders})
+
+	first, doc := discover(t, gateway.URL+"/orders", "")
+	etag := first.Header.Get("ETag")
+	if first.StatusCode != 200 || len(etag) == 0 {
+		t.Fatalf("status = %d, etag = %q", first.StatusCode, etag)
+	}
+	rateLimit := doc["constraints"].(map[string]interface{})["rate_limit"].(map[string]interface{})
+	if rateLimit["rps"] != 10.0 || rateLimit["burst"] != 20.0 {
+		t.Fatalf("rate_limit = %v, want the default rate", rateLimit)
+	}
+	if again, _ := discover(t, gateway.URL+"/orders", etag); again.StatusCode != 304 {
+		t.Fatalf("status = %d, the unchanged document must be validated", again.StatusCode)
+	}
+
+	// the tier is changed at runtime, e.g. through the admin api
+	changed := cloneAPI(orders)
+	changed.RateLimitTier = "gold"
+	if err := changed.isValid(testGateway.currentConfig()); err != nil {
+		t.Fatal(err)
+	}
+	routes.(*apiRouteTable).load([]*api{changed})
+
+	resp, doc := discover(t, gateway.URL+"/orders", etag)
+	if resp.StatusCode != 200 || resp.Header.Get("ETag") == etag {
+		t.Fatalf("status = %d, etag = %s, the changed document must be sent with a new etag", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+	constraints := doc["constraints"].(map[string]interface{})
+	rateLimit = constraints["rate_limit"].(map[string]interface{})
+	if constraints["rate_limit_tier"] != "gold" || rateLimit["rps"] != 100.0 || rateLimit["burst"] != 200.0 {
+		t.Fatalf("constraints = %v, want the gold tier", constraints)
+	}
+}
+
+func TestCapabilityDocument(t *testing.T) {
+	sunset := time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)
+	apiEntry := newTestAPI(t, "orders", "http://orders:8080")
+	apiEntry.Authorization = true
+	apiEntry.AuthMode = authModeAPIKey
+	apiEntry.Whitelist = []string{"admin", "billing"}
+	apiEntry.MaxRequestBodyBytes = 1024
+	apiEntry.Idempotency = &idempotencySetting{TTL: 60}
+	apiEntry.Deprecation = &deprecation{Sunset: &sunset, Link: "https://docs.example.com/orders-v2"}
+	apiEntry.RequestHeadersToAdd = map[string]string{"X-Secret": "secret"}
+
+	body, _ := apiEntry.renderCapabilities(testGateway.currentConfig())
+	doc := map[string]interface{}{}
+	json.Unmarshal(body, &doc)
+	if doc["schema_version"] != float64(capabilitySchemaVersion) || doc["auth_scheme"] != "apikey" {
+		t.Fatalf("doc = %s, the auth scheme must follow the auth_mode", body)
+	}
+	if scopes, _ := json.Marshal(doc["scopes"]); string(scopes) != `["admin","billing"]` {
+		t.Fatalf("scopes = %s, want the whitelist", scopes)
+	}
+	constraints := doc["constraints"].(map[string]interface{})
+	if constraints["max_request_body_bytes"] != 1024.0 || constraints["idempotency"] != true {
+		t.Fatalf("constraints = %v", constraints)
+	}
+	if _, ok := constraints["rate_limit"]; ok {
+		t.Fatal("the rate limit must be left out when it's off")
+	}
+	deprecation := doc["deprecation"].(map[string]interface{})
+	if deprecation["sunset"] != "2027-01-01T00:00:00Z" || deprecation["link"] != "https://docs.example.com/orders-v2" {
+		t.Fatalf("deprecation = %v", deprecation)
+	}
+	for _, secret := range []string{"orders:8080", "X-Secret", "secret\""} {
+		if strings.Contains(string(body), secret) {
+			t.Fatalf("%s leaked into %s", secret, body)
+		}
+	}
+
+	// without auth there is no scheme, the bearer token is the default
+	apiEntry.AuthMode = ""
+	if doc := apiEntry.capabilities(testGateway.currentConfig()); doc.AuthScheme != authModeBearer {
+		t.Fatalf("auth_scheme = %s, want bearer", doc.AuthScheme)
+	}
+	apiEntry.Authorization, apiEntry.Whitelist = false, nil
+	if doc := apiEntry.capabilities(testGateway.currentConfig()); len(doc.AuthScheme) > 0 || doc.Scopes != nil {
+		t.Fatalf("doc = %+v, an open api has no auth scheme", doc)
+	}
+}
+
+func TestDeprecatedAPIAnnouncesTheSunset(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	sunset := time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)
+	apiEntry := newTestAPI(t, "legacy", upstream.URL)
+	apiEntry.Deprecation = &deprecation{Sunset: &sunset, Link: "https://docs.example.com/v2"}
+	gateway, _ := serveTestGateway(t, []*api{apiEntry})
+
+	resp, err := http.Get(gateway.URL + "/legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("Deprecation") != "true" || resp.Header.Get("Sunset") != "Fri, 01 Jan 2027 00:00:00 GMT" {
+		t.Fatalf("header = %v", resp.Header)
+	}
+	if resp.Header.Get("Link") != `<https://docs.example.com/v2>; rel="deprecation"` {
+		t.Fatalf("Link = %s", resp.Header.Get("Link"))
+	}
+}
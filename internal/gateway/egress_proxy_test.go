@@ -0,0 +1,281 @@
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testEgressProxy tunnels CONNECT requests and forwards absolute-form
+// requests, it records what it was asked for.
+type testEgressProxy struct {
+	sync.Mutex
+	requests []string
+}
+
+func (p *testEgressProxy) record(request string) {
+	p.Lock()
+	defer p.Unlock()
+	p.requests = append(p.requests, request)
+}
+
+func (p *testEgressProxy) seen(prefix string) bool {
+	p.Lock()
+	defer p.Unlock()
+	for _, request := range p.requests {
+		if strings.HasPrefix(request, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *testEgressProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "CONNECT" {
+		p.record("CONNECT " + r.Host)
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(502)
+			return
+		}
+		client, buf, _ := w.(http.Hijacker).Hijack()
+		io.WriteString(client, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go func() {
+			io.Copy(upstream, buf)
+			upstream.Close()
+		}()
+		io.Copy(client, upstream)
+		client.Close()
+		return
+	}
+	p.record(r.Method + " " + r.URL.String() + " " + r.Header.Get("X-Bifrost-Mirror"))
+	r.RequestURI = ""
+	resp, err := http.DefaultTransport.RoundTrip(r)
+	if err != nil {
+		w.WriteHeader(502)
+		return
+	}
+	defer resp.Body.Close()
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+func startTestEgressProxy(t *testing.T) (*testEgressProxy, *egressProxy) {
+	proxy := &testEgressProxy{}
+	server := httptest.NewServer(proxy)
+	t.Cleanup(server.Close)
+	return proxy, &egressProxy{ProxyURL: server.URL}
+}
+
+func TestWebSocketGoesThroughEgressProxy(t *testing.T) {
+	// the upstream answers the handshake and echoes the frames
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		if _, err := http.ReadRequest(reader); err != nil {
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		io.Copy(conn, reader)
+	}()
+
+	proxy, setting := startTestEgressProxy(t)
+	apiEntry := newTestAPI(t, "socket", "http://"+ln.Addr().String())
+	apiEntry.EgressProxy = setting
+	gateway, _ := serveTestGateway(t, []*api{apiEntry})
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(gateway.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	io.WriteString(conn, "GET /socket HTTP/1.1\r\nHost: gateway\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 101 {
+		t.Fatalf("status = %d, want 101", resp.StatusCode)
+	}
+	io.WriteString(conn, "ping")
+	echo := make([]byte, 4)
+	if _, err := io.ReadFull(reader, echo); err != nil || string(echo) != "ping" {
+		t.Fatalf("echo = %q, %v", echo, err)
+	}
+	if !proxy.seen("CONNECT " + ln.Addr().String()) {
+		t.Fatalf("the proxy saw %v, want a tunnel to the upstream", proxy.requests)
+	}
+}
+
+func TestMirrorGoesThroughEgressProxy(t *testing.T) {
+	mirrored := make(chan struct{}, 1)
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored <- struct{}{}
+	}))
+	defer mirror.Close()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	proxy, setting := startTestEgressProxy(t)
+	apiEntry := newTestAPI(t, "orders", upstream.URL)
+	apiEntry.EgressProxy = setting
+	apiEntry.Mirror = &mirrorSetting{TargetURL: mirror.URL, Percentage: 100}
+	gateway, _ := serveTestGateway(t, []*api{apiEntry})
+
+	resp, err := http.Get(gateway.URL + "/orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	select {
+	case <-mirrored:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the mirror wasn't called")
+	}
+	if !proxy.seen("GET " + mirror.URL + "/orders true") {
+		t.Fatalf("the proxy saw %v, want the mirrored request", proxy.requests)
+	}
+}
+
+func TestH2CGoesThroughEgressProxy(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	upstream.Config.Protocols = &protocols
+	upstream.Start()
+	defer upstream.Close()
+
+	proxy, setting := startTestEgressProxy(t)
+	apiEntry := newTestAPI(t, "h2c", upstream.URL)
+	apiEntry.H2C = true
+	apiEntry.EgressProxy = setting
+	gateway, _ := serveTestGateway(t, []*api{apiEntry})
+
+	resp, err := http.Get(gateway.URL + "/h2c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || string(body) != "ok" {
+		t.Fatalf("got %d %q, want 200 ok", resp.StatusCode, body)
+	}
+	if !proxy.seen("CONNECT " + strings.TrimPrefix(upstream.URL, "http://")) {
+		t.Fatalf("the proxy saw %v, want a tunnel to the upstream", proxy.requests)
+	}
+}
+
+func TestDialEgressThroughSocks5(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err == nil {
+			io.WriteString(conn, "hello")
+			conn.Close()
+		}
+	}()
+
+	socks, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socks.Close()
+	requested := make(chan string, 1)
+	go func() {
+		conn, err := socks.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		greeting := make([]byte, 3)
+		io.ReadFull(conn, greeting)
+		conn.Write([]byte{0x05, 0x02})
+		// username and password
+		head := make([]byte, 2)
+		io.ReadFull(conn, head)
+		user := make([]byte, head[1])
+		io.ReadFull(conn, user)
+		io.ReadFull(conn, head[:1])
+		password := make([]byte, head[0])
+		io.ReadFull(conn, password)
+		if string(user) != "bifrost" || string(password) != "s3cret" {
+			conn.Write([]byte{0x01, 0x01})
+			return
+		}
+		conn.Write([]byte{0x01, 0x00})
+		req := make([]byte, 5)
+		io.ReadFull(conn, req)
+		host := make([]byte, req[4]+2)
+		io.ReadFull(conn, host)
+		port := int(host[len(host)-2])<<8 | int(host[len(host)-1])
+		addr := net.JoinHostPort(string(host[:len(host)-2]), strconv.Itoa(port))
+		requested <- addr
+		upstream, err := net.Dial("tcp", addr)
+		if err != nil {
+			conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer upstream.Close()
+		conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+		io.Copy(conn, upstream)
+	}()
+
+	setting := &egressProxy{ProxyURL: "socks5://bifrost:s3cret@" + socks.Addr().String()}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialEgress(ctx, dialer.DialContext, setting, target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	body, _ := io.ReadAll(conn)
+	if string(body) != "hello" {
+		t.Fatalf("body = %q, want hello", body)
+	}
+	if got := <-requested; got != target.Addr().String() {
+		t.Fatalf("socks5 target = %s, want %s", got, target.Addr())
+	}
+}
+
+func TestDialEgressBypassesNoProxy(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	// the proxy doesn't exist, the dial must not use it
+	setting := &egressProxy{ProxyURL: "http://127.0.0.1:1", NoProxy: []string{"127.0.0.0/8"}}
+	var dialer net.Dialer
+	conn, err := dialEgress(context.Background(), dialer.DialContext, setting, target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
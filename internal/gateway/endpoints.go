@@ -0,0 +1,926 @@
+package gateway
+
+import (
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/jasonsoft/bifrost/internal/store"
+	"github.com/jasonsoft/napnap"
+	"github.com/satori/go.uuid"
+)
+
+type consumerCollection struct {
+	Consumers []*store.Consumer `json:"consumers"`
+}
+
+type tokenCollection struct {
+	Count  int            `json:"count"`
+	Tokens []*store.Token `json:"tokens"`
+}
+
+func newTokenCollection() *tokenCollection {
+	return &tokenCollection{
+		Tokens: []*store.Token{},
+	}
+}
+
+// tokenIntrospection is the response of token introspection (RFC 7662).
+type tokenIntrospection struct {
+	Active     bool   `json:"active"`
+	Expiration int64  `json:"exp,omitempty"`
+	IssuedAt   int64  `json:"iat,omitempty"`
+	ConsumerID string `json:"consumer_id,omitempty"`
+	Subject    string `json:"sub,omitempty"`
+}
+
+type serviceCollection struct {
+	Count    int              `json:"count"`
+	Services []*store.Service `json:"services"`
+}
+
+func newServiceCollection() *serviceCollection {
+	return &serviceCollection{
+		Count:    0,
+		Services: []*store.Service{},
+	}
+}
+
+func (g *Gateway) createOrupateConsumerEndpoint(c *napnap.Context) {
+	target := bindConsumer(c)
+
+	consumer, err := g.consumerRepo.GetByUsername(target.App, target.Username)
+	panicIf(err)
+
+	if consumer == nil {
+		// create consumer
+		target.ID = uuid.NewV4().String()
+		err = g.consumerRepo.Insert(&target)
+		panicIf(err)
+		c.JSON(201, target)
+		return
+	}
+
+	g.updateConsumer(c, consumer, &target)
+}
+
+func (g *Gateway) updateConsumer(c *napnap.Context, consumer *store.Consumer, target *store.Consumer) {
+	revision, ok := g.expectRevision(c, consumer.Revision)
+	if !ok {
+		return
+	}
+	target.ID = consumer.ID
+	target.CreatedAt = consumer.CreatedAt
+	target.Revision = revision
+	changes := diffFields(target, consumer)
+	err := g.consumerRepo.Update(target)
+	if err == store.ErrRevisionConflict {
+		// the stored consumer was changed since it was read
+		current, err := g.consumerRepo.Get(consumer.ID)
+		panicIf(err)
+		if current == nil {
+			panic(AppError{ErrorCode: "not_found", Message: "consumer was not found"})
+		}
+		writeRevisionConflict(c, revision, target, current.Revision, current)
+		return
+	}
+	panicIf(err)
+	g.auditRevision(adminActor(c), "consumer", target.ID, revision, target.Revision, changes)
+	c.RespHeader("ETag", etag(target.Revision))
+	c.JSON(200, target)
+}
+
+func bindConsumer(c *napnap.Context) store.Consumer {
+	var target store.Consumer
+	err := c.BindJSON(&target)
+	if err != nil {
+		panic(AppError{ErrorCode: "invalid_input", Message: err.Error()})
+	}
+	if len(target.Username) == 0 {
+		panic(AppError{ErrorCode: "invalid_input", Message: "username field is invalid."})
+	}
+	if len(target.App) == 0 {
+		panic(AppError{ErrorCode: "invalid_input", Message: "app field is invalid."})
+	}
+	if len(target.ClientSecret) > 0 {
+		hashed, err := hashClientSecret(target.ClientSecret)
+		if err != nil {
+			panic(AppError{ErrorCode: "invalid_input", Message: "client_secret field is invalid: " + err.Error()})
+		}
+		target.ClientSecretHash = hashed
+		target.ClientSecret = ""
+	}
+	return target
+}
+
+func (g *Gateway) createConsumerEndpoint(c *napnap.Context) {
+	target := bindConsumer(c)
+
+	if len(target.ID) > 0 {
+		consumer, err := g.consumerRepo.Get(target.ID)
+		panicIf(err)
+		if consumer != nil {
+			c.JSON(409, AppError{ErrorCode: "consumer_exists", Message: "The consumer id already exists."})
+			return
+		}
+	} else {
+		target.ID = uuid.NewV4().String()
+	}
+	consumer, err := g.consumerRepo.GetByUsername(target.App, target.Username)
+	panicIf(err)
+	if consumer != nil {
+		c.JSON(409, AppError{ErrorCode: "consumer_exists", Message: "The username already exists in the app."})
+		return
+	}
+
+	err = g.consumerRepo.Insert(&target)
+	panicIf(err)
+	c.JSON(201, target)
+}
+
+func (g *Gateway) updateConsumerEndpoint(c *napnap.Context) {
+	target := bindConsumer(c)
+
+	consumer, err := g.consumerRepo.Get(c.Param("consumer_id"))
+	panicIf(err)
+	if consumer == nil {
+		panic(AppError{ErrorCode: "not_found", Message: "consumer was not found"})
+	}
+	if consumer.App != target.App || consumer.Username != target.Username {
+		other, err := g.consumerRepo.GetByUsername(target.App, target.Username)
+		panicIf(err)
+		if other != nil {
+			c.JSON(409, AppError{ErrorCode: "consumer_exists", Message: "The username already exists in the app."})
+			return
+		}
+	}
+	g.updateConsumer(c, consumer, &target)
+}
+
+func (g *Gateway) getConsumerEndpoint(c *napnap.Context) {
+	consumerID := c.Param("consumer_id")
+	app := c.Query("app")
+	if len(app) == 0 {
+		panic(AppError{ErrorCode: "invalid_input", Message: "app field was missing or empty"})
+	}
+	consumer, err := g.consumerRepo.Get(consumerID)
+	panicIf(err)
+	if consumer == nil {
+		consumer, err = g.consumerRepo.GetByUsername(app, consumerID)
+		panicIf(err)
+	}
+	if consumer == nil {
+		panic(AppError{ErrorCode: "not_found", Message: "consumer was not found"})
+	}
+
+	c.RespHeader("ETag", etag(consumer.Revision))
+	c.JSON(200, consumer)
+}
+
+// tokenStats counts the tokens of a consumer. Redis and the memory store
+// don't return expired tokens, so expired is usually zero and active equals
+// total there.
+type tokenStats struct {
+	Total         int   `json:"total"`
+	Active        int   `json:"active"`
+	Expired       int   `json:"expired"`
+	AvgAgeSeconds int64 `json:"avg_age_seconds"`
+}
+
+func (g *Gateway) getConsumerTokenStatsEndpoint(c *napnap.Context) {
+	consumerID := c.Param("consumer_id")
+	consumer, err := g.consumerRepo.Get(consumerID)
+	panicIf(err)
+	if consumer == nil {
+		panic(AppError{ErrorCode: "not_found", Message: "consumer was not found"})
+	}
+
+	tokens, err := g.tokenRepo.GetByConsumerID(consumerID)
+	panicIf(err)
+
+	stats := tokenStats{Total: len(tokens)}
+	setting := g.currentConfig().Token
+	now := time.Now().UTC()
+	var age time.Duration
+	for _, token := range tokens {
+		if token.IsValid(setting) {
+			stats.Active++
+		} else {
+			stats.Expired++
+		}
+		age += now.Sub(token.CreatedAt)
+	}
+	if len(tokens) > 0 {
+		stats.AvgAgeSeconds = int64(age.Seconds()) / int64(len(tokens))
+	}
+	c.JSON(200, stats)
+}
+
+func (g *Gateway) getConsumerCountEndpoint(c *napnap.Context) {
+	// redis provider doesn't support this feature.
+	if g.currentConfig().Data.Type == "redis" {
+		c.SetStatus(501)
+		return
+	}
+
+	app := c.Query("app")
+	if len(app) == 0 {
+		panic(AppError{ErrorCode: "invalid_input", Message: "app field was missing or empty"})
+	}
+	count, err := g.consumerRepo.Count(app)
+	panicIf(err)
+	result := ApiCount{
+		Count: count,
+	}
+	c.JSON(200, result)
+}
+
+func (g *Gateway) deletedConsumerEndpoint(c *napnap.Context) {
+	consumerID := c.Param("consumer_id")
+	app := c.Query("app")
+	if len(app) == 0 {
+		panic(AppError{ErrorCode: "invalid_input", Message: "app field was missing or empty"})
+	}
+
+	consumer, err := g.consumerRepo.Get(consumerID)
+	panicIf(err)
+	if consumer == nil {
+		consumer, err = g.consumerRepo.GetByUsername(app, consumerID)
+		panicIf(err)
+	}
+	if consumer == nil {
+		panic(AppError{ErrorCode: "not_found", Message: "consumer was not found"})
+	}
+
+	err = g.consumerRepo.Delete(consumer)
+	panicIf(err)
+	// remove the tokens of the consumer as well
+	err = g.tokenRepo.DeleteByConsumerID(consumer.ID)
+	panicIf(err)
+	c.JSON(204, nil)
+}
+
+func (g *Gateway) getTokenEndpoint(c *napnap.Context) {
+	id := c.Param("id")
+
+	if len(id) == 0 {
+		panic(AppError{ErrorCode: "not_found", Message: "key was not found"})
+	}
+
+	token, err := g.tokenRepo.Get(id)
+	panicIf(err)
+	if token == nil {
+		panic(AppError{ErrorCode: "not_found", Message: "token was not found"})
+	}
+
+	token.SetExpiresIn(g.currentConfig().Token)
+	c.JSON(200, token)
+}
+
+func (g *Gateway) introspectTokenEndpoint(c *napnap.Context) {
+	id := c.Param("token_id")
+	result := tokenIntrospection{}
+
+	token, err := g.tokenRepo.Get(id)
+	panicIf(err)
+	if token == nil || token.IsValid(g.currentConfig().Token) == false {
+		c.JSON(200, result)
+		return
+	}
+
+	result.Active = true
+	result.Expiration = token.Expiration.Unix()
+	result.IssuedAt = token.CreatedAt.Unix()
+	result.ConsumerID = token.ConsumerID
+	result.Subject = token.ConsumerID
+
+	consumer, err := g.consumerRepo.Get(token.ConsumerID)
+	panicIf(err)
+	if consumer != nil && len(consumer.Username) > 0 {
+		result.Subject = consumer.Username
+	}
+	c.JSON(200, result)
+}
+
+func (g *Gateway) listTokensEndpoint(c *napnap.Context) {
+	consumerId := c.Query("consumer_id")
+	if len(consumerId) > 0 {
+		tokens, err := g.tokenRepo.GetByConsumerID(consumerId)
+		panicIf(err)
+		if len(tokens) == 0 {
+			err = g.tokenRepo.DeleteByConsumerID(consumerId) // for redis
+			panicIf(err)
+			c.JSON(200, newTokenCollection())
+			return
+		}
+		setting := g.currentConfig().Token
+		for _, token := range tokens {
+			token.SetExpiresIn(setting)
+		}
+		result := tokenCollection{
+			Count:  len(tokens),
+			Tokens: tokens,
+		}
+		c.JSON(200, result)
+		return
+	}
+	//TODO: find all tokens and pagination
+	c.SetStatus(501)
+	return
+}
+
+func (g *Gateway) createTokenEndpoint(c *napnap.Context) {
+	var target store.Token
+	err := c.BindJSON(&target)
+	if err != nil {
+		panic(AppError{ErrorCode: "invalid_input", Message: err.Error()})
+	}
+
+	if len(target.ConsumerID) == 0 {
+		panic(AppError{ErrorCode: "invalid_input", Message: "consumer_id field was invalid."})
+	}
+
+	consumer, err := g.consumerRepo.Get(target.ConsumerID)
+	panicIf(err)
+	if consumer == nil {
+		panic(AppError{ErrorCode: "not_found", Message: "consumer was not found."})
+	}
+
+	if len(target.ID) == 0 {
+		target.ID = uuid.NewV4().String()
+	}
+
+	setting := g.currentConfig().Token
+	now := time.Now().UTC()
+	if target.ExpiresIn > 0 {
+		target.Expiration = now.Add(time.Duration(target.ExpiresIn) * time.Second)
+	} else {
+		target.Expiration = now.Add(time.Duration(setting.Timeout) * time.Second)
+	}
+	target.CreatedAt = now
+	target.CapExpiration(setting)
+	target.SetExpiresIn(setting)
+
+	evictOldest := setting.EvictionPolicy == "evict-oldest"
+	evicted, err := g.tokenRepo.InsertWithLimit(&target, setting.MaxPerConsumer, evictOldest)
+	panicIf(err)
+	for _, tokenID := range evicted {
+		g.notifyTokenEvicted(target.ConsumerID, tokenID)
+	}
+	target.EvictedTokenIDs = evicted
+	c.JSON(201, target)
+}
+
+func (g *Gateway) updateTokensEndpoint(c *napnap.Context) {
+	var tokens []store.Token
+	err := c.BindJSON(&tokens)
+	if err != nil {
+		panic(AppError{ErrorCode: "invalid_input", Message: err.Error()})
+	}
+	if len(tokens) == 0 {
+		c.SetStatus(204)
+		return
+	}
+	for _, token := range tokens {
+		err = g.tokenRepo.Update(&token)
+		panicIf(err)
+	}
+	c.SetStatus(204)
+}
+
+func (g *Gateway) deleteTokenEndpoint(c *napnap.Context) {
+	id := c.Param("id")
+
+	if len(id) == 0 {
+		panic(AppError{ErrorCode: "not_found", Message: "token was not found"})
+	}
+
+	token, err := g.tokenRepo.Get(id)
+	panicIf(err)
+	if token == nil {
+		panic(AppError{ErrorCode: "not_found", Message: "token was not found"})
+	}
+
+	err = g.tokenRepo.Delete(id)
+	panicIf(err)
+
+	c.SetStatus(204)
+}
+
+func (g *Gateway) expireTokenEndpoint(c *napnap.Context) {
+	key := c.Param("key")
+
+	if len(key) == 0 {
+		panic(AppError{ErrorCode: "not_found", Message: "token was not found"})
+	}
+
+	token, err := g.tokenRepo.Get(key)
+	panicIf(err)
+	if token == nil {
+		panic(AppError{ErrorCode: "not_found", Message: "token was not found"})
+	}
+
+	token.Expiration = time.Now().UTC()
+	err = g.tokenRepo.Update(token)
+	panicIf(err)
+
+	c.SetStatus(204)
+}
+
+// tokenDeleteResult is the outcome of one token in a batch delete.
+type tokenDeleteResult struct {
+	ID     string `json:"id"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (g *Gateway) deleteTokensEndpoint(c *napnap.Context) {
+	consumerId := c.Query("consumer_id")
+	var tokens []*store.Token
+	var err error
+
+	if len(consumerId) > 0 {
+		// get all tokens by consumer id
+		tokens, err = g.tokenRepo.GetByConsumerID(consumerId)
+		panicIf(err)
+	}
+
+	if len(tokens) == 0 {
+		panic(AppError{ErrorCode: "not_found", Message: "tokens were not found"})
+	}
+
+	// delete all token by consumer id
+	err = g.tokenRepo.DeleteByConsumerID(consumerId)
+	panicIf(err)
+	c.SetStatus(204)
+}
+
+// deleteTokenBatchEndpoint deletes the tokens of {"ids": [...]} and replies
+// with 207 and the result of every id.
+func (g *Gateway) deleteTokenBatchEndpoint(c *napnap.Context) {
+	var target struct {
+		IDs []string `json:"ids"`
+	}
+	err := c.BindJSON(&target)
+	if err != nil {
+		panic(AppError{ErrorCode: "invalid_input", Message: err.Error()})
+	}
+	if len(target.IDs) == 0 {
+		panic(AppError{ErrorCode: "invalid_input", Message: "ids field can't be empty"})
+	}
+
+	results := make([]tokenDeleteResult, len(target.IDs))
+	deleted, err := g.tokenRepo.DeleteBatch(target.IDs)
+	isDeleted := map[string]bool{}
+	for _, id := range deleted {
+		isDeleted[id] = true
+	}
+	for i, id := range target.IDs {
+		results[i].ID = id
+		switch {
+		case err != nil:
+			results[i].Status = 500
+			results[i].Error = err.Error()
+		case isDeleted[id]:
+			results[i].Status = 204
+		default:
+			results[i].Status = 404
+			results[i].Error = "token was not found"
+		}
+	}
+	c.JSON(207, results)
+}
+
+func (g *Gateway) createAPIEndpoint(c *napnap.Context) {
+	var target api
+	err := c.BindJSON(&target)
+	if err != nil {
+		panic(AppError{ErrorCode: "invalid_input", Message: err.Error()})
+	}
+	if len(target.Name) == 0 {
+		panic(AppError{ErrorCode: "invalid_input", Message: "name field can't be empty or null"})
+	}
+	/*
+		api, err := g.apiRepo.GetByName(target.Name)
+		panicIf(err)
+		if api != nil {
+			panic(AppError{ErrorCode: "invalid_input", Message: "name already exists"})
+		}
+	*/
+	if target.Whitelist == nil {
+		target.Whitelist = []string{}
+	}
+	err = target.isValid(g.currentConfig())
+	panicIf(err)
+	err = g.apiRepo.Insert(&target)
+	panicIf(err)
+	c.JSON(201, target)
+}
+
+func (g *Gateway) getAPIEndpoint(c *napnap.Context) {
+	apiID := c.Param("api_id")
+
+	var result *api
+	for _, api := range g.routes.All() {
+		if api.ID == apiID {
+			result = api
+			break
+		}
+		if api.Name == apiID {
+			result = api
+			break
+		}
+	}
+
+	if result == nil {
+		panic(AppError{ErrorCode: "not_found", Message: "api was not found"})
+	}
+
+	c.RespHeader("ETag", etag(result.Revision))
+	c.JSON(200, result)
+}
+
+func (g *Gateway) listAPIEndpoint(c *napnap.Context) {
+	mode := c.Query("mode")
+	result := newAPICollection()
+	if mode == "preview" {
+		apis, err := g.apiRepo.GetAll()
+		panicIf(err)
+		if len(apis) > 0 {
+			result = &apiCollection{
+				Count: len(apis),
+				APIs:  apis,
+			}
+			c.JSON(200, result)
+			return
+		}
+	}
+
+	apis := g.routes.All()
+	if len(apis) > 0 {
+		result = &apiCollection{
+			Count: len(apis),
+			APIs:  apis,
+		}
+	}
+	c.JSON(200, result)
+}
+
+func (g *Gateway) updateAPIEndpoint(c *napnap.Context) {
+	apiID := c.Param("api_id")
+	var target api
+	err := c.BindJSON(&target)
+	if err != nil {
+		panic(AppError{ErrorCode: "invalid_input", Message: err.Error()})
+	}
+	if len(target.Name) == 0 {
+		panic(AppError{ErrorCode: "invalid_input", Message: "name field can't be empty"})
+	}
+
+	api, err := g.apiRepo.Get(apiID)
+	panicIf(err)
+	if api == nil {
+		panic(AppError{ErrorCode: "not_found", Message: "api was not found"})
+	}
+
+	revision, ok := g.expectRevision(c, api.Revision)
+	if !ok {
+		return
+	}
+	target.ID = api.ID
+	if target.Whitelist == nil {
+		target.Whitelist = []string{}
+	}
+	target.CreatedAt = api.CreatedAt
+	target.Revision = revision
+	target.ManagedBy = api.ManagedBy
+	target.SyncRevision = api.SyncRevision
+	err = target.isValid(g.currentConfig())
+	panicIf(err)
+	changes := diffFields(&target, api)
+	err = g.apiRepo.Update(&target)
+	if err == store.ErrRevisionConflict {
+		// the stored api was changed since it was read
+		current, err := g.apiRepo.Get(api.ID)
+		panicIf(err)
+		if current == nil {
+			panic(AppError{ErrorCode: "not_found", Message: "api was not found"})
+		}
+		writeRevisionConflict(c, revision, &target, current.Revision, current)
+		return
+	}
+	panicIf(err)
+	g.auditRevision(adminActor(c), "api", target.ID, revision, target.Revision, changes)
+	c.RespHeader("ETag", etag(target.Revision))
+	c.JSON(200, &target)
+}
+
+func (g *Gateway) deleteAPIEndpoint(c *napnap.Context) {
+	apiID := c.Param("api_id")
+	api, err := g.apiRepo.Get(apiID)
+	panicIf(err)
+	if api == nil {
+		panic(AppError{ErrorCode: "not_found", Message: "api was not found"})
+	}
+	err = g.apiRepo.Delete(api.ID)
+	panicIf(err)
+	c.SetStatus(204)
+}
+
+func (g *Gateway) switchAPISource(c *napnap.Context) {
+	var target apiSwitch
+	err := c.BindJSON(&target)
+	if err != nil {
+		panic(AppError{ErrorCode: "invalid_input", Message: err.Error()})
+	}
+	if len(target.From) == 0 {
+		panic(AppError{ErrorCode: "invalid_input", Message: "from field can't be empty"})
+	}
+	if len(target.To) == 0 {
+		panic(AppError{ErrorCode: "invalid_input", Message: "to field can't be empty"})
+	}
+
+	apiFrom, err := g.apiRepo.Get(target.From)
+	panicIf(err)
+	if apiFrom == nil {
+		panic(AppError{ErrorCode: "not_found", Message: "api of from field was not found"})
+	}
+
+	apiTo, err := g.apiRepo.Get(target.To)
+	panicIf(err)
+	if apiTo == nil {
+		panic(AppError{ErrorCode: "not_found", Message: "api of to field was not found"})
+	}
+
+	// update
+	fromRevision, fromBefore := apiFrom.Revision, toFields(apiFrom)
+	toRevision, toBefore := apiTo.Revision, toFields(apiTo)
+	apiFrom.switchSource(apiTo)
+	err = g.apiRepo.Update(apiFrom)
+	panicIf(err)
+	g.auditRevision(adminActor(c), "api", apiFrom.ID, fromRevision, apiFrom.Revision, diffFields(apiFrom, fromBefore))
+	err = g.apiRepo.Update(apiTo)
+	panicIf(err)
+	g.auditRevision(adminActor(c), "api", apiTo.ID, toRevision, apiTo.Revision, diffFields(apiTo, toBefore))
+
+	// reload api
+	err = g.reloadAPIs()
+	panicIf(err)
+	c.SetStatus(200)
+}
+
+func (g *Gateway) reloadAPIEndpoint(c *napnap.Context) {
+	err := g.reloadAPIs()
+	panicIf(err)
+	c.SetStatus(204)
+}
+
+func (g *Gateway) createOrUpdateCORSEndpoint(c *napnap.Context) {
+	var target store.GlobalCORS
+	err := c.BindJSON(&target)
+	if err != nil {
+		panic(AppError{ErrorCode: "invalid_input", Message: err.Error()})
+	}
+
+	cors, err := g.corsRepo.Get()
+	panicIf(err)
+
+	if cors == nil {
+		// create configCORS
+		target.Name = "cors"
+		err = g.corsRepo.Insert(&target)
+		panicIf(err)
+		c.JSON(201, target)
+		return
+	}
+
+	// update configCORS
+	cors.AllowedOrigins = target.AllowedOrigins
+	err = g.corsRepo.Update(cors)
+	panicIf(err)
+	c.JSON(200, cors)
+
+}
+
+func (g *Gateway) getCORSEndpoint(c *napnap.Context) {
+	mode := strings.ToLower(c.Query("mode"))
+
+	// preview mode
+	if mode == "preview" {
+		cors, err := g.corsRepo.Get()
+		panicIf(err)
+		if cors == nil {
+			c.SetStatus(404)
+		}
+		c.JSON(200, cors)
+		return
+	}
+
+	// nornal mode
+	c.JSON(200, g.cors)
+}
+
+func (g *Gateway) reloadCORSEndpoint(c *napnap.Context) {
+	var err error
+	g.cors, err = g.corsRepo.Get()
+	panicIf(err)
+	c.SetStatus(204)
+}
+
+func (g *Gateway) createServicesEndpoint(c *napnap.Context) {
+	var target store.Service
+	err := c.BindJSON(&target)
+	if err != nil {
+		panic(AppError{ErrorCode: "invalid_input", Message: err.Error()})
+	}
+	if len(target.Name) == 0 {
+		panic(AppError{ErrorCode: "invalid_input", Message: "name field can't be empty or null"})
+	}
+	service, err := g.serviceRepo.GetByName(target.Name)
+	panicIf(err)
+	if service != nil {
+		panic(AppError{ErrorCode: "invalid_input", Message: "name already exists"})
+	}
+
+	target.Upstreams = []*store.Upstream{}
+
+	err = g.serviceRepo.Insert(&target)
+	panicIf(err)
+
+	c.JSON(201, target)
+}
+
+func (g *Gateway) getServicesEndpoint(c *napnap.Context) {
+	serviceID := c.Param("service_id")
+
+	var result *store.Service
+	for _, svc := range g.services {
+		if svc.ID == serviceID {
+			result = svc
+			break
+		}
+		if svc.Name == serviceID {
+			result = svc
+			break
+		}
+	}
+
+	if result == nil {
+		panic(AppError{ErrorCode: "not_found", Message: "service was not found"})
+	}
+
+	c.JSON(200, result)
+}
+
+func (g *Gateway) listServicesEndpoint(c *napnap.Context) {
+	mode := c.Query("mode")
+	result := newServiceCollection()
+	if mode == "preview" {
+		services, err := g.serviceRepo.GetAll()
+		panicIf(err)
+		if len(services) > 0 {
+			result = &serviceCollection{
+				Count:    len(services),
+				Services: services,
+			}
+			c.JSON(200, result)
+			return
+		}
+	}
+	if len(g.services) > 0 {
+		result = &serviceCollection{
+			Count:    len(g.services),
+			Services: g.services,
+		}
+	}
+	c.JSON(200, result)
+}
+
+func (g *Gateway) updateServicesEndpoint(c *napnap.Context) {
+	serviceID := c.Param("service_id")
+	var target store.Service
+	err := c.BindJSON(&target)
+	if err != nil {
+		panic(AppError{ErrorCode: "invalid_input", Message: err.Error()})
+	}
+	if len(target.Name) == 0 {
+		panic(AppError{ErrorCode: "invalid_input", Message: "name field can't be empty"})
+	}
+
+	service, err := g.serviceRepo.Get(serviceID)
+	panicIf(err)
+	if service == nil {
+		service, err = g.serviceRepo.GetByName(serviceID)
+	}
+	if service == nil {
+		panic(AppError{ErrorCode: "not_found", Message: "service was not found"})
+	}
+
+	target.ID = service.ID
+	target.Upstreams = service.Upstreams
+	target.CreatedAt = service.CreatedAt
+	err = g.serviceRepo.Update(&target)
+	panicIf(err)
+	c.JSON(200, target)
+}
+
+func (g *Gateway) deleteServicesEndpoint(c *napnap.Context) {
+	serviceID := c.Param("service_id")
+	service, err := g.serviceRepo.Get(serviceID)
+	panicIf(err)
+	if service == nil {
+		service, err = g.serviceRepo.GetByName(serviceID)
+	}
+	if service == nil {
+		panic(AppError{ErrorCode: "not_found", Message: "service was not found"})
+	}
+	err = g.serviceRepo.Delete(service.ID)
+	panicIf(err)
+	c.SetStatus(204)
+}
+
+func (g *Gateway) registerServiceUpstreamEndpoint(c *napnap.Context) {
+	var target store.Upstream
+	err := c.BindJSON(&target)
+	if err != nil {
+		panic(AppError{ErrorCode: "invalid_input", Message: err.Error()})
+	}
+
+	// verify input
+	if len(target.TargetURL) == 0 {
+		panic(AppError{ErrorCode: "invalid_input", Message: "target_url field was missing or empty"})
+	}
+
+	serviceID := c.Param("service_id")
+	var service *store.Service
+	for _, svc := range g.services {
+		if svc.ID == serviceID || svc.Name == serviceID {
+			service = svc
+		}
+	}
+	if service == nil {
+		panic(AppError{ErrorCode: "not_found", Message: "service was not found"})
+	}
+
+	service.RegisterUpstream(&target)
+	c.JSON(200, target)
+}
+
+func (g *Gateway) unregisterServiceUpstreamEndpoint(c *napnap.Context) {
+	serviceID := c.Param("service_id")
+	var service *store.Service
+	for _, svc := range g.services {
+		if svc.ID == serviceID {
+			service = svc
+		} else if svc.Name == serviceID {
+			service = svc
+		}
+	}
+	if service == nil {
+		panic(AppError{ErrorCode: "not_found", Message: "service was not found"})
+	}
+
+	upstreamID := c.Param("upstream_id")
+	for _, upS := range service.Upstreams {
+		if upS.Name == upstreamID {
+			// remove upstream
+			service.UnregisterUpstream(upS)
+			c.SetStatus(204)
+			return
+		}
+	}
+	panic(AppError{ErrorCode: "not_found", Message: "upstream was not found"})
+}
+
+func (g *Gateway) reloadServiceEndpoint(c *napnap.Context) {
+	services, err := g.serviceRepo.GetAll()
+	panicIf(err)
+	for _, newSvc := range services {
+		for _, oldSvc := range g.services {
+			if newSvc.ID == oldSvc.ID {
+				newSvc.Upstreams = oldSvc.Upstreams
+			}
+		}
+	}
+	g.services = services
+	c.SetStatus(204)
+}
+
+func (g *Gateway) getStatus(c *napnap.Context) {
+	status := status{}
+	status.Hostname = g.app.hostname
+	status.ServerTime = time.Now().UTC()
+	status.NumCPU = runtime.NumCPU()
+	status.TotalRequests = g.app.totalRequests
+	status.NetworkIn = g.app.networkIn / 1000000
+	status.NetworkOut = g.app.networkOut / 1000000
+	m := &runtime.MemStats{}
+	runtime.ReadMemStats(m)
+	status.MemoryAcquired = m.Sys / 1000000
+	status.MemoryUsed = m.Alloc / 1000000
+	status.StartAt = g.app.startAt
+	status.Uptime = time.Since(g.app.startAt).String()
+	status.InFlight = g.concurrencyLimits.inFlight()
+	status.Server = g.timeouts
+	c.JSON(200, status)
+}
@@ -0,0 +1,266 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jasonsoft/bifrost/internal/store"
+	"github.com/jasonsoft/napnap"
+)
+
+// failingTokenRepo answers reads from the wrapped store and fails every write
+// like a redis which went away.
+type failingTokenRepo struct {
+	store.TokenRepository
+}
+
+func (r *failingTokenRepo) Update(token *store.Token) error {
+	return &store.TokenStoreError{Op: "set", Key: "token:id:" + token.ID, Err: errors.New("connection refused")}
+}
+
+func (r *failingTokenRepo) DeleteByConsumerID(consumerID string) error {
+	return &store.TokenStoreError{Op: "del", Key: "token:consumer:" + consumerID, Err: errors.New("connection refused")}
+}
+
+// serveAdmin runs an admin endpoint behind the error handling middleware.
+func serveAdmin(method string, path string, endpoint napnap.HandlerFunc, req *http.Request) *httptest.ResponseRecorder {
+	nap := napnap.New()
+	nap.Use(newApplicationLogMiddleware(testGateway, false))
+	router := napnap.NewRouter()
+	router.Add(method, path, endpoint)
+	nap.Use(router)
+	w := httptest.NewRecorder()
+	nap.ServeHTTP(w, req)
+	return w
+}
+
+func TestTokenEndpointsReportStoreErrors(t *testing.T) {
+	tokens := newTestTokenStore()
+	token := testGateway.newToken("consumer-1")
+	tokens.Insert(token)
+	useTestRepos(t, &failingTokenRepo{TokenRepository: tokens}, store.NewConsumerMemStore())
+
+	w := serveAdmin("DELETE", "/v1/tokens", testGateway.deleteTokensEndpoint, httptest.NewRequest("DELETE", "/v1/tokens?consumer_id=consumer-1", nil))
+	if w.Code != 503 {
+		t.Fatalf("revoke: status = %d, want 503", w.Code)
+	}
+
+	body := strings.NewReader(`[{"id":"` + token.ID + `","consumer_id":"consumer-1"}]`)
+	w = serveAdmin("PUT", "/v1/tokens", testGateway.updateTokensEndpoint, httptest.NewRequest("PUT", "/v1/tokens", body))
+	if w.Code != 503 {
+		t.Fatalf("update: status = %d, want 503", w.Code)
+	}
+}
+
+// racingConsumerRepo lets another request update the consumer right before
+// every update.
+type racingConsumerRepo struct {
+	store.ConsumerRepository
+}
+
+func (r *racingConsumerRepo) Update(consumer *store.Consumer) error {
+	current, _ := r.ConsumerRepository.Get(consumer.ID)
+	other := *current
+	other.CustomID = "changed by another request"
+	r.ConsumerRepository.Update(&other)
+	return r.ConsumerRepository.Update(consumer)
+}
+
+type racingAPIRepo struct {
+	APIRepository
+}
+
+func (r *racingAPIRepo) Update(apiEntry *api) error {
+	current, _ := r.APIRepository.Get(apiEntry.ID)
+	other := cloneAPI(current)
+	other.TargetURL = "http://changed:8080"
+	r.APIRepository.Update(other)
+	return r.APIRepository.Update(apiEntry)
+}
+
+func TestRevisionConflictReportsTheStoredRevision(t *testing.T) {
+	consumers := store.NewConsumerMemStore()
+	consumer := &store.Consumer{App: "shop", Username: "tom"}
+	consumers.Insert(consumer)
+	useTestRepos(t, newTestTokenStore(), &racingConsumerRepo{ConsumerRepository: consumers})
+
+	req := httptest.NewRequest("PUT", "/v1/consumers/"+consumer.ID, strings.NewReader(`{"app":"shop","username":"tom"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("If-Match", etag(1))
+	w := serveAdmin("PUT", "/v1/consumers/:consumer_id", testGateway.updateConsumerEndpoint, req)
+	if w.Code != 409 {
+		t.Fatalf("consumer: status = %d, want 409", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), `"current_revision":2`) || w.Header().Get("ETag") != etag(2) {
+		t.Fatalf("consumer: the stored revision must be reported, got %s %s", w.Header().Get("ETag"), w.Body.String())
+	}
+
+	apis := &apiTestRepo{}
+	apis.Insert(&api{Name: "orders", RequestPath: "/orders", TargetURL: "http://orders:8080"})
+	useTestAPIRepo(t, &racingAPIRepo{APIRepository: apis})
+	req = httptest.NewRequest("PUT", "/v1/apis/api-1", strings.NewReader(`{"name":"orders","request_path":"/orders","target_url":"http://orders-v2:8080"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("If-Match", etag(1))
+	w = serveAdmin("PUT", "/v1/apis/:api_id", testGateway.updateAPIEndpoint, req)
+	if w.Code != 409 {
+		t.Fatalf("api: status = %d, want 409", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), `"current_revision":2`) || w.Header().Get("ETag") != etag(2) {
+		t.Fatalf("api: the stored revision must be reported, got %s %s", w.Header().Get("ETag"), w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), `"target_url"`) {
+		t.Fatalf("api: the changes must be compared with the stored api, got %s", w.Body.String())
+	}
+}
+
+func TestConcurrentUpdatesWithTheSameRevision(t *testing.T) {
+	const updaters = 8
+	consumers := store.NewConsumerMemStore()
+	consumer := &store.Consumer{App: "shop", Username: "tom"}
+	consumers.Insert(consumer)
+	useTestRepos(t, newTestTokenStore(), consumers)
+	apis := &apiTestRepo{}
+	apis.Insert(&api{Name: "orders", RequestPath: "/orders", TargetURL: "http://orders:8080"})
+	useTestAPIRepo(t, apis)
+
+	cases := []struct {
+		name     string
+		path     string
+		route    string
+		endpoint napnap.HandlerFunc
+		body     func(i int) string
+	}{
+		{"consumer", "/v1/consumers/" + consumer.ID, "/v1/consumers/:consumer_id", testGateway.updateConsumerEndpoint, func(i int) string {
+			return fmt.Sprintf(`{"app":"shop","username":"tom","custom_id":"updater-%d"}`, i)
+		}},
+		{"api", "/v1/apis/api-1", "/v1/apis/:api_id", testGateway.updateAPIEndpoint, func(i int) string {
+			return fmt.Sprintf(`{"name":"orders","request_path":"/orders","target_url":"http://orders-%d:8080"}`, i)
+		}},
+	}
+	for _, tc := range cases {
+		var wg sync.WaitGroup
+		var start sync.WaitGroup
+		start.Add(1)
+		codes := make([]int, updaters)
+		bodies := make([]string, updaters)
+		for i := 0; i < updaters; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				req := httptest.NewRequest("PUT", tc.path, strings.NewReader(tc.body(i)))
+				req.Header.Set("Content-Type", "application/json")
+				req.Header.Set("If-Match", etag(1))
+				start.Wait()
+				w := serveAdmin("PUT", tc.route, tc.endpoint, req)
+				codes[i], bodies[i] = w.Code, w.Body.String()
+			}(i)
+		}
+		start.Done()
+		wg.Wait()
+
+		won := 0
+		for i, code := range codes {
+			switch code {
+			case 200:
+				won++
+			case 409:
+				if !strings.Contains(bodies[i], `"submitted_revision":1`) || !strings.Contains(bodies[i], `"current_revision":2`) {
+					t.Fatalf("%s: the conflict must report both revisions, got %s", tc.name, bodies[i])
+				}
+			default:
+				t.Fatalf("%s: status = %d, want 200 or 409: %s", tc.name, code, bodies[i])
+			}
+		}
+		if won != 1 {
+			t.Fatalf("%s: %d updates won, want exactly 1", tc.name, won)
+		}
+	}
+}
+
+func TestUpdatesAreAuditedWithTheirRevision(t *testing.T) {
+	withConfig(t, func(config *Configuration) {
+		config.AdminTokens = []string{"admin-secret"}
+	})
+	consumers := store.NewConsumerMemStore()
+	consumer := &store.Consumer{App: "shop", Username: "tom"}
+	consumers.Insert(consumer)
+	useTestRepos(t, newTestTokenStore(), consumers)
+	store := &memoryAuditStore{}
+	useTestAuditLog(t, store)
+
+	nap := napnap.New()
+	nap.Use(newApplicationLogMiddleware(testGateway, false))
+	nap.UseFunc(testGateway.auth)
+	router := napnap.NewRouter()
+	router.Put("/v1/consumers/:consumer_id", testGateway.updateConsumerEndpoint)
+	nap.Use(router)
+	req := httptest.NewRequest("PUT", "/v1/consumers/"+consumer.ID, strings.NewReader(`{"app":"shop","username":"tom","custom_id":"crm-7"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "admin-secret")
+	req.Header.Set("If-Match", etag(1))
+	w := httptest.NewRecorder()
+	nap.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+	}
+	testGateway.auditLog.Close()
+
+	if len(store.entries) != 1 {
+		t.Fatalf("got %d entries, want 1", len(store.entries))
+	}
+	entry := store.entries[0]
+	if entry.Entity != "consumer" || entry.EntityID != consumer.ID || entry.ConsumerID != consumer.ID {
+		t.Fatalf("entry = %+v, want the consumer", entry)
+	}
+	if entry.FromRevision != 1 || entry.ToRevision != 2 {
+		t.Fatalf("revision %d -> %d, want 1 -> 2", entry.FromRevision, entry.ToRevision)
+	}
+	if entry.Actor != "token:"+maskTokenID("admin-secret") {
+		t.Fatalf("actor = %s, the admin token must be masked", entry.Actor)
+	}
+	if fmt.Sprint(entry.Changes) != "[custom_id]" {
+		t.Fatalf("changes = %v, want [custom_id]", entry.Changes)
+	}
+}
+
+func TestDeleteTokenBatchEndpoint(t *testing.T) {
+	tokens := newTestTokenStore()
+	token := testGateway.newToken("consumer-1")
+	tokens.Insert(token)
+	useTestRepos(t, tokens, store.NewConsumerMemStore())
+
+	// the batch route must win over the route of a single token
+	nap := napnap.New()
+	nap.Use(newApplicationLogMiddleware(testGateway, false))
+	router := napnap.NewRouter()
+	router.Delete("/v1/tokens/batch", testGateway.deleteTokenBatchEndpoint)
+	router.Delete("/v1/tokens/:id", testGateway.deleteTokenEndpoint)
+	nap.Use(router)
+
+	req := httptest.NewRequest("DELETE", "/v1/tokens/batch", strings.NewReader(`{"ids":["`+token.ID+`","missing"]}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	nap.ServeHTTP(w, req)
+	if w.Code != 207 {
+		t.Fatalf("status = %d, want 207: %s", w.Code, w.Body.String())
+	}
+	expected := `[{"id":"` + token.ID + `","status":204},{"id":"missing","status":404,"error":"token was not found"}]`
+	if strings.TrimSpace(w.Body.String()) != expected {
+		t.Fatalf("body = %s, want %s", w.Body.String(), expected)
+	}
+	if stored, _ := tokens.Get(token.ID); stored != nil {
+		t.Fatal("the token must be deleted")
+	}
+
+	// a body on the delete by consumer isn't a batch anymore
+	req = httptest.NewRequest("DELETE", "/v1/tokens", strings.NewReader(`{"ids":["x"]}`))
+	w = serveAdmin("DELETE", "/v1/tokens", testGateway.deleteTokensEndpoint, req)
+	if w.Code != 404 {
+		t.Fatalf("delete without consumer_id: status = %d, want 404", w.Code)
+	}
+}
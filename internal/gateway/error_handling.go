@@ -0,0 +1,91 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+
+	"github.com/jasonsoft/bifrost/internal/logging"
+	"github.com/jasonsoft/bifrost/internal/store"
+	"github.com/jasonsoft/napnap"
+)
+
+type applicationLogMiddleware struct {
+	gateway  *Gateway
+	writeLog bool
+}
+
+func newApplicationLogMiddleware(g *Gateway, writeLog bool) *applicationLogMiddleware {
+	return &applicationLogMiddleware{
+		gateway:  g,
+		writeLog: writeLog,
+	}
+}
+
+func (m *applicationLogMiddleware) Invoke(c *napnap.Context, next napnap.HandlerFunc) {
+	defer func() {
+		// we only handle error for bifrost application and don't handle can't error from upstream.
+		if r := recover(); r != nil {
+			// the server aborts the connection, e.g. a response which is too large
+			if r == http.ErrAbortHandler {
+				panic(r)
+			}
+			// bad request.  http status code is 400 series.
+			appError, ok := r.(AppError)
+			if ok {
+				c.Set("error", appError.Message)
+				if appError.ErrorCode == "not_found" {
+					m.gateway.writeError(c, 404, appError)
+					return
+				}
+				m.gateway.writeError(c, 400, appError)
+				return
+			}
+
+			// unknown error.  http status code is 500 series.
+			err, ok := r.(error)
+			if !ok {
+				err = fmt.Errorf("unknow error: %v", r)
+			}
+
+			// the token store is down, the client may try again later
+			var storeErr *store.TokenStoreError
+			if errors.As(err, &storeErr) {
+				c.Set("error", err.Error())
+				fields := map[string]interface{}{
+					"op":    storeErr.Op,
+					"key":   storeErr.Key,
+					"error": storeErr.Err.Error(),
+				}
+				if requestID, exist := c.Get("request-id"); exist {
+					fields["request_id"] = requestID
+				}
+				m.gateway.logger.writeErrorLog("token store is unavailable", fields)
+				m.gateway.writeError(c, 503, AppError{ErrorCode: "token_store_unavailable", Message: "The token store is unavailable, please try again later."})
+				return
+			}
+			m.gateway.logger.debugf("unknown error: %v", err)
+			c.Set("error", err.Error())
+			appError = AppError{
+				ErrorCode: "unknown_error",
+				Message:   "An unknown error has occurred.",
+			}
+			if requestID, exist := c.Get("request-id"); exist {
+				appError.RequestID = requestID.(string)
+			}
+			m.gateway.writeError(c, 500, appError)
+
+			// write error log
+			if m.writeLog {
+				requestDump, _ := httputil.DumpRequest(c.Request, true)
+				appLog := logging.NewMessage(m.gateway.app.hostname, m.gateway.app.name, "applications", 3)
+				appLog.CustomFields["request_id"] = appError.RequestID
+				appLog.ShortMessage = err.Error()
+				appLog.FullMessage = fmt.Sprintf("request info: %s", string(requestDump))
+				m.gateway.logger.queueGelfMessage(appLog)
+			}
+		}
+	}()
+	next(c)
+}
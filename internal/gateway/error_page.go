@@ -0,0 +1,92 @@
+package gateway
+
+import (
+	"bytes"
+	"html/template"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jasonsoft/napnap"
+)
+
+// ErrorResponse is the json body of the errors which the gateway generates
+// itself, the error code of an AppError is sent as error_code.
+type ErrorResponse struct {
+	Code      string    `json:"error_code"`
+	Message   string    `json:"message"`
+	RequestID string    `json:"request_id,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func newErrorResponse(appError AppError) ErrorResponse {
+	return ErrorResponse{
+		Code:      appError.ErrorCode,
+		Message:   appError.Message,
+		RequestID: appError.RequestID,
+		Timestamp: time.Now().UTC(),
+	}
+}
+
+// errorPageData is passed to the error page template.
+type errorPageData struct {
+	Status     int
+	StatusText string
+	ErrorCode  string
+	Message    string
+	RequestID  string
+	Timestamp  time.Time
+}
+
+func loadErrorPage(path string) (*template.Template, error) {
+	return template.ParseFiles(path)
+}
+
+// writeError writes the error which the gateway generated itself. Clients
+// asking for text/html get the error page of the config file, everybody
+// else the json document.
+func (g *Gateway) writeError(c *napnap.Context, status int, appError AppError) {
+	if len(appError.RequestID) == 0 {
+		if requestID, ok := c.Get("request-id"); ok {
+			appError.RequestID = requestID.(string)
+		}
+	}
+	resp := newErrorResponse(appError)
+	page := g.currentConfig().errorPage
+	if page != nil && acceptsHTML(c.Request.Header.Get("Accept")) {
+		var buf bytes.Buffer
+		err := page.Execute(&buf, errorPageData{
+			Status:     status,
+			StatusText: http.StatusText(status),
+			ErrorCode:  resp.Code,
+			Message:    resp.Message,
+			RequestID:  resp.RequestID,
+			Timestamp:  resp.Timestamp,
+		})
+		if err == nil {
+			c.Writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+			c.Writer.WriteHeader(status)
+			c.Writer.Write(buf.Bytes())
+			return
+		}
+		g.logger.errorf("failed to render the error page: %v", err)
+	}
+	c.JSON(status, resp)
+}
+
+// acceptsHTML reports whether the Accept header names text/html, media types
+// with q=0 are refused by the client.
+func acceptsHTML(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || mediaType != "text/html" {
+			continue
+		}
+		if q, ok := params["q"]; ok && strings.Trim(q, "0.") == "" {
+			continue
+		}
+		return true
+	}
+	return false
+}
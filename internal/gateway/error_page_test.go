@@ -0,0 +1,89 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jasonsoft/bifrost/internal/store"
+	"github.com/jasonsoft/napnap"
+)
+
+// serveError runs the endpoint behind the error handling of the gateway.
+func serveError(endpoint napnap.HandlerFunc, accept string) *httptest.ResponseRecorder {
+	nap := napnap.New()
+	nap.UseFunc(func(c *napnap.Context, next napnap.HandlerFunc) {
+		c.Set("request-id", "req-1")
+		next(c)
+	})
+	nap.Use(newApplicationLogMiddleware(testGateway, false))
+	nap.UseFunc(func(c *napnap.Context, next napnap.HandlerFunc) {
+		endpoint(c)
+	})
+	req := httptest.NewRequest("GET", "/orders", nil)
+	if len(accept) > 0 {
+		req.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	nap.ServeHTTP(w, req)
+	return w
+}
+
+func TestErrorsAreSentAsErrorResponse(t *testing.T) {
+	tests := []struct {
+		name   string
+		panic  interface{}
+		status int
+		code   string
+	}{
+		{"invalid input", AppError{ErrorCode: "invalid_input", Message: "name is missing"}, 400, "invalid_input"},
+		{"not found", AppError{ErrorCode: "not_found", Message: "api was not found"}, 404, "not_found"},
+		{"token store", &store.TokenStoreError{Op: "get", Key: "abc", Err: errors.New("connection refused")}, 503, "token_store_unavailable"},
+		{"unknown", errors.New("boom"), 500, "unknown_error"},
+		{"not an error", "boom", 500, "unknown_error"},
+	}
+	for _, test := range tests {
+		w := serveError(func(c *napnap.Context) { panic(test.panic) }, "")
+		if w.Code != test.status {
+			t.Errorf("%s: status = %d, want %d", test.name, w.Code, test.status)
+			continue
+		}
+		var resp ErrorResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if resp.Code != test.code || len(resp.Message) == 0 || resp.RequestID != "req-1" || resp.Timestamp.IsZero() {
+			t.Errorf("%s: response = %+v", test.name, resp)
+		}
+		if strings.Contains(w.Body.String(), "boom") || strings.Contains(w.Body.String(), "connection refused") {
+			t.Errorf("%s: internal errors must not reach the client: %s", test.name, w.Body.String())
+		}
+	}
+}
+
+func TestErrorPageIsSentToBrowsers(t *testing.T) {
+	page := template.Must(template.New("error").Parse(`<h1>{{.Status}} {{.StatusText}}</h1><p>{{.ErrorCode}}: {{.Message}} ({{.RequestID}})</p>`))
+	withConfig(t, func(config *Configuration) {
+		config.errorPage = page
+	})
+	endpoint := func(c *napnap.Context) {
+		panic(AppError{ErrorCode: "not_found", Message: "<api> was not found"})
+	}
+
+	w := serveError(endpoint, "text/html,application/xhtml+xml;q=0.9,*/*;q=0.8")
+	want := `<h1>404 Not Found</h1><p>not_found: &lt;api&gt; was not found (req-1)</p>`
+	if w.Code != 404 || w.Body.String() != want || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	for _, accept := range []string{"", "application/json", "text/html;q=0", "text/html; q=0.0, application/json"} {
+		w := serveError(endpoint, accept)
+		if !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+			t.Errorf("accept %q: content type = %s, want json", accept, w.Header().Get("Content-Type"))
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package gateway
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+)
+
+// Envelope format of an encrypted field:
+//
+//	enc:v1:<key id>:<nonce>:<ciphertext>
+//
+// nonce and ciphertext are unpadded base64url, the ciphertext includes the
+// AES-GCM tag and "enc:v1:<key id>" is used as additional data.
+const envelopePrefix = "enc:v1:"
+
+var (
+	errBodyTooLarge     = errors.New("field encryption: body is too large")
+	errMalformedBody    = errors.New("field encryption: body isn't valid json")
+	errInvalidEnvelope  = errors.New("field encryption: invalid envelope")
+	errUnknownKey       = errors.New("field encryption: unknown key id")
+	errUnsupportedValue = errors.New("field encryption: field must be a string or number")
+)
+
+// EncryptionKey refers to an AES key. Secret is the base64 key itself or
+// "env:NAME" to read the base64 key from an environment variable.
+type EncryptionKey struct {
+	ID     string `yaml:"id"`
+	Secret string `yaml:"secret"`
+}
+
+func (k EncryptionKey) resolve() ([]byte, error) {
+	secret := k.Secret
+	if strings.HasPrefix(secret, "env:") {
+		secret = os.Getenv(strings.TrimPrefix(secret, "env:"))
+	}
+	key, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return nil, errors.New("field encryption: key '" + k.ID + "' isn't valid base64")
+	}
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return nil, errors.New("field encryption: key '" + k.ID + "' must be 16, 24 or 32 bytes")
+	}
+	return key, nil
+}
+
+// keyRing encrypts with the first key and decrypts with any key, so a key is
+// rotated by putting the new key first and keeping the old ones.
+type keyRing struct {
+	primaryID string
+	keys      map[string]cipher.AEAD
+}
+
+func newKeyRing(keys []EncryptionKey) (*keyRing, error) {
+	ring := &keyRing{
+		keys: map[string]cipher.AEAD{},
+	}
+	for _, k := range keys {
+		if len(k.ID) == 0 || strings.Contains(k.ID, ":") {
+			return nil, errors.New("field encryption: key id can't be empty or contain ':'")
+		}
+		key, err := k.resolve()
+		if err != nil {
+			return nil, err
+		}
+		block, err := aes.NewCipher(key)
+		zero(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		if len(ring.primaryID) == 0 {
+			ring.primaryID = k.ID
+		}
+		ring.keys[k.ID] = aead
+	}
+	return ring, nil
+}
+
+func (r *keyRing) encrypt(plaintext []byte) (string, error) {
+	aead, ok := r.keys[r.primaryID]
+	if !ok {
+		return "", errUnknownKey
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	header := envelopePrefix + r.primaryID
+	ciphertext := aead.Seal(nil, nonce, plaintext, []byte(header))
+	return header + ":" + base64.RawURLEncoding.EncodeToString(nonce) + ":" + base64.RawURLEncoding.EncodeToString(ciphertext), nil
+}
+
+// decrypt is the reference implementation of the envelope format.
+func (r *keyRing) decrypt(envelope string) ([]byte, error) {
+	if !strings.HasPrefix(envelope, envelopePrefix) {
+		return nil, errInvalidEnvelope
+	}
+	parts := strings.Split(strings.TrimPrefix(envelope, envelopePrefix), ":")
+	if len(parts) != 3 {
+		return nil, errInvalidEnvelope
+	}
+	aead, ok := r.keys[parts[0]]
+	if !ok {
+		return nil, errUnknownKey
+	}
+	nonce, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || len(nonce) != aead.NonceSize() {
+		return nil, errInvalidEnvelope
+	}
+	ciphertext, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidEnvelope
+	}
+	return aead.Open(nil, nonce, ciphertext, []byte(envelopePrefix+parts[0]))
+}
+
+// zero overwrites a secret or plaintext once it isn't needed anymore. The
+// json values the bytes were copied from are beyond reach, zeroing only
+// shortens how long the copies which the gateway owns stay in memory.
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// fieldEncryption lists the json fields of an api which are encrypted before
+// the request is forwarded. Paths are separated by dots, e.g. "card.pan",
+// and apply to every element when a value is an array.
+type fieldEncryption struct {
+	RequestFields []string `json:"request_fields" bson:"request_fields"`
+	// ResponseFields are decrypted before the response is sent back, only
+	// apis which are allowed to read plaintext should use it.
+	ResponseFields []string `json:"response_fields" bson:"response_fields"`
+	ContentTypes   []string `json:"content_types" bson:"content_types"`
+	// OnMalformed is "reject" (default) or "passthrough".
+	OnMalformed string `json:"on_malformed" bson:"on_malformed"`
+}
+
+// isValid needs the keys of the config when fields are listed.
+func (fe *fieldEncryption) isValid(config *Configuration) error {
+	switch fe.OnMalformed {
+	case "", "reject", "passthrough":
+	default:
+		return AppError{ErrorCode: "invalid_input", Message: "field_encryption on_malformed must be reject or passthrough."}
+	}
+	if config.keyRing == nil && (len(fe.RequestFields) > 0 || len(fe.ResponseFields) > 0) {
+		return AppError{ErrorCode: "invalid_input", Message: "field_encryption needs at least one key in the config file."}
+	}
+	return nil
+}
+
+func (fe *fieldEncryption) matchContentType(contentType string) bool {
+	contentTypes := fe.ContentTypes
+	if len(contentTypes) == 0 {
+		contentTypes = []string{"application/json"}
+	}
+	for _, val := range contentTypes {
+		if strings.EqualFold(strings.TrimSpace(contentType), val) {
+			return true
+		}
+	}
+	return false
+}
+
+// encryptBody returns the body with the listed fields encrypted. It returns
+// nil when the content type isn't configured and the body is forwarded as is.
+// The keys and the size limit are the ones of the config.
+func (fe *fieldEncryption) encryptBody(config *Configuration, contentType string, body []byte) ([]byte, error) {
+	if len(fe.RequestFields) == 0 || len(body) == 0 || !fe.matchContentType(contentType) {
+		return nil, nil
+	}
+	if int64(len(body)) > config.FieldEncryption.MaxBodyBytes {
+		return nil, errBodyTooLarge
+	}
+	return transformJSON(body, fe.RequestFields, func(plaintext []byte) (string, error) {
+		defer zero(plaintext)
+		return config.keyRing.encrypt(plaintext)
+	})
+}
+
+// decryptBody returns the body with the listed fields decrypted, values which
+// aren't envelopes are left untouched.
+func (fe *fieldEncryption) decryptBody(config *Configuration, contentType string, body []byte) ([]byte, error) {
+	if len(fe.ResponseFields) == 0 || len(body) == 0 || !fe.matchContentType(contentType) {
+		return nil, nil
+	}
+	return transformJSON(body, fe.ResponseFields, func(val []byte) (string, error) {
+		if !bytes.HasPrefix(val, []byte(envelopePrefix)) {
+			return string(val), nil
+		}
+		plaintext, err := config.keyRing.decrypt(string(val))
+		if err != nil {
+			return "", err
+		}
+		defer zero(plaintext)
+		return string(plaintext), nil
+	})
+}
+
+func transformJSON(body []byte, paths []string, fn func([]byte) (string, error)) ([]byte, error) {
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, errMalformedBody
+	}
+	for _, path := range paths {
+		if err := transformField(doc, strings.Split(path, "."), fn); err != nil {
+			return nil, err
+		}
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(doc); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// transformField replaces the value at path, missing fields are skipped.
+func transformField(node interface{}, path []string, fn func([]byte) (string, error)) error {
+	switch val := node.(type) {
+	case []interface{}:
+		for _, element := range val {
+			if err := transformField(element, path, fn); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		child, ok := val[path[0]]
+		if !ok || child == nil {
+			return nil
+		}
+		if len(path) > 1 {
+			return transformField(child, path[1:], fn)
+		}
+		var plaintext []byte
+		switch field := child.(type) {
+		case string:
+			plaintext = []byte(field)
+		case json.Number:
+			plaintext = []byte(field.String())
+		default:
+			return errUnsupportedValue
+		}
+		result, err := fn(plaintext)
+		if err != nil {
+			return err
+		}
+		val[path[0]] = result
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jasonsoft/napnap"
+)
+
+func testEncryptionKey(id string, b byte) EncryptionKey {
+	return EncryptionKey{ID: id, Secret: base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), 32)))}
+}
+
+// useTestKeyRing replaces the key ring of the config for one test.
+func useTestKeyRing(t *testing.T, keys ...EncryptionKey) *keyRing {
+	ring, err := newKeyRing(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withConfig(t, func(config *Configuration) {
+		config.keyRing = ring
+	})
+	return ring
+}
+
+func TestKeyRingRotation(t *testing.T) {
+	old, err := newKeyRing([]EncryptionKey{testEncryptionKey("k1", 'a')})
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope, err := old.encrypt([]byte("4111111111111111"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(envelope, "enc:v1:k1:") || strings.Contains(envelope, "4111") {
+		t.Fatalf("envelope = %s", envelope)
+	}
+
+	// the new key encrypts, the old one still decrypts
+	rotated, err := newKeyRing([]EncryptionKey{testEncryptionKey("k2", 'b'), testEncryptionKey("k1", 'a')})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := rotated.decrypt(envelope)
+	if err != nil || string(plaintext) != "4111111111111111" {
+		t.Fatalf("decrypt = %q, %v", plaintext, err)
+	}
+	envelope, err = rotated.encrypt([]byte("4111111111111111"))
+	if err != nil || !strings.HasPrefix(envelope, "enc:v1:k2:") {
+		t.Fatalf("envelope = %s, %v", envelope, err)
+	}
+	if _, err := old.decrypt(envelope); err != errUnknownKey {
+		t.Fatalf("err = %v, want the unknown key error", err)
+	}
+
+	// the key id is authenticated, the envelope can't be moved to another key
+	parts := strings.Split(envelope, ":")
+	parts[2] = "k1"
+	if _, err := rotated.decrypt(strings.Join(parts, ":")); err == nil {
+		t.Fatal("a changed key id must not decrypt")
+	}
+	for _, envelope := range []string{"plain", "enc:v1:k2", "enc:v1:k2:!:!"} {
+		if _, err := rotated.decrypt(envelope); err != errInvalidEnvelope {
+			t.Errorf("%s: err = %v, want the invalid envelope error", envelope, err)
+		}
+	}
+}
+
+func TestNewKeyRingValidatesTheKeys(t *testing.T) {
+	t.Setenv("BIFROST_TEST_FIELD_KEY", testEncryptionKey("", 'c').Secret)
+	if _, err := newKeyRing([]EncryptionKey{{ID: "env", Secret: "env:BIFROST_TEST_FIELD_KEY"}}); err != nil {
+		t.Fatalf("a key from the environment: %v", err)
+	}
+
+	invalid := []EncryptionKey{
+		{ID: "", Secret: testEncryptionKey("", 'a').Secret},
+		{ID: "a:b", Secret: testEncryptionKey("", 'a').Secret},
+		{ID: "short", Secret: base64.StdEncoding.EncodeToString([]byte("short"))},
+		{ID: "text", Secret: "not base64!"},
+		{ID: "missing", Secret: "env:BIFROST_TEST_MISSING_FIELD_KEY"},
+	}
+	for _, key := range invalid {
+		if _, err := newKeyRing([]EncryptionKey{key}); err == nil {
+			t.Errorf("key %q must be rejected", key.ID)
+		}
+	}
+}
+
+func TestEncryptBodyEncryptsTheListedFields(t *testing.T) {
+	ring := useTestKeyRing(t, testEncryptionKey("k1", 'a'))
+	fe := &fieldEncryption{RequestFields: []string{"card.pan", "card.cvv", "items.sku", "missing.field"}}
+
+	body := `{"card":{"pan":"4111","cvv":123},"items":[{"sku":"a"},{"sku":"b"}],"name":"<shop>"}`
+	sealed, err := fe.encryptBody(testGateway.currentConfig(), "application/json", []byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Card struct {
+			Pan string `json:"pan"`
+			Cvv string `json:"cvv"`
+		} `json:"card"`
+		Items []struct {
+			Sku string `json:"sku"`
+		} `json:"items"`
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(sealed, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Name != "<shop>" || !strings.Contains(string(sealed), `"<shop>"`) {
+		t.Fatalf("fields which aren't listed must be kept as is: %s", sealed)
+	}
+	want := map[string]string{doc.Card.Pan: "4111", doc.Card.Cvv: "123", doc.Items[0].Sku: "a", doc.Items[1].Sku: "b"}
+	for envelope, value := range want {
+		plaintext, err := ring.decrypt(envelope)
+		if err != nil || string(plaintext) != value {
+			t.Errorf("decrypt(%s) = %q, %v, want %q", envelope, plaintext, err, value)
+		}
+	}
+
+	if sealed, err := fe.encryptBody(testGateway.currentConfig(), "text/plain", []byte(body)); sealed != nil || err != nil {
+		t.Fatal("other content types must be forwarded as is")
+	}
+	if _, err := fe.encryptBody(testGateway.currentConfig(), "application/json", []byte(`{"card":{"pan":true}}`)); err != errUnsupportedValue {
+		t.Fatalf("err = %v, want the unsupported value error", err)
+	}
+	if _, err := fe.encryptBody(testGateway.currentConfig(), "application/json", []byte(`{"card":`)); err != errMalformedBody {
+		t.Fatalf("err = %v, want the malformed body error", err)
+	}
+	withConfig(t, func(config *Configuration) {
+		config.FieldEncryption.MaxBodyBytes = 10
+	})
+	if _, err := fe.encryptBody(testGateway.currentConfig(), "application/json", []byte(body)); err != errBodyTooLarge {
+		t.Fatalf("err = %v, want the body too large error", err)
+	}
+}
+
+func TestProxyEncryptsRequestFieldsAndDecryptsResponseFields(t *testing.T) {
+	ring := useTestKeyRing(t, testEncryptionKey("k1", 'a'))
+	received := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- string(body)
+		envelope, _ := ring.encrypt([]byte("4111"))
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"pan":"`+envelope+`","status":"stored"}`)
+	}))
+	defer upstream.Close()
+
+	reject := newTestAPI(t, "reject", upstream.URL)
+	reject.RequestPath = "/reject"
+	reject.FieldEncryption = &fieldEncryption{RequestFields: []string{"pan"}, ResponseFields: []string{"pan"}}
+	passthrough := newTestAPI(t, "passthrough", upstream.URL)
+	passthrough.RequestPath = "/passthrough"
+	passthrough.FieldEncryption = &fieldEncryption{RequestFields: []string{"pan"}, OnMalformed: "passthrough"}
+	server, _ := serveTestGateway(t, []*api{reject, passthrough})
+
+	resp, err := http.Post(server.URL+"/reject", "application/json", strings.NewReader(`{"pan":"4111"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	forwarded := <-received
+	if strings.Contains(forwarded, "4111") || !strings.Contains(forwarded, `"pan":"enc:v1:k1:`) {
+		t.Fatalf("the upstream got %s", forwarded)
+	}
+	if resp.StatusCode != 200 || string(body) != `{"pan":"4111","status":"stored"}` {
+		t.Fatalf("status = %d, body = %s", resp.StatusCode, body)
+	}
+
+	resp, err = http.Post(server.URL+"/reject", "application/json", strings.NewReader(`{"pan":`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Fatalf("malformed body with reject: status = %d, want 400", resp.StatusCode)
+	}
+
+	// a field which can't be encrypted is rejected instead of being forwarded
+	resp, err = http.Post(server.URL+"/reject", "application/json", strings.NewReader(`{"pan":{"number":"4111"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 400 || !strings.Contains(string(body), "invalid_input") {
+		t.Fatalf("unsupported value: status = %d, body = %s, want 400", resp.StatusCode, body)
+	}
+
+	resp, err = http.Post(server.URL+"/passthrough", "application/json", strings.NewReader(`{"pan":`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if forwarded := <-received; resp.StatusCode != 200 || forwarded != `{"pan":` {
+		t.Fatalf("malformed body with passthrough: status = %d, forwarded %s", resp.StatusCode, forwarded)
+	}
+}
+
+func TestEncryptRequestBodyZeroesThePlaintext(t *testing.T) {
+	useTestKeyRing(t, testEncryptionKey("k1", 'a'))
+	apiEntry := newTestAPI(t, "zero", "http://zero:8080")
+	apiEntry.FieldEncryption = &fieldEncryption{RequestFields: []string{"pan"}}
+	p := newProxy(testGateway, newAPIRouteTable([]*api{apiEntry}))
+
+	for _, body := range []string{`{"pan":"4111"}`, `{"pan":`, `{"pan":{"number":"4111"}}`} {
+		c, _, _ := napnap.CreateTestContext()
+		c.Request = httptest.NewRequest("POST", "/", nil)
+		c.Request.Header.Set("Content-Type", "application/json")
+		plaintext := []byte(body)
+		p.encryptRequestBody(c, apiEntry, plaintext)
+		if !bytes.Equal(plaintext, make([]byte, len(plaintext))) {
+			t.Errorf("%s: the plaintext body must be zeroed, got %q", body, plaintext)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jasonsoft/bifrost/internal/logging"
+	upstream "github.com/jasonsoft/bifrost/internal/proxy"
+	"github.com/jasonsoft/bifrost/internal/store"
+	"github.com/jasonsoft/napnap"
+)
+
+// Gateway owns the config, the repositories and the middlewares, New builds
+// them and Run serves the requests until Shutdown.
+type Gateway struct {
+	sync.Mutex
+	servers      []*http.Server
+	inflight     int64
+	shuttingDown int32
+	// timeouts of the servers, set before the first serve
+	timeouts ServerSetting
+
+	config     atomic.Value // *Configuration, swapped on SIGHUP
+	configPath string
+	app        *application
+	logger     *logger
+	metrics    *metrics
+	httpClient *http.Client
+
+	consumerRepo store.ConsumerRepository
+	tokenRepo    store.TokenRepository
+	apiRepo      APIRepository
+	corsRepo     store.CORSRepository
+	serviceRepo  store.ServiceRepository
+
+	routes   *apiRouteTable
+	cors     *store.GlobalCORS
+	services []*store.Service
+
+	gelfWriter         *logging.Writer // only set when the log target is gelf
+	auditLog           *auditLog
+	healthChecker      *healthChecker
+	circuitBreakers    *circuitBreakers
+	unmatchedReport    *unmatchedReport
+	configSync         *configSync
+	middlewares        *MiddlewareRegistry
+	plugins            []*loadedPlugin
+	upstreamTransports *upstream.Transports
+	dnsRefresher       *upstream.DNSRefresher
+	concurrencyLimits  *concurrencyLimits
+	mirrorPool         *mirrorPool
+	mirrorSpill        *spillStore
+	captureWriter      *captureWriter
+	certificate        *certificateFile
+	// stickySecret signs the sticky session cookies when the config file
+	// doesn't set sticky_session_secret
+	stickySecret []byte
+}
+
+// newGateway returns a gateway with the config and the parts which don't
+// depend on it, New adds the repositories and the apis.
+func newGateway(config *Configuration, app *application) *Gateway {
+	g := &Gateway{
+		app:               app,
+		logger:            newLog(app),
+		metrics:           newMetrics(),
+		middlewares:       newMiddlewareRegistry(),
+		concurrencyLimits: newConcurrencyLimits(),
+		plugins:           []*loadedPlugin{},
+		stickySecret:      newStickySecret(),
+	}
+	g.config.Store(config)
+	g.circuitBreakers = newCircuitBreakers(g.logger)
+	g.dnsRefresher = upstream.NewDNSRefresher(g.logger.infof, g.logger.errorf)
+	g.upstreamTransports = upstream.NewTransports(g.dnsRefresher, upstreamProxy)
+	g.healthChecker = newHealthChecker(g.logger, g.dnsRefresher)
+	return g
+}
+
+// serve blocks until the listener is closed. It returns nil when the
+// listener was closed by Shutdown.
+func (g *Gateway) serve(addr string, handler http.Handler, tlsConfig *tls.Config) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, withALPN(tlsConfig))
+	}
+	server := g.newServer(handler, tlsConfig == nil)
+	g.Lock()
+	if g.isShuttingDown() {
+		g.Unlock()
+		ln.Close()
+		return nil
+	}
+	g.servers = append(g.servers, server)
+	g.Unlock()
+
+	err = server.Serve(ln)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// newServer speaks http/1.1 and http/2, grpc clients need the latter. A
+// plaintext server accepts http/2 with prior knowledge (h2c) as well.
+func (g *Gateway) newServer(handler http.Handler, plaintext bool) *http.Server {
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(plaintext)
+	return &http.Server{
+		Handler:           withResponseController(handler),
+		Protocols:         &protocols,
+		ReadHeaderTimeout: time.Duration(g.timeouts.ReadHeaderTimeout) * time.Second,
+		ReadTimeout:       time.Duration(g.timeouts.ReadTimeout) * time.Second,
+		WriteTimeout:      time.Duration(g.timeouts.WriteTimeout) * time.Second,
+		IdleTimeout:       time.Duration(g.timeouts.IdleTimeout) * time.Second,
+	}
+}
+
+// withALPN offers http/2 during the tls handshake, the server only speaks it
+// when the client picked it there.
+func withALPN(config *tls.Config) *tls.Config {
+	if len(config.NextProtos) > 0 {
+		return config
+	}
+	result := config.Clone()
+	result.NextProtos = []string{"h2", "http/1.1"}
+	return result
+}
+
+func (g *Gateway) isShuttingDown() bool {
+	return atomic.LoadInt32(&g.shuttingDown) == 1
+}
+
+// Invoke counts the requests in flight and rejects new requests with 503 once
+// the shutdown has begun, e.g. requests of keep-alive connections.
+func (g *Gateway) Invoke(c *napnap.Context, next napnap.HandlerFunc) {
+	if g.isShuttingDown() {
+		c.RespHeader("Connection", "close")
+		g.writeError(c, 503, AppError{ErrorCode: "service_unavailable", Message: "The gateway is shutting down."})
+		return
+	}
+	atomic.AddInt64(&g.inflight, 1)
+	defer atomic.AddInt64(&g.inflight, -1)
+	next(c)
+}
+
+// Shutdown stops accepting connections, waits for the requests in flight and
+// the queued gelf messages, writes the dead letters to the fallback file and
+// closes the gelf connection and the repositories. It gives up when ctx is
+// done.
+func (g *Gateway) Shutdown(ctx context.Context) error {
+	g.Lock()
+	atomic.StoreInt32(&g.shuttingDown, 1)
+	servers := g.servers
+	g.Unlock()
+	// the gelf connection is closed even when ctx is done before the queued
+	// messages are sent
+	defer func() {
+		if g.gelfWriter != nil {
+			g.gelfWriter.Close()
+		}
+	}()
+
+	// the servers close their listeners and idle connections and wait for
+	// the connections which are active
+	errs := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) {
+			errs <- server.Shutdown(ctx)
+		}(server)
+	}
+	for range servers {
+		if err := <-errs; err != nil {
+			return err
+		}
+	}
+
+	// hijacked connections, e.g. websockets, aren't tracked by the servers
+	for atomic.LoadInt64(&g.inflight) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	if g.logger.queue != nil {
+		if err := g.logger.queue.Flush(ctx); err != nil {
+			return err
+		}
+	}
+	if g.logger.deadLetters != nil {
+		g.logger.deadLetters.flush()
+	}
+	if g.auditLog != nil {
+		g.auditLog.Close()
+	}
+	if closer, ok := g.consumerRepo.(io.Closer); ok {
+		closer.Close()
+	}
+	if closer, ok := g.tokenRepo.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package gateway
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jasonsoft/bifrost/internal/store"
+	"github.com/jasonsoft/napnap"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden responses in testdata/golden")
+
+const goldenRequestID = "6ba7b810-9dad-41d1-80b4-00c04fd430c8"
+
+// goldenTimestamp matches the timestamp of an error response, it's the only
+// part of a response which changes between runs.
+var goldenTimestamp = regexp.MustCompile(`"timestamp":"[^"]*"`)
+
+// serveGoldenGateway runs the apis behind the middlewares which every
+// request of the gateway passes.
+func serveGoldenGateway(t *testing.T, apis ...*api) *httptest.Server {
+	withConfig(t, func(config *Configuration) {
+		config.TrustIncomingRequestID = true
+	})
+	useTestRepos(t, newTestTokenStore(), store.NewConsumerMemStore())
+	useTestRoutes(t, apis...)
+	nap := napnap.New()
+	nap.ForwardRemoteIpAddress = false
+	nap.UseFunc(testGateway.requestIDMiddleware())
+	nap.Use(newApplicationLogMiddleware(testGateway, false))
+	nap.UseFunc(testGateway.identity)
+	nap.Use(newProxy(testGateway, testGateway.routes))
+	nap.UseFunc(testGateway.notFound)
+	server := httptest.NewServer(withResponseController(nap))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// dumpGoldenResponse writes the status, the headers in sorted order and the
+// body. Date changes on every run and is left out, the length of the
+// timestamp changes as well so Content-Length is written for the body
+// without it when it matches the body which was sent.
+func dumpGoldenResponse(resp *http.Response, body []byte) []byte {
+	normalized := goldenTimestamp.ReplaceAll(body, []byte(`"timestamp":"-"`))
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s\n", resp.Status)
+	names := []string{}
+	for name := range resp.Header {
+		if name != "Date" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		val := strings.Join(resp.Header[name], ", ")
+		if name == "Content-Length" && val == strconv.Itoa(len(body)) {
+			val = strconv.Itoa(len(normalized))
+		}
+		fmt.Fprintf(&buf, "%s: %s\n", name, val)
+	}
+	buf.WriteString("\n")
+	buf.Write(normalized)
+	return buf.Bytes()
+}
+
+// TestGoldenResponses keeps the http behavior of the gateway byte-identical
+// while the code moves into packages. Run with -update to record the
+// responses again after an intended change.
+func TestGoldenResponses(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Upstream", "orders")
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if r.URL.Path == "/orders/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, "upstream failed")
+			return
+		}
+		if r.Method == "POST" {
+			w.WriteHeader(http.StatusCreated)
+		}
+		fmt.Fprintf(w, "%s %s\nrequest id: %s\nforwarded for: %s\nbody: %s\n",
+			r.Method, r.URL.RequestURI(), r.Header.Get("X-Request-Id"), r.Header.Get("X-Forwarded-For"), body)
+	}))
+	defer upstream.Close()
+
+	orders := newRouteTestAPI(t, "orders", "/orders", func(a *api) {
+		a.TargetURL = upstream.URL
+		a.ResponseHeadersToAdd = map[string]string{"X-Gateway": "bifrost"}
+	})
+	private := newRouteTestAPI(t, "private", "/private", func(a *api) {
+		a.TargetURL = upstream.URL
+		a.Authorization = true
+	})
+	down := newRouteTestAPI(t, "down", "/down", func(a *api) {
+		a.TargetURL = "http://" + freeAddr(t)
+	})
+	server := serveGoldenGateway(t, orders, private, down)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+	}{
+		{"get", "GET", "/orders/7?expand=items", ""},
+		{"post", "POST", "/orders", `{"qty":2}`},
+		{"upstream_error", "GET", "/orders/fail", ""},
+		{"unauthorized", "GET", "/private/orders", ""},
+		{"unreachable", "GET", "/down", ""},
+		{"not_found", "GET", "/unknown", ""},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, server.URL+test.path, strings.NewReader(test.body))
+		req.Header.Set("X-Request-Id", goldenRequestID)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		got := dumpGoldenResponse(resp, body)
+
+		file := filepath.Join("testdata", "golden", test.name+".golden")
+		if *updateGolden {
+			if err := ioutil.WriteFile(file, got, 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("%s: %v, run the test with -update to record it", test.name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: response changed\n--- got\n%s\n--- want\n%s", test.name, got, want)
+		}
+	}
+}
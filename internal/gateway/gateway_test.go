@@ -0,0 +1,74 @@
+package gateway
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jasonsoft/bifrost/internal/store"
+)
+
+// freeAddr returns an address which was free a moment ago.
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestGatewayShutdownWaitsForRequests(t *testing.T) {
+	useTestRepos(t, newTestTokenStore(), store.NewConsumerMemStore())
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+
+	g := newGateway(testGateway.currentConfig(), testGateway.app)
+	addr := freeAddr(t)
+	served := make(chan error, 1)
+	go func() {
+		served <- g.serve(addr, handler, nil)
+	}()
+
+	response := make(chan string, 1)
+	go func() {
+		var resp *http.Response
+		var err error
+		for i := 0; i < 50; i++ {
+			if resp, err = http.Get("http://" + addr + "/"); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			response <- err.Error()
+			return
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		response <- string(body)
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := g.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-response; got != "done" {
+		t.Fatalf("response = %q, the request in flight must finish", got)
+	}
+	if err := <-served; err != nil {
+		t.Fatalf("serve = %v, want nil after shutdown", err)
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Fatal("the listener must be closed")
+	}
+}
@@ -0,0 +1,72 @@
+package gateway
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jasonsoft/bifrost/internal/logging"
+	"github.com/jasonsoft/bifrost/internal/store"
+)
+
+func TestGelfWriterUsesTheSchemeOfTheConnectionString(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	tcp := newGelfWriter("tcp://"+ln.Addr().String(), "", "", "")
+	defer tcp.Close()
+	if !tcp.IsTCP() || tcp.IsTLS() || tcp.ConnectionString != ln.Addr().String() {
+		t.Fatalf("config = %+v, want plain tcp", tcp.Config)
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	udp := newGelfWriter("udp://"+conn.LocalAddr().String(), "", "", "")
+	defer udp.Close()
+	if udp.IsTCP() {
+		t.Fatal("udp connection strings must not use tcp")
+	}
+}
+
+func TestShutdownClosesGelfWriterWhenFlushTimesOut(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	disconnected := make(chan struct{})
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		// the read ends when the writer closes the connection
+		ioutil.ReadAll(conn)
+		close(disconnected)
+	}()
+
+	g := newGateway(testGateway.currentConfig(), testGateway.app)
+	g.consumerRepo = store.NewConsumerMemStore()
+	g.tokenRepo = newTestTokenStore()
+	// nothing reads the queue so the flush can't finish
+	g.logger.queue = logging.NewQueue(0)
+	g.gelfWriter = logging.NewWriter(logging.Config{ConnectionString: ln.Addr().String(), Protocol: "tcp"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := g.Shutdown(ctx); err == nil {
+		t.Fatal("the shutdown must report the unflushed queue")
+	}
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		t.Fatal("the gelf writer must be closed on shutdown")
+	}
+}
@@ -0,0 +1,119 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	upstream "github.com/jasonsoft/bifrost/internal/proxy"
+	"github.com/jasonsoft/bifrost/internal/store"
+	"github.com/jasonsoft/napnap"
+)
+
+// protocolGRPC is the protocol of apis which proxy grpc calls. The request
+// and response bodies are streamed over http/2 and the trailers with
+// grpc-status and grpc-message are forwarded. Plaintext upstreams need h2c.
+//
+// The path of a grpc call names the method, so strip_request_path,
+// rewrite_pattern, target_path_template and redirect aren't supported. The
+// body is never buffered, which rules out mirror, retry, field_encryption,
+// verify_signature, decompress_response, decompress_request, cache and
+// max_request_body_bytes.
+// A call isn't resent to another upstream after a connection failure, the
+// client retries by its own grpc retry policy.
+const protocolGRPC = "grpc"
+
+func (a *api) isGRPC() bool {
+	return a.Protocol == protocolGRPC
+}
+
+// grpcUnsupported returns the first setting of the api which can't be used
+// with grpc, or empty when there is none.
+func (a *api) grpcUnsupported() string {
+	switch {
+	case a.StripRequestPath:
+		return "strip_request_path"
+	case len(a.RewritePattern) > 0:
+		return "rewrite_pattern"
+	case len(a.TargetPathTemplate) > 0:
+		return "target_path_template"
+	case a.Redirect:
+		return "redirect"
+	case a.Mirror != nil:
+		return "mirror"
+	case a.Retry != nil:
+		return "retry"
+	case a.FieldEncryption != nil:
+		return "field_encryption"
+	case a.VerifySignature:
+		return "verify_signature"
+	case a.DecompressResponse:
+		return "decompress_response"
+	case a.DecompressRequest:
+		return "decompress_request"
+	case a.Cache.Enabled:
+		return "cache"
+	case a.MaxRequestBodyBytes > 0:
+		return "max_request_body_bytes"
+	}
+	return ""
+}
+
+func isGRPCContentType(contentType string) bool {
+	return strings.HasPrefix(strings.ToLower(contentType), "application/grpc")
+}
+
+// proxyGRPC streams the call to the upstream and the response with its
+// trailers back. The api timeout is an idle timeout between two reads of the
+// response, the deadline of the call is sent by the client as grpc-timeout.
+func (p *proxy) proxyGRPC(c *napnap.Context, apiEntry *api, consumer store.Consumer, url string) error {
+	if !isGRPCContentType(c.Request.Header.Get("Content-Type")) {
+		p.gateway.writeError(c, 415, AppError{ErrorCode: "unsupported_media_type", Message: "The api only accepts grpc calls."})
+		return nil
+	}
+
+	outReq, err := http.NewRequest(c.Request.Method, url, c.Request.Body)
+	if err != nil {
+		panic(err)
+	}
+	outReq.ContentLength = c.Request.ContentLength
+
+	ctx, deadline, cancel := upstream.NewDeadline(c.Request.Context(), apiEntry.upstreamTimeout(p.gateway.currentConfig()))
+	defer cancel()
+	outReq = outReq.WithContext(withEgressProxy(ctx, apiEntry.egressProxySetting(p.gateway.currentConfig())))
+
+	if apiEntry.PreserveHost {
+		outReq.Host = c.Request.Host
+	}
+
+	p.copyHeader(outReq.Header, c.Request.Header)
+	p.removeHeader(outReq.Header)
+	p.setUpstreamHeader(c, apiEntry, consumer, outReq.Header)
+	outReq.Header.Set("Te", "trailers")
+
+	client, err := p.clientFor(apiEntry)
+	if err != nil {
+		p.writeBadGateway(c, err)
+		return err
+	}
+	resp, err := client.Do(outReq)
+	if err != nil {
+		if deadline.IsExpired() {
+			p.writeTimeout(c, url, deadline.Timeout())
+			return err
+		}
+		p.writeBadGateway(c, err)
+		return err
+	}
+	defer respClose(resp.Body)
+
+	// grpc errors are reported by grpc-status with http status 200, the
+	// circuit breaker only counts failures of the transport
+	if err := p.streamResponse(c, apiEntry, resp, deadline); err != nil {
+		return err
+	}
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("upstream status %d", resp.StatusCode)
+	}
+	return nil
+}
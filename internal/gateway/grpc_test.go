@@ -0,0 +1,121 @@
+package gateway
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// grpcFrame is a length-prefixed grpc message without compression.
+func grpcFrame(message string) []byte {
+	frame := make([]byte, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(message)))
+	copy(frame[5:], message)
+	return frame
+}
+
+// newGRPCUpstream echoes the message over h2c and answers with grpc-status
+// in the trailers like a grpc server.
+func newGRPCUpstream(t *testing.T) *httptest.Server {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("upstream got %s, want HTTP/2", r.Proto)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.WriteHeader(200)
+		w.Write(body)
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", "")
+	}))
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	upstream.Config.Protocols = &protocols
+	upstream.Start()
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+// serveGRPCGateway runs the proxy behind the server of the gateway, with tls
+// when tlsConfig is set.
+func serveGRPCGateway(t *testing.T, upstreamURL string, tlsConfig *tls.Config) string {
+	apiEntry := newTestAPI(t, "greeter", upstreamURL)
+	apiEntry.Protocol = protocolGRPC
+	apiEntry.H2C = true
+	if err := apiEntry.isValid(testGateway.currentConfig()); err != nil {
+		t.Fatal(err)
+	}
+	handler, _ := serveTestGateway(t, []*api{apiEntry})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, withALPN(tlsConfig))
+	}
+	server := newGateway(testGateway.currentConfig(), testGateway.app).newServer(handler.Config.Handler, tlsConfig == nil)
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Close() })
+	if tlsConfig != nil {
+		return "https://" + ln.Addr().String()
+	}
+	return "http://" + ln.Addr().String()
+}
+
+func callGreeter(t *testing.T, client *http.Client, gatewayURL string) {
+	req, _ := http.NewRequest("POST", gatewayURL+"/helloworld.Greeter/SayHello", bytes.NewReader(grpcFrame("bifrost")))
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("gateway answered with %s, grpc needs HTTP/2", resp.Proto)
+	}
+	if !bytes.Equal(body, grpcFrame("bifrost")) {
+		t.Fatalf("body = %q, want the echoed frame", body)
+	}
+	if status := resp.Trailer.Get("Grpc-Status"); status != "0" {
+		t.Fatalf("grpc-status trailer = %q, want 0", status)
+	}
+}
+
+func TestGRPCOverH2C(t *testing.T) {
+	upstream := newGRPCUpstream(t)
+	gatewayURL := serveGRPCGateway(t, upstream.URL, nil)
+
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: &protocols}}
+	callGreeter(t, client, gatewayURL)
+}
+
+func TestGRPCOverTLS(t *testing.T) {
+	upstream := newGRPCUpstream(t)
+
+	// borrow the test certificate of httptest, the gateway config has no
+	// NextProtos like the one in main
+	certServer := httptest.NewTLSServer(http.NotFoundHandler())
+	defer certServer.Close()
+	tlsConfig := &tls.Config{Certificates: certServer.TLS.Certificates}
+	gatewayURL := serveGRPCGateway(t, upstream.URL, tlsConfig)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(certServer.Certificate())
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots},
+		ForceAttemptHTTP2: true,
+	}}
+	callGreeter(t, client, gatewayURL)
+}
@@ -0,0 +1,198 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxHealthBodyBytes = 64 * 1024
+	maxSelectorDepth   = 16
+	maxPatternLength   = 256
+)
+
+var errSelectorDepth = errors.New("selector is too deep")
+
+// healthAssertion checks the body of a health check response. Selector picks
+// a value of a json body, e.g. "checks.database.status" or "items[0].name",
+// and the value must equal Equals or match Regex. Without a selector the
+// whole body must contain Contains.
+type healthAssertion struct {
+	Selector string `json:"selector,omitempty" bson:"selector,omitempty"`
+	Equals   string `json:"equals,omitempty" bson:"equals,omitempty"`
+	Regex    string `json:"regex,omitempty" bson:"regex,omitempty"`
+	Contains string `json:"contains,omitempty" bson:"contains,omitempty"`
+}
+
+func (a *healthAssertion) isValid() error {
+	if len(a.Selector) == 0 && len(a.Contains) == 0 {
+		return errors.New("health check assertion needs a selector or contains")
+	}
+	if len(a.Selector) > 0 {
+		if len(a.Equals) == 0 && len(a.Regex) == 0 {
+			return errors.New("health check assertion needs equals or regex")
+		}
+		if _, err := parseSelector(a.Selector); err != nil {
+			return err
+		}
+	}
+	if len(a.Regex) > maxPatternLength {
+		return errors.New("health check assertion regex is too long")
+	}
+	if _, err := regexp.Compile(a.Regex); err != nil {
+		return err
+	}
+	return nil
+}
+
+// assert returns why the body doesn't satisfy the assertion. doc is nil when
+// the body isn't json.
+func (a *healthAssertion) assert(body []byte, doc interface{}) error {
+	if len(a.Selector) == 0 {
+		if !bytes.Contains(body, []byte(a.Contains)) {
+			return fmt.Errorf("body doesn't contain '%s'", a.Contains)
+		}
+		return nil
+	}
+	if doc == nil {
+		return fmt.Errorf("%s can't be read, the body isn't json", a.Selector)
+	}
+	val, ok, err := selectJSON(doc, a.Selector)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s was missing", a.Selector)
+	}
+	actual := jsonString(val)
+	if len(a.Equals) > 0 && actual != a.Equals {
+		return fmt.Errorf("%s was '%s', expected '%s'", a.Selector, actual, a.Equals)
+	}
+	if len(a.Regex) > 0 {
+		re, err := regexp.Compile(a.Regex)
+		if err != nil {
+			return err
+		}
+		if !re.MatchString(actual) {
+			return fmt.Errorf("%s was '%s', expected to match '%s'", a.Selector, actual, a.Regex)
+		}
+	}
+	return nil
+}
+
+// assertBody evaluates the assertions of the health check. Mode "any"
+// passes when one assertion passes, otherwise all of them must pass.
+func (hc *healthCheck) assertBody(body []byte) error {
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if decoder.Decode(&doc) != nil {
+		doc = nil
+	}
+
+	var failures []string
+	for _, assertion := range hc.Assertions {
+		err := assertion.assert(body, doc)
+		if err == nil {
+			if hc.AssertionMode == "any" {
+				return nil
+			}
+			continue
+		}
+		if hc.AssertionMode != "any" {
+			return err
+		}
+		failures = append(failures, err.Error())
+	}
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+type selectorSegment struct {
+	key   string
+	index int // -1 when the segment is a key
+}
+
+// parseSelector splits "checks.items[1].status" into keys and array indexes.
+func parseSelector(selector string) ([]selectorSegment, error) {
+	result := []selectorSegment{}
+	for _, part := range strings.Split(selector, ".") {
+		key := part
+		if i := strings.IndexByte(part, '['); i >= 0 {
+			key = part[:i]
+		}
+		if len(key) > 0 {
+			result = append(result, selectorSegment{key: key, index: -1})
+		}
+		rest := part[len(key):]
+		for len(rest) > 0 {
+			end := strings.IndexByte(rest, ']')
+			if rest[0] != '[' || end < 0 {
+				return nil, fmt.Errorf("selector '%s' is invalid", selector)
+			}
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("selector '%s' has an invalid index", selector)
+			}
+			result = append(result, selectorSegment{index: index})
+			rest = rest[end+1:]
+		}
+		if len(key) == 0 && len(part) == 0 {
+			return nil, fmt.Errorf("selector '%s' is invalid", selector)
+		}
+	}
+	if len(result) > maxSelectorDepth {
+		return nil, errSelectorDepth
+	}
+	return result, nil
+}
+
+// selectJSON returns the value at selector and whether it exists.
+func selectJSON(doc interface{}, selector string) (interface{}, bool, error) {
+	segments, err := parseSelector(selector)
+	if err != nil {
+		return nil, false, err
+	}
+	node := doc
+	for _, segment := range segments {
+		if segment.index < 0 {
+			obj, ok := node.(map[string]interface{})
+			if !ok {
+				return nil, false, nil
+			}
+			node, ok = obj[segment.key]
+			if !ok {
+				return nil, false, nil
+			}
+			continue
+		}
+		arr, ok := node.([]interface{})
+		if !ok || segment.index >= len(arr) {
+			return nil, false, nil
+		}
+		node = arr[segment.index]
+	}
+	return node, true, nil
+}
+
+func jsonString(val interface{}) string {
+	switch v := val.(type) {
+	case nil:
+		return "null"
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	b, _ := json.Marshal(val)
+	return string(b)
+}
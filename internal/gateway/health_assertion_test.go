@@ -0,0 +1,129 @@
+package gateway
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSelectJSON(t *testing.T) {
+	body := []byte(`{"checks":{"database":{"status":"up","latency":12.5}},"items":[{"name":"a"},{"name":"b","tags":["x","y"]}],"ready":true,"empty":null}`)
+	hc := &healthCheck{}
+	tests := []struct {
+		selector string
+		equals   string
+		ok       bool
+	}{
+		{"checks.database.status", "up", true},
+		{"checks.database.latency", "12.5", true},
+		{"items[1].name", "b", true},
+		{"items[1].tags[0]", "x", true},
+		{"ready", "true", true},
+		{"empty", "null", true},
+		{"checks.database", `{"latency":12.5,"status":"up"}`, true},
+		{"checks.cache.status", "", false},
+		{"items[2].name", "", false},
+		{"ready.value", "", false},
+	}
+	for _, test := range tests {
+		hc.Assertions = []*healthAssertion{{Selector: test.selector, Equals: test.equals}}
+		if !test.ok {
+			hc.Assertions[0].Equals = "anything"
+		}
+		err := hc.assertBody(body)
+		if test.ok && err != nil {
+			t.Errorf("%s: %v", test.selector, err)
+		}
+		if !test.ok && (err == nil || !strings.Contains(err.Error(), "missing")) {
+			t.Errorf("%s: err = %v, want missing", test.selector, err)
+		}
+	}
+}
+
+func TestHealthAssertionModes(t *testing.T) {
+	body := []byte(`{"status":"degraded","version":"1.4.2"}`)
+	assertions := []*healthAssertion{
+		{Selector: "status", Equals: "up"},
+		{Selector: "version", Regex: `^1\.4\.`},
+		{Contains: "version"},
+	}
+
+	all := &healthCheck{Assertions: assertions}
+	if err := all.assertBody(body); err == nil || err.Error() != "status was 'degraded', expected 'up'" {
+		t.Fatalf("all: err = %v", err)
+	}
+	anyMode := &healthCheck{Assertions: assertions, AssertionMode: "any"}
+	if err := anyMode.assertBody(body); err != nil {
+		t.Fatalf("any: %v", err)
+	}
+	anyMode.Assertions = assertions[:1]
+	if err := anyMode.assertBody(body); err == nil {
+		t.Fatal("any: one failing assertion must fail")
+	}
+
+	plain := &healthCheck{Assertions: []*healthAssertion{{Selector: "status", Equals: "up"}}}
+	if err := plain.assertBody([]byte("OK")); err == nil || !strings.Contains(err.Error(), "isn't json") {
+		t.Fatalf("a selector on a body which isn't json: err = %v", err)
+	}
+	plain.Assertions = []*healthAssertion{{Contains: "OK"}}
+	if err := plain.assertBody([]byte("OK")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHealthAssertionIsValid(t *testing.T) {
+	deep := strings.Repeat("a.", maxSelectorDepth) + "a"
+	invalid := []*healthAssertion{
+		{},
+		{Selector: "status"},
+		{Selector: "items[", Equals: "x"},
+		{Selector: "items[-1]", Equals: "x"},
+		{Selector: "a..b", Equals: "x"},
+		{Selector: deep, Equals: "x"},
+		{Selector: "status", Regex: "("},
+		{Selector: "status", Regex: strings.Repeat("a", maxPatternLength+1)},
+	}
+	for _, assertion := range invalid {
+		if assertion.isValid() == nil {
+			t.Errorf("%+v must be invalid", assertion)
+		}
+	}
+	hc := &healthCheck{Assertions: []*healthAssertion{{Selector: "status", Equals: "up"}}, AssertionMode: "some"}
+	if hc.isValid() == nil {
+		t.Error("an unknown assertion mode must be invalid")
+	}
+	hc = &healthCheck{Assertions: []*healthAssertion{nil}}
+	if hc.isValid() == nil {
+		t.Error("a null assertion must be invalid")
+	}
+}
+
+func TestHealthCheckFailsOnAssertion(t *testing.T) {
+	status := "down"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"status":"`+status+`"}`)
+	}))
+	defer upstream.Close()
+
+	checker := newHealthChecker(testGateway.logger, testGateway.dnsRefresher)
+	checker.targets[upstream.URL] = &targetHealth{URL: upstream.URL, Up: true}
+	config := &healthCheck{
+		Timeout:            1,
+		UnhealthyThreshold: 1,
+		Assertions:         []*healthAssertion{{Selector: "status", Equals: "up"}},
+	}
+	checker.check(config, upstream.URL, nil)
+	health := checker.status(upstream.URL)
+	if health.Up || health.LastError != "status was 'down', expected 'up'" {
+		t.Fatalf("health = %+v, want down by the assertion", health)
+	}
+
+	status = "up"
+	checker.check(config, upstream.URL, nil)
+	checker.check(config, upstream.URL, nil)
+	if !checker.isUp(upstream.URL) {
+		t.Fatal("the target must be up once the assertion passes")
+	}
+}
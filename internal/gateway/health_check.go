@@ -0,0 +1,283 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	upstream "github.com/jasonsoft/bifrost/internal/proxy"
+	"github.com/jasonsoft/napnap"
+)
+
+// healthCheck configures active health checks for the targets of an api.
+type healthCheck struct {
+	Path               string `json:"path" bson:"path"`
+	Interval           int    `json:"interval" bson:"interval"` // seconds
+	Timeout            int    `json:"timeout" bson:"timeout"`   // seconds
+	HealthyThreshold   int    `json:"healthy_threshold" bson:"healthy_threshold"`
+	UnhealthyThreshold int    `json:"unhealthy_threshold" bson:"unhealthy_threshold"`
+	// Assertions check the response body in addition to the status code.
+	Assertions    []*healthAssertion `json:"assertions,omitempty" bson:"assertions,omitempty"`
+	AssertionMode string             `json:"assertion_mode,omitempty" bson:"assertion_mode,omitempty"` // all (default) or any
+}
+
+func (hc *healthCheck) isValid() error {
+	switch hc.AssertionMode {
+	case "", "all", "any":
+	default:
+		return errors.New("health check assertion_mode must be all or any")
+	}
+	for _, assertion := range hc.Assertions {
+		if assertion == nil {
+			return errors.New("health check assertion can't be null")
+		}
+		if err := assertion.isValid(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (hc *healthCheck) interval() time.Duration {
+	if hc.Interval <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(hc.Interval) * time.Second
+}
+
+func (hc *healthCheck) timeout() time.Duration {
+	if hc.Timeout <= 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(hc.Timeout) * time.Second
+}
+
+func (hc *healthCheck) healthyThreshold() int {
+	if hc.HealthyThreshold <= 0 {
+		return 2
+	}
+	return hc.HealthyThreshold
+}
+
+func (hc *healthCheck) unhealthyThreshold() int {
+	if hc.UnhealthyThreshold <= 0 {
+		return 3
+	}
+	return hc.UnhealthyThreshold
+}
+
+type targetHealth struct {
+	URL       string    `json:"url"`
+	Up        bool      `json:"up"`
+	Successes int       `json:"successes"`
+	Failures  int       `json:"failures"`
+	LastError string    `json:"last_error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+type targetHealthCollection struct {
+	Count   int             `json:"count"`
+	Targets []*targetHealth `json:"targets"`
+}
+
+// healthChecker probes targets periodically and remembers which are down.
+// Targets are keyed by url so the state survives api reloads.
+type healthChecker struct {
+	sync.RWMutex
+	client  *http.Client
+	targets map[string]*targetHealth
+	logger  *logger
+}
+
+func newHealthChecker(logger *logger, refresher *upstream.DNSRefresher) *healthChecker {
+	transport := &http.Transport{
+		Proxy:               upstreamProxy,
+		MaxIdleConnsPerHost: 2,
+	}
+	refresher.Watch(transport)
+	return &healthChecker{
+		client: &http.Client{
+			Transport: transport,
+		},
+		targets: map[string]*targetHealth{},
+		logger:  logger,
+	}
+}
+
+// isUp reports whether the target may receive traffic. Targets which
+// haven't been checked yet are treated as up.
+func (hc *healthChecker) isUp(targetURL string) bool {
+	hc.RLock()
+	defer hc.RUnlock()
+	health, ok := hc.targets[targetURL]
+	if !ok {
+		return true
+	}
+	return health.Up
+}
+
+func (hc *healthChecker) status(targetURL string) *targetHealth {
+	hc.RLock()
+	defer hc.RUnlock()
+	health, ok := hc.targets[targetURL]
+	if !ok {
+		return &targetHealth{URL: targetURL, Up: true}
+	}
+	result := *health
+	return &result
+}
+
+// run checks the targets of the apis in routes, config is read for the
+// egress proxy of every check.
+func (hc *healthChecker) run(routes RouteTable, config func() *Configuration) {
+	for {
+		for _, apiEntry := range routes.All() {
+			if apiEntry.HealthCheck == nil {
+				continue
+			}
+			for _, target := range apiEntry.targets() {
+				if hc.isDue(target.URL, apiEntry.HealthCheck.interval()) {
+					go hc.check(apiEntry.HealthCheck, target.URL, apiEntry.egressProxySetting(config()))
+				}
+			}
+		}
+		time.Sleep(1 * time.Second)
+	}
+}
+
+func (hc *healthChecker) isDue(targetURL string, interval time.Duration) bool {
+	hc.Lock()
+	defer hc.Unlock()
+	health, ok := hc.targets[targetURL]
+	if !ok {
+		health = &targetHealth{URL: targetURL, Up: true}
+		hc.targets[targetURL] = health
+	}
+	if time.Since(health.CheckedAt) < interval {
+		return false
+	}
+	// mark it now so the target isn't probed twice
+	health.CheckedAt = time.Now().UTC()
+	return true
+}
+
+// prune forgets the targets which aren't health checked by the apis anymore,
+// a target which comes back later starts as up again.
+func (hc *healthChecker) prune(apis []*api) {
+	checked := map[string]bool{}
+	for _, apiEntry := range apis {
+		if apiEntry.HealthCheck == nil {
+			continue
+		}
+		for _, target := range apiEntry.targets() {
+			checked[target.URL] = true
+		}
+	}
+	hc.Lock()
+	defer hc.Unlock()
+	for targetURL := range hc.targets {
+		if !checked[targetURL] {
+			delete(hc.targets, targetURL)
+		}
+	}
+}
+
+func (hc *healthCheck) url(targetURL string) string {
+	path := hc.Path
+	if len(path) == 0 {
+		path = "/"
+	}
+	return strings.TrimSuffix(targetURL, "/") + "/" + strings.TrimPrefix(path, "/")
+}
+
+func (hc *healthChecker) check(config *healthCheck, targetURL string, egress *egressProxy) {
+	healthy := false
+	reason := ""
+	client := *hc.client
+	client.Timeout = config.timeout()
+	var resp *http.Response
+	req, err := http.NewRequest("GET", config.url(targetURL), nil)
+	if err == nil {
+		resp, err = client.Do(req.WithContext(withEgressProxy(req.Context(), egress)))
+	}
+	if err == nil {
+		healthy = resp.StatusCode >= 200 && resp.StatusCode < 400
+		if !healthy {
+			reason = fmt.Sprintf("status code was %d", resp.StatusCode)
+		} else if len(config.Assertions) > 0 {
+			// the body is capped so a huge response can't stall the checker
+			body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxHealthBodyBytes))
+			if err == nil {
+				err = config.assertBody(body)
+			}
+			if err != nil {
+				healthy = false
+				reason = err.Error()
+			}
+		}
+		respClose(resp.Body)
+	} else {
+		reason = err.Error()
+	}
+
+	hc.Lock()
+	defer hc.Unlock()
+	health, ok := hc.targets[targetURL]
+	if !ok {
+		// the target was removed while it was probed
+		return
+	}
+	if healthy {
+		health.Successes++
+		health.Failures = 0
+		health.LastError = ""
+		if !health.Up && health.Successes >= config.healthyThreshold() {
+			health.Up = true
+			hc.logger.infof("target is up: %s", targetURL)
+			hc.logger.writeEventLog("health_check.target_up", map[string]interface{}{
+				"target": targetURL,
+			})
+		}
+		return
+	}
+	health.Failures++
+	health.Successes = 0
+	health.LastError = reason
+	if health.Up && health.Failures >= config.unhealthyThreshold() {
+		health.Up = false
+		hc.logger.infof("target is down: %s, %s", targetURL, reason)
+		hc.logger.writeEventLog("health_check.target_down", map[string]interface{}{
+			"target": targetURL,
+			"reason": reason,
+		})
+	}
+}
+
+func (g *Gateway) getAPIHealthEndpoint(c *napnap.Context) {
+	apiID := c.Param("api_id")
+
+	var result *api
+	for _, api := range g.routes.All() {
+		if api.ID == apiID || api.Name == apiID {
+			result = api
+			break
+		}
+	}
+	if result == nil {
+		panic(AppError{ErrorCode: "not_found", Message: "api was not found"})
+	}
+
+	collection := targetHealthCollection{
+		Targets: []*targetHealth{},
+	}
+	for _, target := range result.targets() {
+		collection.Targets = append(collection.Targets, g.healthChecker.status(target.URL))
+	}
+	collection.Count = len(collection.Targets)
+	c.JSON(200, collection)
+}
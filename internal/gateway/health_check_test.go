@@ -0,0 +1,54 @@
+package gateway
+
+import (
+	"testing"
+)
+
+func TestHealthCheckerPrunesRemovedTargets(t *testing.T) {
+	checker := newHealthChecker(testGateway.logger, testGateway.dnsRefresher)
+	checker.targets["http://removed:8080"] = &targetHealth{URL: "http://removed:8080", Up: false, Failures: 3}
+	checker.targets["http://kept:8080"] = &targetHealth{URL: "http://kept:8080", Up: false, Failures: 3}
+	checker.targets["http://unchecked:8080"] = &targetHealth{URL: "http://unchecked:8080", Up: false, Failures: 3}
+
+	kept := newTestAPI(t, "kept", "http://kept:8080")
+	kept.HealthCheck = &healthCheck{}
+	unchecked := newTestAPI(t, "unchecked", "http://unchecked:8080")
+	checker.prune([]*api{kept, unchecked})
+
+	if len(checker.targets) != 1 {
+		t.Fatalf("%d targets are kept, want 1", len(checker.targets))
+	}
+	if checker.isUp("http://kept:8080") {
+		t.Fatal("the state of a checked target must be kept")
+	}
+	if !checker.isUp("http://removed:8080") || !checker.isUp("http://unchecked:8080") {
+		t.Fatal("a target which isn't checked anymore must be up")
+	}
+}
+
+func TestLoadRoutesPrunesHealthState(t *testing.T) {
+	previous := testGateway.routes.All()
+	t.Cleanup(func() {
+		testGateway.loadRoutes(previous)
+	})
+	apiEntry := newTestAPI(t, "health", "http://health-target:8080")
+	apiEntry.HealthCheck = &healthCheck{}
+	testGateway.loadRoutes([]*api{apiEntry})
+	testGateway.healthChecker.Lock()
+	testGateway.healthChecker.targets["http://health-target:8080"] = &targetHealth{URL: "http://health-target:8080"}
+	testGateway.healthChecker.Unlock()
+
+	testGateway.loadRoutes([]*api{newTestAPI(t, "health", "http://other-target:8080")})
+	if !testGateway.healthChecker.isUp("http://health-target:8080") {
+		t.Fatal("the removed target must be forgotten when the apis are loaded")
+	}
+}
+
+func TestHealthCheckIgnoresPrunedTarget(t *testing.T) {
+	checker := newHealthChecker(testGateway.logger, testGateway.dnsRefresher)
+	// the result of a probe which finished after the target was removed
+	checker.check(&healthCheck{Timeout: 1}, "http://127.0.0.1:1", nil)
+	if len(checker.targets) != 0 {
+		t.Fatal("a removed target must not be added again")
+	}
+}
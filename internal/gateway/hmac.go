@@ -0,0 +1,129 @@
+package gateway
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jasonsoft/bifrost/internal/store"
+	"github.com/jasonsoft/napnap"
+)
+
+// HMACMiddleware verifies the signature of requests to apis with
+// verify_signature. The client sends X-Timestamp in unix seconds and
+//
+//	X-Signature: hex(HMAC-SHA256(consumer.hmac_secret, method + path + timestamp + body))
+//
+// where path includes the query string. A timestamp outside of the window
+// or a signature which was already used is rejected to prevent replays.
+type HMACMiddleware struct {
+	gateway *Gateway
+	routes  RouteTable
+	window  time.Duration
+	seen    *seenSignatures
+}
+
+func newHMACMiddleware(g *Gateway, routes RouteTable, window time.Duration) *HMACMiddleware {
+	return &HMACMiddleware{
+		gateway: g,
+		routes:  routes,
+		window:  window,
+		seen:    newSeenSignatures(),
+	}
+}
+
+func (m *HMACMiddleware) Invoke(c *napnap.Context, next napnap.HandlerFunc) {
+	apiEntry := m.routes.Match(c.Request.Host, c.Request.URL.Path, c.Request.Header)
+	if apiEntry == nil || !apiEntry.VerifySignature {
+		next(c)
+		return
+	}
+
+	consumer := c.MustGet("consumer").(store.Consumer)
+	if !consumer.IsAuthenticated() || len(consumer.HMACSecret) == 0 {
+		m.reject(c, "the consumer doesn't have a hmac secret")
+		return
+	}
+
+	timestamp := c.RequestHeader("X-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		m.reject(c, "X-Timestamp is invalid")
+		return
+	}
+	age := time.Since(time.Unix(seconds, 0))
+	if age > m.window || age < -m.window {
+		m.reject(c, "X-Timestamp is outside of the window")
+		return
+	}
+
+	signature, err := hex.DecodeString(c.RequestHeader("X-Signature"))
+	if err != nil || len(signature) == 0 {
+		m.reject(c, "X-Signature is invalid")
+		return
+	}
+
+	// the body is put back for the proxy
+	body, ok := m.gateway.readRequestBody(c, apiEntry, consumer, nil)
+	if !ok {
+		return
+	}
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	mac := hmac.New(sha256.New, []byte(consumer.HMACSecret))
+	mac.Write([]byte(c.Request.Method + c.Request.URL.RequestURI() + timestamp))
+	mac.Write(body)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		m.reject(c, "signature doesn't match")
+		return
+	}
+	if !m.seen.add(consumer.ID+":"+hex.EncodeToString(signature), 2*m.window) {
+		m.reject(c, "signature was already used")
+		return
+	}
+	next(c)
+}
+
+func (m *HMACMiddleware) reject(c *napnap.Context, reason string) {
+	c.Set("error", reason)
+	m.gateway.writeError(c, 401, AppError{ErrorCode: "invalid_signature", Message: "The request signature is invalid."})
+}
+
+// seenSignatures remembers the signatures until they are outside of the window.
+type seenSignatures struct {
+	sync.Mutex
+	entries   map[string]time.Time
+	cleanedAt time.Time
+}
+
+func newSeenSignatures() *seenSignatures {
+	return &seenSignatures{
+		entries:   map[string]time.Time{},
+		cleanedAt: time.Now(),
+	}
+}
+
+// add returns false when the signature is already known.
+func (s *seenSignatures) add(key string, ttl time.Duration) bool {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	if now.Sub(s.cleanedAt) > ttl {
+		for k, expiredAt := range s.entries {
+			if now.After(expiredAt) {
+				delete(s.entries, k)
+			}
+		}
+		s.cleanedAt = now
+	}
+	if expiredAt, ok := s.entries[key]; ok && now.Before(expiredAt) {
+		return false
+	}
+	s.entries[key] = now.Add(ttl)
+	return true
+}
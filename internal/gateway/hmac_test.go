@@ -0,0 +1,142 @@
+package gateway
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jasonsoft/bifrost/internal/store"
+	"github.com/jasonsoft/napnap"
+)
+
+func sign(secret string, method string, uri string, timestamp string, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + uri + timestamp + body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// serveSigned runs the hmac middleware for the consumer, it returns the
+// status, the body the next handler got and the reason of a rejection.
+func serveSigned(m *HMACMiddleware, consumer store.Consumer, timestamp string, signature string, body string) (int, string, string) {
+	nap := napnap.New()
+	var reason string
+	nap.UseFunc(func(c *napnap.Context, next napnap.HandlerFunc) {
+		c.Set("request-id", "test")
+		c.Set("consumer", consumer)
+		next(c)
+		if err, exists := c.Get("error"); exists {
+			reason = err.(string)
+		}
+	})
+	var received []byte
+	nap.Use(m)
+	nap.UseFunc(func(c *napnap.Context, next napnap.HandlerFunc) {
+		received, _ = ioutil.ReadAll(c.Request.Body)
+		c.SetStatus(200)
+	})
+
+	req := httptest.NewRequest("POST", "/orders?page=1", strings.NewReader(body))
+	req.Header.Set("X-Timestamp", timestamp)
+	req.Header.Set("X-Signature", signature)
+	w := httptest.NewRecorder()
+	nap.ServeHTTP(w, req)
+	return w.Code, string(received), reason
+}
+
+func TestHMACVerifiesTheSignature(t *testing.T) {
+	apiEntry := newTestAPI(t, "orders", "http://orders:8080")
+	apiEntry.VerifySignature = true
+	m := newHMACMiddleware(testGateway, newAPIRouteTable([]*api{apiEntry}), 5*time.Minute)
+	consumer := store.Consumer{ID: "consumer-1", HMACSecret: "s3cret"}
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	body := `{"item":"book"}`
+
+	status, received, reason := serveSigned(m, consumer, now, sign("s3cret", "POST", "/orders?page=1", now, body), body)
+	if status != 200 || received != body {
+		t.Fatalf("status = %d, reason = %s, the upstream must get the body %s, got %s", status, reason, body, received)
+	}
+
+	for _, test := range []struct {
+		name      string
+		consumer  store.Consumer
+		signature string
+		body      string
+		reason    string
+	}{
+		{"wrong secret", consumer, sign("guess", "POST", "/orders?page=1", now, body), body, "signature doesn't match"},
+		{"changed body", consumer, sign("s3cret", "POST", "/orders?page=1", now, body), `{"item":"car"}`, "signature doesn't match"},
+		{"other query", consumer, sign("s3cret", "POST", "/orders?page=2", now, body), body, "signature doesn't match"},
+		{"not hex", consumer, "zz", body, "X-Signature is invalid"},
+		{"anonymous", store.Consumer{}, sign("s3cret", "POST", "/orders?page=1", now, body), body, "the consumer doesn't have a hmac secret"},
+	} {
+		status, _, reason := serveSigned(m, test.consumer, now, test.signature, test.body)
+		if status != 401 || reason != test.reason {
+			t.Errorf("%s: status = %d, reason = %q, want 401 and %q", test.name, status, reason, test.reason)
+		}
+	}
+
+	unsigned := newTestAPI(t, "unsigned", "http://unsigned:8080")
+	unsigned.RequestPath = "/orders"
+	if status, _, _ := serveSigned(newHMACMiddleware(testGateway, newAPIRouteTable([]*api{unsigned}), time.Minute), store.Consumer{}, "", "", body); status != 200 {
+		t.Fatalf("status = %d, an api without verify_signature must not be checked", status)
+	}
+}
+
+func TestHMACRejectsReplays(t *testing.T) {
+	apiEntry := newTestAPI(t, "orders", "http://orders:8080")
+	apiEntry.VerifySignature = true
+	window := 5 * time.Minute
+	m := newHMACMiddleware(testGateway, newAPIRouteTable([]*api{apiEntry}), window)
+	consumer := store.Consumer{ID: "consumer-1", HMACSecret: "s3cret"}
+	signed := func(at time.Time) (string, string) {
+		timestamp := strconv.FormatInt(at.Unix(), 10)
+		return timestamp, sign("s3cret", "POST", "/orders?page=1", timestamp, "")
+	}
+
+	// inside the window a signature is accepted once
+	timestamp, signature := signed(time.Now().Add(-window / 2))
+	if status, _, reason := serveSigned(m, consumer, timestamp, signature, ""); status != 200 {
+		t.Fatalf("status = %d, reason = %s", status, reason)
+	}
+	status, _, reason := serveSigned(m, consumer, timestamp, signature, "")
+	if status != 401 || reason != "signature was already used" {
+		t.Fatalf("replay: status = %d, reason = %q", status, reason)
+	}
+	// another consumer with the same secret has its own signatures
+	if status, _, _ := serveSigned(m, store.Consumer{ID: "consumer-2", HMACSecret: "s3cret"}, timestamp, signature, ""); status != 200 {
+		t.Fatalf("status = %d, the signatures are remembered per consumer", status)
+	}
+
+	// outside the window it's rejected before the signature is remembered
+	for _, at := range []time.Time{time.Now().Add(-window - time.Minute), time.Now().Add(window + time.Minute)} {
+		timestamp, signature := signed(at)
+		status, _, reason := serveSigned(m, consumer, timestamp, signature, "")
+		if status != 401 || reason != "X-Timestamp is outside of the window" {
+			t.Errorf("%s: status = %d, reason = %q", at, status, reason)
+		}
+	}
+	if status, _, reason := serveSigned(m, consumer, "yesterday", signature, ""); status != 401 || reason != "X-Timestamp is invalid" {
+		t.Fatalf("status = %d, reason = %q", status, reason)
+	}
+}
+
+func TestSeenSignaturesExpire(t *testing.T) {
+	seen := newSeenSignatures()
+	if !seen.add("a", time.Minute) || seen.add("a", time.Minute) {
+		t.Fatal("a signature must be accepted once")
+	}
+	seen.entries["a"] = time.Now().Add(-time.Second)
+	seen.cleanedAt = time.Now().Add(-2 * time.Minute)
+	if !seen.add("b", time.Minute) {
+		t.Fatal("a new signature must be accepted")
+	}
+	if _, ok := seen.entries["a"]; ok {
+		t.Fatal("the expired signature must be removed")
+	}
+}
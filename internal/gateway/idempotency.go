@@ -0,0 +1,291 @@
+package gateway
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jasonsoft/bifrost/internal/store"
+	"github.com/jasonsoft/napnap"
+)
+
+const defaultIdempotencyMaxBodySize = 1 << 20
+
+var (
+	errIdempotencyInFlight = errors.New("a request with the idempotency key is in flight")
+	errIdempotencyFull     = errors.New("idempotency max_entries are used up")
+)
+
+// idempotencySetting replays the stored response when a client resends a
+// request with the same Idempotency-Key, so a retried payment or order
+// isn't executed twice. A key which is reused with another request is
+// rejected.
+type idempotencySetting struct {
+	TTL         int   `json:"ttl" bson:"ttl"`                     // seconds a response is replayed
+	MaxBodySize int64 `json:"max_body_size" bson:"max_body_size"` // bytes of a stored response, zero is 1MB
+}
+
+func (s *idempotencySetting) isValid() error {
+	if s.TTL <= 0 {
+		return errors.New("idempotency ttl must be greater than zero")
+	}
+	if s.MaxBodySize < 0 {
+		return errors.New("idempotency max_body_size can't be negative")
+	}
+	return nil
+}
+
+func (s *idempotencySetting) maxBodySize() int64 {
+	if s.MaxBodySize > 0 {
+		return s.MaxBodySize
+	}
+	return defaultIdempotencyMaxBodySize
+}
+
+// idempotentResponse is a finished request. Only the fingerprint of the
+// request is kept, the body is hashed while the proxy streams it, so a
+// large upload doesn't need to be kept in memory or on disk.
+type idempotentResponse struct {
+	fingerprint []byte
+	response    *cachedResponse
+	expiredAt   time.Time
+}
+
+// idempotencyStore keeps the keys of the requests in flight and the
+// responses of the finished ones until their ttl passes.
+type idempotencyStore struct {
+	sync.Mutex
+	maxEntries int
+	inFlight   map[string]bool
+	finished   map[string]*idempotentResponse
+}
+
+func newIdempotencyStore(maxEntries int) *idempotencyStore {
+	return &idempotencyStore{
+		maxEntries: maxEntries,
+		inFlight:   map[string]bool{},
+		finished:   map[string]*idempotentResponse{},
+	}
+}
+
+// begin returns the finished request of the key, or reserves the key when
+// there is none.
+func (s *idempotencyStore) begin(key string) (*idempotentResponse, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.inFlight[key] {
+		return nil, errIdempotencyInFlight
+	}
+	if finished, ok := s.finished[key]; ok {
+		if time.Now().Before(finished.expiredAt) {
+			return finished, nil
+		}
+		delete(s.finished, key)
+	}
+	if len(s.inFlight)+len(s.finished) >= s.maxEntries {
+		s.removeExpired()
+		if len(s.inFlight)+len(s.finished) >= s.maxEntries {
+			return nil, errIdempotencyFull
+		}
+	}
+	s.inFlight[key] = true
+	return nil, nil
+}
+
+func (s *idempotencyStore) finish(key string, finished *idempotentResponse) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.inFlight, key)
+	s.finished[key] = finished
+}
+
+// cancel gives the key up, so the client can send the request again.
+func (s *idempotencyStore) cancel(key string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.inFlight, key)
+}
+
+func (s *idempotencyStore) removeExpired() {
+	now := time.Now()
+	for key, finished := range s.finished {
+		if now.After(finished.expiredAt) {
+			delete(s.finished, key)
+		}
+	}
+}
+
+// IdempotencyMiddleware answers requests with an Idempotency-Key which was
+// used before with the stored response. It runs right before the proxy, so
+// only requests which may call the api are stored.
+type IdempotencyMiddleware struct {
+	gateway *Gateway
+	routes  RouteTable
+	store   *idempotencyStore
+}
+
+func newIdempotencyMiddleware(g *Gateway, routes RouteTable, store *idempotencyStore) *IdempotencyMiddleware {
+	return &IdempotencyMiddleware{
+		gateway: g,
+		routes:  routes,
+		store:   store,
+	}
+}
+
+func (m *IdempotencyMiddleware) Invoke(c *napnap.Context, next napnap.HandlerFunc) {
+	idempotencyKey := c.RequestHeader("Idempotency-Key")
+	switch c.Request.Method {
+	case "GET", "HEAD", "OPTIONS":
+		idempotencyKey = ""
+	}
+	if len(idempotencyKey) == 0 || isWebSocketRequest(c.Request) {
+		next(c)
+		return
+	}
+	apiEntry := m.routes.Match(c.Request.Host, c.Request.URL.Path, c.Request.Header)
+	if apiEntry == nil || apiEntry.Idempotency == nil {
+		next(c)
+		return
+	}
+	consumer := c.MustGet("consumer").(store.Consumer)
+	if !apiEntry.isAllow(consumer) {
+		// the proxy rejects the request
+		next(c)
+		return
+	}
+
+	key := apiEntry.ID + ":" + consumer.ID + ":" + idempotencyKey
+	finished, err := m.store.begin(key)
+	if err == errIdempotencyFull {
+		// the request is still sent, it just can't be replayed
+		m.gateway.logger.errorf("idempotency key can't be stored: %v", err)
+		next(c)
+		return
+	}
+	if err != nil {
+		c.Set("error", err.Error())
+		m.gateway.writeError(c, 409, AppError{
+			ErrorCode: "idempotency_conflict",
+			Message:   "A request with the Idempotency-Key is in progress, please try again later.",
+		})
+		return
+	}
+	if finished != nil {
+		m.replay(c, apiEntry, consumer, finished)
+		return
+	}
+
+	body := newFingerprintBody(c.Request)
+	c.Request.Body = body
+	recorder := &cacheRecorder{
+		ResponseWriter: c.Writer,
+		maxBodySize:    apiEntry.Idempotency.maxBodySize(),
+	}
+	c.Writer = recorder
+	finishedProxy := false
+	defer func() {
+		c.Writer = recorder.ResponseWriter
+		fingerprint, complete := body.sum()
+		// failed requests can be sent again with the same key, a panic
+		// leaves the recorder without the real status
+		if !finishedProxy || !complete || recorder.overflow || recorder.Status() >= 500 || recorder.Status() == 429 {
+			m.store.cancel(key)
+			return
+		}
+		header := http.Header{}
+		for name, values := range recorder.Header() {
+			if !containsFold(uncachedHeaders, name) {
+				header[name] = values
+			}
+		}
+		m.store.finish(key, &idempotentResponse{
+			fingerprint: fingerprint,
+			response: &cachedResponse{
+				StatusCode: recorder.Status(),
+				Header:     header,
+				Body:       recorder.body.Bytes(),
+				StoredAt:   time.Now().UTC(),
+			},
+			expiredAt: time.Now().Add(time.Duration(apiEntry.Idempotency.TTL) * time.Second),
+		})
+	}()
+	next(c)
+	finishedProxy = true
+}
+
+// replay writes the stored response when the request is the same as the
+// first one. The body is hashed without being kept.
+func (m *IdempotencyMiddleware) replay(c *napnap.Context, apiEntry *api, consumer store.Consumer, finished *idempotentResponse) {
+	body := newFingerprintBody(c.Request)
+	reader := io.Reader(body)
+	limit := apiEntry.maxRequestBodyBytes(m.gateway.currentConfig())
+	if limit > 0 {
+		reader = io.LimitReader(body, limit+1)
+	}
+	read, _ := io.Copy(ioutil.Discard, reader)
+	if limit > 0 && read > limit {
+		m.gateway.writeRequestTooLarge(c, apiEntry, consumer, limit, read)
+		return
+	}
+	fingerprint, _ := body.sum()
+	if !bytes.Equal(fingerprint, finished.fingerprint) {
+		c.Set("error", "idempotency key was used with another request")
+		m.gateway.writeError(c, 422, AppError{
+			ErrorCode: "idempotency_key_reused",
+			Message:   "The Idempotency-Key was used with another request.",
+		})
+		return
+	}
+	cached := finished.response
+	for name, values := range cached.Header {
+		c.Writer.Header()[name] = values
+	}
+	c.RespHeader("Idempotent-Replayed", "true")
+	c.Set("idempotency", "replayed")
+	c.SetStatus(cached.StatusCode)
+	c.Writer.Write(cached.Body)
+}
+
+// fingerprintBody hashes the method, the url and the body while the proxy
+// reads it. The transport can still read after the response arrived, so the
+// hash is guarded by the mutex.
+type fingerprintBody struct {
+	sync.Mutex
+	body io.ReadCloser
+	hash hash.Hash
+	eof  bool
+}
+
+func newFingerprintBody(req *http.Request) *fingerprintBody {
+	b := &fingerprintBody{body: req.Body, hash: sha256.New()}
+	b.hash.Write([]byte(req.Method + " " + req.URL.RequestURI() + "\n"))
+	return b
+}
+
+func (b *fingerprintBody) Read(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	n, err := b.body.Read(p)
+	b.hash.Write(p[:n])
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+func (b *fingerprintBody) Close() error {
+	return b.body.Close()
+}
+
+// sum returns the fingerprint and whether the whole body was read.
+func (b *fingerprintBody) sum() ([]byte, bool) {
+	b.Lock()
+	defer b.Unlock()
+	return b.hash.Sum(nil), b.eof
+}
@@ -0,0 +1,162 @@
+package gateway
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serveIdempotentAPI runs an api with an idempotency setting, the upstream
+// answers with the number of its calls and the length of the body.
+func serveIdempotentAPI(t *testing.T, handler http.HandlerFunc) (*httptest.Server, *int64) {
+	var calls int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&calls, 1)
+		if handler != nil {
+			handler(w, r)
+			return
+		}
+		read, _ := io.Copy(ioutil.Discard, r.Body)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "call %d, %d bytes", n, read)
+	}))
+	t.Cleanup(upstream.Close)
+	apiEntry := newTestAPI(t, "payments", upstream.URL)
+	apiEntry.Idempotency = &idempotencySetting{TTL: 60}
+	routes := newAPIRouteTable([]*api{apiEntry})
+	gateway, _ := serveTestGateway(t, []*api{apiEntry}, newIdempotencyMiddleware(testGateway, routes, newIdempotencyStore(100)))
+	return gateway, &calls
+}
+
+func postIdempotent(t *testing.T, url string, key string, body io.Reader) (*http.Response, string) {
+	req, _ := http.NewRequest("POST", url, body)
+	req.Header.Set("Idempotency-Key", key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp, string(got)
+}
+
+func TestIdempotencyReplaysTheStoredResponse(t *testing.T) {
+	gateway, calls := serveIdempotentAPI(t, nil)
+
+	first, firstBody := postIdempotent(t, gateway.URL+"/payments", "key-1", strings.NewReader(`{"amount":10}`))
+	if first.StatusCode != 201 || len(first.Header.Get("Idempotent-Replayed")) > 0 {
+		t.Fatalf("status = %d, the first request must reach the upstream", first.StatusCode)
+	}
+	second, secondBody := postIdempotent(t, gateway.URL+"/payments", "key-1", strings.NewReader(`{"amount":10}`))
+	if second.StatusCode != 201 || secondBody != firstBody {
+		t.Fatalf("status = %d, body = %q, want the stored %q", second.StatusCode, secondBody, firstBody)
+	}
+	if second.Header.Get("Idempotent-Replayed") != "true" {
+		t.Fatal("a replayed response must be marked")
+	}
+	if n := atomic.LoadInt64(calls); n != 1 {
+		t.Fatalf("the upstream was called %d times, want 1", n)
+	}
+
+	// another key is another request
+	postIdempotent(t, gateway.URL+"/payments", "key-2", strings.NewReader(`{"amount":10}`))
+	if n := atomic.LoadInt64(calls); n != 2 {
+		t.Fatalf("the upstream was called %d times, want 2", n)
+	}
+}
+
+func TestIdempotencyRejectsAKeyReusedWithAnotherBody(t *testing.T) {
+	gateway, calls := serveIdempotentAPI(t, nil)
+	postIdempotent(t, gateway.URL+"/payments", "key-1", strings.NewReader(`{"amount":10}`))
+	resp, body := postIdempotent(t, gateway.URL+"/payments", "key-1", strings.NewReader(`{"amount":99}`))
+	if resp.StatusCode != 422 || !strings.Contains(body, "idempotency_key_reused") {
+		t.Fatalf("status = %d, body = %q, want 422", resp.StatusCode, body)
+	}
+	if n := atomic.LoadInt64(calls); n != 1 {
+		t.Fatalf("the upstream was called %d times, want 1", n)
+	}
+}
+
+func TestIdempotencyRejectsAKeyInFlight(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	arrived := make(chan struct{}, 1)
+	gateway, _ := serveIdempotentAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		arrived <- struct{}{}
+		<-release
+	})
+	go func() {
+		req, _ := http.NewRequest("POST", gateway.URL+"/payments", strings.NewReader("first"))
+		req.Header.Set("Idempotency-Key", "key-1")
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	select {
+	case <-arrived:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the first request didn't reach the upstream")
+	}
+	resp, body := postIdempotent(t, gateway.URL+"/payments", "key-1", strings.NewReader("first"))
+	if resp.StatusCode != 409 || !strings.Contains(body, "idempotency_conflict") {
+		t.Fatalf("status = %d, body = %q, want 409", resp.StatusCode, body)
+	}
+}
+
+func TestIdempotencyDoesNotStoreFailures(t *testing.T) {
+	var failed int64
+	gateway, calls := serveIdempotentAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		if atomic.AddInt64(&failed, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	first, _ := postIdempotent(t, gateway.URL+"/payments", "key-1", strings.NewReader("body"))
+	second, _ := postIdempotent(t, gateway.URL+"/payments", "key-1", strings.NewReader("body"))
+	if first.StatusCode != 503 || second.StatusCode != 201 {
+		t.Fatalf("status = %d then %d, a failed request must be sent again", first.StatusCode, second.StatusCode)
+	}
+	if n := atomic.LoadInt64(calls); n != 2 {
+		t.Fatalf("the upstream was called %d times, want 2", n)
+	}
+}
+
+func TestIdempotencyFingerprintsAStreamedUpload(t *testing.T) {
+	const size = 16 << 20
+	gateway, calls := serveIdempotentAPI(t, nil)
+	upload := func(seed int64) (*http.Response, string) {
+		return postIdempotent(t, gateway.URL+"/payments", "upload", io.LimitReader(rand.New(rand.NewSource(seed)), size))
+	}
+	_, firstBody := upload(1)
+	if want := fmt.Sprintf("call 1, %d bytes", size); firstBody != want {
+		t.Fatalf("body = %q, want %q", firstBody, want)
+	}
+	if replayed, body := upload(1); replayed.Header.Get("Idempotent-Replayed") != "true" || body != firstBody {
+		t.Fatalf("body = %q, the same upload must be replayed", body)
+	}
+	if reused, _ := upload(2); reused.StatusCode != 422 {
+		t.Fatalf("status = %d, another upload with the key must be rejected", reused.StatusCode)
+	}
+	if n := atomic.LoadInt64(calls); n != 1 {
+		t.Fatalf("the upstream was called %d times, want 1", n)
+	}
+}
+
+func TestIdempotencySetting(t *testing.T) {
+	if err := (&idempotencySetting{}).isValid(); err == nil {
+		t.Fatal("a ttl of zero must be rejected")
+	}
+	if err := (&idempotencySetting{TTL: 60, MaxBodySize: -1}).isValid(); err == nil {
+		t.Fatal("a negative max_body_size must be rejected")
+	}
+}
@@ -0,0 +1,205 @@
+package gateway
+
+import (
+	"time"
+
+	"github.com/jasonsoft/bifrost/internal/store"
+	"github.com/jasonsoft/napnap"
+)
+
+// authReason explains how the caller was identified. The same value is used
+// as metric label and as error code when the request is rejected.
+type authReason string
+
+const (
+	authValid            authReason = "valid"
+	authAnonymous        authReason = "anonymous"
+	authNotFound         authReason = "not_found"
+	authExpired          authReason = "expired"
+	authIPMismatch       authReason = "ip_mismatch"
+	authConsumerNotFound authReason = "consumer_not_found"
+	authStoreError       authReason = "store_error"
+	authScopeDenied      authReason = "scope_denied"
+	authModeDenied       authReason = "auth_mode_denied"
+)
+
+// auth modes of an api, the mode decides which header may carry the token
+const (
+	authModeBearer = "bearer"
+	authModeAPIKey = "apikey"
+	authModeAny    = "any"
+)
+
+var authMessages = map[authReason]string{
+	authAnonymous:        "The request doesn't have an access token.",
+	authNotFound:         "The access token was not found.",
+	authExpired:          "The access token has expired.",
+	authIPMismatch:       "The access token doesn't belong to the client ip.",
+	authConsumerNotFound: "The consumer of the access token was not found.",
+	authStoreError:       "The access token can't be verified.",
+	authScopeDenied:      "The consumer isn't allowed to access the api.",
+	authModeDenied:       "The api doesn't accept the access token in this header.",
+}
+
+func (r authReason) appError() AppError {
+	return AppError{
+		ErrorCode: string(r),
+		Message:   authMessages[r],
+	}
+}
+
+// credentials returns the keys of the headers which the api accepts, in the
+// order they are tried. An api without auth_mode only accepts the
+// Authorization header, a request which matches no api may use both.
+func credentials(c *napnap.Context, apiEntry *api) []string {
+	bearer := c.Request.Header.Get("Authorization")
+	apiKey := c.Request.Header.Get("X-API-Key")
+	mode := authModeAny
+	if apiEntry != nil {
+		mode = apiEntry.AuthMode
+		if len(mode) == 0 {
+			mode = authModeBearer
+		}
+	}
+	keys := []string{}
+	if len(bearer) > 0 && mode != authModeAPIKey {
+		keys = append(keys, bearer)
+	}
+	if len(apiKey) > 0 && (mode == authModeAPIKey || mode == authModeAny) {
+		keys = append(keys, apiKey)
+	}
+	return keys
+}
+
+// setWWWAuthenticate tells the client which credentials the api accepts.
+func (a *api) setWWWAuthenticate(c *napnap.Context) {
+	header := c.Writer.Header()
+	if a.AuthMode != authModeAPIKey {
+		header.Add("WWW-Authenticate", `Bearer realm="bifrost"`)
+	}
+	if a.AuthMode == authModeAPIKey || a.AuthMode == authModeAny {
+		header.Add("WWW-Authenticate", `APIKey realm="bifrost", header="X-API-Key"`)
+	}
+}
+
+func (g *Gateway) countAuth(reason authReason) {
+	g.metrics.incCounter("bifrost_auth_total", "Authentication outcomes by reason.", "reason", string(reason))
+}
+
+func (g *Gateway) countRenewal(result string) {
+	g.metrics.incCounter("bifrost_token_renewals_total", "Sliding token renewals by result.", "result", result)
+}
+
+func (g *Gateway) anonymous(c *napnap.Context, next napnap.HandlerFunc, reason authReason) {
+	g.countAuth(reason)
+	g.logger.debugf("anonymous consumer: %v", reason)
+	c.Set("consumer", store.Consumer{})
+	c.Set("auth_reason", reason)
+	next(c)
+}
+
+// identity finds the consumer of the token in the Authorization header or
+// of the api key in X-API-Key, the auth_mode of the api decides which headers
+// are read. With the any mode X-API-Key is tried when the Authorization
+// header doesn't carry a known token. The mode is resolved before the token
+// is renewed or audited.
+func (g *Gateway) identity(c *napnap.Context, next napnap.HandlerFunc) {
+	apiEntry := g.routes.Match(c.Request.Host, c.Request.URL.Path, c.Request.Header)
+	keys := credentials(c, apiEntry)
+	if len(keys) == 0 {
+		reason := authAnonymous
+		if len(c.Request.Header.Get("Authorization")) > 0 || len(c.Request.Header.Get("X-API-Key")) > 0 {
+			// the token is in a header which the api doesn't accept
+			reason = authModeDenied
+		}
+		g.anonymous(c, next, reason)
+		return
+	}
+
+	var key string
+	var token *store.Token
+	for _, key = range keys {
+		var err error
+		token, err = g.tokenRepo.Get(key)
+		if err != nil {
+			g.countAuth(authStoreError)
+			panic(err)
+		}
+		if token != nil {
+			break
+		}
+	}
+	if token == nil {
+		g.anonymous(c, next, authNotFound)
+		return
+	}
+
+	// the token setting is read once, a reload can't change it mid-request
+	setting := g.currentConfig().Token
+	if token.IsValid(setting) == false {
+		err := g.tokenRepo.Delete(token.ID)
+		if err != nil {
+			g.countAuth(authStoreError)
+			panic(err)
+		}
+		g.anonymous(c, next, authExpired)
+		return
+	}
+
+	// verify client's ip which must be the same as token's ip address.
+	if setting.VerifyIP {
+		clientIP := g.clientIP(c)
+		g.logger.debugf("consumer ip: %v", clientIP)
+		if len(token.IPAddress) > 0 && token.IPAddress != clientIP {
+			g.anonymous(c, next, authIPMismatch)
+			return
+		}
+	}
+
+	target, err := g.consumerRepo.Get(token.ConsumerID)
+	if err != nil {
+		g.countAuth(authStoreError)
+		panic(err)
+	}
+	if target == nil {
+		g.anonymous(c, next, authConsumerNotFound)
+		return
+	}
+
+	// extend token's life, last_used_at is saved with the renewal
+	now := time.Now().UTC()
+	lastUsedAt := token.LastUsedAt
+	token.LastUsedAt = now
+	renewed := false
+	if setting.Sliding() {
+		if token.ShouldRenew(setting) {
+			token.Renew(setting)
+			renewed = true
+			err = g.tokenRepo.Update(token)
+			if err != nil {
+				g.countRenewal("error")
+				g.logger.errorf("failed to renew token: %v", err)
+			} else {
+				g.countRenewal("persisted")
+			}
+		} else {
+			g.countRenewal("skipped")
+		}
+	}
+	// only last_used_at is written, and not more often than the interval
+	interval := time.Duration(setting.LastUsedInterval) * time.Second
+	if !renewed && now.Sub(lastUsedAt) >= interval {
+		if err := g.tokenRepo.Touch(token.ID, now); err != nil {
+			g.logger.errorf("failed to update last_used_at of token: %v", err)
+		}
+	}
+
+	g.countAuth(authValid)
+	g.recordAudit(c, token, apiEntry)
+	consumer := *(target)
+	g.logger.debugf("consumer id: %v", consumer.ID)
+	c.Set("consumer", consumer)
+	c.Set("auth_reason", authValid)
+	c.Set("token", key)
+	next(c)
+}
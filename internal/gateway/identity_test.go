@@ -0,0 +1,320 @@
+package gateway
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jasonsoft/bifrost/internal/store"
+	"github.com/jasonsoft/napnap"
+)
+
+// countingTokenRepo counts the writes which reach the store.
+type countingTokenRepo struct {
+	store.TokenRepository
+	updates int
+	touches int
+}
+
+func (r *countingTokenRepo) Update(token *store.Token) error {
+	r.updates++
+	return r.TokenRepository.Update(token)
+}
+
+func (r *countingTokenRepo) Touch(id string, lastUsedAt time.Time) error {
+	r.touches++
+	return r.TokenRepository.Touch(id, lastUsedAt)
+}
+
+// useTestRepos replaces the repositories for one test.
+func useTestRepos(t *testing.T, tokens store.TokenRepository, consumers store.ConsumerRepository) {
+	previousTokens, previousConsumers := testGateway.tokenRepo, testGateway.consumerRepo
+	testGateway.tokenRepo, testGateway.consumerRepo = tokens, consumers
+	t.Cleanup(func() {
+		testGateway.tokenRepo, testGateway.consumerRepo = previousTokens, previousConsumers
+	})
+}
+
+func authenticate(t *testing.T, key string) *napnap.Context {
+	c, _, _ := napnap.CreateTestContext()
+	c.Request = httptest.NewRequest("GET", "/orders", nil)
+	c.Request.Header.Set("Authorization", key)
+	testGateway.identity(c, func(c *napnap.Context) {})
+	return c
+}
+
+func TestIdentityThrottlesLastUsedAt(t *testing.T) {
+	withConfig(t, func(config *Configuration) {
+		config.Token.Timeout = 3600
+		config.Token.LastUsedInterval = 60
+	})
+	consumers := store.NewConsumerMemStore()
+	consumer := &store.Consumer{App: "shop"}
+	consumers.Insert(consumer)
+	repo := &countingTokenRepo{TokenRepository: newTestTokenStore()}
+	useTestRepos(t, repo, consumers)
+
+	token := testGateway.newToken(consumer.ID)
+	if err := repo.Insert(token); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		c := authenticate(t, token.ID)
+		if reason, _ := c.Get("auth_reason"); reason != authValid {
+			t.Fatalf("auth_reason = %v, want valid", reason)
+		}
+	}
+	if repo.updates != 0 {
+		t.Fatalf("the token was written %d times, only last_used_at may be written", repo.updates)
+	}
+	if repo.touches != 1 {
+		t.Fatalf("last_used_at was written %d times within the interval, want 1", repo.touches)
+	}
+	stored, _ := repo.Get(token.ID)
+	if stored.LastUsedAt.IsZero() {
+		t.Fatal("last_used_at wasn't saved")
+	}
+}
+
+func useTestRoutes(t *testing.T, apis ...*api) {
+	previous := testGateway.routes.All()
+	testGateway.loadRoutes(apis)
+	t.Cleanup(func() {
+		testGateway.loadRoutes(previous)
+	})
+}
+
+func authenticateWith(t *testing.T, path string, header map[string]string) *napnap.Context {
+	c, _, _ := napnap.CreateTestContext()
+	c.Request = httptest.NewRequest("GET", path, nil)
+	for name, val := range header {
+		c.Request.Header.Set(name, val)
+	}
+	testGateway.identity(c, func(c *napnap.Context) {})
+	return c
+}
+
+func TestIdentityResolvesTheAuthModeOfTheAPI(t *testing.T) {
+	withConfig(t, func(config *Configuration) {
+		config.Token.Timeout = 3600
+	})
+	consumers := store.NewConsumerMemStore()
+	consumer := &store.Consumer{App: "shop"}
+	consumers.Insert(consumer)
+	repo := &countingTokenRepo{TokenRepository: newTestTokenStore()}
+	useTestRepos(t, repo, consumers)
+	token := testGateway.newToken(consumer.ID)
+	if err := repo.Insert(token); err != nil {
+		t.Fatal(err)
+	}
+
+	bearer := newTestAPI(t, "bearer", "http://bearer:8080")
+	bearer.RequestPath = "/bearer"
+	apiKey := newTestAPI(t, "apikey", "http://apikey:8080")
+	apiKey.RequestPath = "/apikey"
+	apiKey.AuthMode = authModeAPIKey
+	anyMode := newTestAPI(t, "any", "http://any:8080")
+	anyMode.RequestPath = "/any"
+	anyMode.AuthMode = authModeAny
+	useTestRoutes(t, bearer, apiKey, anyMode)
+
+	tests := []struct {
+		path   string
+		header map[string]string
+		reason authReason
+	}{
+		{"/bearer", map[string]string{"Authorization": token.ID}, authValid},
+		{"/bearer", map[string]string{"X-API-Key": token.ID}, authModeDenied},
+		{"/apikey", map[string]string{"X-API-Key": token.ID}, authValid},
+		{"/apikey", map[string]string{"Authorization": token.ID}, authModeDenied},
+		{"/any", map[string]string{"X-API-Key": token.ID}, authValid},
+		// the Authorization header is meant for the upstream
+		{"/any", map[string]string{"Authorization": "Basic dXNlcjpwYXNz", "X-API-Key": token.ID}, authValid},
+		{"/any", map[string]string{"Authorization": "unknown"}, authNotFound},
+	}
+	for _, test := range tests {
+		repo.touches = 0
+		c := authenticateWith(t, test.path, test.header)
+		reason, _ := c.Get("auth_reason")
+		if reason != test.reason {
+			t.Errorf("%s %v: reason = %v, want %v", test.path, test.header, reason, test.reason)
+		}
+		if test.reason != authValid && repo.touches+repo.updates > 0 {
+			t.Errorf("%s %v: a rejected token must not be written", test.path, test.header)
+		}
+		if test.reason == authValid && c.MustGet("consumer").(store.Consumer).ID != consumer.ID {
+			t.Errorf("%s %v: the consumer must be set", test.path, test.header)
+		}
+	}
+}
+
+func TestIdentityRenewsOnlySlidingTokens(t *testing.T) {
+	for _, mode := range []string{"absolute", "sliding"} {
+		t.Run(mode, func(t *testing.T) {
+			withConfig(t, func(config *Configuration) {
+				config.Token.Timeout = 3600
+				config.Token.ExpirationMode = mode
+				config.Token.RenewThreshold = 0.5
+				config.Token.MaxLifetime = 7200
+			})
+			consumers := store.NewConsumerMemStore()
+			consumer := &store.Consumer{App: "shop"}
+			consumers.Insert(consumer)
+			repo := &countingTokenRepo{TokenRepository: newTestTokenStore()}
+			useTestRepos(t, repo, consumers)
+
+			// the token was created 100 minutes ago and expires in 10 minutes,
+			// insert sets created_at so it's changed afterwards
+			now := time.Now().UTC()
+			token := testGateway.newToken(consumer.ID)
+			if err := repo.Insert(token); err != nil {
+				t.Fatal(err)
+			}
+			token.CreatedAt = now.Add(-100 * time.Minute)
+			token.Expiration = now.Add(10 * time.Minute)
+			if err := repo.TokenRepository.Update(token); err != nil {
+				t.Fatal(err)
+			}
+
+			c := authenticate(t, token.ID)
+			if reason, _ := c.Get("auth_reason"); reason != authValid {
+				t.Fatalf("auth_reason = %v, want valid", reason)
+			}
+			stored, _ := repo.Get(token.ID)
+			if mode == "absolute" {
+				if repo.updates != 0 || !stored.Expiration.Equal(token.Expiration) {
+					t.Fatal("an absolute token must not be renewed")
+				}
+				return
+			}
+			// the renewal stops at max_lifetime, 20 minutes from now
+			if want := token.CreatedAt.Add(2 * time.Hour); repo.updates != 1 || !stored.Expiration.Equal(want) {
+				t.Fatalf("expiration = %v after %d updates, want %v", stored.Expiration, repo.updates, want)
+			}
+		})
+	}
+}
+
+// staleTokenRepo returns its token after it expired, like a store which
+// doesn't check the expiration on reads.
+type staleTokenRepo struct {
+	store.TokenRepository
+	token *store.Token
+}
+
+func (r *staleTokenRepo) Get(key string) (*store.Token, error) {
+	if key != r.token.ID {
+		return r.TokenRepository.Get(key)
+	}
+	token := *r.token
+	return &token, nil
+}
+
+func authCount(t *testing.T, reason authReason) float64 {
+	return metricCount(t, `bifrost_auth_total{reason="`+string(reason)+`"}`)
+}
+
+func TestIdentityCountsEveryAuthReason(t *testing.T) {
+	withConfig(t, func(config *Configuration) {
+		config.Token.Timeout = 3600
+		config.Token.VerifyIP = true
+	})
+	repos := openTestStorage(t)
+	consumer := &store.Consumer{App: "shop"}
+	repos.consumers.Insert(consumer)
+	insert := func(token *store.Token) string {
+		if err := repos.tokens.Insert(token); err != nil {
+			t.Fatal(err)
+		}
+		return token.ID
+	}
+	valid := insert(testGateway.newToken(consumer.ID))
+	expired := testGateway.newToken(consumer.ID)
+	expired.Expiration = time.Now().UTC().Add(-time.Minute)
+	otherIP := testGateway.newToken(consumer.ID)
+	otherIP.IPAddress = "10.9.9.9"
+	insert(otherIP)
+	orphan := insert(testGateway.newToken("gone"))
+	useTestRepos(t, &staleTokenRepo{TokenRepository: repos.tokens, token: expired}, repos.consumers)
+
+	apiKeyOnly := newTestAPI(t, "apikey", "http://apikey:8080")
+	apiKeyOnly.RequestPath = "/apikey"
+	apiKeyOnly.AuthMode = authModeAPIKey
+	admin := newTestAPI(t, "admin", "http://admin:8080")
+	admin.RequestPath = "/admin"
+	admin.Whitelist = []string{"admin"}
+	useTestRoutes(t, apiKeyOnly, admin)
+
+	cases := []struct {
+		reason authReason
+		run    func()
+	}{
+		{authValid, func() { authenticate(t, valid) }},
+		{authAnonymous, func() { authenticateWith(t, "/orders", nil) }},
+		{authNotFound, func() { authenticate(t, "missing") }},
+		{authExpired, func() { authenticate(t, expired.ID) }},
+		{authIPMismatch, func() { authenticate(t, otherIP.ID) }},
+		{authConsumerNotFound, func() { authenticate(t, orphan) }},
+		{authModeDenied, func() { authenticateWith(t, "/apikey", map[string]string{"Authorization": valid}) }},
+		{authScopeDenied, func() {
+			c := authenticateWith(t, "/admin", map[string]string{"Authorization": valid})
+			newProxy(testGateway, newAPIRouteTable([]*api{admin})).Invoke(c, func(c *napnap.Context) {})
+			if c.Writer.Status() != 403 {
+				t.Fatalf("status = %d, a consumer without the role must be rejected", c.Writer.Status())
+			}
+		}},
+		{authStoreError, func() {
+			useTestRepos(t, &unreachableTokenRepo{TokenRepository: repos.tokens}, repos.consumers)
+			defer func() {
+				if recover() == nil {
+					t.Fatal("a store error must not be treated as a missing token")
+				}
+			}()
+			authenticate(t, valid)
+		}},
+	}
+	for _, tc := range cases {
+		before := authCount(t, tc.reason)
+		tc.run()
+		if got := authCount(t, tc.reason); got != before+1 {
+			t.Fatalf("%s = %v, want %v", tc.reason, got, before+1)
+		}
+	}
+}
+
+func TestIdentityCountsTokenRenewals(t *testing.T) {
+	renewals := func(result string) float64 {
+		return metricCount(t, `bifrost_token_renewals_total{result="`+result+`"}`)
+	}
+	repos := openTestStorage(t)
+	consumer := &store.Consumer{App: "shop"}
+	repos.consumers.Insert(consumer)
+
+	cases := []struct {
+		result         string
+		renewThreshold float64
+		tokens         store.TokenRepository
+	}{
+		{"persisted", 0, repos.tokens},
+		{"skipped", 0.5, repos.tokens},
+		{"error", 0, &failingTokenRepo{TokenRepository: repos.tokens}},
+	}
+	for _, tc := range cases {
+		withConfig(t, func(config *Configuration) {
+			config.Token.Timeout = 3600
+			config.Token.ExpirationMode = "sliding"
+			config.Token.RenewThreshold = tc.renewThreshold
+		})
+		useTestRepos(t, tc.tokens, repos.consumers)
+		token := testGateway.newToken(consumer.ID)
+		if err := repos.tokens.Insert(token); err != nil {
+			t.Fatal(err)
+		}
+		before := renewals(tc.result)
+		authenticate(t, token.ID)
+		if got := renewals(tc.result); got != before+1 {
+			t.Fatalf("%s = %v, want %v", tc.result, got, before+1)
+		}
+	}
+}
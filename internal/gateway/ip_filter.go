@@ -0,0 +1,145 @@
+package gateway
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/jasonsoft/napnap"
+)
+
+// ipRange is an inclusive range of ips in the 16 byte form, ipv4 addresses
+// are mapped into ipv6 so both families share one ordering.
+type ipRange struct {
+	start net.IP
+	end   net.IP
+}
+
+// ipRangeSet is sorted by start and the ranges don't overlap, so a lookup is
+// a binary search.
+type ipRangeSet []ipRange
+
+// compileIPRanges parses single ips and cidrs, e.g. 10.0.0.1 or fd00::/8.
+// Overlapping entries are merged.
+func compileIPRanges(entries []string) (ipRangeSet, error) {
+	ranges := ipRangeSet{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if strings.Contains(entry, "/") {
+			_, network, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, errors.New("'" + entry + "' isn't a valid cidr")
+			}
+			start := network.IP.Mask(network.Mask)
+			end := make(net.IP, len(start))
+			for i := range start {
+				end[i] = start[i] | ^network.Mask[i]
+			}
+			ranges = append(ranges, ipRange{start: start.To16(), end: end.To16()})
+			continue
+		}
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, errors.New("'" + entry + "' isn't a valid ip")
+		}
+		ranges = append(ranges, ipRange{start: ip.To16(), end: ip.To16()})
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].start, ranges[j].start) < 0
+	})
+	merged := ipRangeSet{}
+	for _, r := range ranges {
+		last := len(merged) - 1
+		if last >= 0 && bytes.Compare(r.start, merged[last].end) <= 0 {
+			if bytes.Compare(r.end, merged[last].end) > 0 {
+				merged[last].end = r.end
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged, nil
+}
+
+func (s ipRangeSet) contains(ip net.IP) bool {
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+	// the first range which starts after the ip, the one before may hold it
+	i := sort.Search(len(s), func(i int) bool {
+		return bytes.Compare(s[i].start, ip) > 0
+	})
+	return i > 0 && bytes.Compare(ip, s[i-1].end) <= 0
+}
+
+// isIPFilterValid compiles ip_whitelist and ip_blacklist.
+func (a *api) isIPFilterValid() error {
+	allow, err := compileIPRanges(a.IPWhitelist)
+	if err != nil {
+		return errors.New("ip_whitelist " + err.Error())
+	}
+	deny, err := compileIPRanges(a.IPBlacklist)
+	if err != nil {
+		return errors.New("ip_blacklist " + err.Error())
+	}
+	a.ipAllow = allow
+	a.ipDeny = deny
+	return nil
+}
+
+// allowsIP reports whether the client ip may call the api. The blacklist is
+// checked first, a whitelist then admits only the ips in it.
+func (a *api) allowsIP(ip net.IP) bool {
+	if len(a.IPWhitelist) == 0 && len(a.IPBlacklist) == 0 {
+		return true
+	}
+	allow, deny := a.ipAllow, a.ipDeny
+	if allow == nil || deny == nil {
+		var err error
+		if allow, err = compileIPRanges(a.IPWhitelist); err != nil {
+			return false
+		}
+		if deny, err = compileIPRanges(a.IPBlacklist); err != nil {
+			return false
+		}
+	}
+	if ip == nil {
+		return false
+	}
+	if deny.contains(ip) {
+		return false
+	}
+	return len(a.IPWhitelist) == 0 || allow.contains(ip)
+}
+
+// ipFilterMiddleware rejects clients by the ip lists of the api before the
+// token is looked up.
+type ipFilterMiddleware struct {
+	gateway *Gateway
+	routes  RouteTable
+}
+
+func newIPFilterMiddleware(g *Gateway, routes RouteTable) *ipFilterMiddleware {
+	return &ipFilterMiddleware{
+		gateway: g,
+		routes:  routes,
+	}
+}
+
+func (m *ipFilterMiddleware) Invoke(c *napnap.Context, next napnap.HandlerFunc) {
+	apiEntry := m.routes.Match(c.Request.Host, c.Request.URL.Path, c.Request.Header)
+	if apiEntry == nil {
+		next(c)
+		return
+	}
+	ip := m.gateway.clientIP(c)
+	if !apiEntry.allowsIP(net.ParseIP(ip)) {
+		c.Set("error", "client ip "+ip+" isn't allowed")
+		m.gateway.writeError(c, 403, AppError{ErrorCode: "ip_forbidden", Message: "The client ip isn't allowed to call the api."})
+		return
+	}
+	next(c)
+}
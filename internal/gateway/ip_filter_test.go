@@ -0,0 +1,110 @@
+package gateway
+
+import (
+	"bytes"
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jasonsoft/napnap"
+)
+
+func TestCompileIPRangesSortsAndMerges(t *testing.T) {
+	ranges, err := compileIPRanges([]string{"fd00::/8", "10.1.0.0/16", "10.0.0.0/8", "10.0.0.1", "192.168.1.10", "192.168.1.0/24", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 10.1.0.0/16 and 10.0.0.1 are in 10.0.0.0/8, 192.168.1.10 in its /24
+	if len(ranges) != 4 {
+		t.Fatalf("%d ranges, want 4: %v", len(ranges), ranges)
+	}
+	for i := 1; i < len(ranges); i++ {
+		if bytes.Compare(ranges[i-1].end, ranges[i].start) >= 0 {
+			t.Fatalf("ranges %d and %d are out of order or overlap", i-1, i)
+		}
+	}
+	if !ranges[0].start.Equal(net.ParseIP("10.0.0.0")) || !ranges[0].end.Equal(net.ParseIP("10.255.255.255")) {
+		t.Fatalf("first range = %v - %v, want 10.0.0.0/8", ranges[0].start, ranges[0].end)
+	}
+
+	for _, entry := range []string{"10.0.0.0/33", "10.0.0.300", "fd00::/129"} {
+		if _, err := compileIPRanges([]string{entry}); err == nil {
+			t.Errorf("%s must be rejected", entry)
+		}
+	}
+}
+
+func TestAPIAllowsIP(t *testing.T) {
+	apiEntry := &api{
+		IPWhitelist: []string{"10.0.0.0/8", "10.1.0.0/16", "2001:db8::/32"},
+		IPBlacklist: []string{"10.1.2.0/24", "10.1.2.3", "2001:db8:bad::/48"},
+	}
+	if err := apiEntry.isIPFilterValid(); err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]bool{
+		"10.0.0.1":        true,
+		"10.1.0.1":        true,  // in both whitelisted cidrs
+		"10.1.2.3":        false, // the blacklist wins over the whitelist
+		"10.1.2.255":      false,
+		"10.1.3.0":        true,
+		"11.0.0.1":        false, // not whitelisted
+		"::ffff:10.0.0.1": true,  // an ipv4 mapped address is the ipv4 one
+		"2001:db8::1":     true,
+		"2001:db8:bad::1": false,
+		"2001:db8:baf::1": true,
+		"2001:db9::1":     false,
+		"fe80::1":         false,
+	}
+	for ip, want := range cases {
+		if got := apiEntry.allowsIP(net.ParseIP(ip)); got != want {
+			t.Errorf("%s: allowed = %v, want %v", ip, got, want)
+		}
+	}
+	if apiEntry.allowsIP(nil) {
+		t.Error("an unknown ip must be rejected when the api has ip lists")
+	}
+
+	// the lookups use the compiled ranges, the lists aren't parsed again
+	apiEntry.IPWhitelist = []string{"not an ip"}
+	if !apiEntry.allowsIP(net.ParseIP("10.0.0.1")) {
+		t.Fatal("the compiled whitelist must be used")
+	}
+
+	blacklistOnly := &api{IPBlacklist: []string{"fd00::/8"}}
+	if err := blacklistOnly.isIPFilterValid(); err != nil {
+		t.Fatal(err)
+	}
+	if blacklistOnly.allowsIP(net.ParseIP("fd12::1")) || !blacklistOnly.allowsIP(net.ParseIP("10.0.0.1")) {
+		t.Fatal("without a whitelist only the blacklisted ips must be rejected")
+	}
+}
+
+func TestIPFilterMiddleware(t *testing.T) {
+	apiEntry := newTestAPI(t, "internal", "http://internal:8080")
+	apiEntry.IPWhitelist = []string{"10.0.0.0/8", "fd00::/8"}
+	if err := apiEntry.isValid(testGateway.currentConfig()); err != nil {
+		t.Fatal(err)
+	}
+	routes := newAPIRouteTable([]*api{apiEntry})
+
+	nap := napnap.New()
+	nap.Use(newIPFilterMiddleware(testGateway, routes))
+	nap.UseFunc(func(c *napnap.Context, next napnap.HandlerFunc) {
+		c.SetStatus(200)
+	})
+	for remoteAddr, want := range map[string]int{
+		"10.2.3.4:4000":  200,
+		"[fd00::1]:4000": 200,
+		"192.0.2.1:4000": 403,
+		"[2001::1]:4000": 403,
+	} {
+		req := httptest.NewRequest("GET", "/internal", nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		nap.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("%s: status = %d, want %d", remoteAddr, w.Code, want)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package gateway
+
+import (
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/jasonsoft/bifrost/internal/logging"
+)
+
+const (
+	debugLevel   = 0
+	infoLevel    = 1
+	warningLevel = 2
+	errorLevel   = 3
+	fatalLevel   = 4
+)
+
+// logger prints to the standard logger and sends the gelf messages to the
+// log target, queue is nil when the log target isn't gelf.
+type logger struct {
+	mode        int
+	app         *application
+	queue       *logging.Queue
+	deadLetters *deadLetterQueue
+}
+
+func newLog(app *application) *logger {
+	return &logger{
+		mode: infoLevel,
+		app:  app,
+	}
+}
+
+func (l *logger) debug(v ...interface{}) {
+	if l.mode <= debugLevel {
+		log.Println("[Debug] ", v)
+	}
+}
+
+func (l *logger) debugf(format string, v ...interface{}) {
+	if l.mode <= debugLevel {
+		log.Printf("[Debug] "+format, v...)
+	}
+}
+
+func (l *logger) info(v ...interface{}) {
+	if l.mode <= infoLevel {
+		log.Println("[Info] ", v)
+	}
+}
+
+func (l *logger) infof(format string, v ...interface{}) {
+	if l.mode <= infoLevel {
+		log.Printf("[Info] "+format, v...)
+	}
+}
+
+func (l *logger) error(v ...interface{}) {
+	if l.mode <= errorLevel {
+		log.Println("[Debug] ", v)
+	}
+}
+
+func (l *logger) errorf(format string, v ...interface{}) {
+	if l.mode <= errorLevel {
+		log.Printf("[Error] "+format, v...)
+	}
+}
+
+func (l *logger) fatal(v ...interface{}) {
+	if l.mode <= fatalLevel {
+		log.Fatal(v...)
+	}
+}
+
+func (l *logger) fatalf(format string, v ...interface{}) {
+	if l.mode <= fatalLevel {
+		log.Fatalf(format, v...)
+	}
+}
+
+// writeEventLog sends an event to the log target when it's enabled.
+func (l *logger) writeEventLog(event string, fields map[string]interface{}) {
+	fields["event"] = event
+	l.sendGelfMessage("events", 6, event, fields)
+}
+
+// writeErrorLog sends an error level gelf message.
+func (l *logger) writeErrorLog(message string, fields map[string]interface{}) {
+	l.sendGelfMessage("application", 3, message, fields)
+}
+
+// writeWarnLog sends a warning level gelf message.
+func (l *logger) writeWarnLog(message string, fields map[string]interface{}) {
+	l.sendGelfMessage("application", 4, message, fields)
+}
+
+// writeDebugLog sends a debug level gelf message.
+func (l *logger) writeDebugLog(message string, fields map[string]interface{}) {
+	l.sendGelfMessage("application", 7, message, fields)
+}
+
+func (l *logger) sendGelfMessage(loggerName string, level int, message string, fields map[string]interface{}) {
+	if l.queue == nil {
+		return
+	}
+	msg := logging.NewMessage(l.app.hostname, l.app.name, loggerName, level)
+	msg.ShortMessage = message
+	for k, v := range fields {
+		msg.CustomFields[k] = v
+	}
+	l.queueGelfMessage(msg)
+}
+
+// newGelfWriter returns the gelf writer for a "tcp://host:port" or
+// "udp://host:port" connection string, tls needs a tcp connection string.
+func newGelfWriter(connectionString, certFile, keyFile, caFile string) *logging.Writer {
+	url, err := url.Parse(connectionString)
+	panicIf(err)
+	protocol := "udp"
+	if strings.EqualFold(url.Scheme, "tcp") {
+		protocol = "tcp"
+	}
+	useTLS := len(certFile) > 0 && len(keyFile) > 0 && len(caFile) > 0
+	if useTLS && protocol != "tcp" {
+		log.Fatalf("config error: gelf tls needs a tcp connection string")
+	}
+	return logging.NewWriter(logging.Config{
+		ConnectionString: url.Host,
+		Protocol:         protocol,
+		TLSCertFile:      certFile,
+		TLSKeyFile:       keyFile,
+		TLSCAFile:        caFile,
+	})
+}
@@ -0,0 +1,512 @@
+package gateway
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jasonsoft/bifrost/internal/store"
+	"github.com/jasonsoft/napnap"
+)
+
+const (
+	counterMetric   = "counter"
+	gaugeMetric     = "gauge"
+	histogramMetric = "histogram"
+)
+
+// latency buckets in seconds
+var defaultBuckets = []float64{0.0005, 0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+type metricSeries struct {
+	sync.Mutex
+	labels  string // formatted for the exposition
+	value   float64
+	buckets []uint64
+	sum     float64
+	count   uint64
+	fn      func() float64
+}
+
+type metricFamily struct {
+	sync.RWMutex
+	name   string
+	help   string
+	kind   string
+	series map[string]*metricSeries // by seriesKey
+	// collect returns gauge values by labels, for series which come and go
+	collect func(add func(value float64, labels ...string))
+}
+
+// metrics is a small registry which renders the prometheus text format.
+// Requests only take read locks once their series exist, every series has
+// its own lock for the values.
+type metrics struct {
+	sync.RWMutex
+	families map[string]*metricFamily
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		families: map[string]*metricFamily{},
+	}
+}
+
+// labels are passed as key and value pairs.
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(labels[i+1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// seriesKey appends the labels to buf. A map lookup with string(key) doesn't
+// allocate, unlike formatting the labels.
+func seriesKey(buf []byte, labels []string) []byte {
+	for _, label := range labels {
+		buf = append(buf, label...)
+		buf = append(buf, 0xff)
+	}
+	return buf
+}
+
+func (m *metrics) getFamily(name, help, kind string) *metricFamily {
+	m.RLock()
+	family, ok := m.families[name]
+	m.RUnlock()
+	if ok {
+		return family
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	family, ok = m.families[name]
+	if !ok {
+		family = &metricFamily{
+			name:   name,
+			help:   help,
+			kind:   kind,
+			series: map[string]*metricSeries{},
+		}
+		m.families[name] = family
+	}
+	return family
+}
+
+func (m *metrics) getSeries(name, help, kind string, labels []string) *metricSeries {
+	family := m.getFamily(name, help, kind)
+	var buf [128]byte
+	key := seriesKey(buf[:0], labels)
+	family.RLock()
+	series, ok := family.series[string(key)]
+	family.RUnlock()
+	if ok {
+		return series
+	}
+
+	family.Lock()
+	defer family.Unlock()
+	series, ok = family.series[string(key)]
+	if !ok {
+		series = &metricSeries{labels: formatLabels(labels)}
+		if kind == histogramMetric {
+			series.buckets = make([]uint64, len(defaultBuckets))
+		}
+		family.series[string(key)] = series
+	}
+	return series
+}
+
+func (m *metrics) incCounter(name, help string, labels ...string) {
+	m.getSeries(name, help, counterMetric, labels).inc()
+}
+
+func (m *metrics) observe(name, help string, value float64, labels ...string) {
+	m.getSeries(name, help, histogramMetric, labels).observe(value)
+}
+
+// histogram returns the series, so a caller which observes it often keeps
+// the handle instead of looking it up every time.
+func (m *metrics) histogram(name, help string, labels ...string) *metricSeries {
+	return m.getSeries(name, help, histogramMetric, labels)
+}
+
+func (series *metricSeries) inc() {
+	series.Lock()
+	series.value++
+	series.Unlock()
+}
+
+func (series *metricSeries) observe(value float64) {
+	series.Lock()
+	defer series.Unlock()
+	for i, bound := range defaultBuckets {
+		if value <= bound {
+			series.buckets[i]++
+		}
+	}
+	series.sum += value
+	series.count++
+}
+
+// gaugeFunc registers a gauge which is evaluated every time metrics are written.
+func (m *metrics) gaugeFunc(name, help string, fn func() float64, labels ...string) {
+	series := m.getSeries(name, help, gaugeMetric, labels)
+	series.Lock()
+	series.fn = fn
+	series.Unlock()
+}
+
+// gaugeCollector registers a gauge whose series are created every time
+// metrics are written, e.g. one series per target of every api.
+func (m *metrics) gaugeCollector(name, help string, collect func(add func(value float64, labels ...string))) {
+	m.Lock()
+	defer m.Unlock()
+	m.families[name] = &metricFamily{
+		name:    name,
+		help:    help,
+		kind:    gaugeMetric,
+		series:  map[string]*metricSeries{},
+		collect: collect,
+	}
+}
+
+func (m *metrics) writeTo(w io.Writer) {
+	m.RLock()
+	families := make([]*metricFamily, 0, len(m.families))
+	for _, family := range m.families {
+		families = append(families, family)
+	}
+	m.RUnlock()
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].name < families[j].name
+	})
+
+	for _, family := range families {
+		name := family.name
+		fmt.Fprintf(w, "# HELP %s %s\n", family.name, family.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", family.name, family.kind)
+
+		if family.collect != nil {
+			family.collect(func(value float64, labels ...string) {
+				fmt.Fprintf(w, "%s%s %g\n", name, formatLabels(labels), value)
+			})
+			continue
+		}
+
+		family.RLock()
+		series := make([]*metricSeries, 0, len(family.series))
+		for _, item := range family.series {
+			series = append(series, item)
+		}
+		family.RUnlock()
+		sort.Slice(series, func(i, j int) bool {
+			return series[i].labels < series[j].labels
+		})
+
+		for _, item := range series {
+			key := item.labels
+			item.Lock()
+			switch family.kind {
+			case histogramMetric:
+				for i, bound := range defaultBuckets {
+					fmt.Fprintf(w, "%s_bucket%s %d\n", name, withLabel(key, "le", fmt.Sprint(bound)), item.buckets[i])
+				}
+				fmt.Fprintf(w, "%s_bucket%s %d\n", name, withLabel(key, "le", "+Inf"), item.count)
+				fmt.Fprintf(w, "%s_sum%s %g\n", name, key, item.sum)
+				fmt.Fprintf(w, "%s_count%s %d\n", name, key, item.count)
+			case gaugeMetric:
+				value := item.value
+				if item.fn != nil {
+					value = item.fn()
+				}
+				fmt.Fprintf(w, "%s%s %g\n", name, key, value)
+			default:
+				fmt.Fprintf(w, "%s%s %g\n", name, key, item.value)
+			}
+			item.Unlock()
+		}
+	}
+}
+
+func withLabel(labels, key, value string) string {
+	label := key + "=" + strconv.Quote(value)
+	if len(labels) == 0 {
+		return "{" + label + "}"
+	}
+	return labels[:len(labels)-1] + "," + label + "}"
+}
+
+func (g *Gateway) getMetricsEndpoint(c *napnap.Context) {
+	c.Writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	c.SetStatus(200)
+	g.metrics.writeTo(c.Writer)
+}
+
+/*********************
+	Repository metrics
+*********************/
+
+var storeOutcomes = [...]string{"ok", "not_found", "error"}
+
+func storeOutcome(found bool, err error) int {
+	if err != nil {
+		return 2
+	}
+	if !found {
+		return 1
+	}
+	return 0
+}
+
+// storeMetrics keeps the latency series of every operation and outcome of
+// one repository, they are made with the repository so an operation only
+// takes the time.
+type storeMetrics struct {
+	series map[string]*[len(storeOutcomes)]*metricSeries
+}
+
+func newStoreMetrics(m *metrics, name, backend string, operations ...string) *storeMetrics {
+	metricName := "bifrost_" + name + "_store_duration_seconds"
+	help := "Latency of " + name + " repository operations."
+	sm := &storeMetrics{
+		series: map[string]*[len(storeOutcomes)]*metricSeries{},
+	}
+	for _, operation := range operations {
+		series := &[len(storeOutcomes)]*metricSeries{}
+		for i, outcome := range storeOutcomes {
+			series[i] = m.histogram(metricName, help, "backend", backend, "operation", operation, "outcome", outcome)
+		}
+		sm.series[operation] = series
+	}
+	return sm
+}
+
+func (sm *storeMetrics) observe(operation string, startTime time.Time, found bool, err error) {
+	sm.series[operation][storeOutcome(found, err)].observe(time.Since(startTime).Seconds())
+}
+
+// tokenRepoMetrics records latency and outcome of every call to the wrapped repository.
+type tokenRepoMetrics struct {
+	repo    store.TokenRepository
+	metrics *storeMetrics
+}
+
+func newTokenRepoMetrics(repo store.TokenRepository, backend string, m *metrics) *tokenRepoMetrics {
+	if memStore, ok := repo.(*store.TokenMemStore); ok {
+		m.gaugeFunc("bifrost_token_memstore_entries", "Number of tokens held by the memory store.", func() float64 {
+			return float64(memStore.Count())
+		})
+	}
+	return &tokenRepoMetrics{
+		repo:    repo,
+		metrics: newStoreMetrics(m, "token", backend, "get", "get_by_consumer_id", "insert", "insert_with_limit", "update", "touch", "delete_by_consumer_id", "delete", "delete_batch"),
+	}
+}
+
+// Close closes the wrapped repository when it holds connections.
+func (r *tokenRepoMetrics) Close() error {
+	if closer, ok := r.repo.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (r *tokenRepoMetrics) Get(key string) (*store.Token, error) {
+	startTime := time.Now()
+	token, err := r.repo.Get(key)
+	r.metrics.observe("get", startTime, token != nil, err)
+	return token, err
+}
+
+func (r *tokenRepoMetrics) GetByConsumerID(consumerID string) ([]*store.Token, error) {
+	startTime := time.Now()
+	tokens, err := r.repo.GetByConsumerID(consumerID)
+	r.metrics.observe("get_by_consumer_id", startTime, len(tokens) > 0, err)
+	return tokens, err
+}
+
+func (r *tokenRepoMetrics) Insert(token *store.Token) error {
+	startTime := time.Now()
+	err := r.repo.Insert(token)
+	r.metrics.observe("insert", startTime, true, err)
+	return err
+}
+
+func (r *tokenRepoMetrics) InsertWithLimit(token *store.Token, max int, evictOldest bool) ([]string, error) {
+	startTime := time.Now()
+	evicted, err := r.repo.InsertWithLimit(token, max, evictOldest)
+	r.metrics.observe("insert_with_limit", startTime, true, err)
+	return evicted, err
+}
+
+func (r *tokenRepoMetrics) Update(token *store.Token) error {
+	startTime := time.Now()
+	err := r.repo.Update(token)
+	r.metrics.observe("update", startTime, true, err)
+	return err
+}
+
+func (r *tokenRepoMetrics) Touch(id string, lastUsedAt time.Time) error {
+	startTime := time.Now()
+	err := r.repo.Touch(id, lastUsedAt)
+	r.metrics.observe("touch", startTime, true, err)
+	return err
+}
+
+func (r *tokenRepoMetrics) DeleteByConsumerID(consumerID string) error {
+	startTime := time.Now()
+	err := r.repo.DeleteByConsumerID(consumerID)
+	r.metrics.observe("delete_by_consumer_id", startTime, true, err)
+	return err
+}
+
+func (r *tokenRepoMetrics) Delete(key string) error {
+	startTime := time.Now()
+	err := r.repo.Delete(key)
+	r.metrics.observe("delete", startTime, true, err)
+	return err
+}
+
+func (r *tokenRepoMetrics) DeleteBatch(keys []string) ([]string, error) {
+	startTime := time.Now()
+	deleted, err := r.repo.DeleteBatch(keys)
+	r.metrics.observe("delete_batch", startTime, true, err)
+	return deleted, err
+}
+
+// consumerRepoMetrics records latency and outcome of every call to the wrapped repository.
+type consumerRepoMetrics struct {
+	repo    store.ConsumerRepository
+	metrics *storeMetrics
+}
+
+func newConsumerRepoMetrics(repo store.ConsumerRepository, backend string, m *metrics) *consumerRepoMetrics {
+	return &consumerRepoMetrics{
+		repo:    repo,
+		metrics: newStoreMetrics(m, "consumer", backend, "get", "get_by_username", "insert", "update", "delete", "count"),
+	}
+}
+
+// Close closes the wrapped repository when it holds connections.
+func (r *consumerRepoMetrics) Close() error {
+	if closer, ok := r.repo.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (r *consumerRepoMetrics) Get(id string) (*store.Consumer, error) {
+	startTime := time.Now()
+	consumer, err := r.repo.Get(id)
+	r.metrics.observe("get", startTime, consumer != nil, err)
+	return consumer, err
+}
+
+func (r *consumerRepoMetrics) GetByUsername(app string, username string) (*store.Consumer, error) {
+	startTime := time.Now()
+	consumer, err := r.repo.GetByUsername(app, username)
+	r.metrics.observe("get_by_username", startTime, consumer != nil, err)
+	return consumer, err
+}
+
+func (r *consumerRepoMetrics) Insert(consumer *store.Consumer) error {
+	startTime := time.Now()
+	err := r.repo.Insert(consumer)
+	r.metrics.observe("insert", startTime, true, err)
+	return err
+}
+
+func (r *consumerRepoMetrics) Update(consumer *store.Consumer) error {
+	startTime := time.Now()
+	err := r.repo.Update(consumer)
+	r.metrics.observe("update", startTime, true, err)
+	return err
+}
+
+func (r *consumerRepoMetrics) Delete(consumer *store.Consumer) error {
+	startTime := time.Now()
+	err := r.repo.Delete(consumer)
+	r.metrics.observe("delete", startTime, true, err)
+	return err
+}
+
+func (r *consumerRepoMetrics) Count(app string) (int, error) {
+	startTime := time.Now()
+	count, err := r.repo.Count(app)
+	r.metrics.observe("count", startTime, true, err)
+	return count, err
+}
+
+/*********************
+	Request metrics
+*********************/
+
+var metricMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+
+// RequestMetricsMiddleware counts requests and their latency per api. The
+// labels are the api name, the method and the status only, so the number
+// of series is bounded by the number of apis.
+type RequestMetricsMiddleware struct {
+	routes  RouteTable
+	metrics *metrics
+}
+
+func newRequestMetricsMiddleware(routes RouteTable, metrics *metrics) *RequestMetricsMiddleware {
+	return &RequestMetricsMiddleware{
+		routes:  routes,
+		metrics: metrics,
+	}
+}
+
+func (m *RequestMetricsMiddleware) Invoke(c *napnap.Context, next napnap.HandlerFunc) {
+	startTime := time.Now()
+	next(c)
+
+	apiName := "unmatched"
+	if apiEntry := m.routes.Match(c.Request.Host, c.Request.URL.Path, c.Request.Header); apiEntry != nil {
+		apiName = apiEntry.Name
+	}
+	method := strings.ToUpper(c.Request.Method)
+	if !contains(metricMethods, method) {
+		method = "OTHER"
+	}
+	status := strconv.Itoa(c.Writer.Status())
+
+	m.metrics.incCounter("bifrost_requests_total", "Requests by api, method and status.", "api", apiName, "method", method, "status", status)
+	m.metrics.observe("bifrost_request_duration_seconds", "Latency of requests by api and method.", time.Since(startTime).Seconds(), "api", apiName, "method", method)
+	if c.Writer.Status() == 502 || c.Writer.Status() == 504 {
+		m.metrics.incCounter("bifrost_upstream_errors_total", "Requests which failed because of the upstream.", "api", apiName, "status", status)
+	}
+}
+
+// registerUpstreamHealthMetric reports 1 for targets which are up and 0 for
+// targets which are down, the series follow the apis after a reload.
+func (g *Gateway) registerUpstreamHealthMetric() {
+	g.metrics.gaugeCollector("bifrost_upstream_health", "Health of the targets of every api.", func(add func(value float64, labels ...string)) {
+		for _, apiEntry := range g.routes.All() {
+			for _, target := range apiEntry.targets() {
+				value := 0.0
+				if g.healthChecker.isUp(target.URL) {
+					value = 1
+				}
+				add(value, "api", apiEntry.Name, "target", target.URL)
+			}
+		}
+	})
+}
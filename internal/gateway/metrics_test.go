@@ -0,0 +1,109 @@
+package gateway
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// metricValue returns the value of the series in the exposition of the
+// gateway, "0" when it wasn't written.
+func metricValue(series string) string {
+	var buf bytes.Buffer
+	testGateway.metrics.writeTo(&buf)
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, series+" ") {
+			return strings.TrimPrefix(line, series+" ")
+		}
+	}
+	return "0"
+}
+
+// metricCount returns the value of the series as a number, tests compare it
+// before and after because the metrics of testGateway are shared.
+func metricCount(t *testing.T, series string) float64 {
+	value, err := strconv.ParseFloat(metricValue(series), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestMetricsCountConcurrentRequests(t *testing.T) {
+	m := newMetrics()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				m.incCounter("requests_total", "Requests.", "api", "orders", "status", "200")
+				m.observe("request_duration_seconds", "Latency.", 0.002, "api", "orders")
+			}
+		}()
+	}
+	// writing while the requests are counted must not block them or race
+	var buf bytes.Buffer
+	m.writeTo(&buf)
+	wg.Wait()
+
+	buf.Reset()
+	m.writeTo(&buf)
+	out := buf.String()
+	for _, line := range []string{
+		`requests_total{api="orders",status="200"} 8000`,
+		`request_duration_seconds_bucket{api="orders",le="0.005"} 8000`,
+		`request_duration_seconds_bucket{api="orders",le="0.001"} 0`,
+		`request_duration_seconds_count{api="orders"} 8000`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Fatalf("missing %q in\n%s", line, out)
+		}
+	}
+}
+
+func TestFormatLabelsQuotesValues(t *testing.T) {
+	if got := formatLabels([]string{"api", `a"b`, "method", "GET"}); got != `{api="a\"b",method="GET"}` {
+		t.Fatalf("formatLabels = %s", got)
+	}
+	if got := formatLabels(nil); got != "" {
+		t.Fatalf("formatLabels(nil) = %q", got)
+	}
+}
+
+func TestMetricsDoNotAllocateForExistingSeries(t *testing.T) {
+	m := newMetrics()
+	store := newStoreMetrics(testGateway.metrics, "token", "memory", "get")
+	startTime := time.Now()
+	allocs := testing.AllocsPerRun(100, func() {
+		m.incCounter("bifrost_requests_total", "Requests by api, method and status.", "api", "orders", "method", "GET", "status", "200")
+		m.observe("bifrost_request_duration_seconds", "Latency of requests by api and method.", 0.01, "api", "orders", "method", "GET")
+		store.observe("get", startTime, true, nil)
+	})
+	if allocs != 0 {
+		t.Fatalf("%v allocations per call, want 0", allocs)
+	}
+}
+
+func BenchmarkMetricsIncCounter(b *testing.B) {
+	m := newMetrics()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			m.incCounter("bifrost_requests_total", "Requests by api, method and status.", "api", "orders", "method", "GET", "status", "200")
+		}
+	})
+}
+
+func BenchmarkMetricsObserve(b *testing.B) {
+	m := newMetrics()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			m.observe("bifrost_request_duration_seconds", "Latency of requests by api and method.", 0.01, "api", "orders", "method", "GET")
+		}
+	})
+}
@@ -0,0 +1,115 @@
+package gateway
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/jasonsoft/napnap"
+)
+
+// Default priorities of the built-in middlewares, lower runs first. The gaps
+// leave room for custom middlewares, e.g. 950 runs after identity and before
+// the rate limit.
+const (
+	PriorityDrain          = 50
+	PriorityRequestID      = 100
+	PriorityRequestMetrics = 150
+	PriorityAccessLog      = 200
+	PriorityApplicationLog = 300
+	PriorityCustomErrors   = 400
+	PriorityApplication    = 500
+	PriorityGzip           = 600
+	PriorityHealth         = 700
+	PriorityCors           = 800
+	PriorityIPFilter       = 825
+	PriorityIdentity       = 900
+	PrioritySignature      = 950
+	PriorityRateLimit      = 1000
+	PriorityOAuthToken     = 1025 // client secrets are guessed behind the rate limit
+	PriorityCache          = 1050
+	PriorityIdempotency    = 1075
+	PriorityProxy          = 1100
+	PriorityNotFound       = 1200
+)
+
+type registeredMiddleware struct {
+	name     string
+	priority int
+	order    int
+	handler  napnap.MiddlewareHandler
+}
+
+// MiddlewareRegistry collects the middlewares of the gateway and orders them
+// by priority. Middlewares with the same priority keep the registration order.
+type MiddlewareRegistry struct {
+	middlewares []*registeredMiddleware
+	registered  int
+}
+
+func newMiddlewareRegistry() *MiddlewareRegistry {
+	return &MiddlewareRegistry{}
+}
+
+// Register adds the middleware. A name can only be registered once, so a
+// plugin can't replace a built-in middleware by accident.
+func (r *MiddlewareRegistry) Register(name string, priority int, mw napnap.MiddlewareHandler) error {
+	for _, existing := range r.middlewares {
+		if existing.name == name {
+			return fmt.Errorf("middleware %s is already registered", name)
+		}
+	}
+	r.registered++
+	r.middlewares = append(r.middlewares, &registeredMiddleware{
+		name:     name,
+		priority: priority,
+		order:    r.registered,
+		handler:  mw,
+	})
+	return nil
+}
+
+// RegisterFunc is the same as Register for middleware functions.
+func (r *MiddlewareRegistry) RegisterFunc(name string, priority int, mw func(c *napnap.Context, next napnap.HandlerFunc)) error {
+	return r.Register(name, priority, napnap.MiddlewareFunc(mw))
+}
+
+// sorted returns a copy of the middlewares in execution order.
+func (r *MiddlewareRegistry) sorted() []*registeredMiddleware {
+	sorted := make([]*registeredMiddleware, len(r.middlewares))
+	copy(sorted, r.middlewares)
+	sort.Sort(byPriority(sorted))
+	return sorted
+}
+
+// Build returns the middlewares sorted by priority.
+func (r *MiddlewareRegistry) Build() []napnap.MiddlewareHandler {
+	result := []napnap.MiddlewareHandler{}
+	for _, entry := range r.sorted() {
+		result = append(result, entry.handler)
+	}
+	return result
+}
+
+// Names returns the middleware names in execution order.
+func (r *MiddlewareRegistry) Names() []string {
+	result := []string{}
+	for _, entry := range r.sorted() {
+		result = append(result, entry.name)
+	}
+	return result
+}
+
+type byPriority []*registeredMiddleware
+
+func (source byPriority) Len() int {
+	return len(source)
+}
+func (source byPriority) Swap(i, j int) {
+	source[i], source[j] = source[j], source[i]
+}
+func (source byPriority) Less(i, j int) bool {
+	if source[i].priority != source[j].priority {
+		return source[i].priority < source[j].priority
+	}
+	return source[i].order < source[j].order
+}
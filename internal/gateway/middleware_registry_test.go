@@ -0,0 +1,39 @@
+package gateway
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jasonsoft/napnap"
+)
+
+func TestMiddlewareRegistryOrdersByPriority(t *testing.T) {
+	registry := newMiddlewareRegistry()
+	noop := func(c *napnap.Context, next napnap.HandlerFunc) { next(c) }
+	registry.RegisterFunc("proxy", PriorityProxy, noop)
+	registry.RegisterFunc("identity", PriorityIdentity, noop)
+	registry.RegisterFunc("audit", PriorityIdentity, noop)
+	registry.RegisterFunc("request_id", PriorityRequestID, noop)
+
+	want := []string{"request_id", "identity", "audit", "proxy"}
+	if got := registry.Names(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("names = %v, want %v", got, want)
+	}
+	if got := len(registry.Build()); got != len(want) {
+		t.Fatalf("built %d middlewares, want %d", got, len(want))
+	}
+}
+
+func TestMiddlewareRegistryRejectsDuplicateNames(t *testing.T) {
+	registry := newMiddlewareRegistry()
+	noop := func(c *napnap.Context, next napnap.HandlerFunc) { next(c) }
+	if err := registry.RegisterFunc("identity", PriorityIdentity, noop); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.RegisterFunc("identity", 1, noop); err == nil {
+		t.Fatal("registering identity again must fail")
+	}
+	if got := registry.Names(); !reflect.DeepEqual(got, []string{"identity"}) {
+		t.Fatalf("names = %v, the first middleware must be kept", got)
+	}
+}
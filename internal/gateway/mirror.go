@@ -0,0 +1,184 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	neturl "net/url"
+)
+
+// mirrorPool sends the mirrored requests with a fixed number of workers. As
+// many requests as there are workers can wait, more are dropped so a slow
+// mirror can't pile up goroutines.
+type mirrorPool struct {
+	jobs   chan func()
+	logger *logger
+}
+
+func newMirrorPool(workers int, logger *logger) *mirrorPool {
+	mp := &mirrorPool{
+		jobs:   make(chan func(), workers),
+		logger: logger,
+	}
+	for i := 0; i < workers; i++ {
+		go mp.work()
+	}
+	return mp
+}
+
+func (mp *mirrorPool) work() {
+	for job := range mp.jobs {
+		mp.run(job)
+	}
+}
+
+func (mp *mirrorPool) run(job func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			mp.logger.errorf("mirror request panicked: %v", r)
+		}
+	}()
+	job()
+}
+
+// submit queues the job, false means the pool is busy and it was dropped.
+func (mp *mirrorPool) submit(job func()) bool {
+	select {
+	case mp.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// mirrorSetting sends a copy of a percentage of the requests to another
+// target. The mirror's response is discarded.
+type mirrorSetting struct {
+	TargetURL  string  `json:"target_url" bson:"target_url"`
+	Percentage float64 `json:"percentage" bson:"percentage"` // 0 - 100
+}
+
+func (m *mirrorSetting) isValid() error {
+	target, err := neturl.Parse(m.TargetURL)
+	if err != nil || len(target.Scheme) == 0 || len(target.Host) == 0 {
+		return errors.New("mirror target_url is invalid")
+	}
+	if m.Percentage < 0 || m.Percentage > 100 {
+		return errors.New("mirror percentage must be between 0 and 100")
+	}
+	return nil
+}
+
+func (m *mirrorSetting) sample() bool {
+	return m.Percentage > 0 && rand.Float64()*100 < m.Percentage
+}
+
+// mirrorRequest sends the copy in the background, errors and latency of the
+// mirror never reach the client. The mirror's status or error is logged at
+// debug level. The body is read from spill instead of being copied when it
+// was spilled, the mirror request takes over the file and removes it.
+func (p *proxy) mirrorRequest(apiEntry *api, method string, escapedPath string, rawQuery string, header http.Header, body []byte, spill *spillFile) {
+	if p.gateway.mirrorPool == nil {
+		if spill != nil {
+			spill.remove()
+		}
+		return
+	}
+	if spill != nil && spill.err != nil {
+		spill.remove()
+		p.gateway.skipMirrorRequest(apiEntry, method, spill.err)
+		return
+	}
+	mirrorHeader := http.Header{}
+	p.copyHeader(mirrorHeader, header)
+	mirrorHeader.Set("X-Bifrost-Mirror", "true")
+	var mirrorBody []byte
+	length := int64(len(body))
+	if spill == nil {
+		mirrorBody = make([]byte, len(body))
+		copy(mirrorBody, body)
+	} else {
+		length = spill.size
+	}
+	timeout := apiEntry.upstreamTimeout(p.gateway.currentConfig())
+	targetURL := apiEntry.Mirror.TargetURL
+	egress := apiEntry.egressProxySetting(p.gateway.currentConfig())
+
+	submitted := p.gateway.mirrorPool.submit(func() {
+		if spill != nil {
+			// the file is removed when the mirror request panics as well
+			defer spill.remove()
+		}
+		result := "ok"
+		defer func() {
+			p.gateway.metrics.incCounter("bifrost_mirror_requests_total", "Mirrored requests by api and result.", "api", apiEntry.Name, "result", result)
+		}()
+		fields := map[string]interface{}{
+			"api":    apiEntry.Name,
+			"mirror": targetURL,
+			"method": method,
+		}
+
+		url, err := upstreamURL(targetURL, escapedPath, rawQuery)
+		if err != nil {
+			result = "error"
+			fields["error"] = err.Error()
+			p.gateway.logger.writeDebugLog("mirror request failed", fields)
+			return
+		}
+		var reqBody io.Reader = bytes.NewReader(mirrorBody)
+		if spill != nil {
+			reqBody = spill.reader()
+		}
+		req, err := http.NewRequest(method, url.String(), reqBody)
+		if err != nil {
+			result = "error"
+			fields["error"] = err.Error()
+			p.gateway.logger.writeDebugLog("mirror request failed", fields)
+			return
+		}
+		req.URL = url
+		req.ContentLength = length
+		req.Header = mirrorHeader
+		ctx, cancel := withEgressProxy(context.Background(), egress), context.CancelFunc(func() {})
+		if timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		defer cancel()
+		resp, err := p.client.Do(req.WithContext(ctx))
+		if err != nil {
+			result = "error"
+			fields["error"] = err.Error()
+			p.gateway.logger.writeDebugLog("mirror request failed", fields)
+			return
+		}
+		// the body isn't read, closing it drops the connection to the mirror
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			result = "error"
+		}
+		fields["status_code"] = resp.StatusCode
+		p.gateway.logger.writeDebugLog("mirror request was sent", fields)
+	})
+	if !submitted {
+		if spill != nil {
+			spill.remove()
+		}
+		p.gateway.metrics.incCounter("bifrost_mirror_requests_total", "Mirrored requests by api and result.", "api", apiEntry.Name, "result", "dropped")
+	}
+}
+
+// skipMirrorRequest counts and logs a mirror request which can't be sent
+// because the body isn't available.
+func (g *Gateway) skipMirrorRequest(apiEntry *api, method string, err error) {
+	g.metrics.incCounter("bifrost_mirror_requests_total", "Mirrored requests by api and result.", "api", apiEntry.Name, "result", "skipped")
+	g.logger.writeWarnLog("mirror request was skipped", map[string]interface{}{
+		"api":    apiEntry.Name,
+		"mirror": apiEntry.Mirror.TargetURL,
+		"method": method,
+		"error":  err.Error(),
+	})
+}
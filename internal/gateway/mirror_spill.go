@@ -0,0 +1,221 @@
+package gateway
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jasonsoft/napnap"
+)
+
+const spillFilePrefix = "bifrost-mirror-"
+
+var (
+	errSpillTooLarge = errors.New("the body is larger than mirror_spill max_bytes")
+	errSpillQuota    = errors.New("mirror_spill quota_bytes is used up")
+)
+
+// spillStore keeps the bodies of mirrored and captured requests which are
+// larger than memoryBytes in files, so they don't need another copy of a
+// large upload in memory. Spilling stops while the files use up quotaBytes and
+// starts again once mirror requests were sent and their files removed.
+type spillStore struct {
+	sync.Mutex
+	dir           string
+	memoryBytes   int64
+	maxBytes      int64
+	quotaBytes    int64
+	sweepInterval time.Duration
+	used          int64 // bytes of the files, updated atomically
+	active        map[string]bool
+	logger        *logger
+}
+
+func newSpillStore(dir string, memoryBytes, maxBytes, quotaBytes int64, sweepInterval time.Duration, logger *logger, metrics *metrics) (*spillStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &spillStore{
+		dir:           dir,
+		memoryBytes:   memoryBytes,
+		maxBytes:      maxBytes,
+		quotaBytes:    quotaBytes,
+		sweepInterval: sweepInterval,
+		active:        map[string]bool{},
+		logger:        logger,
+	}
+	metrics.gaugeFunc("bifrost_mirror_spill_bytes", "Bytes of the mirrored bodies which are spilled to disk.", func() float64 {
+		return float64(atomic.LoadInt64(&s.used))
+	})
+	return s, nil
+}
+
+// shouldSpill reports whether a body of length bytes goes to a file, a body
+// of unknown length does as it can be large.
+func (s *spillStore) shouldSpill(length int64) bool {
+	return length < 0 || length > s.memoryBytes
+}
+
+// create returns an empty spill file. A body which is known to be too large
+// or doesn't fit into the quota gets a failed spill file instead of an
+// error, so the mirror request is skipped and counted.
+func (s *spillStore) create(length int64) *spillFile {
+	f := &spillFile{store: s, refs: 1}
+	if length > s.maxBytes {
+		f.err = errSpillTooLarge
+		return f
+	}
+	if atomic.LoadInt64(&s.used) >= s.quotaBytes {
+		f.err = errSpillQuota
+		return f
+	}
+	file, err := ioutil.TempFile(s.dir, spillFilePrefix)
+	if err != nil {
+		f.err = err
+		return f
+	}
+	s.Lock()
+	s.active[file.Name()] = true
+	s.Unlock()
+	f.file = file
+	return f
+}
+
+func (s *spillStore) reserve(n int64) bool {
+	if atomic.AddInt64(&s.used, n) > s.quotaBytes {
+		atomic.AddInt64(&s.used, -n)
+		return false
+	}
+	return true
+}
+
+// run removes the orphaned spill files every sweep interval, starting with
+// the ones left by the last run of the gateway.
+func (s *spillStore) run() {
+	for {
+		s.sweep()
+		time.Sleep(s.sweepInterval)
+	}
+}
+
+// sweep removes the spill files which no mirror request uses, e.g. after a
+// crash. Files of other gateways in the same dir are kept until they are
+// older than the sweep interval.
+func (s *spillStore) sweep() {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		s.logger.errorf("mirror spill files can't be swept: %v", err)
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	for _, info := range files {
+		path := filepath.Join(s.dir, info.Name())
+		if info.IsDir() || !strings.HasPrefix(info.Name(), spillFilePrefix) || s.active[path] {
+			continue
+		}
+		if time.Since(info.ModTime()) < s.sweepInterval {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			s.logger.errorf("orphaned mirror spill file can't be removed: %v", err)
+			continue
+		}
+		s.logger.debugf("orphaned mirror spill file was removed: %s", path)
+	}
+}
+
+// spillRequestBody returns the file which gets the body of a mirrored or
+// captured request while it's read, nil keeps the body in memory. Bodies
+// with encrypted fields stay in memory, they are mirrored and captured
+// encrypted as well.
+func (g *Gateway) spillRequestBody(c *napnap.Context, apiEntry *api) *spillFile {
+	if g.mirrorSpill == nil || apiEntry.FieldEncryption != nil || !g.mirrorSpill.shouldSpill(c.Request.ContentLength) {
+		return nil
+	}
+	return g.mirrorSpill.create(c.Request.ContentLength)
+}
+
+// spillFile receives the body while the proxy reads it. Writes never fail,
+// so the client's request isn't affected by the disk: the first error is
+// kept, the file is removed and the mirror request or capture is skipped.
+// The mirror and the capture share the file, it's removed once both of
+// them removed it.
+type spillFile struct {
+	store    *spillStore
+	file     *os.File
+	size     int64
+	reserved int64
+	err      error
+	refs     int32
+	once     sync.Once
+}
+
+func (f *spillFile) Write(p []byte) (int, error) {
+	if f.err != nil {
+		return len(p), nil
+	}
+	n := int64(len(p))
+	if f.size+n > f.store.maxBytes {
+		f.fail(errSpillTooLarge)
+		return len(p), nil
+	}
+	if !f.store.reserve(n) {
+		f.fail(errSpillQuota)
+		return len(p), nil
+	}
+	f.reserved += n
+	written, err := f.file.Write(p)
+	f.size += int64(written)
+	if err != nil {
+		f.fail(err)
+	}
+	return len(p), nil
+}
+
+func (f *spillFile) fail(err error) {
+	f.err = err
+	f.discard()
+}
+
+// share adds a reader of the file, which removes it when it's done.
+func (f *spillFile) share() *spillFile {
+	atomic.AddInt32(&f.refs, 1)
+	return f
+}
+
+// reader reads the file from the start.
+func (f *spillFile) reader() io.Reader {
+	return io.NewSectionReader(f.file, 0, f.size)
+}
+
+// remove gives up one reference, the last one closes and deletes the file.
+func (f *spillFile) remove() {
+	if atomic.AddInt32(&f.refs, -1) <= 0 {
+		f.discard()
+	}
+}
+
+// discard closes and deletes the file and frees its quota, it's safe to call
+// more than once.
+func (f *spillFile) discard() {
+	f.once.Do(func() {
+		if f.file == nil {
+			return
+		}
+		f.file.Close()
+		if err := os.Remove(f.file.Name()); err != nil && !os.IsNotExist(err) {
+			f.store.logger.errorf("mirror spill file can't be removed: %v", err)
+		}
+		f.store.Lock()
+		delete(f.store.active, f.file.Name())
+		f.store.Unlock()
+		atomic.AddInt64(&f.store.used, -f.reserved)
+	})
+}
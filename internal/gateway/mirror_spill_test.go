@@ -0,0 +1,286 @@
+package gateway
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useTestMirrorSpill spills mirrored bodies larger than memoryBytes to a temp
+// dir for one test.
+func useTestMirrorSpill(t *testing.T, memoryBytes, maxBytes, quotaBytes int64) *spillStore {
+	store, err := newSpillStore(t.TempDir(), memoryBytes, maxBytes, quotaBytes, time.Minute, testGateway.logger, testGateway.metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := testGateway.mirrorSpill
+	testGateway.mirrorSpill = store
+	t.Cleanup(func() {
+		testGateway.mirrorSpill = previous
+	})
+	return store
+}
+
+// waitForNoSpillFiles fails the test when the spill files aren't removed.
+func waitForNoSpillFiles(t *testing.T, store *spillStore) {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		files, _ := ioutil.ReadDir(store.dir)
+		if len(files) == 0 && atomic.LoadInt64(&store.used) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d spill files and %d bytes are left", len(files), atomic.LoadInt64(&store.used))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func mirrorMetric(apiName, result string) string {
+	return metricValue(`bifrost_mirror_requests_total{api="` + apiName + `",result="` + result + `"}`)
+}
+
+type mirroredBody struct {
+	size int64
+	sum  [sha256.Size]byte
+}
+
+func TestMirrorSpillsALargeUploadToDisk(t *testing.T) {
+	if testing.Short() {
+		t.Skip("uploads 100MB")
+	}
+	const size = 100 << 20
+	store := useTestMirrorSpill(t, 1<<20, 200<<20, 400<<20)
+
+	release := make(chan struct{})
+	var releaseOnce sync.Once
+	mirrored := make(chan mirroredBody, 1)
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		hash := sha256.New()
+		n, _ := io.Copy(hash, r.Body)
+		var body mirroredBody
+		body.size = n
+		copy(body.sum[:], hash.Sum(nil))
+		mirrored <- body
+	}))
+	defer mirror.Close()
+	// the mirror can't be closed while its handler waits
+	defer releaseOnce.Do(func() { close(release) })
+	// the heap is sampled while the upload is in flight, halfway through the
+	// body the gateway must hold neither the body nor a copy of it
+	var peakHeap uint64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, io.LimitReader(r.Body, size/2))
+		runtime.GC()
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		atomic.StoreUint64(&peakHeap, stats.HeapAlloc)
+		io.Copy(ioutil.Discard, r.Body)
+	}))
+	defer upstream.Close()
+
+	apiEntry := newTestAPI(t, "spill", upstream.URL)
+	apiEntry.MaxRequestBodyBytes = -1
+	apiEntry.Mirror = &mirrorSetting{TargetURL: mirror.URL, Percentage: 100}
+	gateway, _ := serveTestGateway(t, []*api{apiEntry})
+
+	req, _ := http.NewRequest("POST", gateway.URL+"/upload", io.LimitReader(rand.New(rand.NewSource(1)), size))
+	req.ContentLength = size
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	if heap := atomic.LoadUint64(&peakHeap); heap == 0 || heap > size/8 {
+		t.Fatalf("heap = %d bytes halfway through the upload, the body must be streamed", heap)
+	}
+
+	// the mirror hasn't read the body yet, only the spill file keeps it
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	if stats.HeapAlloc > size/8 {
+		t.Fatalf("heap = %d bytes while the mirror waits, the body must not stay in memory", stats.HeapAlloc)
+	}
+	if atomic.LoadInt64(&store.used) != size {
+		t.Fatalf("spilled %d bytes, want %d", atomic.LoadInt64(&store.used), size)
+	}
+
+	releaseOnce.Do(func() { close(release) })
+	want := sha256.New()
+	io.Copy(want, io.LimitReader(rand.New(rand.NewSource(1)), size))
+	select {
+	case body := <-mirrored:
+		if body.size != size || !bytes.Equal(body.sum[:], want.Sum(nil)) {
+			t.Fatalf("the mirror got %d bytes which aren't the upload", body.size)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the mirror wasn't called")
+	}
+	waitForNoSpillFiles(t, store)
+}
+
+func TestMirrorSpillSkipsWhileTheQuotaIsUsedUp(t *testing.T) {
+	store := useTestMirrorSpill(t, 10, 1000, 1000)
+	mirrored := make(chan string, 2)
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mirrored <- string(body)
+	}))
+	defer mirror.Close()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer upstream.Close()
+	apiEntry := newTestAPI(t, "spill-quota", upstream.URL)
+	apiEntry.Mirror = &mirrorSetting{TargetURL: mirror.URL, Percentage: 100}
+	gateway, _ := serveTestGateway(t, []*api{apiEntry})
+
+	// another request holds the whole quota
+	held := store.create(1000)
+	held.Write(make([]byte, 1000))
+	if held.err != nil {
+		t.Fatal(held.err)
+	}
+
+	body := strings.Repeat("x", 100)
+	send := func() {
+		resp, err := http.Post(gateway.URL+"/orders", "text/plain", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(got) != body {
+			t.Fatalf("body = %q, the client must not notice the spill", got)
+		}
+	}
+	send()
+	if skipped := mirrorMetric("spill-quota", "skipped"); skipped != "1" {
+		t.Fatalf("skipped = %s, want 1", skipped)
+	}
+	select {
+	case <-mirrored:
+		t.Fatal("the mirror must be skipped without quota")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// spilling starts again once space is freed
+	held.remove()
+	send()
+	select {
+	case got := <-mirrored:
+		if got != body {
+			t.Fatalf("the mirror got %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the mirror wasn't called after the quota was freed")
+	}
+	waitForNoSpillFiles(t, store)
+}
+
+func TestMirrorSpillSkipsOnDiskErrors(t *testing.T) {
+	store := useTestMirrorSpill(t, 10, 1000, 1000)
+	// the dir is gone, so no spill file can be created
+	os.RemoveAll(store.dir)
+	mirrored := make(chan struct{}, 1)
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored <- struct{}{}
+	}))
+	defer mirror.Close()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer upstream.Close()
+	apiEntry := newTestAPI(t, "spill-error", upstream.URL)
+	apiEntry.Mirror = &mirrorSetting{TargetURL: mirror.URL, Percentage: 100}
+	gateway, _ := serveTestGateway(t, []*api{apiEntry})
+
+	resp, err := http.Post(gateway.URL+"/orders", "text/plain", strings.NewReader(strings.Repeat("x", 100)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("status = %d, disk errors must not fail the request", resp.StatusCode)
+	}
+	if skipped := mirrorMetric("spill-error", "skipped"); skipped != "1" {
+		t.Fatalf("skipped = %s, want 1", skipped)
+	}
+	select {
+	case <-mirrored:
+		t.Fatal("the mirror must be skipped")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSpillFileRejectsBodiesAboveMaxBytes(t *testing.T) {
+	store := useTestMirrorSpill(t, 10, 100, 1000)
+	if f := store.create(101); f.err != errSpillTooLarge {
+		t.Fatalf("err = %v, a known length above max_bytes must be rejected", f.err)
+	}
+	// a body of unknown length fails once it grows beyond max_bytes
+	f := store.create(-1)
+	f.Write(make([]byte, 60))
+	f.Write(make([]byte, 60))
+	if f.err != errSpillTooLarge {
+		t.Fatalf("err = %v, want too large", f.err)
+	}
+	waitForNoSpillFiles(t, store)
+}
+
+func TestSpillSweepRemovesOrphanedFiles(t *testing.T) {
+	store := useTestMirrorSpill(t, 10, 1000, 1000)
+	old := time.Now().Add(-time.Hour)
+	orphan := filepath.Join(store.dir, spillFilePrefix+"orphan")
+	other := filepath.Join(store.dir, "other")
+	for _, path := range []string{orphan, other} {
+		ioutil.WriteFile(path, []byte("body"), 0600)
+		os.Chtimes(path, old, old)
+	}
+	fresh := filepath.Join(store.dir, spillFilePrefix+"fresh")
+	ioutil.WriteFile(fresh, []byte("body"), 0600)
+	active := store.create(-1)
+	active.Write([]byte("body"))
+	os.Chtimes(active.file.Name(), old, old)
+
+	store.sweep()
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Fatal("the orphaned spill file must be removed")
+	}
+	for _, path := range []string{other, fresh, active.file.Name()} {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("%s must be kept: %v", filepath.Base(path), err)
+		}
+	}
+	active.remove()
+}
+
+func TestMirrorSpillIsValidated(t *testing.T) {
+	config := newConfiguration()
+	config.MirrorSpill.Dir = "/var/spool/bifrost"
+	if err := config.isValid(); err != nil {
+		t.Fatalf("the defaults must be valid: %v", err)
+	}
+	config.MirrorSpill.QuotaBytes = config.MirrorSpill.MaxBytes - 1
+	if err := config.isValid(); err == nil || !strings.Contains(err.Error(), ErrMirrorSpill.Error()) {
+		t.Fatalf("err = %v, a quota below max_bytes must be rejected", err)
+	}
+}
@@ -0,0 +1,122 @@
+package gateway
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type mirroredRequest struct {
+	method string
+	uri    string
+	body   string
+	header http.Header
+}
+
+func TestMirrorSendsACopyWithoutDelayingTheClient(t *testing.T) {
+	release := make(chan struct{})
+	mirrored := make(chan mirroredRequest, 1)
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mirrored <- mirroredRequest{r.Method, r.RequestURI, string(body), r.Header}
+		// a slow mirror must not delay the client
+		<-release
+	}))
+	defer mirror.Close()
+	defer close(release)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(append([]byte("upstream:"), body...))
+	}))
+	defer upstream.Close()
+
+	apiEntry := newTestAPI(t, "orders", upstream.URL)
+	apiEntry.Mirror = &mirrorSetting{TargetURL: mirror.URL, Percentage: 100}
+	gateway, _ := serveTestGateway(t, []*api{apiEntry})
+
+	req, _ := http.NewRequest("POST", gateway.URL+"/orders/7?expand=items", strings.NewReader(`{"qty":2}`))
+	req.Header.Set("X-Tenant", "shop")
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != `upstream:{"qty":2}` {
+		t.Fatalf("body = %s, want the upstream's response", body)
+	}
+
+	select {
+	case request := <-mirrored:
+		if request.method != "POST" || request.uri != "/orders/7?expand=items" || request.body != `{"qty":2}` {
+			t.Fatalf("the mirror got %s %s %s", request.method, request.uri, request.body)
+		}
+		if request.header.Get("X-Bifrost-Mirror") != "true" || request.header.Get("X-Tenant") != "shop" {
+			t.Fatalf("mirror header = %v", request.header)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the mirror wasn't called")
+	}
+}
+
+func TestMirrorPoolDropsJobsWhenBusy(t *testing.T) {
+	pool := newMirrorPool(1, testGateway.logger)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+
+	if !pool.submit(func() { close(started); <-release }) {
+		t.Fatal("the first job must be accepted")
+	}
+	<-started
+	// one job can wait while the worker is busy
+	if !pool.submit(func() {}) {
+		t.Fatal("the second job must be queued")
+	}
+	if pool.submit(func() {}) {
+		t.Fatal("the third job must be dropped")
+	}
+}
+
+func TestMirrorPoolSurvivesAPanic(t *testing.T) {
+	pool := newMirrorPool(1, testGateway.logger)
+	pool.submit(func() { panic("mirror") })
+	done := make(chan struct{})
+	deadline := time.Now().Add(time.Second)
+	for !pool.submit(func() { close(done) }) {
+		if time.Now().After(deadline) {
+			t.Fatal("the pool doesn't accept jobs")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the worker stopped after the panic")
+	}
+}
+
+func TestMirrorSetting(t *testing.T) {
+	invalid := []*mirrorSetting{
+		{TargetURL: "mirror:8080", Percentage: 10},
+		{TargetURL: "", Percentage: 10},
+		{TargetURL: "http://mirror:8080", Percentage: -1},
+		{TargetURL: "http://mirror:8080", Percentage: 101},
+	}
+	for _, setting := range invalid {
+		if setting.isValid() == nil {
+			t.Errorf("%+v must be invalid", setting)
+		}
+	}
+	never := &mirrorSetting{TargetURL: "http://mirror:8080"}
+	always := &mirrorSetting{TargetURL: "http://mirror:8080", Percentage: 100}
+	for i := 0; i < 100; i++ {
+		if never.sample() || !always.sample() {
+			t.Fatal("0% must never and 100% must always be mirrored")
+		}
+	}
+}
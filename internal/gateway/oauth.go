@@ -0,0 +1,134 @@
+package gateway
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+
+	"github.com/jasonsoft/bifrost/internal/store"
+	"github.com/jasonsoft/napnap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// hashClientSecret returns the bcrypt hash of the secret, the secret itself
+// is never stored. bcrypt reads at most 72 bytes, longer secrets are
+// rejected.
+func hashClientSecret(secret string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashed), nil
+}
+
+// verifyClientSecret compares the secret with a bcrypt hash, or with a
+// "sha256$<salt>$<hash>" of consumers created before bcrypt was used.
+func verifyClientSecret(hashed string, secret string) bool {
+	if !strings.HasPrefix(hashed, "sha256$") {
+		return bcrypt.CompareHashAndPassword([]byte(hashed), []byte(secret)) == nil
+	}
+	parts := strings.Split(hashed, "$")
+	if len(parts) != 3 {
+		return false
+	}
+	salt, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(secret))
+	return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(h.Sum(nil))), []byte(parts[2])) == 1
+}
+
+type oauthTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+type oauthError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// newToken returns a token which expires after token.timeout seconds.
+func (g *Gateway) newToken(consumerID string) *store.Token {
+	return store.NewToken(consumerID, g.currentConfig().Token)
+}
+
+// notifyTokenEvicted publishes the token.evicted event to the log target.
+func (g *Gateway) notifyTokenEvicted(consumerID string, tokenID string) {
+	g.logger.infof("token.evicted: consumer %s, token %s", consumerID, tokenID)
+	g.logger.writeEventLog("token.evicted", map[string]interface{}{
+		"consumer_id": consumerID,
+		"token_id":    tokenID,
+	})
+}
+
+// oauthTokenMiddleware issues tokens with the client credentials grant
+// (RFC 6749 section 4.4). client_id is the consumer id and the credentials
+// are read from the form or from basic authentication.
+func (g *Gateway) oauthTokenMiddleware(path string) napnap.MiddlewareFunc {
+	return func(c *napnap.Context, next napnap.HandlerFunc) {
+		if c.Request.URL.Path != path {
+			next(c)
+			return
+		}
+		c.RespHeader("Cache-Control", "no-store")
+		c.RespHeader("Pragma", "no-cache")
+		if c.Request.Method != "POST" {
+			c.RespHeader("Allow", "POST")
+			c.JSON(405, oauthError{Error: "invalid_request", ErrorDescription: "The token endpoint only accepts POST."})
+			return
+		}
+
+		if c.Request.ParseForm() != nil {
+			c.JSON(400, oauthError{Error: "invalid_request"})
+			return
+		}
+		if c.Request.PostForm.Get("grant_type") != "client_credentials" {
+			c.JSON(400, oauthError{Error: "unsupported_grant_type"})
+			return
+		}
+		clientID, clientSecret, basic := c.Request.BasicAuth()
+		if !basic {
+			clientID = c.Request.PostForm.Get("client_id")
+			clientSecret = c.Request.PostForm.Get("client_secret")
+		}
+		if len(clientID) == 0 || len(clientSecret) == 0 {
+			c.JSON(400, oauthError{Error: "invalid_request", ErrorDescription: "client_id and client_secret are required."})
+			return
+		}
+
+		consumer, err := g.consumerRepo.Get(clientID)
+		panicIf(err)
+		if consumer == nil || len(consumer.ClientSecretHash) == 0 || !verifyClientSecret(consumer.ClientSecretHash, clientSecret) {
+			if basic {
+				c.RespHeader("WWW-Authenticate", `Basic realm="bifrost"`)
+			}
+			c.JSON(401, oauthError{Error: "invalid_client"})
+			return
+		}
+
+		token := g.newToken(consumer.ID)
+		token.Source = "oauth"
+		evictOldest := g.currentConfig().Token.EvictionPolicy == "evict-oldest"
+		evicted, err := g.tokenRepo.InsertWithLimit(token, g.currentConfig().Token.MaxPerConsumer, evictOldest)
+		if err == store.ErrTokenLimitExceeded {
+			c.JSON(400, oauthError{Error: "invalid_request", ErrorDescription: store.ErrTokenLimitExceeded.Message})
+			return
+		}
+		panicIf(err)
+		for _, tokenID := range evicted {
+			g.notifyTokenEvicted(consumer.ID, tokenID)
+		}
+
+		c.JSON(200, oauthTokenResponse{
+			AccessToken: token.ID,
+			TokenType:   "Bearer",
+			ExpiresIn:   token.ExpiresIn,
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package gateway
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jasonsoft/bifrost/internal/store"
+	"github.com/jasonsoft/napnap"
+)
+
+func TestClientSecretHash(t *testing.T) {
+	hashed, err := hashClientSecret("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hashed, "$2a$") {
+		t.Fatalf("hash = %q, want a bcrypt hash", hashed)
+	}
+	if !verifyClientSecret(hashed, "s3cret") {
+		t.Fatal("the secret doesn't match its hash")
+	}
+	if verifyClientSecret(hashed, "guess") {
+		t.Fatal("a wrong secret matches")
+	}
+	if _, err := hashClientSecret(strings.Repeat("x", 73)); err == nil {
+		t.Fatal("a secret longer than 72 bytes was hashed")
+	}
+
+	// sha256 of the salt 00 and "s3cret", the format before bcrypt
+	legacy := "sha256$00$4ed94222a5825b5e3cd0d6a475e291bc33074f1ff9e72e30be0aed7d71095ed2"
+	if !verifyClientSecret(legacy, "s3cret") {
+		t.Fatal("the secret doesn't match the legacy hash")
+	}
+	if verifyClientSecret(legacy, "guess") {
+		t.Fatal("a wrong secret matches the legacy hash")
+	}
+}
+
+func TestNewTokenExpiresAfterTimeoutSeconds(t *testing.T) {
+	withConfig(t, func(config *Configuration) {
+		config.Token.Timeout = 120
+	})
+	token := testGateway.newToken("consumer-1")
+	lifetime := token.Expiration.Sub(token.CreatedAt)
+	if lifetime != 120*time.Second {
+		t.Fatalf("lifetime = %v, want 2m0s", lifetime)
+	}
+	if token.ExpiresIn < 119 || token.ExpiresIn > 120 {
+		t.Fatalf("expires_in = %d, want 120", token.ExpiresIn)
+	}
+}
+
+func TestOAuthTokenIsRateLimited(t *testing.T) {
+	consumers := store.NewConsumerMemStore()
+	hashed, _ := hashClientSecret("s3cret")
+	consumer := &store.Consumer{App: "shop", ClientSecretHash: hashed}
+	consumers.Insert(consumer)
+	useTestRepos(t, newTestTokenStore(), consumers)
+
+	registry := newMiddlewareRegistry()
+	registry.Register("oauth_token", PriorityOAuthToken, testGateway.oauthTokenMiddleware("/oauth/token"))
+	// nothing is refilled while the test runs, even under -race
+	registry.Register("rate_limit", PriorityRateLimit, newRateLimitMiddleware(testGateway, 0.001, 2, nil))
+	nap := napnap.New()
+	nap.UseFunc(func(c *napnap.Context, next napnap.HandlerFunc) {
+		c.Set("consumer", store.Consumer{})
+		next(c)
+	})
+	for _, handler := range registry.Build() {
+		nap.Use(handler)
+	}
+
+	statuses := []int{}
+	for _, secret := range []string{"guess-1", "guess-2", "s3cret"} {
+		form := url.Values{"grant_type": {"client_credentials"}, "client_id": {consumer.ID}, "client_secret": {secret}}
+		req := httptest.NewRequest("POST", "/oauth/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		nap.ServeHTTP(w, req)
+		statuses = append(statuses, w.Code)
+	}
+	if statuses[0] != 401 || statuses[1] != 401 || statuses[2] != 429 {
+		t.Fatalf("statuses = %v, want [401 401 429]", statuses)
+	}
+}
+
+func TestClientSecretHashIsNotWrittenToTheAdminAPI(t *testing.T) {
+	consumers := store.NewConsumerMemStore()
+	useTestRepos(t, newTestTokenStore(), consumers)
+
+	req := httptest.NewRequest("POST", "/v1/consumers", strings.NewReader(`{"app":"shop","username":"tom","client_secret":"s3cret"}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := serveAdmin("POST", "/v1/consumers", testGateway.createConsumerEndpoint, req)
+	if w.Code != 201 {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "client_secret") {
+		t.Fatalf("body = %s, the secret and its hash must be left out", w.Body.String())
+	}
+	stored, _ := consumers.GetByUsername("shop", "tom")
+	if stored == nil || !verifyClientSecret(stored.ClientSecretHash, "s3cret") {
+		t.Fatal("the hash of the secret must be stored")
+	}
+}
@@ -0,0 +1,121 @@
+package gateway
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+var (
+	templateParamPattern    = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+	errInvalidTemplateParam = errors.New("request_path_template has an invalid parameter")
+)
+
+// compilePathTemplate turns a template like /users/{id}/profile into a
+// regexp which matches the whole path, every {name} matches one segment.
+func compilePathTemplate(template string) (*regexp.Regexp, error) {
+	if !strings.HasPrefix(template, "/") {
+		return nil, errors.New("request_path_template must start with /")
+	}
+	pattern := "(?i)^"
+	names := map[string]bool{}
+	last := 0
+	for _, loc := range templateParamPattern.FindAllStringSubmatchIndex(template, -1) {
+		name := template[loc[2]:loc[3]]
+		if names[name] {
+			return nil, errors.New("request_path_template has the parameter {" + name + "} twice")
+		}
+		names[name] = true
+		literal := template[last:loc[0]]
+		if strings.ContainsAny(literal, "{}") {
+			return nil, errInvalidTemplateParam
+		}
+		pattern += regexp.QuoteMeta(literal) + "(?P<" + name + ">[^/]+)"
+		last = loc[1]
+	}
+	rest := template[last:]
+	if strings.ContainsAny(rest, "{}") {
+		return nil, errInvalidTemplateParam
+	}
+	pattern += regexp.QuoteMeta(strings.TrimSuffix(rest, "/")) + "/?$"
+	return regexp.Compile(pattern)
+}
+
+// pathTemplateRegexp returns the compiled request path template, or nil
+// when the api doesn't have one.
+func (a *api) pathTemplateRegexp() *regexp.Regexp {
+	if len(a.RequestPathTemplate) == 0 {
+		return nil
+	}
+	if a.pathTemplate != nil {
+		return a.pathTemplate
+	}
+	re, err := compilePathTemplate(a.RequestPathTemplate)
+	if err != nil {
+		return nil
+	}
+	return re
+}
+
+// pathParams returns the values of the template parameters in the path, ok
+// is false when the path doesn't match the template.
+func (a *api) pathParams(path string) (map[string]string, bool) {
+	re := a.pathTemplateRegexp()
+	if re == nil {
+		return nil, false
+	}
+	match := re.FindStringSubmatch(path)
+	if match == nil {
+		return nil, false
+	}
+	params := map[string]string{}
+	for i, name := range re.SubexpNames() {
+		if len(name) > 0 {
+			params[name] = match[i]
+		}
+	}
+	return params, true
+}
+
+// expandTargetPath puts the parameters of the request path into
+// TargetPathTemplate, e.g. /users/42/profile becomes /v2/users/42.
+func (a *api) expandTargetPath(path string) (string, bool) {
+	if len(a.TargetPathTemplate) == 0 {
+		return path, false
+	}
+	params, ok := a.pathParams(path)
+	if !ok {
+		return path, false
+	}
+	result := templateParamPattern.ReplaceAllStringFunc(a.TargetPathTemplate, func(param string) string {
+		return params[param[1:len(param)-1]]
+	})
+	return result, true
+}
+
+func (a *api) isPathTemplateValid() error {
+	if len(a.RequestPathTemplate) == 0 {
+		if len(a.TargetPathTemplate) > 0 {
+			return errors.New("target_path_template needs a request_path_template")
+		}
+		return nil
+	}
+	re, err := compilePathTemplate(a.RequestPathTemplate)
+	if err != nil {
+		return err
+	}
+	if len(a.TargetPathTemplate) > 0 && !strings.HasPrefix(a.TargetPathTemplate, "/") {
+		return errors.New("target_path_template must start with /")
+	}
+	names := map[string]bool{}
+	for _, name := range re.SubexpNames() {
+		names[name] = true
+	}
+	for _, match := range templateParamPattern.FindAllStringSubmatch(a.TargetPathTemplate, -1) {
+		if !names[match[1]] {
+			return errors.New("target_path_template uses {" + match[1] + "} which isn't in request_path_template")
+		}
+	}
+	a.pathTemplate = re
+	return nil
+}
@@ -0,0 +1,224 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	goplugin "plugin"
+
+	"github.com/jasonsoft/napnap"
+)
+
+// Plugin is a middleware which is turned on in the plugins section of the
+// config file:
+//
+//	plugin_dir: /etc/bifrost/plugins
+//	plugins:
+//	  - name: request_header
+//	    priority: 975
+//	    config:
+//	      header: X-Gateway
+//
+// A plugin is looked up as <plugin_dir>/<name>.so first, which must be built
+// with -buildmode=plugin and export a variable named Plugin whose address
+// implements the interface, see examples/plugins/request_header. Otherwise
+// a built-in plugin of that name is used. Init gets the config of the plugin
+// once at startup, an error stops the gateway. The handler is registered
+// with the priority of the plugin and replaces a built-in middleware of the
+// same name.
+//
+// The interface only matches when the shared object uses the same napnap
+// package as the gateway. A gateway built from the Godeps workspace uses
+// the vendored copy, whose types differ from the napnap of a plugin built
+// elsewhere, so such a plugin exports Middleware as well, see
+// MiddlewareFactory.
+//
+// The circuit breaker isn't a plugin. It guards every upstream call inside
+// the proxy after the target was picked, so it's configured in the
+// circuit_breaker section and per api.
+type Plugin interface {
+	Name() string
+	Init(config map[string]interface{}) error
+	Handler() napnap.MiddlewareHandler
+}
+
+// PluginSetting turns on a plugin.
+type PluginSetting struct {
+	Name     string                 `yaml:"name" json:"name"`
+	Priority int                    `yaml:"priority" json:"priority"`
+	Config   map[string]interface{} `yaml:"config" json:"config"`
+}
+
+// MiddlewareFactory is the signature of the Middleware function which a
+// shared object may export instead of Plugin. It only uses the standard
+// library, so it works whatever napnap the plugin was built with. The
+// returned middleware may change the request or answer it, the response of
+// the gateway is written to the original ResponseWriter.
+type MiddlewareFactory = func(config map[string]interface{}) (func(http.Handler) http.Handler, error)
+
+// funcPlugin adapts a MiddlewareFactory to the plugin interface.
+type funcPlugin struct {
+	name    string
+	factory MiddlewareFactory
+	wrap    func(http.Handler) http.Handler
+}
+
+func (p *funcPlugin) Name() string {
+	return p.name
+}
+
+func (p *funcPlugin) Init(config map[string]interface{}) error {
+	wrap, err := p.factory(config)
+	if err != nil {
+		return err
+	}
+	if wrap == nil {
+		return errors.New("the Middleware function returned no middleware")
+	}
+	p.wrap = wrap
+	return nil
+}
+
+func (p *funcPlugin) Handler() napnap.MiddlewareHandler {
+	return napnap.MiddlewareFunc(func(c *napnap.Context, next napnap.HandlerFunc) {
+		p.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c.Request = r
+			next(c)
+		})).ServeHTTP(c.Writer, c.Request)
+	})
+}
+
+var errCircuitBreakerPlugin = errors.New("plugin circuit_breaker: the circuit breaker is part of the proxy, configure it in the circuit_breaker section")
+
+// loadedPlugin is a plugin which was initialized, Source is "builtin" or the
+// path of the shared object.
+type loadedPlugin struct {
+	Name     string                 `json:"name"`
+	Source   string                 `json:"source"`
+	Priority int                    `json:"priority"`
+	Config   map[string]interface{} `json:"config"`
+}
+
+// builtinPlugins are the plugins which are available without a shared
+// object.
+func (g *Gateway) builtinPlugins() map[string]func() Plugin {
+	return map[string]func() Plugin{
+		"access_log": func() Plugin { return newAccessLogMiddleware(g) },
+		"rate_limit": func() Plugin { return &RateLimitMiddleware{gateway: g} },
+	}
+}
+
+// openPlugin returns the plugin of the shared object or the built-in one.
+func (g *Gateway) openPlugin(dir string, name string) (Plugin, string, error) {
+	if len(dir) > 0 {
+		path := filepath.Join(dir, name+".so")
+		if _, err := os.Stat(path); err == nil {
+			p, err := goplugin.Open(path)
+			if err != nil {
+				return nil, "", err
+			}
+			result, err := lookupPlugin(name, path, p.Lookup)
+			if err != nil {
+				return nil, "", err
+			}
+			return result, path, nil
+		}
+	}
+	if name == "circuit_breaker" {
+		return nil, "", errCircuitBreakerPlugin
+	}
+	factory, ok := g.builtinPlugins()[name]
+	if !ok {
+		return nil, "", errors.New("plugin " + name + " wasn't found")
+	}
+	return factory(), "builtin", nil
+}
+
+// lookupPlugin returns the Plugin variable of the shared object, or its
+// Middleware function when the Plugin doesn't match the interface of the
+// gateway.
+func lookupPlugin(name string, path string, lookup func(string) (goplugin.Symbol, error)) (Plugin, error) {
+	if symbol, err := lookup("Plugin"); err == nil {
+		if result, ok := symbol.(Plugin); ok {
+			return result, nil
+		}
+	}
+	if symbol, err := lookup("Middleware"); err == nil {
+		switch factory := symbol.(type) {
+		case MiddlewareFactory:
+			return &funcPlugin{name: name, factory: factory}, nil
+		case *MiddlewareFactory:
+			return &funcPlugin{name: name, factory: *factory}, nil
+		}
+	}
+	return nil, errors.New(path + " exports neither a Plugin variable which implements the plugin interface nor a Middleware function, napnap of the plugin may differ from the gateway's")
+}
+
+// loadPlugins initializes the plugins of the config and registers their
+// middlewares.
+func (g *Gateway) loadPlugins(dir string, settings []PluginSetting, registry *MiddlewareRegistry) error {
+	for _, setting := range settings {
+		p, source, err := g.openPlugin(dir, setting.Name)
+		if err != nil {
+			return err
+		}
+		config := map[string]interface{}{}
+		if setting.Config != nil {
+			config = normalizePluginConfig(setting.Config).(map[string]interface{})
+		}
+		if err := p.Init(config); err != nil {
+			return fmt.Errorf("plugin %s: %v", setting.Name, err)
+		}
+		if err := registry.Register(p.Name(), setting.Priority, p.Handler()); err != nil {
+			return fmt.Errorf("plugin %s: %v", setting.Name, err)
+		}
+		g.plugins = append(g.plugins, &loadedPlugin{
+			Name:     p.Name(),
+			Source:   source,
+			Priority: setting.Priority,
+			Config:   config,
+		})
+		g.logger.infof("plugin %s was loaded from %s", p.Name(), source)
+	}
+	return nil
+}
+
+// normalizePluginConfig turns the maps of the yaml decoder into maps with
+// string keys, so plugins and the json encoder can read them.
+func normalizePluginConfig(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		result := map[string]interface{}{}
+		for key, val := range v {
+			result[fmt.Sprint(key)] = normalizePluginConfig(val)
+		}
+		return result
+	case map[string]interface{}:
+		result := map[string]interface{}{}
+		for key, val := range v {
+			result[key] = normalizePluginConfig(val)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, val := range v {
+			result[i] = normalizePluginConfig(val)
+		}
+		return result
+	}
+	return value
+}
+
+type pluginCollection struct {
+	Count   int             `json:"count"`
+	Plugins []*loadedPlugin `json:"plugins"`
+}
+
+func (g *Gateway) listPluginsEndpoint(c *napnap.Context) {
+	c.JSON(200, pluginCollection{
+		Count:   len(g.plugins),
+		Plugins: g.plugins,
+	})
+}
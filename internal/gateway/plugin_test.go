@@ -0,0 +1,137 @@
+package gateway
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	goplugin "plugin"
+	"reflect"
+	"testing"
+
+	"github.com/jasonsoft/napnap"
+)
+
+// otherNapnapPlugin stands for a Plugin variable which was built against
+// another copy of napnap, it doesn't implement the interface of the gateway.
+type otherNapnapPlugin struct{}
+
+func (p *otherNapnapPlugin) Name() string {
+	return "other"
+}
+
+func symbols(values map[string]goplugin.Symbol) func(string) (goplugin.Symbol, error) {
+	return func(name string) (goplugin.Symbol, error) {
+		if symbol, ok := values[name]; ok {
+			return symbol, nil
+		}
+		return nil, errors.New("symbol " + name + " not found")
+	}
+}
+
+func headerMiddleware(config map[string]interface{}) (func(http.Handler) http.Handler, error) {
+	value, _ := config["value"].(string)
+	if len(value) == 0 {
+		return nil, errors.New("value can't be empty")
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/deny" {
+				w.WriteHeader(403)
+				return
+			}
+			r.Header.Set("X-Plugin", value)
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+func TestLookupPluginFallsBackToTheMiddlewareFunc(t *testing.T) {
+	factory := MiddlewareFactory(headerMiddleware)
+	p, err := lookupPlugin("header", "header.so", symbols(map[string]goplugin.Symbol{
+		"Plugin":     &otherNapnapPlugin{},
+		"Middleware": factory,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name() != "header" {
+		t.Fatalf("name = %s, want the name of the setting", p.Name())
+	}
+	if err := p.Init(map[string]interface{}{}); err == nil {
+		t.Fatal("the error of the factory must be returned")
+	}
+	if err := p.Init(map[string]interface{}{"value": "on"}); err != nil {
+		t.Fatal(err)
+	}
+
+	nap := napnap.New()
+	nap.Use(p.Handler())
+	nap.UseFunc(func(c *napnap.Context, next napnap.HandlerFunc) {
+		c.String(200, c.Request.Header.Get("X-Plugin"))
+	})
+	w := httptest.NewRecorder()
+	nap.ServeHTTP(w, httptest.NewRequest("GET", "/orders", nil))
+	if w.Code != 200 || w.Body.String() != "on" {
+		t.Fatalf("got %d %q, the next middleware must see the changed request", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	nap.ServeHTTP(w, httptest.NewRequest("GET", "/deny", nil))
+	if w.Code != 403 {
+		t.Fatalf("status = %d, the middleware may answer the request", w.Code)
+	}
+
+	// a variable of the func type is looked up as a pointer
+	if _, err := lookupPlugin("header", "header.so", symbols(map[string]goplugin.Symbol{"Middleware": &factory})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lookupPlugin("header", "header.so", symbols(map[string]goplugin.Symbol{"Plugin": &otherNapnapPlugin{}})); err == nil {
+		t.Fatal("a plugin without a usable symbol must be rejected")
+	}
+}
+
+func TestLookupPluginPrefersThePluginVariable(t *testing.T) {
+	builtin := &RateLimitMiddleware{}
+	p, err := lookupPlugin("rate_limit", "rate_limit.so", symbols(map[string]goplugin.Symbol{
+		"Plugin":     builtin,
+		"Middleware": MiddlewareFactory(headerMiddleware),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != Plugin(builtin) {
+		t.Fatal("the Plugin variable must be used when it implements the interface")
+	}
+}
+
+func TestCircuitBreakerIsNotAPlugin(t *testing.T) {
+	if _, _, err := testGateway.openPlugin("", "circuit_breaker"); err != errCircuitBreakerPlugin {
+		t.Fatalf("err = %v, want %v", err, errCircuitBreakerPlugin)
+	}
+}
+
+func TestLoadPluginsRegistersBuiltinPlugins(t *testing.T) {
+	previous := testGateway.plugins
+	testGateway.plugins = []*loadedPlugin{}
+	t.Cleanup(func() {
+		testGateway.plugins = previous
+	})
+	registry := newMiddlewareRegistry()
+	settings := []PluginSetting{{
+		Name:     "rate_limit",
+		Priority: PriorityRateLimit,
+		Config:   map[string]interface{}{"rps": 10, "burst": 20},
+	}}
+	if err := testGateway.loadPlugins(t.TempDir(), settings, registry); err != nil {
+		t.Fatal(err)
+	}
+	if got := registry.Names(); !reflect.DeepEqual(got, []string{"rate_limit"}) {
+		t.Fatalf("names = %v, want rate_limit", got)
+	}
+	if len(testGateway.plugins) != 1 || testGateway.plugins[0].Source != "builtin" {
+		t.Fatalf("plugins = %v, want the builtin rate_limit", testGateway.plugins)
+	}
+
+	if err := testGateway.loadPlugins("", []PluginSetting{{Name: "missing"}}, newMiddlewareRegistry()); err == nil {
+		t.Fatal("an unknown plugin must stop the gateway")
+	}
+}
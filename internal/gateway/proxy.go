@@ -0,0 +1,1060 @@
+package gateway
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	upstream "github.com/jasonsoft/bifrost/internal/proxy"
+	"github.com/jasonsoft/bifrost/internal/store"
+	"github.com/jasonsoft/napnap"
+)
+
+type proxy struct {
+	gateway     *Gateway
+	routes      RouteTable
+	client      *http.Client
+	h2cClient   *http.Client
+	hopHeaders  []string
+	corsHeaders []string
+}
+
+func newProxy(g *Gateway, routes RouteTable) *proxy {
+	p := &proxy{
+		gateway: g,
+		routes:  routes,
+	}
+
+	// the timeout is applied per request, see api.upstreamTimeout. http/2 is
+	// negotiated over tls, the dialer of the dns refresher turns it off unless
+	// it's forced.
+	transport := &http.Transport{
+		Proxy:               upstreamProxy,
+		MaxIdleConnsPerHost: 20,
+		ForceAttemptHTTP2:   true,
+	}
+	g.dnsRefresher.Watch(transport)
+	p.client = &http.Client{
+		Transport:     transport,
+		CheckRedirect: passRedirect,
+	}
+
+	// apis with h2c send http/2 over plaintext connections
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	h2cTransport := &http.Transport{
+		MaxIdleConnsPerHost: 20,
+		Protocols:           &protocols,
+	}
+	g.dnsRefresher.Watch(h2cTransport)
+	h2cTransport.DialContext = tunnelEgress(h2cTransport.DialContext)
+	p.h2cClient = &http.Client{
+		Transport:     h2cTransport,
+		CheckRedirect: passRedirect,
+	}
+
+	// Hop-by-hop headers. These are removed when sent to the backend.
+	// http://www.w3.org/Protocols/rfc2616/rfc2616-sec13.html
+	p.hopHeaders = []string{
+		"Connection",
+		"Proxy-Connection", // non-standard but still sent by libcurl and rejected by e.g. google
+		"Keep-Alive",
+		"Proxy-Authenticate",
+		"Proxy-Authorization",
+		"Te",      // canonicalized version of "TE"
+		"Trailer", // not Trailers per URL above; http://www.rfc-editor.org/errata_search.php?eid=4522
+		"Transfer-Encoding",
+		"Upgrade",
+
+		// custom
+		"Content-Length",
+	}
+
+	p.corsHeaders = []string{
+		"Access-Control-Allow-Origin",
+		"Access-Control-Allow-Headers",
+		"Access-Control-Allow-Methods",
+		"Access-Control-Allow-Credentials",
+		"Access-Control-Max-Age",
+	}
+
+	return p
+}
+
+func (p *proxy) Invoke(c *napnap.Context, next napnap.HandlerFunc) {
+	p.gateway.logger.debugf("request host: %v", c.Request.Host)
+	p.gateway.logger.debugf("request path: %v", c.Request.URL.Path)
+
+	//requestHost := strings.ToLower(c.Request.Host)
+
+	consumer := c.MustGet("consumer").(store.Consumer)
+
+	// find api entry which match the request.
+	apiEntry := p.routes.Match(c.Request.Host, c.Request.URL.Path, c.Request.Header)
+
+	// none of api enties are match
+	if apiEntry == nil {
+		if p.gateway.currentConfig().FallThroughUnmatched {
+			next(c) // local routes, then the notFound middleware
+			return
+		}
+		p.gateway.notFound(c, next)
+		return
+	}
+
+	// answer OPTIONS discovery before the permission check so clients can learn the auth scheme
+	if isDiscoveryRequest(c, apiEntry) {
+		writeDiscovery(c, apiEntry, p.gateway.currentConfig())
+		return
+	}
+
+	// reject other methods before the upstream is touched
+	if !apiEntry.isMethodAllowed(c.Request.Method) {
+		c.Set("error", "method "+c.Request.Method+" is not allowed")
+		c.RespHeader("Allow", strings.Join(apiEntry.allowedMethods(), ", "))
+		p.gateway.writeError(c, 405, AppError{ErrorCode: "method_not_allowed", Message: "The method isn't allowed by the api."})
+		return
+	}
+
+	// ensure the consumer has access permission
+	if apiEntry.isAllow(consumer) == false {
+		if consumer.IsAuthenticated() {
+			p.gateway.countAuth(authScopeDenied)
+			p.gateway.writeError(c, 403, authScopeDenied.appError())
+			return
+		}
+		apiEntry.setWWWAuthenticate(c)
+		// a middleware which runs before identity may reject the request
+		// without a reason
+		appError := AppError{ErrorCode: "unauthorized", Message: "The request isn't authorized."}
+		reason, _ := c.Get("auth_reason")
+		if reason, ok := reason.(authReason); ok {
+			appError = reason.appError()
+		}
+		p.gateway.writeError(c, 401, appError)
+		return
+	}
+
+	// the slot is released by the defer even when the upstream call panics
+	var slot *concurrencySlot
+	if apiEntry.MaxConcurrentRequests > 0 {
+		slot = &concurrencySlot{
+			limit: p.gateway.concurrencyLimits.get(apiEntry.Name, apiEntry.MaxConcurrentRequests),
+			wait:  time.Duration(apiEntry.MaxQueueWaitMs) * time.Millisecond,
+		}
+		if !slot.reacquire(c.Request.Context()) {
+			c.Set("error", "api has "+strconv.Itoa(apiEntry.MaxConcurrentRequests)+" requests in flight")
+			p.gateway.writeError(c, 503, AppError{
+				ErrorCode: "too_many_inflight",
+				Message:   "The api has too many requests in flight, please try again later.",
+			})
+			return
+		}
+		defer slot.release()
+	}
+
+	p.gateway.logger.debugf("api host: %s", apiEntry.RequestHost)
+	p.gateway.logger.debugf("api path: %s", apiEntry.RequestPath)
+
+	var targetURL string
+	var svcEntry *store.Service
+	var upstreamEntry *store.Upstream
+	if len(apiEntry.Service) > 0 {
+		for _, svcElement := range p.gateway.services {
+			if apiEntry.Service == svcElement.Name {
+				svcEntry = svcElement
+			}
+		}
+		if svcEntry != nil {
+			// get upstream and exchange url
+			upstreamEntry = svcEntry.AskForUpstream()
+			if upstreamEntry != nil {
+				p.gateway.logger.debugf("upstream: %v", upstreamEntry.Name)
+				targetURL = upstreamEntry.TargetURL
+			}
+
+		}
+	}
+
+	if svcEntry == nil || upstreamEntry == nil {
+		if apiEntry.StickySession != nil {
+			targetURL = apiEntry.askForStickyTarget(c, p.gateway.healthChecker, p.gateway.currentStickySecret())
+		} else {
+			targetURL = apiEntry.askForTarget(p.gateway.healthChecker)
+		}
+		p.gateway.logger.debugf("api entry target url: %v", targetURL)
+	}
+
+	// the canary replaces the chosen target for its share of the requests
+	if apiEntry.Canary != nil {
+		c.Set("variant", "primary")
+		if apiEntry.Canary.isCanary(apiEntry, consumer, p.gateway.clientIP(c)) {
+			c.Set("variant", "canary")
+			targetURL = apiEntry.Canary.TargetURL
+			svcEntry, upstreamEntry = nil, nil
+		}
+	}
+
+	if len(targetURL) == 0 {
+		// no upstreams are available
+		p.gateway.writeError(c, 503, AppError{ErrorCode: "service_unavailable", Message: "There isn't any available upstream."})
+		return
+	}
+
+	// the escaped path is used, so the upstream gets the encoding of the client
+	escapedPath := c.Request.URL.EscapedPath()
+	newPath, templated := apiEntry.expandTargetPath(escapedPath)
+	if !templated && apiEntry.StripRequestPath {
+		prefix := strings.ToLower(apiEntry.RequestPath)
+		if strings.HasPrefix(strings.ToLower(escapedPath), prefix) {
+			newPath = escapedPath[len(prefix):]
+		}
+	}
+
+	// the rewrite target may set its own query string
+	rawQuery := c.Request.URL.RawQuery
+	newPath, targetQuery, rewritten := apiEntry.rewritePath(newPath)
+	if rewritten && len(targetQuery) > 0 {
+		rawQuery = targetQuery
+	}
+
+	outURL, err := upstreamURL(targetURL, newPath, rawQuery)
+	if err != nil {
+		p.writeBadGateway(c, err)
+		return
+	}
+	url := outURL.String()
+
+	p.gateway.logger.debugf("URL: %s", url)
+	c.Set("upstream", targetURL)
+
+	// redirect if needed
+	if apiEntry.Redirect {
+		p.gateway.logger.debug("redirect to ", url)
+		c.Redirect(301, url)
+		return
+	}
+
+	// fail fast when the target keeps failing
+	upstreamFailed := true
+	cbSetting := apiEntry.circuitBreakerSetting(p.gateway.currentConfig())
+	if cbSetting.Enable {
+		breaker := apiEntry.circuitBreaker(p.gateway.circuitBreakers, cbSetting, targetURL)
+		if !breaker.allow(cbSetting) {
+			p.gateway.writeError(c, 503, AppError{
+				ErrorCode: "circuit_open",
+				Message:   "The upstream is failing, please try again later.",
+			})
+			return
+		}
+		defer func() {
+			breaker.record(!upstreamFailed)
+		}()
+	}
+
+	// grpc calls are streamed in both directions instead of buffered
+	if apiEntry.isGRPC() {
+		upstreamFailed = p.proxyGRPC(c, apiEntry, consumer, url) != nil
+		return
+	}
+
+	// websocket connections are tunneled instead of buffered
+	if isWebSocketRequest(c.Request) {
+		upstreamFailed = p.tunnelWebSocket(c, apiEntry, consumer, url) != nil
+		return
+	}
+
+	method := c.Request.Method
+	if !p.gateway.decompressRequestBody(c, apiEntry) {
+		return
+	}
+	// shadow traffic and captures are sampled before the body is read, so a
+	// large body is written to a spill file while the client sends it
+	mirrored := apiEntry.Mirror != nil && apiEntry.Mirror.sample()
+	captured := apiEntry.Capture != nil && p.gateway.captureWriter != nil && apiEntry.Capture.sample()
+	var spill *spillFile
+	if mirrored || captured {
+		spill = p.gateway.spillRequestBody(c, apiEntry)
+		defer func() {
+			// the mirror request and the capture remove the file once they
+			// took it over
+			if spill != nil {
+				spill.remove()
+			}
+		}()
+	}
+	// the body is streamed to the upstream while the client sends it, only a
+	// body which is replayed by a retry or has encrypted fields is buffered
+	var body []byte
+	var stream *streamedBody
+	var reqBody io.Reader
+	if streamsRequestBody(c, apiEntry) {
+		var ok bool
+		stream, ok = p.gateway.newStreamedBody(c, apiEntry, consumer, spill, mirrored || captured)
+		if !ok {
+			return
+		}
+		reqBody = stream
+	} else {
+		var ok bool
+		body, ok = p.gateway.readRequestBody(c, apiEntry, consumer, spill)
+		if !ok {
+			return
+		}
+		body, ok = p.encryptRequestBody(c, apiEntry, body)
+		if !ok {
+			return
+		}
+		reqBody = bytes.NewReader(body)
+	}
+
+	outReq, err := http.NewRequest(method, url, reqBody)
+	if err != nil {
+		panic(err)
+	}
+	outReq.URL = outURL
+	if stream != nil {
+		outReq.ContentLength = c.Request.ContentLength
+	}
+
+	timeout := apiEntry.upstreamTimeout(p.gateway.currentConfig())
+	ctx, deadline, cancel := upstream.NewDeadline(c.Request.Context(), timeout)
+	defer cancel()
+	outReq = outReq.WithContext(withEgressProxy(ctx, apiEntry.egressProxySetting(p.gateway.currentConfig())))
+
+	// keep the original host for virtual host based upstreams
+	if apiEntry.PreserveHost {
+		outReq.Host = c.Request.Host
+	}
+
+	// copy the request header
+	p.copyHeader(outReq.Header, c.Request.Header)
+	p.removeHeader(outReq.Header)
+
+	p.setUpstreamHeader(c, apiEntry, consumer, outReq.Header)
+	// Te is a hop header, but grpc upstreams need to know that trailers arrive
+	if acceptsTrailers(c.Request) {
+		outReq.Header.Set("Te", "trailers")
+	}
+
+	client, err := p.clientFor(apiEntry)
+	if err != nil {
+		p.gateway.logger.writeErrorLog("upstream tls config can't be loaded", map[string]interface{}{
+			"api":   apiEntry.Name,
+			"error": err.Error(),
+		})
+		p.writeBadGateway(c, err)
+		return
+	}
+
+	// send to target, transient failures are resent by the retry policy
+	resp, err := p.doWithRetry(c, apiEntry, client, outReq, slot)
+
+	if err != nil && stream != nil && !stream.writeError(c, apiEntry, consumer) {
+		return
+	}
+
+	// shadow traffic and the capture get the same request once the upstream
+	// was called, a streamed body which the upstream didn't read to the end
+	// can't be sent
+	if mirrored || captured {
+		sentBody, complete := body, true
+		if stream != nil {
+			sentBody, complete = stream.copied(), stream.complete()
+		}
+		if complete {
+			if mirrored && captured && spill != nil {
+				spill.share()
+			}
+			if mirrored {
+				p.mirrorRequest(apiEntry, method, newPath, rawQuery, outReq.Header, sentBody, spill)
+			}
+			if captured {
+				p.gateway.captureWriter.captureRequest(apiEntry, method, outReq.URL.RequestURI(), outReq.URL.Host, outReq.Header, sentBody, spill)
+			}
+			spill = nil
+		} else {
+			if mirrored {
+				p.gateway.skipMirrorRequest(apiEntry, method, errIncompleteBody)
+			}
+			if captured {
+				p.gateway.captureWriter.skipCapture(apiEntry, method, errIncompleteBody)
+			}
+		}
+	}
+	if err != nil {
+		// upsteam server is down, it's taken out of the service. The request
+		// isn't resent as the body was read already, the retry policy
+		// resends buffered bodies.
+		if strings.Contains(err.Error(), "No connection could be made") {
+			if svcEntry != nil && upstreamEntry != nil {
+				svcEntry.UnregisterUpstream(upstreamEntry)
+			}
+			p.writeBadGateway(c, err)
+			return
+		}
+		// upstream server is timeout
+		if deadline.IsExpired() {
+			p.writeTimeout(c, url, timeout)
+			return
+		}
+		if strings.Contains(err.Error(), "request canceled") {
+			p.gateway.logger.debug("request canceled")
+			p.gateway.writeError(c, 504, AppError{ErrorCode: "request_canceled", Message: "The request was canceled."})
+			return
+		}
+		// dns failure, connection refused, tls handshake failure and so on
+		p.writeBadGateway(c, err)
+		return
+	}
+	defer respClose(resp.Body)
+
+	// event streams and bodies without a length are written as they arrive
+	if isStreamingResponse(apiEntry, resp) {
+		upstreamFailed = p.streamResponse(c, apiEntry, resp, deadline) != nil
+		return
+	}
+
+	body, err = ioutil.ReadAll(limitResponseBody(resp.Body, apiEntry.MaxResponseBytes))
+	if err != nil && deadline.IsExpired() {
+		p.writeTimeout(c, url, timeout)
+		return
+	}
+	if apiEntry.MaxResponseBytes > 0 && int64(len(body)) > apiEntry.MaxResponseBytes {
+		// closing instead of draining drops the connection to the upstream
+		resp.Body.Close()
+		p.writeResponseTooLarge(c, apiEntry)
+		return
+	}
+	upstreamFailed = resp.StatusCode >= 500
+
+	// clients which can't read gzip get the plain body
+	decompressed := false
+	if apiEntry.DecompressResponse && isGzipEncoded(resp.Header) && !acceptsGzip(c.Request.Header) {
+		plain, err := gunzip(body, apiEntry.MaxResponseBytes)
+		if err == errResponseTooLarge {
+			p.writeResponseTooLarge(c, apiEntry)
+			return
+		}
+		if err != nil {
+			p.gateway.logger.errorf("failed to decompress the response: %v", err)
+		} else {
+			body = plain
+			decompressed = true
+			resp.Header.Del("Content-Encoding")
+		}
+	}
+
+	// set error message
+	if !(resp.StatusCode >= 200 && resp.StatusCode < 400) {
+		c.Set("status_code", resp.StatusCode)
+		err := string(body)
+		c.Set("error", err)
+		p.gateway.logger.debugf("error: %v", err)
+	}
+
+	if p.gateway.currentConfig().CustomErrors && resp.StatusCode == 500 {
+		// don't write the message when custom error turns on
+		return
+	}
+
+	if apiEntry.FieldEncryption != nil {
+		plaintext, err := apiEntry.FieldEncryption.decryptBody(p.gateway.currentConfig(), filterContentType(resp.Header.Get("Content-Type")), body)
+		if err != nil {
+			p.gateway.logger.errorf("failed to decrypt response fields: %v", err)
+		} else if plaintext != nil {
+			body = plaintext
+		}
+	}
+
+	// copy the response header
+	p.removeHeader(resp.Header)
+	p.removeCORSHeader(apiEntry, resp.Header)
+	p.copyHeader(c.Writer.Header(), resp.Header)
+	apiEntry.rewriteResponseHeader(c.Writer.Header())
+
+	// Content-Length is a hop header, the length of the plain body is set again
+	if decompressed {
+		c.Writer.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	}
+
+	// write body
+	c.SetStatus(resp.StatusCode)
+	c.Writer.Write(body)
+	p.copyTrailer(c, resp)
+}
+
+// copyTrailer sends the trailers of the upstream response, e.g. grpc-status,
+// when the client accepts trailers. The body must be read already.
+func (p *proxy) copyTrailer(c *napnap.Context, resp *http.Response) {
+	if len(resp.Trailer) == 0 || !acceptsTrailers(c.Request) {
+		return
+	}
+	header := c.Writer.Header()
+	for key, values := range resp.Trailer {
+		for _, value := range values {
+			header.Add(http.TrailerPrefix+key, value)
+		}
+	}
+}
+
+// acceptsTrailers reports whether the client connection supports trailers,
+// http/2 always does and http/1.1 clients ask for them with "TE: trailers".
+func acceptsTrailers(req *http.Request) bool {
+	if req.ProtoMajor >= 2 {
+		return true
+	}
+	for _, te := range req.Header["Te"] {
+		for _, value := range strings.Split(te, ",") {
+			if strings.EqualFold(strings.TrimSpace(value), "trailers") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isGzipEncoded(header http.Header) bool {
+	return strings.EqualFold(strings.TrimSpace(header.Get("Content-Encoding")), "gzip")
+}
+
+// acceptsGzip reads the Accept-Encoding header, "gzip;q=0" means the client refuses gzip.
+func acceptsGzip(header http.Header) bool {
+	for _, val := range header["Accept-Encoding"] {
+		for _, token := range strings.Split(val, ",") {
+			parts := strings.Split(token, ";")
+			name := strings.TrimSpace(parts[0])
+			if !strings.EqualFold(name, "gzip") && name != "*" {
+				continue
+			}
+			refused := false
+			for _, param := range parts[1:] {
+				param = strings.Replace(param, " ", "", -1)
+				if param == "q=0" || strings.HasPrefix(param, "q=0.") && strings.Trim(param[4:], "0") == "" {
+					refused = true
+				}
+			}
+			if !refused {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// gunzip unpacks the body, max limits the plain body as well, so a small
+// compressed body can't expand beyond max_response_bytes.
+func gunzip(body []byte, max int64) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	plain, err := ioutil.ReadAll(limitResponseBody(reader, max))
+	if err != nil {
+		return nil, err
+	}
+	if max > 0 && int64(len(plain)) > max {
+		return nil, errResponseTooLarge
+	}
+	return plain, nil
+}
+
+// gzipRequestBody remembers the error of a malformed gzip body, so it's
+// answered with 400 instead of forwarding a truncated body.
+type gzipRequestBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+	err  error
+	// remaining stops the decompression one byte after the limit of the
+	// api, it's negative when there is no limit
+	remaining int64
+}
+
+func (b *gzipRequestBody) Read(p []byte) (int, error) {
+	if b.remaining == 0 {
+		return 0, io.EOF
+	}
+	if b.remaining > 0 && int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.Reader.Read(p)
+	if b.remaining > 0 {
+		b.remaining -= int64(n)
+	}
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+func (b *gzipRequestBody) Close() error {
+	b.Reader.Close()
+	return b.body.Close()
+}
+
+// decompressRequestBody unpacks a gzip request body for apis with
+// decompress_request. The length is unknown until the body is read, the
+// size limit applies to the plain body. It writes the error response and
+// returns false when the body isn't gzip.
+func (g *Gateway) decompressRequestBody(c *napnap.Context, apiEntry *api) bool {
+	if !apiEntry.DecompressRequest || !isGzipEncoded(c.Request.Header) {
+		return true
+	}
+	reader, err := gzip.NewReader(c.Request.Body)
+	if err != nil {
+		g.writeInvalidGzip(c, err)
+		return false
+	}
+	remaining := int64(-1)
+	if limit := apiEntry.maxRequestBodyBytes(g.currentConfig()); limit > 0 {
+		remaining = limit + 1
+	}
+	c.Request.Body = &gzipRequestBody{Reader: reader, body: c.Request.Body, remaining: remaining}
+	c.Request.Header.Del("Content-Encoding")
+	c.Request.Header.Del("Content-Length")
+	c.Request.ContentLength = -1
+	return true
+}
+
+func (g *Gateway) writeInvalidGzip(c *napnap.Context, err error) {
+	c.Set("error", "request body isn't valid gzip: "+err.Error())
+	g.writeError(c, 400, AppError{ErrorCode: "invalid_input", Message: "The request body isn't valid gzip."})
+}
+
+// readRequestBody reads at most one byte more than the api's limit, so a
+// large body is rejected with 413 before the upstream is contacted. The body
+// is written to the spill file of the mirror as well while it's read.
+func (g *Gateway) readRequestBody(c *napnap.Context, apiEntry *api, consumer store.Consumer, spill *spillFile) ([]byte, bool) {
+	limit := apiEntry.maxRequestBodyBytes(g.currentConfig())
+	gzipBody, _ := c.Request.Body.(*gzipRequestBody)
+	var reader io.Reader = c.Request.Body
+	if spill != nil {
+		reader = io.TeeReader(reader, spill)
+	}
+	if limit <= 0 {
+		body, _ := ioutil.ReadAll(reader)
+		if gzipBody != nil && gzipBody.err != nil {
+			g.writeInvalidGzip(c, gzipBody.err)
+			return nil, false
+		}
+		return body, true
+	}
+	read := 0
+	if c.Request.ContentLength <= limit {
+		body, _ := ioutil.ReadAll(io.LimitReader(reader, limit+1))
+		if gzipBody != nil && gzipBody.err != nil {
+			g.writeInvalidGzip(c, gzipBody.err)
+			return nil, false
+		}
+		if int64(len(body)) <= limit {
+			return body, true
+		}
+		read = len(body)
+	}
+	g.writeRequestTooLarge(c, apiEntry, consumer, limit, int64(read))
+	return nil, false
+}
+
+func (g *Gateway) writeRequestTooLarge(c *napnap.Context, apiEntry *api, consumer store.Consumer, limit int64, read int64) {
+	g.logger.writeWarnLog("request body is too large", map[string]interface{}{
+		"api":         apiEntry.Name,
+		"client_ip":   g.clientIP(c),
+		"consumer_id": consumer.ID,
+		"limit":       limit,
+		"read":        read,
+	})
+	c.Set("request_body_read", read)
+	c.Set("error", "request body is larger than "+strconv.FormatInt(limit, 10)+" bytes")
+	g.writeError(c, 413, AppError{ErrorCode: "request_too_large", Message: "The request body is too large."})
+}
+
+var (
+	errRequestTooLarge = errors.New("request body is larger than max_request_body_bytes")
+	errIncompleteBody  = errors.New("the upstream didn't read the whole body")
+)
+
+// streamsRequestBody reports whether the body is forwarded while it's read.
+// A retry resends the body and the encryption needs all of it, so they get a
+// buffered body, an empty body is never streamed.
+func streamsRequestBody(c *napnap.Context, apiEntry *api) bool {
+	if c.Request.ContentLength == 0 {
+		return false
+	}
+	if fe := apiEntry.FieldEncryption; fe != nil && len(fe.RequestFields) > 0 {
+		return false
+	}
+	return apiEntry.Retry == nil || !apiEntry.Retry.allowsMethod(c.Request.Method)
+}
+
+// streamedBody is the request body of the upstream request. It's written to
+// the spill file of the mirror and, for a mirrored body which isn't spilled,
+// to memory while the transport reads it. The transport can still read after
+// the response arrived, so the state is guarded by the mutex.
+type streamedBody struct {
+	sync.Mutex
+	reader   io.Reader
+	copy     *bytes.Buffer
+	gzipped  bool
+	limit    int64
+	read     int64
+	exceeded bool
+	eof      bool
+	err      error
+	gateway  *Gateway
+}
+
+// newStreamedBody rejects a body whose Content-Length is beyond the api's
+// limit before the upstream is contacted, a body of unknown length fails the
+// upstream request once it grows beyond it. It writes the error response and
+// returns false when the body is rejected.
+func (g *Gateway) newStreamedBody(c *napnap.Context, apiEntry *api, consumer store.Consumer, spill *spillFile, mirrored bool) (*streamedBody, bool) {
+	limit := apiEntry.maxRequestBodyBytes(g.currentConfig())
+	if limit > 0 && c.Request.ContentLength > limit {
+		g.writeRequestTooLarge(c, apiEntry, consumer, limit, 0)
+		return nil, false
+	}
+	_, gzipped := c.Request.Body.(*gzipRequestBody)
+	b := &streamedBody{reader: c.Request.Body, gzipped: gzipped, limit: limit, gateway: g}
+	switch {
+	case spill != nil:
+		b.reader = io.TeeReader(b.reader, spill)
+	case mirrored:
+		b.copy = &bytes.Buffer{}
+		b.reader = io.TeeReader(b.reader, b.copy)
+	}
+	return b, true
+}
+
+func (b *streamedBody) Read(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	if b.exceeded {
+		return 0, errRequestTooLarge
+	}
+	n, err := b.reader.Read(p)
+	b.read += int64(n)
+	if b.limit > 0 && b.read > b.limit {
+		b.exceeded = true
+		return n - int(b.read-b.limit), errRequestTooLarge
+	}
+	switch {
+	case err == io.EOF:
+		b.eof = true
+	case err != nil && b.err == nil:
+		b.err = err
+	}
+	return n, err
+}
+
+// complete reports whether the whole body was read.
+func (b *streamedBody) complete() bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.eof
+}
+
+// copied returns the body which was kept in memory for the mirror.
+func (b *streamedBody) copied() []byte {
+	b.Lock()
+	defer b.Unlock()
+	if b.copy == nil {
+		return nil
+	}
+	return b.copy.Bytes()
+}
+
+// writeError answers a failed upstream request whose body couldn't be read
+// with 413 or 400 instead of 502. It returns true when the failure wasn't
+// caused by the body.
+func (b *streamedBody) writeError(c *napnap.Context, apiEntry *api, consumer store.Consumer) bool {
+	b.Lock()
+	exceeded, read, err := b.exceeded, b.read, b.err
+	b.Unlock()
+	switch {
+	case exceeded:
+		b.gateway.writeRequestTooLarge(c, apiEntry, consumer, b.limit, read)
+		return false
+	case err != nil && b.gzipped:
+		b.gateway.writeInvalidGzip(c, err)
+		return false
+	}
+	return true
+}
+
+// encryptRequestBody encrypts the configured json fields of the body. The
+// plaintext is zeroed once the encrypted copy exists. It writes the error
+// response and returns false when the body can't be forwarded.
+func (p *proxy) encryptRequestBody(c *napnap.Context, apiEntry *api, body []byte) ([]byte, bool) {
+	fe := apiEntry.FieldEncryption
+	if fe == nil || len(fe.RequestFields) == 0 {
+		return body, true
+	}
+	// the access log must not write the plaintext
+	c.Set("field_encryption", true)
+
+	sealed, err := fe.encryptBody(p.gateway.currentConfig(), c.ContentType(), body)
+	switch {
+	case err == errMalformedBody && fe.OnMalformed == "passthrough":
+		return body, true
+	case err == errMalformedBody:
+		zero(body)
+		p.gateway.writeError(c, 400, AppError{ErrorCode: "invalid_input", Message: "The request body isn't valid json."})
+		return nil, false
+	case err == errBodyTooLarge:
+		zero(body)
+		p.gateway.writeError(c, 413, AppError{ErrorCode: "request_too_large", Message: "The request body is too large to be encrypted."})
+		return nil, false
+	case err != nil:
+		// e.g. a listed field which is an object, the request is the
+		// client's fault and mustn't be forwarded in plaintext
+		zero(body)
+		c.Set("error", err.Error())
+		p.gateway.writeError(c, 400, AppError{ErrorCode: "invalid_input", Message: "The request body can't be encrypted."})
+		return nil, false
+	case sealed == nil:
+		return body, true
+	}
+	zero(body)
+	return sealed, true
+}
+
+func (p *proxy) writeTimeout(c *napnap.Context, url string, timeout time.Duration) {
+	p.gateway.logger.debugf("upstream timeout: %v", timeout)
+	c.Set("upstream_timeout", timeout)
+	p.gateway.logger.writeErrorLog("upstream timeout", map[string]interface{}{
+		"request_id": c.MustGet("request-id").(string),
+		"upstream":   url,
+		"timeout_ms": int64(timeout / time.Millisecond),
+	})
+	appError := AppError{
+		ErrorCode: "upstream_timeout",
+		Message:   fmt.Sprintf("The upstream didn't respond within %v.", timeout),
+	}
+	c.Set("error", appError.Message)
+	p.gateway.writeError(c, 504, appError)
+}
+
+// upstreamURL joins the target url and the escaped path. Path, RawPath and
+// RawQuery are set directly, so the percent-encoding of the client is kept
+// byte for byte, e.g. %2F isn't turned into a slash.
+func upstreamURL(targetURL string, escapedPath string, rawQuery string) (*neturl.URL, error) {
+	target, err := neturl.Parse(targetURL)
+	if err != nil {
+		return nil, err
+	}
+	result := *target
+	result.RawPath = target.EscapedPath() + escapedPath
+	result.Path, err = neturl.PathUnescape(result.RawPath)
+	if err != nil {
+		return nil, err
+	}
+	result.RawQuery = rawQuery
+	result.Fragment = ""
+	return &result, nil
+}
+
+// passRedirect returns redirects of the upstream to the client unchanged
+// instead of following them.
+func passRedirect(req *http.Request, via []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+// clientFor returns the client with the api's upstream tls setting.
+func (p *proxy) clientFor(apiEntry *api) (*http.Client, error) {
+	if apiEntry.H2C {
+		if !apiEntry.FollowRedirects {
+			return p.h2cClient, nil
+		}
+		return &http.Client{Transport: p.h2cClient.Transport}, nil
+	}
+	// upstream_http2 uses the shared transports, they negotiate http/2 over tls
+	setting := apiEntry.tlsSetting(p.gateway.currentConfig())
+	if setting == nil && !apiEntry.FollowRedirects {
+		return p.client, nil
+	}
+	client := &http.Client{
+		Transport:     p.client.Transport,
+		CheckRedirect: passRedirect,
+	}
+	if setting != nil {
+		transport, err := p.gateway.upstreamTransports.Get(setting)
+		if err != nil {
+			return nil, err
+		}
+		client.Transport = transport
+	}
+	if apiEntry.FollowRedirects {
+		client.CheckRedirect = nil
+	}
+	return client, nil
+}
+
+var errResponseTooLarge = errors.New("upstream response is larger than max_response_bytes")
+
+// limitResponseBody reads one byte more than max, so a body which is too
+// large can be told apart from one which has exactly max bytes.
+func limitResponseBody(body io.Reader, max int64) io.Reader {
+	if max <= 0 {
+		return body
+	}
+	return io.LimitReader(body, max+1)
+}
+
+func (p *proxy) writeResponseTooLarge(c *napnap.Context, apiEntry *api) {
+	c.Set("error", errResponseTooLarge.Error())
+	c.Set("response_too_large", true)
+	p.gateway.writeError(c, 502, AppError{
+		ErrorCode: "response_too_large",
+		Message:   "The upstream response is too large.",
+	})
+}
+
+// abortResponseTooLarge closes the upstream connection and aborts the
+// response which was partly sent already, so the client sees the
+// truncation instead of a complete but short body.
+func (p *proxy) abortResponseTooLarge(c *napnap.Context, apiEntry *api, resp *http.Response) {
+	resp.Body.Close()
+	c.Set("error", errResponseTooLarge.Error())
+	c.Set("response_too_large", true)
+	p.gateway.logger.writeWarnLog("upstream response was aborted", map[string]interface{}{
+		"api":                apiEntry.Name,
+		"request_id":         c.MustGet("request-id").(string),
+		"max_response_bytes": apiEntry.MaxResponseBytes,
+		"forwarded_bytes":    c.Writer.ContentLength(),
+	})
+	panic(http.ErrAbortHandler)
+}
+
+func (p *proxy) writeBadGateway(c *napnap.Context, err error) {
+	p.gateway.logger.debugf("upstream error: %v", err)
+	c.Set("error", err.Error())
+	p.gateway.writeError(c, 502, AppError{
+		ErrorCode: "bad_gateway",
+		Message:   "The upstream server is unreachable.",
+	})
+}
+
+// setUpstreamHeader adds the gateway's headers to the upstream request.
+func (p *proxy) setUpstreamHeader(c *napnap.Context, apiEntry *api, consumer store.Consumer, header http.Header) {
+	// forward client ip, scheme and host
+	p.setForwardedHeader(c, apiEntry, header)
+
+	// forward request id, it replaces the client's header when it isn't trusted
+	header.Set("X-Request-Id", c.MustGet("request-id").(string))
+
+	// forward consumer information
+	for k := range header {
+		// delete all header value start with X-Consumer
+		if strings.HasPrefix(k, "X-Consumer") {
+			header.Del(k)
+		}
+	}
+
+	if len(consumer.ID) > 0 {
+		header.Set("X-Consumer-Id", consumer.ID)
+		if len(consumer.App) > 0 {
+			header.Set("X-Consumer-App", consumer.App)
+		}
+		if len(consumer.Username) > 0 {
+			header.Set("X-Consumer-Username", consumer.Username)
+		}
+		if len(consumer.CustomID) > 0 {
+			header.Set("X-Consumer-Custom-Id", consumer.CustomID)
+		}
+		if len(consumer.Roles) > 0 {
+			roles := strings.Join(consumer.Roles, ",")
+			header.Set("X-Consumer-Roles", roles)
+		}
+		if len(consumer.CustomFields) > 0 {
+			for key, field := range consumer.CustomFields {
+				if len(key) > 0 && len(field) > 0 {
+					header.Set("X-Consumer-"+key, field)
+				}
+			}
+		}
+	}
+
+	// forward token
+	val, ok := c.Get("token")
+	token, ook := val.(string)
+	if ok && ook && len(token) > 0 {
+		header.Set("X-Token", token)
+	}
+
+	// the api's own header rules are applied last
+	apiEntry.rewriteRequestHeader(header, consumer.ID, c.MustGet("request-id").(string), p.gateway.clientIP(c))
+}
+
+// setForwardedHeader appends the peer ip to X-Forwarded-For and sets
+// X-Real-IP. The incoming X-Forwarded-For and X-Real-IP are dropped unless
+// the api or trusted_proxies trust them, so external clients can't spoof
+// their ip.
+func (p *proxy) setForwardedHeader(c *napnap.Context, apiEntry *api, header http.Header) {
+	peerIP := peerIP(c)
+	trustedPeer := ipInCIDRs(peerIP, p.gateway.currentConfig().TrustedProxies)
+
+	forwardedFor := strings.Join(c.Request.Header["X-Forwarded-For"], ", ")
+	if (apiEntry.TrustForwardedFor || trustedPeer) && len(forwardedFor) > 0 {
+		header.Set("X-Forwarded-For", forwardedFor+", "+peerIP)
+	} else {
+		header.Set("X-Forwarded-For", peerIP)
+	}
+
+	if !apiEntry.TrustForwardedFor {
+		header.Set("X-Real-IP", p.gateway.clientIP(c))
+	} else if len(header.Get("X-Real-IP")) == 0 {
+		header.Set("X-Real-IP", p.gateway.clientIP(c))
+	}
+
+	if c.Request.TLS != nil {
+		header.Set("X-Forwarded-Proto", "https")
+	} else {
+		header.Set("X-Forwarded-Proto", "http")
+	}
+	header.Set("X-Forwarded-Host", c.Request.Host)
+}
+
+// CopyHeaders copies http headers from source to destination, it
+// does not overide, but adds multiple headers
+func (p *proxy) copyHeader(dst, src http.Header) {
+	for k, vv := range src {
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+}
+
+func (p *proxy) removeHeader(header http.Header) {
+	// headers listed in Connection are hop-by-hop as well, RFC 7230 section 6.1
+	for _, val := range header["Connection"] {
+		for _, h := range strings.Split(val, ",") {
+			if h = strings.TrimSpace(h); len(h) > 0 {
+				header.Del(h)
+			}
+		}
+	}
+	for _, h := range p.hopHeaders {
+		header.Del(h)
+	}
+}
+
+// removeCORSHeader removes the cors headers of the upstream response when
+// the gateway sets them.
+func (p *proxy) removeCORSHeader(apiEntry *api, header http.Header) {
+	if !p.gateway.currentConfig().Cors.Enable && apiEntry.CORS == nil {
+		return
+	}
+	for _, corsHeader := range p.corsHeaders {
+		header.Del(corsHeader)
+	}
+}
@@ -0,0 +1,461 @@
+package gateway
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	upstream "github.com/jasonsoft/bifrost/internal/proxy"
+	"github.com/jasonsoft/napnap"
+)
+
+func gzipBytes(t *testing.T, plain []byte) []byte {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecompressedResponseIsLimited(t *testing.T) {
+	// a megabyte of zeros compresses to about a kilobyte
+	compressed := gzipBytes(t, make([]byte, 1<<20))
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compressed)
+	}))
+	defer upstream.Close()
+
+	apiEntry := newTestAPI(t, "bomb", upstream.URL)
+	apiEntry.DecompressResponse = true
+	apiEntry.MaxResponseBytes = 64 * 1024
+	gateway, _ := serveTestGateway(t, []*api{apiEntry})
+
+	req, _ := http.NewRequest("GET", gateway.URL+"/bomb", nil)
+	req.Header.Set("Accept-Encoding", "identity")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 502 {
+		t.Fatalf("status = %d, want 502", resp.StatusCode)
+	}
+	if !strings.Contains(string(body), "response_too_large") {
+		t.Fatalf("body = %q, want response_too_large", body)
+	}
+}
+
+func TestDecompressedRequestIsLimited(t *testing.T) {
+	// the body is streamed, the upstream request fails once the plain body
+	// grows beyond the limit
+	received := make(chan int64, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(ioutil.Discard, r.Body)
+		received <- n
+	}))
+	defer upstream.Close()
+
+	apiEntry := newTestAPI(t, "upload", upstream.URL)
+	apiEntry.DecompressRequest = true
+	apiEntry.MaxRequestBodyBytes = 64 * 1024
+	gateway, _ := serveTestGateway(t, []*api{apiEntry})
+
+	req, _ := http.NewRequest("POST", gateway.URL+"/upload", bytes.NewReader(gzipBytes(t, make([]byte, 1<<20))))
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 413 {
+		t.Fatalf("status = %d, want 413", resp.StatusCode)
+	}
+	select {
+	case n := <-received:
+		if n > apiEntry.MaxRequestBodyBytes {
+			t.Fatalf("the upstream got %d bytes, more than the limit", n)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the upstream request wasn't aborted")
+	}
+}
+
+func TestStreamedResponseTooLargeBeforeFirstWrite(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// no Content-Length, so the response is streamed
+		w.Write(bytes.Repeat([]byte("a"), 100))
+		w.(http.Flusher).Flush()
+	}))
+	defer upstream.Close()
+
+	apiEntry := newTestAPI(t, "stream", upstream.URL)
+	apiEntry.MaxResponseBytes = 10
+	gateway, _ := serveTestGateway(t, []*api{apiEntry})
+
+	resp, err := http.Get(gateway.URL + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 502 {
+		t.Fatalf("status = %d, want 502", resp.StatusCode)
+	}
+	if !strings.Contains(string(body), "response_too_large") {
+		t.Fatalf("body = %q, want response_too_large", body)
+	}
+}
+
+func TestStreamedResponseWithinLimit(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream", "yes")
+		w.WriteHeader(201)
+		w.Write([]byte("hello"))
+		w.(http.Flusher).Flush()
+		w.Write([]byte(" world"))
+	}))
+	defer upstream.Close()
+
+	apiEntry := newTestAPI(t, "stream", upstream.URL)
+	apiEntry.MaxResponseBytes = 64
+	gateway, _ := serveTestGateway(t, []*api{apiEntry})
+
+	resp, err := http.Get(gateway.URL + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 201 || resp.Header.Get("X-Upstream") != "yes" || string(body) != "hello world" {
+		t.Fatalf("got %d %q %q, want the upstream response", resp.StatusCode, resp.Header.Get("X-Upstream"), body)
+	}
+}
+
+func TestUnauthorizedWithoutAuthReason(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the upstream must not be called")
+	}))
+	defer upstream.Close()
+
+	apiEntry := newTestAPI(t, "private", upstream.URL)
+	apiEntry.Authorization = true
+	// a middleware which doesn't know the auth reasons
+	gateway, _ := serveTestGateway(t, []*api{apiEntry}, napnap.MiddlewareFunc(func(c *napnap.Context, next napnap.HandlerFunc) {
+		c.Set("auth_reason", "rejected")
+		next(c)
+	}))
+
+	resp, err := http.Get(gateway.URL + "/private")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 401 || !strings.Contains(string(body), `"unauthorized"`) {
+		t.Fatalf("got %d %q, want 401 unauthorized", resp.StatusCode, body)
+	}
+}
+
+func TestAPICanOptOutOfTheGlobalBodyLimit(t *testing.T) {
+	withConfig(t, func(config *Configuration) {
+		config.MaxRequestBodyBytes = 1024
+	})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte(strings.Repeat("x", len(body))))
+	}))
+	defer upstream.Close()
+
+	inherited := newTestAPI(t, "inherited", upstream.URL)
+	inherited.RequestPath = "/inherited"
+	unlimited := newTestAPI(t, "unlimited", upstream.URL)
+	unlimited.RequestPath = "/unlimited"
+	unlimited.MaxRequestBodyBytes = -1
+	if err := unlimited.isValid(testGateway.currentConfig()); err != nil {
+		t.Fatal(err)
+	}
+	gateway, _ := serveTestGateway(t, []*api{inherited, unlimited})
+
+	for path, status := range map[string]int{"/inherited": 413, "/unlimited": 200} {
+		resp, err := http.Post(gateway.URL+path, "text/plain", bytes.NewReader(make([]byte, 4096)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Fatalf("%s: status = %d, want %d", path, resp.StatusCode, status)
+		}
+		if status == 200 && len(body) != 4096 {
+			t.Fatalf("%s: the upstream got %d bytes, want 4096", path, len(body))
+		}
+	}
+
+	invalid := newTestAPI(t, "invalid", upstream.URL)
+	invalid.MaxRequestBodyBytes = -2
+	if invalid.isValid(testGateway.currentConfig()) == nil {
+		t.Fatal("a limit below -1 must be rejected")
+	}
+}
+
+// startEchoUpstream returns a tls upstream which echoes the request body,
+// with http2 it offers http/2 and http/1.1 otherwise.
+func startEchoUpstream(tb testing.TB, http2 bool) *httptest.Server {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proto", r.Proto)
+		io.Copy(w, r.Body)
+	}))
+	upstream.EnableHTTP2 = http2
+	upstream.StartTLS()
+	tb.Cleanup(upstream.Close)
+	return upstream
+}
+
+func newHTTP2TestAPI(tb testing.TB, name string, server *httptest.Server) *api {
+	apiEntry := newTestAPI(tb, name, server.URL)
+	apiEntry.RequestPath = "/" + name
+	apiEntry.UpstreamHTTP2 = true
+	apiEntry.UpstreamTLS = &upstream.TLS{InsecureSkipVerify: true}
+	if err := apiEntry.isValid(testGateway.currentConfig()); err != nil {
+		tb.Fatal(err)
+	}
+	return apiEntry
+}
+
+func TestUpstreamHTTP2UsesTheSharedTransport(t *testing.T) {
+	upstream := startEchoUpstream(t, true)
+	apiEntry := newHTTP2TestAPI(t, "h2", upstream)
+	gateway, _ := serveTestGateway(t, []*api{apiEntry})
+
+	resp, err := http.Get(gateway.URL + "/h2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if proto := resp.Header.Get("X-Proto"); proto != "HTTP/2.0" {
+		t.Fatalf("the upstream got %s, want HTTP/2.0", proto)
+	}
+
+	client, err := newProxy(testGateway, newAPIRouteTable(nil)).clientFor(apiEntry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, _ := testGateway.upstreamTransports.Get(apiEntry.UpstreamTLS)
+	if client.Transport != shared {
+		t.Fatal("upstream_http2 must use the transport of the tls setting")
+	}
+
+	plain := newTestAPI(t, "plain", "http://127.0.0.1:1")
+	plain.UpstreamHTTP2 = true
+	if plain.isValid(testGateway.currentConfig()) == nil {
+		t.Fatal("upstream_http2 needs https targets")
+	}
+}
+
+// BenchmarkUpstreamProtocols compares the throughput of http/1.1 and http/2
+// upstreams under 50 concurrent clients.
+func BenchmarkUpstreamProtocols(b *testing.B) {
+	for _, test := range []struct {
+		name  string
+		http2 bool
+	}{{"http1", false}, {"http2", true}} {
+		b.Run(test.name, func(b *testing.B) {
+			apiEntry := newHTTP2TestAPI(b, test.name, startEchoUpstream(b, test.http2))
+			gateway, _ := serveTestGateway(b, []*api{apiEntry})
+			client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 50}}
+			defer client.CloseIdleConnections()
+			payload := bytes.Repeat([]byte("x"), 1024)
+
+			b.SetParallelism((50 + runtime.GOMAXPROCS(0) - 1) / runtime.GOMAXPROCS(0))
+			b.SetBytes(int64(len(payload)))
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					resp, err := client.Post(gateway.URL+"/"+test.name, "text/plain", bytes.NewReader(payload))
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					io.Copy(ioutil.Discard, resp.Body)
+					resp.Body.Close()
+				}
+			})
+		})
+	}
+}
+
+func TestUnreachableUpstreamFailuresAreBadGateway(t *testing.T) {
+	tlsUpstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the upstream must not be reached without a trusted certificate")
+	}))
+	defer tlsUpstream.Close()
+
+	tests := []struct {
+		name      string
+		targetURL string
+		cause     string
+	}{
+		{"connection_refused", "http://" + freeAddr(t), "connection refused"},
+		// .invalid never resolves, see rfc 2606
+		{"dns_failure", "http://bifrost-upstream.invalid", "bifrost-upstream.invalid"},
+		{"tls_handshake_failure", tlsUpstream.URL, "certificate"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			apiEntry := newTestAPI(t, test.name, test.targetURL)
+			apiEntry.TimeoutMs = 5000
+			var cause string
+			gateway, _ := serveTestGateway(t, []*api{apiEntry}, napnap.MiddlewareFunc(func(c *napnap.Context, next napnap.HandlerFunc) {
+				next(c)
+				if err, ok := c.Get("error"); ok {
+					cause = err.(string)
+				}
+			}))
+
+			resp, err := http.Get(gateway.URL + "/orders")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var body AppError
+			json.NewDecoder(resp.Body).Decode(&body)
+			resp.Body.Close()
+			if resp.StatusCode != 502 || body.ErrorCode != "bad_gateway" {
+				t.Fatalf("status = %d, error_code = %q, want 502 bad_gateway", resp.StatusCode, body.ErrorCode)
+			}
+			if body.RequestID != "test" {
+				t.Fatalf("request_id = %q, the error must name the request", body.RequestID)
+			}
+			if !strings.Contains(cause, test.cause) {
+				t.Fatalf("error = %q, want the cause %q for the access log", cause, test.cause)
+			}
+		})
+	}
+}
+
+func TestPreserveHost(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	}))
+	defer upstream.Close()
+	targetHost := strings.TrimPrefix(upstream.URL, "http://")
+
+	for _, preserveHost := range []bool{true, false} {
+		apiEntry := newTestAPI(t, "shop", upstream.URL)
+		apiEntry.PreserveHost = preserveHost
+		gateway, _ := serveTestGateway(t, []*api{apiEntry})
+
+		req, _ := http.NewRequest("GET", gateway.URL+"/shop", nil)
+		req.Host = "shop.example.com"
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		host, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		want := targetHost
+		if preserveHost {
+			want = "shop.example.com"
+		}
+		if string(host) != want {
+			t.Errorf("preserve_host %v: the upstream got the host %s, want %s", preserveHost, host, want)
+		}
+	}
+}
+
+func TestUpstreamRedirectIsPassedToTheClient(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			w.Write([]byte("login page"))
+			return
+		}
+		http.Redirect(w, r, "/login?next=%2Fcart", 302)
+	}))
+	defer upstream.Close()
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	for _, followRedirects := range []bool{false, true} {
+		apiEntry := newTestAPI(t, "cart", upstream.URL)
+		apiEntry.FollowRedirects = followRedirects
+		gateway, _ := serveTestGateway(t, []*api{apiEntry})
+
+		resp, err := client.Get(gateway.URL + "/cart")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if followRedirects {
+			if resp.StatusCode != 200 || string(body) != "login page" {
+				t.Errorf("follow_redirects: status = %d, body = %s, want the login page", resp.StatusCode, body)
+			}
+			continue
+		}
+		if resp.StatusCode != 302 || resp.Header.Get("Location") != "/login?next=%2Fcart" {
+			t.Errorf("status = %d, Location = %q, want the redirect of the upstream", resp.StatusCode, resp.Header.Get("Location"))
+		}
+	}
+}
+
+func TestUpstreamURLKeepsTheEncoding(t *testing.T) {
+	for _, test := range []struct {
+		target, path, query string
+		want                string
+	}{
+		{"http://files:8080", "/files/a%2Fb.txt", "", "http://files:8080/files/a%2Fb.txt"},
+		{"http://files:8080/v1", "/a%20b+c", "", "http://files:8080/v1/a%20b+c"},
+		{"http://files:8080", "/search", "q=tom%26jerry&page=2", "http://files:8080/search?q=tom%26jerry&page=2"},
+		{"http://files:8080", "/search", "tag=a+b&tag=c%2Bd", "http://files:8080/search?tag=a+b&tag=c%2Bd"},
+	} {
+		result, err := upstreamURL(test.target, test.path, test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.String() != test.want {
+			t.Errorf("url = %s, want %s", result, test.want)
+		}
+	}
+
+	result, _ := upstreamURL("http://files:8080", "/search", "q=tom%26jerry&page=2")
+	if q := result.Query(); q.Get("q") != "tom&jerry" || q.Get("page") != "2" {
+		t.Fatalf("query = %v, the encoded & must not split the value", q)
+	}
+}
+
+func TestUpstreamSeesTheEncodedPathAndQuery(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RequestURI))
+	}))
+	defer upstream.Close()
+	apiEntry := newTestAPI(t, "files", upstream.URL)
+	apiEntry.RequestPath = "/files"
+	gateway, _ := serveTestGateway(t, []*api{apiEntry})
+
+	resp, err := http.Get(gateway.URL + "/files/a%2Fb.txt?q=tom%26jerry&page=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.HasSuffix(string(uri), "/a%2Fb.txt?q=tom%26jerry&page=2") {
+		t.Fatalf("the upstream got %s", uri)
+	}
+}
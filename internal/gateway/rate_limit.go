@@ -0,0 +1,242 @@
+package gateway
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jasonsoft/bifrost/internal/store"
+	"github.com/jasonsoft/napnap"
+	redis "gopkg.in/redis.v4"
+)
+
+// RateLimitStore keeps a token bucket per consumer.
+type RateLimitStore interface {
+	Allow(consumerID string) bool
+}
+
+// RateLimitTier is a rate which apis choose by name with rate_limit_tier.
+type RateLimitTier struct {
+	RPS   float64 `yaml:"rps" json:"rps"`
+	Burst int     `yaml:"burst" json:"burst"`
+}
+
+// RateLimitMiddleware rejects requests of consumers which exceed their rate with 429.
+// An api with a rate_limit_tier has its own buckets with the rate of the tier.
+type RateLimitMiddleware struct {
+	gateway *Gateway
+	rps     float64
+	burst   int
+	store   RateLimitStore
+	tiers   map[string]*rateLimitTierStore
+}
+
+type rateLimitTierStore struct {
+	RateLimitTier
+	store RateLimitStore
+}
+
+func newRateLimitMiddleware(g *Gateway, rps float64, burst int, store RateLimitStore) *RateLimitMiddleware {
+	if store == nil {
+		store = newRateLimitMemStore(rps, burst)
+	}
+	return &RateLimitMiddleware{
+		gateway: g,
+		rps:     rps,
+		burst:   burst,
+		store:   store,
+		tiers:   map[string]*rateLimitTierStore{},
+	}
+}
+
+// addTier adds the buckets of a tier, a nil store keeps them in memory.
+func (m *RateLimitMiddleware) addTier(name string, tier RateLimitTier, store RateLimitStore) {
+	if store == nil {
+		store = newRateLimitMemStore(tier.RPS, tier.Burst)
+	}
+	m.tiers[name] = &rateLimitTierStore{RateLimitTier: tier, store: store}
+}
+
+// Name, Init and Handler make the rate limit a built-in plugin. The config
+// has rps, burst and store, memory or redis of the data setting.
+func (m *RateLimitMiddleware) Name() string {
+	return "rate_limit"
+}
+
+func (m *RateLimitMiddleware) Init(config map[string]interface{}) error {
+	rps, ok := config["rps"].(float64)
+	if !ok {
+		if n, isInt := config["rps"].(int); isInt {
+			rps, ok = float64(n), true
+		}
+	}
+	burst, isInt := config["burst"].(int)
+	if !ok || !isInt || rps <= 0 || burst <= 0 {
+		return ErrRateLimit
+	}
+	var limitStore RateLimitStore
+	switch config["store"] {
+	case nil, "memory":
+	case "redis":
+		limitStore = newRateLimitRedis(store.NewRedisClient(m.gateway.currentConfig().Data), rps, burst, m.gateway.logger)
+	default:
+		return errors.New("rate_limit store must be memory or redis")
+	}
+	*m = *newRateLimitMiddleware(m.gateway, rps, burst, limitStore)
+	return nil
+}
+
+func (m *RateLimitMiddleware) Handler() napnap.MiddlewareHandler {
+	return m
+}
+
+func (m *RateLimitMiddleware) Invoke(c *napnap.Context, next napnap.HandlerFunc) {
+	key := "ip:" + m.gateway.clientIP(c)
+	if consumer, ok := c.MustGet("consumer").(store.Consumer); ok && consumer.IsAuthenticated() {
+		key = consumer.ID
+	}
+
+	store, rps := m.store, m.rps
+	apiEntry := m.gateway.routes.Match(c.Request.Host, c.Request.URL.Path, c.Request.Header)
+	if apiEntry != nil && len(apiEntry.RateLimitTier) > 0 {
+		if tier, ok := m.tiers[apiEntry.RateLimitTier]; ok {
+			store, rps = tier.store, tier.RPS
+			key = apiEntry.ID + ":" + key
+		}
+	}
+
+	if !store.Allow(key) {
+		// the bucket is empty, one token is refilled after 1/rps seconds
+		retryAfter := int(math.Ceil(1 / rps))
+		c.RespHeader("Retry-After", strconv.Itoa(retryAfter))
+		m.gateway.writeError(c, 429, AppError{ErrorCode: "too_many_requests", Message: "The rate limit was exceeded."})
+		return
+	}
+	next(c)
+}
+
+/*********************
+	Memory
+*********************/
+
+type tokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// rateLimitMemStore forgets the buckets which are full again, they don't
+// differ from a new bucket. Otherwise every client ip would stay in the map.
+type rateLimitMemStore struct {
+	sync.Mutex
+	rps       float64
+	burst     int
+	buckets   map[string]*tokenBucket
+	refill    time.Duration // how long an empty bucket takes to be full
+	sweptAt   time.Time
+	sweepEach time.Duration
+}
+
+func newRateLimitMemStore(rps float64, burst int) *rateLimitMemStore {
+	refill := time.Duration(float64(burst) / rps * float64(time.Second))
+	sweepEach := refill
+	if sweepEach < time.Minute {
+		sweepEach = time.Minute
+	}
+	return &rateLimitMemStore{
+		rps:       rps,
+		burst:     burst,
+		buckets:   map[string]*tokenBucket{},
+		refill:    refill,
+		sweptAt:   time.Now(),
+		sweepEach: sweepEach,
+	}
+}
+
+// sweep removes the buckets which are full, it's called with the lock held.
+func (s *rateLimitMemStore) sweep(now time.Time) {
+	for key, bucket := range s.buckets {
+		if now.Sub(bucket.updatedAt) >= s.refill {
+			delete(s.buckets, key)
+		}
+	}
+	s.sweptAt = now
+}
+
+func (s *rateLimitMemStore) Allow(consumerID string) bool {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	if now.Sub(s.sweptAt) >= s.sweepEach {
+		s.sweep(now)
+	}
+
+	bucket, ok := s.buckets[consumerID]
+	if !ok {
+		bucket = &tokenBucket{
+			tokens:    float64(s.burst),
+			updatedAt: now,
+		}
+		s.buckets[consumerID] = bucket
+	}
+
+	bucket.tokens = math.Min(float64(s.burst), bucket.tokens+now.Sub(bucket.updatedAt).Seconds()*s.rps)
+	bucket.updatedAt = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+/*********************
+	Redis Database
+*********************/
+
+// KEYS[1] bucket key, ARGV[1] rps, ARGV[2] burst, ARGV[3] now in ms
+var redisTokenBucket = redis.NewScript(`
+local rps = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'updated_at')
+local tokens = tonumber(bucket[1]) or burst
+local updatedAt = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + (now - updatedAt) / 1000 * rps)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HMSET', KEYS[1], 'tokens', tokens, 'updated_at', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rps * 1000))
+return allowed
+`)
+
+type rateLimitRedis struct {
+	client *redis.Client
+	rps    float64
+	burst  int
+	logger *logger
+}
+
+func newRateLimitRedis(client *redis.Client, rps float64, burst int, logger *logger) *rateLimitRedis {
+	return &rateLimitRedis{
+		client: client,
+		rps:    rps,
+		burst:  burst,
+		logger: logger,
+	}
+}
+
+// Allow lets the request through when redis can't be reached.
+func (s *rateLimitRedis) Allow(consumerID string) bool {
+	key := "ratelimit:" + consumerID
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	allowed, err := redisTokenBucket.Run(s.client, []string{key}, s.rps, s.burst, now).Result()
+	if err != nil {
+		s.logger.errorf("rate limit error: %v", err)
+		return true
+	}
+	return allowed.(int64) == 1
+}
@@ -0,0 +1,105 @@
+package gateway
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jasonsoft/bifrost/internal/store"
+	"github.com/jasonsoft/napnap"
+)
+
+func TestRateLimitMemStoreSweepsFullBuckets(t *testing.T) {
+	store := newRateLimitMemStore(10, 2)
+	store.Allow("idle")
+	store.Allow("busy")
+	store.Allow("busy")
+
+	// idle has one token left, busy none, both are full after the refill
+	later := time.Now().Add(store.refill / 2)
+	store.buckets["idle"].updatedAt = later.Add(-store.refill)
+	store.sweep(later)
+	if _, ok := store.buckets["idle"]; ok {
+		t.Fatal("the full bucket must be removed")
+	}
+	if _, ok := store.buckets["busy"]; !ok {
+		t.Fatal("the bucket which is still refilling must be kept")
+	}
+}
+
+func TestRateLimitMemStoreSweepsOnAllow(t *testing.T) {
+	store := newRateLimitMemStore(10, 2)
+	for i := 0; i < 100; i++ {
+		store.Allow("ip:10.0.0." + string(rune('a'+i%26)) + string(rune('a'+i/26)))
+	}
+	for _, bucket := range store.buckets {
+		bucket.updatedAt = bucket.updatedAt.Add(-time.Hour)
+	}
+	store.sweptAt = store.sweptAt.Add(-store.sweepEach)
+	if !store.Allow("ip:10.0.0.1") {
+		t.Fatal("a new client must be allowed")
+	}
+	if len(store.buckets) != 1 {
+		t.Fatalf("%d buckets are kept, want only the new one", len(store.buckets))
+	}
+}
+
+func TestRateLimitMemStoreLimits(t *testing.T) {
+	store := newRateLimitMemStore(1, 2)
+	if !store.Allow("a") || !store.Allow("a") {
+		t.Fatal("the burst must be allowed")
+	}
+	if store.Allow("a") {
+		t.Fatal("the third request must be rejected")
+	}
+	if !store.Allow("b") {
+		t.Fatal("another client has its own bucket")
+	}
+}
+
+func TestRateLimitTierOverridesTheDefaultRate(t *testing.T) {
+	withConfig(t, func(config *Configuration) {
+		config.RateLimit.Tiers = map[string]RateLimitTier{"free": {RPS: 0.001, Burst: 1}}
+	})
+	free := newTestAPI(t, "free", "http://free:8080")
+	free.RequestPath = "/free"
+	free.RateLimitTier = "free"
+	if err := free.isValid(testGateway.currentConfig()); err != nil {
+		t.Fatal(err)
+	}
+	open := newTestAPI(t, "open", "http://open:8080")
+	open.RequestPath = "/open"
+	useTestRoutes(t, free, open)
+
+	// the default rate is far from being exceeded
+	rateLimiter := newRateLimitMiddleware(testGateway, 1000, 1000, nil)
+	rateLimiter.addTier("free", RateLimitTier{RPS: 0.001, Burst: 1}, nil)
+	nap := napnap.New()
+	nap.UseFunc(func(c *napnap.Context, next napnap.HandlerFunc) {
+		c.Set("consumer", store.Consumer{})
+		next(c)
+	})
+	nap.Use(rateLimiter)
+	nap.UseFunc(func(c *napnap.Context, next napnap.HandlerFunc) {
+		c.SetStatus(200)
+	})
+
+	statuses := map[string][]int{}
+	for _, path := range []string{"/free", "/open", "/free", "/open"} {
+		w := httptest.NewRecorder()
+		nap.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		statuses[path] = append(statuses[path], w.Code)
+	}
+	if statuses["/free"][0] != 200 || statuses["/free"][1] != 429 {
+		t.Fatalf("free: statuses = %v, want [200 429]", statuses["/free"])
+	}
+	if statuses["/open"][0] != 200 || statuses["/open"][1] != 200 {
+		t.Fatalf("open: statuses = %v, want [200 200]", statuses["/open"])
+	}
+
+	unknown := newTestAPI(t, "unknown", "http://unknown:8080")
+	unknown.RateLimitTier = "gold"
+	if err := unknown.isValid(testGateway.currentConfig()); err == nil {
+		t.Fatal("a tier which isn't in the config must be rejected")
+	}
+}
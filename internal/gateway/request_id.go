@@ -0,0 +1,35 @@
+package gateway
+
+import (
+	"github.com/jasonsoft/napnap"
+	"github.com/satori/go.uuid"
+)
+
+// requestIDMiddleware gives every request an id which is sent to the
+// upstream and back to the client as X-Request-Id. The incoming id is kept
+// when every client is trusted or the client is in a trusted network.
+func (g *Gateway) requestIDMiddleware() napnap.MiddlewareFunc {
+	return func(c *napnap.Context, next napnap.HandlerFunc) {
+		config := g.currentConfig()
+		requestID := ""
+		if config.TrustIncomingRequestID || ipInCIDRs(peerIP(c), config.TrustedRequestIDCIDRs) {
+			requestID = incomingRequestID(c.RequestHeader("X-Request-Id"))
+		}
+		if len(requestID) == 0 {
+			requestID = uuid.NewV4().String()
+		}
+		c.Set("request-id", requestID)
+		c.RespHeader("X-Request-Id", requestID)
+		next(c)
+	}
+}
+
+// incomingRequestID returns the id in canonical form, or empty when it isn't
+// a uuid v4 so clients can't put arbitrary text into the logs.
+func incomingRequestID(value string) string {
+	id, err := uuid.FromString(value)
+	if err != nil || id.Version() != 4 || id.Variant() != uuid.VariantRFC4122 {
+		return ""
+	}
+	return id.String()
+}
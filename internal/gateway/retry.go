@@ -0,0 +1,172 @@
+package gateway
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/jasonsoft/napnap"
+)
+
+const (
+	defaultInitialBackoff = 100 * time.Millisecond
+	defaultMaxBackoff     = 2 * time.Second
+)
+
+// RetryConfig resends a buffered request to the upstream when the connection
+// fails or the upstream answers with one of RetryOn. Only idempotent methods
+// are retried unless AlwaysRetry is set. The attempts share the timeout of
+// the api, the wait between them doubles from InitialBackoffMs up to
+// MaxBackoffMs with jitter.
+type RetryConfig struct {
+	MaxAttempts      int   `json:"max_attempts" bson:"max_attempts"` // including the first attempt
+	InitialBackoffMs int64 `json:"initial_backoff_ms" bson:"initial_backoff_ms"`
+	MaxBackoffMs     int64 `json:"max_backoff_ms" bson:"max_backoff_ms"`
+	RetryOn          []int `json:"retry_on" bson:"retry_on"` // 502, 503 and 504 when empty
+	AlwaysRetry      bool  `json:"always_retry" bson:"always_retry"`
+}
+
+func (rc *RetryConfig) isValid() error {
+	if rc.MaxAttempts < 1 || rc.MaxAttempts > 10 {
+		return errors.New("retry max_attempts must be between 1 and 10")
+	}
+	if rc.InitialBackoffMs < 0 || rc.MaxBackoffMs < 0 {
+		return errors.New("retry backoff can't be negative")
+	}
+	if rc.InitialBackoffMs > 0 && rc.MaxBackoffMs > 0 && rc.MaxBackoffMs < rc.InitialBackoffMs {
+		return errors.New("retry max_backoff_ms can't be less than initial_backoff_ms")
+	}
+	for _, code := range rc.RetryOn {
+		if code < 100 || code > 599 {
+			return errors.New("retry retry_on must be http status codes")
+		}
+	}
+	return nil
+}
+
+func (rc *RetryConfig) allowsMethod(method string) bool {
+	if rc.AlwaysRetry {
+		return true
+	}
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+func (rc *RetryConfig) retriesStatus(code int) bool {
+	if len(rc.RetryOn) == 0 {
+		return code == 502 || code == 503 || code == 504
+	}
+	for _, retryCode := range rc.RetryOn {
+		if retryCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the wait after the attempt, a random duration between the
+// half and the whole of the exponential backoff.
+func (rc *RetryConfig) backoff(attempt int) time.Duration {
+	initial := defaultInitialBackoff
+	if rc.InitialBackoffMs > 0 {
+		initial = time.Duration(rc.InitialBackoffMs) * time.Millisecond
+	}
+	max := defaultMaxBackoff
+	if rc.MaxBackoffMs > 0 {
+		max = time.Duration(rc.MaxBackoffMs) * time.Millisecond
+	}
+	if max < initial {
+		max = initial
+	}
+	wait := initial
+	for i := 1; i < attempt && wait < max; i++ {
+		wait *= 2
+	}
+	if wait > max {
+		wait = max
+	}
+	half := wait / 2
+	return half + time.Duration(rand.Int63n(int64(wait-half)+1))
+}
+
+// isTransientError reports whether the upstream wasn't reached or dropped
+// the connection, a timeout or a canceled request isn't retried.
+func isTransientError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// doWithRetry sends the request and resends it by the retry policy of the
+// api. The request body must be replayable by GetBody. The concurrency slot
+// is given back during the backoff.
+func (p *proxy) doWithRetry(c *napnap.Context, apiEntry *api, client *http.Client, outReq *http.Request, slot *concurrencySlot) (*http.Response, error) {
+	retry := apiEntry.Retry
+	if retry == nil || !retry.allowsMethod(outReq.Method) {
+		return client.Do(outReq)
+	}
+	ctx := outReq.Context()
+	req := outReq
+	for attempt := 1; ; attempt++ {
+		resp, err := client.Do(req)
+		if attempt >= retry.MaxAttempts || ctx.Err() != nil {
+			return resp, err
+		}
+		reason := ""
+		if err != nil {
+			if !isTransientError(err) {
+				return resp, err
+			}
+			reason = err.Error()
+		} else {
+			if !retry.retriesStatus(resp.StatusCode) {
+				return resp, err
+			}
+			reason = http.StatusText(resp.StatusCode)
+		}
+
+		// the last answer is returned when the deadline passes while waiting
+		// or no slot is free again
+		wait := retry.backoff(attempt)
+		slot.release()
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return resp, err
+		case <-timer.C:
+		}
+		if !slot.reacquire(ctx) {
+			return resp, err
+		}
+		if resp != nil {
+			respClose(resp.Body)
+		}
+
+		p.gateway.logger.writeWarnLog("upstream request is retried", map[string]interface{}{
+			"api":        apiEntry.Name,
+			"request_id": c.MustGet("request-id").(string),
+			"upstream":   outReq.URL.Host,
+			"attempt":    attempt + 1,
+			"reason":     reason,
+			"backoff_ms": int64(wait / time.Millisecond),
+		})
+		req = outReq.Clone(ctx)
+		if outReq.GetBody != nil {
+			body, err := outReq.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+		c.Set("upstream_attempts", attempt+1)
+	}
+}
@@ -0,0 +1,76 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryBackoffReleasesTheConcurrencySlot(t *testing.T) {
+	var calls int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(503)
+			return
+		}
+		w.WriteHeader(200)
+	}))
+	defer upstream.Close()
+
+	apiEntry := newTestAPI(t, "limited", upstream.URL)
+	apiEntry.MaxConcurrentRequests = 1
+	apiEntry.Retry = &RetryConfig{MaxAttempts: 2, InitialBackoffMs: 1000}
+	gateway, _ := serveTestGateway(t, []*api{apiEntry})
+
+	first := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(gateway.URL + "/first")
+		if err != nil {
+			t.Error(err)
+			first <- 0
+			return
+		}
+		resp.Body.Close()
+		first <- resp.StatusCode
+	}()
+
+	// the first request backs off for at least half a second
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	resp, err := http.Get(gateway.URL + "/second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("second: status = %d, the slot must be free during the backoff", resp.StatusCode)
+	}
+	if status := <-first; status != 200 {
+		t.Fatalf("first: status = %d, want 200 after the retry", status)
+	}
+	if inFlight := testGateway.concurrencyLimits.get("limited", 1).inFlight(); inFlight != 0 {
+		t.Fatalf("%d slots are still held", inFlight)
+	}
+}
+
+func TestConcurrencySlotIsReleasedOnce(t *testing.T) {
+	slot := &concurrencySlot{limit: newConcurrencyLimits().get("api", 1)}
+	if !slot.reacquire(context.Background()) {
+		t.Fatal("the free slot must be taken")
+	}
+	slot.release()
+	slot.release()
+	if slot.limit.inFlight() != 0 {
+		t.Fatal("the slot must be given back once")
+	}
+	var unlimited *concurrencySlot
+	unlimited.release()
+	if !unlimited.reacquire(context.Background()) {
+		t.Fatal("an api without limit always has a slot")
+	}
+}
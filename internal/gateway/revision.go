@@ -0,0 +1,130 @@
+package gateway
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jasonsoft/bifrost/internal/store"
+	"github.com/jasonsoft/napnap"
+)
+
+type revisionConflict struct {
+	ErrorCode         string   `json:"error_code"`
+	Message           string   `json:"message"`
+	SubmittedRevision int64    `json:"submitted_revision"`
+	CurrentRevision   int64    `json:"current_revision"`
+	Changes           []string `json:"changes"`
+}
+
+func etag(revision int64) string {
+	return `"` + strconv.FormatInt(revision, 10) + `"`
+}
+
+// ifMatch returns the revision of the If-Match request header.
+func ifMatch(c *napnap.Context) (int64, bool) {
+	val := strings.TrimSpace(c.RequestHeader("If-Match"))
+	val = strings.TrimPrefix(val, "W/")
+	val = strings.Trim(val, `"`)
+	if len(val) == 0 {
+		return 0, false
+	}
+	revision, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		panic(AppError{ErrorCode: "invalid_input", Message: "If-Match header was invalid."})
+	}
+	return revision, true
+}
+
+// expectRevision decides which revision the update is based on. It writes
+// 428 and returns false when If-Match is required but missing.
+func (g *Gateway) expectRevision(c *napnap.Context, current int64) (int64, bool) {
+	revision, ok := ifMatch(c)
+	if ok {
+		return revision, true
+	}
+	if g.currentConfig().SkipIfMatch {
+		return current, true
+	}
+	c.JSON(428, AppError{ErrorCode: "precondition_required", Message: "If-Match header is required."})
+	return 0, false
+}
+
+func writeRevisionConflict(c *napnap.Context, submitted int64, submittedEntity interface{}, current int64, currentEntity interface{}) {
+	c.RespHeader("ETag", etag(current))
+	c.JSON(409, revisionConflict{
+		ErrorCode:         store.ErrRevisionConflict.ErrorCode,
+		Message:           store.ErrRevisionConflict.Message,
+		SubmittedRevision: submitted,
+		CurrentRevision:   current,
+		Changes:           diffFields(submittedEntity, currentEntity),
+	})
+}
+
+// diffFields returns the json fields whose values are different.
+func diffFields(a, b interface{}) []string {
+	ignored := []string{"revision", "created_at", "updated_at"}
+	left := toFields(a)
+	right := toFields(b)
+	result := []string{}
+	for key, val := range left {
+		if contains(ignored, key) {
+			continue
+		}
+		if !reflect.DeepEqual(val, right[key]) {
+			result = append(result, key)
+		}
+	}
+	for key := range right {
+		if _, ok := left[key]; !ok && !contains(ignored, key) {
+			result = append(result, key)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func toFields(entity interface{}) map[string]interface{} {
+	result := map[string]interface{}{}
+	b, err := json.Marshal(entity)
+	if err != nil {
+		return result
+	}
+	json.Unmarshal(b, &result)
+	return result
+}
+
+// adminActor names the caller of the admin api for the audit log, auth
+// stores it once the credentials were verified.
+func adminActor(c *napnap.Context) string {
+	if actor, ok := c.Get("admin"); ok {
+		return actor.(string)
+	}
+	return "anonymous"
+}
+
+// auditRevision records the revision transition of the entity with the json
+// fields which were changed.
+func (g *Gateway) auditRevision(actor, kind, id string, from, to int64, changes []string) {
+	g.logger.infof("%s %s revision: %d -> %d by %s", kind, id, from, to, actor)
+	if g.auditLog == nil {
+		return
+	}
+	entry := AuditEntry{
+		Timestamp:    time.Now().UTC(),
+		Entity:       kind,
+		EntityID:     id,
+		Actor:        actor,
+		FromRevision: from,
+		ToRevision:   to,
+		Changes:      changes,
+	}
+	if kind == "consumer" {
+		// the audit of a consumer is found by its consumer_id
+		entry.ConsumerID = id
+	}
+	g.auditLog.add(entry)
+}
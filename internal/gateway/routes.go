@@ -0,0 +1,220 @@
+package gateway
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// RouteTable finds the api which serves a request.
+type RouteTable interface {
+	Match(host, path string, header http.Header) *api
+	All() []*api
+}
+
+// apiRouteTable keeps an immutable snapshot of the apis. Reloads build a new
+// snapshot and swap it, so in-flight requests keep the one they started with.
+type apiRouteTable struct {
+	snapshot atomic.Value // *routeSnapshot
+}
+
+type routeSnapshot struct {
+	apis   []*api // declaration order
+	routes []*api // highest priority first, then longest request path
+}
+
+func newAPIRouteTable(apis []*api) *apiRouteTable {
+	table := &apiRouteTable{}
+	table.load(apis)
+	return table
+}
+
+func (t *apiRouteTable) load(apis []*api) {
+	if apis == nil {
+		apis = []*api{}
+	}
+	routes := make([]*api, len(apis))
+	copy(routes, apis)
+	sort.Stable(byPrecedence(routes))
+	t.snapshot.Store(&routeSnapshot{
+		apis:   apis,
+		routes: routes,
+	})
+}
+
+func (t *apiRouteTable) All() []*api {
+	return t.snapshot.Load().(*routeSnapshot).apis
+}
+
+// Match returns the api with the highest priority and then the longest
+// request path which prefixes the path, or equals it for the exact match
+// mode. When several apis have the same path, an exact host beats a wildcard
+// host like "*.foo.com" which beats an api without host ("" or "*"). With
+// the same host, the api with more header conditions wins, and after that
+// the api declared first wins. Apis whose header conditions aren't met are
+// skipped.
+func (t *apiRouteTable) Match(host, path string, header http.Header) *api {
+	path = strings.ToLower(path)
+	host = normalizeHost(host)
+	var result *api
+	bestScore := hostNoMatch
+	bestHeaders := 0
+	for _, apiElement := range t.snapshot.Load().(*routeSnapshot).routes {
+		if result != nil && precedes(result, apiElement) {
+			// routes are sorted, only less specific paths are left
+			break
+		}
+		// ensure request path is match, a path template has to match the whole path
+		if len(apiElement.RequestPathTemplate) > 0 {
+			if _, ok := apiElement.pathParams(path); !ok {
+				continue
+			}
+		} else if apiElement.MatchMode == matchModeExact {
+			if path != strings.ToLower(apiElement.RequestPath) {
+				continue
+			}
+		} else if apiElement.RequestPath != "*" && strings.HasPrefix(path, apiElement.RequestPath) == false {
+			continue
+		}
+		// ensure request host is match
+		score := matchHost(apiElement.RequestHost, host)
+		if score == hostNoMatch || score < bestScore {
+			continue
+		}
+		// ensure request headers are match
+		if !apiElement.matchHeaders(header) {
+			continue
+		}
+		if score > bestScore || len(apiElement.MatchHeaders) > bestHeaders {
+			result = apiElement
+			bestScore = score
+			bestHeaders = len(apiElement.MatchHeaders)
+		}
+	}
+	return result
+}
+
+// pathLength is the specificity of the api's request path, "*" matches everything.
+func pathLength(a *api) int {
+	if len(a.RequestPathTemplate) > 0 {
+		return len(a.RequestPathTemplate)
+	}
+	if a.RequestPath == "*" {
+		return 0
+	}
+	return len(a.RequestPath)
+}
+
+// match modes of the request path
+const (
+	matchModePrefix = "prefix"
+	matchModeExact  = "exact"
+)
+
+// precedes reports whether a is tried before b: the higher priority first,
+// then the longer path and then the exact match mode.
+func precedes(a, b *api) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	if pathLength(a) != pathLength(b) {
+		return pathLength(a) > pathLength(b)
+	}
+	return a.MatchMode == matchModeExact && b.MatchMode != matchModeExact
+}
+
+type byPrecedence []*api
+
+func (source byPrecedence) Len() int {
+	return len(source)
+}
+func (source byPrecedence) Swap(i, j int) {
+	source[i], source[j] = source[j], source[i]
+}
+func (source byPrecedence) Less(i, j int) bool {
+	return precedes(source[i], source[j])
+}
+
+const (
+	hostNoMatch = iota
+	hostAny
+	hostWildcard
+	hostExact
+)
+
+// matchHost compares case and port insensitively and returns how specific the match is.
+func matchHost(pattern, host string) int {
+	pattern = normalizeHost(pattern)
+	switch {
+	case len(pattern) == 0 || pattern == "*":
+		return hostAny
+	case pattern == host:
+		return hostExact
+	case strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]) && len(host) > len(pattern)-1:
+		return hostWildcard
+	}
+	return hostNoMatch
+}
+
+// normalizeHost lowercases the host and removes the port, "[::1]:8080" becomes "::1".
+func normalizeHost(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return strings.TrimSuffix(host, ".")
+}
+
+// loadAPIs returns the apis of the config file followed by the apis of the
+// repository. Every invalid api is reported.
+func (g *Gateway) loadAPIs(config *Configuration) ([]*api, error) {
+	apis := []*api{}
+	apis = append(apis, config.APIs...)
+	if g.apiRepo != nil {
+		repoAPIs, err := g.apiRepo.GetAll()
+		if err != nil {
+			return nil, err
+		}
+		apis = append(apis, repoAPIs...)
+	}
+	if err := validateAPIs(apis, config); err != nil {
+		return nil, err
+	}
+	return apis, nil
+}
+
+// validateAPIs reports every invalid api of config.
+func validateAPIs(apis []*api, config *Configuration) error {
+	problems := []string{}
+	for _, apiEntry := range apis {
+		if err := apiEntry.isValid(config); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// reloadAPIs reads the apis again and swaps the route table.
+func (g *Gateway) reloadAPIs() error {
+	apis, err := g.loadAPIs(g.currentConfig())
+	if err != nil {
+		return err
+	}
+	g.loadRoutes(apis)
+	return nil
+}
+
+// loadRoutes swaps the route table and drops the health state of the
+// targets which were removed.
+func (g *Gateway) loadRoutes(apis []*api) {
+	g.routes.load(apis)
+	if g.healthChecker != nil {
+		g.healthChecker.prune(apis)
+	}
+}
@@ -0,0 +1,145 @@
+package gateway
+
+import (
+	"net/http"
+	"testing"
+)
+
+// newRouteTestAPI returns a valid api for the request path after change was
+// applied to it.
+func newRouteTestAPI(t *testing.T, name string, requestPath string, change func(a *api)) *api {
+	apiEntry := &api{
+		ID:          name,
+		Name:        name,
+		RequestPath: requestPath,
+		TargetURL:   "http://" + name + ":8080",
+	}
+	if change != nil {
+		change(apiEntry)
+	}
+	if err := apiEntry.isValid(testGateway.currentConfig()); err != nil {
+		t.Fatal(err)
+	}
+	return apiEntry
+}
+
+func matchedName(routes RouteTable, host, path string, header http.Header) string {
+	apiEntry := routes.Match(host, path, header)
+	if apiEntry == nil {
+		return ""
+	}
+	return apiEntry.Name
+}
+
+func TestMatchByRequestHeaders(t *testing.T) {
+	routes := newAPIRouteTable([]*api{
+		newRouteTestAPI(t, "default", "/orders", nil),
+		newRouteTestAPI(t, "v2", "/orders", func(a *api) {
+			a.MatchHeaders = map[string]string{"x-version": "2"}
+		}),
+		newRouteTestAPI(t, "mobile", "/orders", func(a *api) {
+			a.MatchHeaders = map[string]string{"X-Client": "~^mobile-"}
+		}),
+		newRouteTestAPI(t, "mobile-v2", "/orders", func(a *api) {
+			a.MatchHeaders = map[string]string{"X-Client": "~^mobile-", "X-Version": "2"}
+		}),
+		newRouteTestAPI(t, "canary", "/canary", func(a *api) {
+			a.MatchHeaders = map[string]string{"X-Canary": "true"}
+		}),
+	})
+
+	tests := []struct {
+		header http.Header
+		path   string
+		want   string
+	}{
+		{http.Header{}, "/orders", "default"},
+		{http.Header{"X-Version": {"2"}}, "/orders", "v2"},
+		{http.Header{"X-Version": {"3"}}, "/orders", "default"},
+		{http.Header{"X-Client": {"mobile-ios"}}, "/orders", "mobile"},
+		{http.Header{"X-Client": {"web-mobile-ios"}}, "/orders", "default"},
+		// the api with more header conditions wins
+		{http.Header{"X-Client": {"mobile-ios"}, "X-Version": {"2"}}, "/orders", "mobile-v2"},
+		{http.Header{"X-Canary": {"true"}}, "/canary", "canary"},
+		// an api whose headers don't match is skipped
+		{http.Header{}, "/canary", ""},
+	}
+	for _, test := range tests {
+		if name := matchedName(routes, "", test.path, test.header); name != test.want {
+			t.Errorf("%s %v: matched %q, want %q", test.path, test.header, name, test.want)
+		}
+	}
+}
+
+func TestMatchHeadersAreValidated(t *testing.T) {
+	for _, matchHeaders := range []map[string]string{{"": "1"}, {"X-Client": "~("}} {
+		apiEntry := &api{ID: "invalid", Name: "invalid", RequestPath: "/", TargetURL: "http://invalid:8080", MatchHeaders: matchHeaders}
+		if apiEntry.isValid(testGateway.currentConfig()) == nil {
+			t.Errorf("%v must be invalid", matchHeaders)
+		}
+	}
+}
+
+func TestMatchPrefersTheMoreSpecificRoute(t *testing.T) {
+	routes := newAPIRouteTable([]*api{
+		newRouteTestAPI(t, "wildcard", "*", nil),
+		newRouteTestAPI(t, "users", "/users", nil),
+		newRouteTestAPI(t, "users-exact", "/users", func(a *api) {
+			a.MatchMode = matchModeExact
+		}),
+		newRouteTestAPI(t, "admins", "/users/admin", nil),
+		newRouteTestAPI(t, "profile", "", func(a *api) {
+			a.RequestPathTemplate = "/users/{id}/profile"
+		}),
+		newRouteTestAPI(t, "priority", "/reports", func(a *api) {
+			a.Priority = 10
+		}),
+		newRouteTestAPI(t, "reports-daily", "/reports/daily", nil),
+	})
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/users", "users-exact"},
+		{"/users/42", "users"},
+		{"/users/admin/settings", "admins"},
+		{"/users/42/profile", "profile"},
+		{"/USERS/ADMIN", "admins"},
+		// a higher priority beats a longer path
+		{"/reports/daily", "priority"},
+		{"/other", "wildcard"},
+	}
+	for _, test := range tests {
+		if name := matchedName(routes, "", test.path, http.Header{}); name != test.want {
+			t.Errorf("%s: matched %q, want %q", test.path, name, test.want)
+		}
+	}
+}
+
+func TestMatchPrefersTheExactHost(t *testing.T) {
+	routes := newAPIRouteTable([]*api{
+		newRouteTestAPI(t, "any", "/", nil),
+		newRouteTestAPI(t, "wildcard", "/", func(a *api) {
+			a.RequestHost = "*.example.com"
+		}),
+		newRouteTestAPI(t, "exact", "/", func(a *api) {
+			a.RequestHost = "api.example.com"
+		}),
+	})
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"api.example.com:8080", "exact"},
+		{"API.Example.com.", "exact"},
+		{"shop.example.com", "wildcard"},
+		{"example.com", "any"},
+		{"other.org", "any"},
+	}
+	for _, test := range tests {
+		if name := matchedName(routes, test.host, "/orders", http.Header{}); name != test.want {
+			t.Errorf("%s: matched %q, want %q", test.host, name, test.want)
+		}
+	}
+}
@@ -0,0 +1,422 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jasonsoft/bifrost/internal/store"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/jasonsoft/bifrost/internal/logging"
+	"github.com/jasonsoft/napnap"
+	redis "gopkg.in/redis.v4"
+)
+
+// New reads the config file and builds the repositories, it runs before
+// the listeners are started.
+func New(configPath string) (*Gateway, error) {
+	// parse yaml
+	config, err := loadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	g := newGateway(config, newApplication())
+	g.configPath = configPath
+	g.httpClient = &http.Client{
+		Transport: &http.Transport{
+			MaxIdleConnsPerHost: 20,
+		},
+		Timeout: time.Duration(30) * time.Second,
+	}
+
+	// setup logger
+	if config.Debug {
+		g.logger.mode = debugLevel
+		g.logger.info("debug mode was enabled")
+	}
+
+	// initial storage, the consumer and token repositories of every data type
+	// record latency and outcome of their operations
+	repos, err := newBuiltinStorageRegistry().Open(config.Data, g.currentTokenSetting, g.logger.debugf, g.metrics)
+	if err != nil {
+		return nil, fmt.Errorf("storage error: %v", err)
+	}
+	g.consumerRepo, g.tokenRepo = repos.consumers, repos.tokens
+	g.apiRepo, g.serviceRepo, g.corsRepo = repos.apis, repos.services, repos.cors
+	if config.ConsumerCacheTTL > 0 {
+		g.consumerRepo = g.newConsumerCache(g.consumerRepo, time.Duration(config.ConsumerCacheTTL)*time.Second)
+		g.logger.infof("consumer cache was enabled: %d seconds", config.ConsumerCacheTTL)
+	}
+
+	g.logger.infof("hostname: %v", g.app.hostname)
+
+	// load api
+	apis, err := g.loadAPIs(config)
+	if err != nil {
+		return nil, fmt.Errorf("config error: %v", err)
+	}
+	g.routes = newAPIRouteTable(apis)
+	g.services, err = g.serviceRepo.GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("storage error: %v", err)
+	}
+
+	g.registerUpstreamHealthMetric()
+
+	if config.TLS.Enable && len(config.TLS.CertFile) > 0 {
+		g.certificate, err = newCertificateFile(config.TLS.CertFile, config.TLS.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("config error: tls certificate can't be loaded: %v", err)
+		}
+	}
+	return g, nil
+}
+
+// Run starts the health checks and the listeners and blocks until they are
+// closed by Shutdown. It returns the first error of a listener.
+func (g *Gateway) Run() error {
+	config := g.currentConfig()
+	go g.healthChecker.run(g.routes, g.currentConfig)
+	if config.DNSRefreshInterval > 0 {
+		go g.dnsRefresher.Run(time.Duration(config.DNSRefreshInterval) * time.Second)
+	}
+
+	// keep apis in sync with the source of truth
+	if config.ConfigSync.Enable {
+		g.configSync = newConfigSync(g, config.ConfigSync)
+		go g.configSync.run()
+	}
+
+	// aggregate requests which don't match any api
+	if config.Unmatched.Enable {
+		g.unmatchedReport = newUnmatchedReport(config.Unmatched.MaxSignatures, config.Unmatched.SpikeThreshold, g.logger)
+		go g.unmatchedReport.summarize(time.Duration(config.Unmatched.SummaryInterval) * time.Second)
+	}
+
+	nap := napnap.New()
+	// the client ip is resolved with trusted_proxies, see clientIP
+	nap.ForwardRemoteIpAddress = false
+	// bodies are limited by max_request_body_bytes instead of napnap's 10MB,
+	// which would cut a larger body off without an error response
+	nap.MaxRequestBodySize = math.MaxInt64
+	g.middlewares.Register("drain", PriorityDrain, g)
+	g.middlewares.RegisterFunc("request_id", PriorityRequestID, g.requestIDMiddleware())
+	g.middlewares.Register("request_metrics", PriorityRequestMetrics, newRequestMetricsMiddleware(g.routes, g.metrics))
+
+	// set logs
+	if config.Logs.Target.Type == "gelf" && len(config.Logs.Target.ConnectionString) > 0 {
+		g.logger.queue = logging.NewQueue(30000) // TODO: allow user to set the value via config file
+		if config.Logs.DeadLetterQueueSize > 0 {
+			g.logger.deadLetters = newDeadLetterQueue(config.Logs.DeadLetterQueueSize, config.Logs.MaxRetries, config.Logs.FallbackFile, g.logger)
+			go g.logger.deadLetters.run(time.Duration(config.Logs.RetryInterval) * time.Second)
+		}
+		target := config.Logs.Target
+		g.gelfWriter = newGelfWriter(target.ConnectionString, target.TLSCertFile, target.TLSKeyFile, target.TLSCAFile)
+		go g.logger.queue.Run(g.gelfWriter)
+		g.logger.infof("log was enabled and connection string is %s", config.Logs.Target.ConnectionString)
+
+		// set access log
+		if config.Logs.AccessLog {
+			g.middlewares.Register("access_log", PriorityAccessLog, newAccessLogMiddleware(g))
+			g.logger.info("access log was enabled")
+		}
+		// set application log
+		if config.Logs.ApplicationLog {
+			g.middlewares.Register("application_log", PriorityApplicationLog, newApplicationLogMiddleware(g, true))
+			g.logger.info("application log was enabled")
+		} else {
+			g.middlewares.Register("application_log", PriorityApplicationLog, newApplicationLogMiddleware(g, false))
+		}
+	} else {
+		// still recover from panics and reply with json error
+		g.middlewares.Register("application_log", PriorityApplicationLog, newApplicationLogMiddleware(g, false))
+	}
+
+	g.mirrorPool = newMirrorPool(config.MirrorWorkerCount, g.logger)
+	if spill := config.MirrorSpill; len(spill.Dir) > 0 {
+		var err error
+		g.mirrorSpill, err = newSpillStore(spill.Dir, spill.MemoryBytes, spill.MaxBytes, spill.QuotaBytes, time.Duration(spill.SweepInterval)*time.Second, g.logger, g.metrics)
+		if err != nil {
+			return fmt.Errorf("mirror spill error: %v", err)
+		}
+		go g.mirrorSpill.run()
+		g.logger.infof("mirror bodies larger than %d bytes are spilled to %s", spill.MemoryBytes, spill.Dir)
+	}
+	if len(config.Capture.Dir) > 0 {
+		var err error
+		g.captureWriter, err = newCaptureWriter(config.Capture.Dir, config.Capture.QueueSize, g.logger, g.metrics)
+		if err != nil {
+			return fmt.Errorf("capture error: %v", err)
+		}
+		go g.captureWriter.run()
+		g.logger.infof("requests are captured to %s", config.Capture.Dir)
+	}
+
+	if config.Audit.Enable {
+		store, err := newAuditStore(config, g.logger)
+		if err != nil {
+			return fmt.Errorf("audit error: %v", err)
+		}
+		g.auditLog = newAuditLog(store, config.Audit.QueueSize, g.logger, g.metrics)
+		g.logger.infof("audit log was enabled: %s", config.Audit.Store)
+	}
+
+	// set custom errors
+	if config.CustomErrors {
+		g.middlewares.Register("custom_errors", PriorityCustomErrors, newCustomErrorsMiddleware(g))
+	}
+
+	g.middlewares.Register("application", PriorityApplication, g.app)
+
+	// turn on gzip feature
+	gzip := config.Gzip
+	if gzip.Enable {
+		g.logger.info("gzip was enabled")
+		g.middlewares.Register("gzip", PriorityGzip, napnap.NewGzip(napnap.DefaultCompression))
+	}
+
+	// turn on health check feature
+	g.middlewares.Register("health", PriorityHealth, napnap.NewHealth())
+
+	// turn on CORS feature, the cors setting of an api is used instead
+	var globalCors napnap.MiddlewareHandler
+	cors := config.Cors
+	if cors.Enable {
+		options := napnap.Options{}
+		var err error
+		g.cors, err = g.corsRepo.Get()
+		if err != nil {
+			return fmt.Errorf("storage error: %v", err)
+		}
+		if g.cors == nil {
+			g.cors = store.NewGlobalCORS()
+		}
+		options.AllowOriginFunc = g.verifyOrigin
+		options.AllowedMethods = []string{"GET", "POST", "PUT", "DELETE"}
+		options.AllowedHeaders = []string{"*"}
+		globalCors = napnap.NewCors(options)
+		g.logger.infof("cors was enabled: %v", strings.Join(g.cors.AllowedOrigins[:], ","))
+	}
+	g.middlewares.Register("cors", PriorityCors, newCorsMiddleware(g.routes, globalCors))
+
+	g.middlewares.Register("ip_filter", PriorityIPFilter, newIPFilterMiddleware(g, g.routes))
+	g.middlewares.Register("oauth_token", PriorityOAuthToken, g.oauthTokenMiddleware("/oauth/token"))
+	g.middlewares.RegisterFunc("identity", PriorityIdentity, g.identity)
+	g.middlewares.Register("signature", PrioritySignature, newHMACMiddleware(g, g.routes, time.Duration(config.HMAC.Window)*time.Second))
+
+	// turn on rate limit feature
+	rateLimit := config.RateLimit
+	if rateLimit.Enable {
+		var limitStore RateLimitStore
+		var client *redis.Client
+		if rateLimit.Store == "redis" {
+			client = store.NewRedisClient(config.Data)
+			limitStore = newRateLimitRedis(client, rateLimit.RPS, rateLimit.Burst, g.logger)
+		}
+		rateLimiter := newRateLimitMiddleware(g, rateLimit.RPS, rateLimit.Burst, limitStore)
+		for name, tier := range rateLimit.Tiers {
+			var tierStore RateLimitStore
+			if client != nil {
+				tierStore = newRateLimitRedis(client, tier.RPS, tier.Burst, g.logger)
+			}
+			rateLimiter.addTier(name, tier, tierStore)
+		}
+		g.middlewares.Register("rate_limit", PriorityRateLimit, rateLimiter)
+		g.logger.infof("rate limit was enabled: %v rps, burst %d", rateLimit.RPS, rateLimit.Burst)
+	}
+
+	// turn on response cache feature
+	cache := config.Cache
+	if cache.Enable {
+		var cacheStore CacheStore
+		if cache.Store == "redis" {
+			cacheStore = newCacheRedis(store.NewRedisClient(config.Data), g.logger)
+		} else {
+			cacheStore = newCacheMemStore(cache.MaxEntries)
+		}
+		g.middlewares.Register("cache", PriorityCache, newCacheMiddleware(g.routes, cacheStore))
+		g.logger.infof("cache was enabled: %s store", cache.Store)
+	}
+
+	g.middlewares.Register("idempotency", PriorityIdempotency, newIdempotencyMiddleware(g, g.routes, newIdempotencyStore(config.Idempotency.MaxEntries)))
+	g.middlewares.Register("proxy", PriorityProxy, newProxy(g, g.routes))
+	g.middlewares.RegisterFunc("not_found", PriorityNotFound, g.notFound)
+
+	if err := g.loadPlugins(config.PluginDir, config.Plugins, g.middlewares); err != nil {
+		return fmt.Errorf("plugin error: %v", err)
+	}
+
+	for _, mw := range g.middlewares.Build() {
+		nap.Use(mw)
+	}
+	g.logger.debugf("middlewares: %s", strings.Join(g.middlewares.Names(), ", "))
+
+	// admin endpoints
+	adminNap := napnap.New()
+	adminNap.Use(napnap.NewHealth())
+	adminNap.Use(newApplicationLogMiddleware(g, false))
+	adminNap.UseFunc(g.requestIDMiddleware())
+	adminNap.UseFunc(g.auth) // verify all request which send to admin api and ensure the caller has valid admin token.
+
+	adminRouter := napnap.NewRouter()
+	adminRouter.Get("/status", g.getStatus)
+	adminRouter.Get("/metrics", g.getMetricsEndpoint)
+	adminRouter.Get("/v1/circuit-breakers", g.listCircuitBreakersEndpoint)
+	adminRouter.Get("/internal/circuit-breakers", g.listCircuitBreakersEndpoint)
+	adminRouter.Get("/v1/unmatched", g.listUnmatchedEndpoint)
+	adminRouter.Get("/v1/plugins", g.listPluginsEndpoint)
+	adminRouter.Get("/v1/audit", g.listAuditEndpoint)
+
+	// consumer endpoints
+	adminRouter.Get("/v1/consumers/count", g.getConsumerCountEndpoint)
+	adminRouter.Get("/v1/consumers/:consumer_id", g.getConsumerEndpoint)
+	adminRouter.Get("/v1/consumers/:consumer_id/tokens/stats", g.getConsumerTokenStatsEndpoint)
+	adminRouter.Delete("/v1/consumers/:consumer_id", g.deletedConsumerEndpoint)
+	adminRouter.Put("/v1/consumers", g.createOrupateConsumerEndpoint)
+	adminRouter.Post("/v1/consumers", g.createConsumerEndpoint)
+	adminRouter.Put("/v1/consumers/:consumer_id", g.updateConsumerEndpoint)
+
+	// token endpoints
+	//adminRouter.Put("/v1/tokens/:key/expire", expireTokenEndpoint) //deprecated
+	adminRouter.Get("/v1/tokens/:id", g.getTokenEndpoint)
+	adminRouter.Delete("/v1/tokens/batch", g.deleteTokenBatchEndpoint)
+	adminRouter.Delete("/v1/tokens/:id", g.deleteTokenEndpoint)
+	adminRouter.Get("/v1/tokens", g.listTokensEndpoint)
+	adminRouter.Post("/v1/tokens", g.createTokenEndpoint)
+	adminRouter.Put("/v1/tokens", g.updateTokensEndpoint)
+	adminRouter.Delete("/v1/tokens", g.deleteTokensEndpoint)
+	adminRouter.Get("/internal/tokens/:token_id/introspect", g.introspectTokenEndpoint)
+
+	// api endpoints
+	adminRouter.Post("/v1/apis/switch", g.switchAPISource)
+	adminRouter.Put("/v1/apis/reload", g.reloadAPIEndpoint)
+	adminRouter.Get("/v1/apis/:api_id/health", g.getAPIHealthEndpoint)
+	adminRouter.Get("/v1/apis/:api_id", g.getAPIEndpoint)
+	adminRouter.Delete("/v1/apis/:api_id", g.deleteAPIEndpoint)
+	adminRouter.Put("/v1/apis/:api_id", g.updateAPIEndpoint)
+	adminRouter.Get("/v1/apis", g.listAPIEndpoint)
+	adminRouter.Post("/v1/apis", g.createAPIEndpoint)
+
+	// upstream endpoints
+	adminRouter.Delete("/v1/services/:service_id/upstreams/:upstream_id", g.unregisterServiceUpstreamEndpoint)
+	adminRouter.Put("/v1/services/:service_id/upstreams", g.registerServiceUpstreamEndpoint)
+
+	// service endpoints
+	adminRouter.Put("/v1/services/reload", g.reloadServiceEndpoint)
+	adminRouter.Delete("/v1/services/:service_id", g.deleteServicesEndpoint)
+	adminRouter.Put("/v1/services/:service_id", g.updateServicesEndpoint)
+	adminRouter.Get("/v1/services/:service_id", g.getServicesEndpoint)
+	adminRouter.Post("/v1/services", g.createServicesEndpoint)
+	adminRouter.Get("/v1/services", g.listServicesEndpoint)
+
+	// config endpoints
+	adminRouter.Put("/v1/configs/cors/reload", g.reloadCORSEndpoint)
+	adminRouter.Get("/v1/configs/cors", g.getCORSEndpoint)
+	adminRouter.Put("/v1/configs/cors", g.createOrUpdateCORSEndpoint)
+	adminRouter.Get("/v1/configs/sync", g.getConfigSyncEndpoint)
+	adminRouter.Put("/v1/configs/sync", g.syncConfigEndpoint)
+
+	adminNap.Use(adminRouter)
+	adminNap.UseFunc(g.notFound)
+
+	// run two http servers on different ports
+	// one is for bifrost service and another is for admin api
+	g.timeouts = config.Server
+	servers := 2 + len(config.Binds)
+	errs := make(chan error, servers+1)
+	go func() {
+		// http server for admin api
+		errs <- g.serve(config.AdminBind, adminNap, nil)
+	}()
+	for _, bind := range config.Binds {
+		go func(addr string) {
+			// http server for bifrost service
+			errs <- g.serve(addr, nap, nil)
+		}(bind)
+	}
+	go func() {
+		if !config.TLS.Enable {
+			errs <- nil
+			return
+		}
+		tlsConfig := &tls.Config{
+			NextProtos: []string{"h2", "http/1.1"},
+		}
+		if len(config.TLS.CertFile) > 0 {
+			tlsConfig.GetCertificate = g.certificate.GetCertificate
+		} else {
+			m := autocert.Manager{
+				Prompt:     autocert.AcceptTOS,
+				HostPolicy: autocert.HostWhitelist(config.TLS.ApplyCertDomainNames...),
+				Cache:      autocert.DirCache("./certs"),
+			}
+			tlsConfig.GetCertificate = m.GetCertificate
+		}
+
+		// plaintext requests are redirected to the https listener
+		if len(config.TLS.RedirectAddr) > 0 {
+			go func() {
+				if err := g.serve(config.TLS.RedirectAddr, httpsRedirectHandler(config.TLS.Addr), nil); err != nil {
+					errs <- err
+				}
+			}()
+			g.logger.infof("https redirect was enabled on %s", config.TLS.RedirectAddr)
+		}
+		errs <- g.serve(config.TLS.Addr, nap, tlsConfig)
+	}()
+
+	for i := 0; i < servers; i++ {
+		if err := <-errs; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reload reads the config file again, e.g. on SIGHUP. Requests which are in
+// flight keep the config and apis they started with. The tls certificate
+// files are read again, but listeners, storage and the enabled middlewares
+// need a restart.
+func (g *Gateway) Reload() {
+	config, err := loadConfig(g.configPath)
+	if err != nil {
+		g.logger.errorf("config reload failed: %v", err)
+		return
+	}
+	apis, err := g.loadAPIs(config)
+	if err != nil {
+		g.logger.errorf("config reload failed: %v", err)
+		return
+	}
+	g.config.Store(config)
+	g.loadRoutes(apis)
+	// certificates of upstream tls are read again on the next request
+	g.upstreamTransports.Reset()
+	if g.certificate != nil {
+		if err := g.certificate.reload(); err != nil {
+			g.logger.errorf("tls certificate reload failed: %v", err)
+		}
+	}
+	if g.gelfWriter != nil && g.gelfWriter.IsTLS() {
+		if err := g.gelfWriter.ReloadTLS(); err != nil {
+			g.logger.errorf("gelf tls certificate reload failed: %v", err)
+		}
+	}
+	g.logger.info("config was reloaded")
+}
+
+// ShutdownTimeout is how long Shutdown may wait for the requests in flight,
+// see shutdown_timeout.
+func (g *Gateway) ShutdownTimeout() time.Duration {
+	return time.Duration(g.currentConfig().ShutdownTimeout) * time.Second
+}
+
+// verifyOrigin checks the origin against the cors config of the store.
+func (g *Gateway) verifyOrigin(origin string) bool {
+	g.logger.debugf("origin: %v", origin)
+	return g.cors.VerifyOrigin(origin)
+}
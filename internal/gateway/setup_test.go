@@ -0,0 +1,81 @@
+package gateway
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jasonsoft/bifrost/internal/store"
+	"github.com/jasonsoft/napnap"
+)
+
+// testGateway keeps its repositories in memory, the tests change its config
+// with withConfig.
+var testGateway *Gateway
+
+func TestMain(m *testing.M) {
+	config := newConfiguration()
+	config.Data.Type = "memory"
+	testGateway = newGateway(&config, &application{name: "bifrost", hostname: "test"})
+	testGateway.consumerRepo = store.NewConsumerMemStore()
+	testGateway.tokenRepo = store.NewTokenMemStore(testGateway.currentTokenSetting, testGateway.logger.debugf)
+	testGateway.routes = newAPIRouteTable(nil)
+	testGateway.mirrorPool = newMirrorPool(config.MirrorWorkerCount, testGateway.logger)
+	testGateway.httpClient = &http.Client{Timeout: 10 * time.Second}
+	os.Exit(m.Run())
+}
+
+// newTestTokenStore reads the token setting of the current config, like the
+// token repository of the gateway.
+func newTestTokenStore() *store.TokenMemStore {
+	return store.NewTokenMemStore(testGateway.currentTokenSetting, testGateway.logger.debugf)
+}
+
+// withConfig changes the current config for one test.
+func withConfig(t *testing.T, change func(config *Configuration)) {
+	previous := testGateway.currentConfig()
+	config := *previous
+	change(&config)
+	testGateway.config.Store(&config)
+	t.Cleanup(func() {
+		testGateway.config.Store(previous)
+	})
+}
+
+// newTestAPI returns a valid api which sends every request to targetURL.
+func newTestAPI(t testing.TB, name string, targetURL string) *api {
+	apiEntry := &api{
+		ID:          name,
+		Name:        name,
+		RequestPath: "/",
+		TargetURL:   targetURL,
+	}
+	if err := apiEntry.isValid(testGateway.currentConfig()); err != nil {
+		t.Fatal(err)
+	}
+	return apiEntry
+}
+
+// serveTestGateway runs the middlewares in front of the proxy for the apis,
+// requests are anonymous unless a middleware sets the consumer.
+func serveTestGateway(t testing.TB, apis []*api, middlewares ...napnap.MiddlewareHandler) (*httptest.Server, RouteTable) {
+	routes := newAPIRouteTable(apis)
+	nap := napnap.New()
+	nap.MaxRequestBodySize = math.MaxInt64
+	nap.UseFunc(func(c *napnap.Context, next napnap.HandlerFunc) {
+		c.Set("request-id", "test")
+		c.Set("consumer", store.Consumer{})
+		c.Set("auth_reason", authAnonymous)
+		next(c)
+	})
+	for _, middleware := range middlewares {
+		nap.Use(middleware)
+	}
+	nap.Use(newProxy(testGateway, routes))
+	server := httptest.NewServer(withResponseController(nap))
+	t.Cleanup(server.Close)
+	return server, routes
+}
@@ -0,0 +1,123 @@
+package gateway
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jasonsoft/napnap"
+)
+
+const defaultStickyCookieName = "bifrost_sticky"
+
+// stickySession pins a client to the target of its first request with a
+// cookie. The cookie holds the index of the target and an hmac of the index
+// and the target url, so clients can't pick a target and the cookie becomes
+// invalid when the targets change.
+type stickySession struct {
+	CookieName string `json:"cookie_name" bson:"cookie_name"`
+	MaxAge     int    `json:"max_age" bson:"max_age"` // seconds, zero is a session cookie
+}
+
+func (s *stickySession) isValid() error {
+	if s.MaxAge < 0 {
+		return errors.New("sticky_session max_age can't be negative")
+	}
+	if strings.ContainsAny(s.CookieName, " ;,=") {
+		return errors.New("sticky_session cookie_name is invalid")
+	}
+	return nil
+}
+
+func (s *stickySession) cookieName() string {
+	if len(s.CookieName) == 0 {
+		return defaultStickyCookieName
+	}
+	return s.CookieName
+}
+
+// currentStickySecret signs the cookies. It is random when the config file doesn't
+// set sticky_session_secret, then cookies don't survive a restart and
+// aren't shared by several gateways.
+func (g *Gateway) currentStickySecret() []byte {
+	if secret := g.currentConfig().StickySessionSecret; len(secret) > 0 {
+		return []byte(secret)
+	}
+	return g.stickySecret
+}
+
+// newStickySecret returns the random secret which is used when the config
+// file doesn't set sticky_session_secret.
+func newStickySecret() []byte {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func signSticky(apiEntry *api, index int, targetURL string, secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(apiEntry.ID + ":" + strconv.Itoa(index) + ":" + targetURL))
+	return strconv.Itoa(index) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// pinnedTarget returns the target of the cookie when it is valid and the target is up.
+func (s *stickySession) pinnedTarget(c *napnap.Context, apiEntry *api, targets []*apiTarget, health *healthChecker, secret []byte) string {
+	cookie, err := c.Request.Cookie(s.cookieName())
+	if err != nil {
+		return ""
+	}
+	parts := strings.SplitN(cookie.Value, ".", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	index, err := strconv.Atoi(parts[0])
+	if err != nil || index < 0 || index >= len(targets) {
+		return ""
+	}
+	target := targets[index]
+	if !hmac.Equal([]byte(cookie.Value), []byte(signSticky(apiEntry, index, target.URL, secret))) {
+		return ""
+	}
+	if !health.isUp(target.URL) {
+		return ""
+	}
+	return target.URL
+}
+
+// askForStickyTarget keeps the client on its pinned target and pins it to a
+// new target when there is none or the pinned target is down. The cookie is
+// signed with secret.
+func (a *api) askForStickyTarget(c *napnap.Context, health *healthChecker, secret []byte) string {
+	targets := a.targets()
+	if targetURL := a.StickySession.pinnedTarget(c, a, targets, health, secret); len(targetURL) > 0 {
+		return targetURL
+	}
+
+	targetURL := a.askForTarget(health)
+	for index, target := range targets {
+		if target.URL != targetURL {
+			continue
+		}
+		path := "/"
+		if a.RequestPath != "*" && len(a.RequestPath) > 0 {
+			path = a.RequestPath
+		}
+		cookie := &http.Cookie{
+			Name:     a.StickySession.cookieName(),
+			Value:    signSticky(a, index, targetURL, secret),
+			Path:     path,
+			MaxAge:   a.StickySession.MaxAge,
+			HttpOnly: true,
+		}
+		c.Writer.Header().Add("Set-Cookie", cookie.String())
+		break
+	}
+	return targetURL
+}
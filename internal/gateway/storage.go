@@ -0,0 +1,149 @@
+package gateway
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jasonsoft/bifrost/internal/store"
+)
+
+// storage holds the repositories of one data type. The memory type only has
+// consumers and tokens, the apis are read from the config file then.
+type storage struct {
+	consumers store.ConsumerRepository
+	tokens    store.TokenRepository
+	apis      APIRepository
+	services  store.ServiceRepository
+	cors      store.CORSRepository
+}
+
+// StorageOpener opens the repositories of a data type. tokenSettings returns
+// the token setting in effect and debugf prints the debug messages of the
+// repositories.
+type StorageOpener func(setting store.DataSetting, tokenSettings store.TokenSettings, debugf store.Logf) (*storage, error)
+
+// StorageRegistry knows the data types by name. Open wraps the consumer and
+// token repositories of every type with their metrics, so a backend which is
+// registered later is measured like the built-in ones.
+type StorageRegistry struct {
+	sync.Mutex
+	openers map[string]StorageOpener
+}
+
+func newStorageRegistry() *StorageRegistry {
+	return &StorageRegistry{
+		openers: map[string]StorageOpener{},
+	}
+}
+
+// newBuiltinStorageRegistry has the memory, mongodb and redis types.
+func newBuiltinStorageRegistry() *StorageRegistry {
+	r := newStorageRegistry()
+	r.Register("memory", openMemoryStorage)
+	r.Register("mongodb", openMongoStorage)
+	r.Register("redis", openRedisStorage)
+	return r
+}
+
+// Register adds the data type, a name can only be registered once.
+func (r *StorageRegistry) Register(name string, open StorageOpener) error {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.openers[name]; ok {
+		return fmt.Errorf("storage %s is already registered", name)
+	}
+	r.openers[name] = open
+	return nil
+}
+
+// Open opens the repositories of setting.Type with metrics around the
+// consumer and token repositories, they are recorded to m.
+func (r *StorageRegistry) Open(setting store.DataSetting, tokenSettings store.TokenSettings, debugf store.Logf, m *metrics) (*storage, error) {
+	r.Lock()
+	open, ok := r.openers[setting.Type]
+	names := make([]string, 0, len(r.openers))
+	for name := range r.openers {
+		names = append(names, name)
+	}
+	r.Unlock()
+	if !ok {
+		sort.Strings(names)
+		return nil, fmt.Errorf("data type %q isn't one of %s", setting.Type, strings.Join(names, ", "))
+	}
+	s, err := open(setting, tokenSettings, debugf)
+	if err != nil {
+		return nil, err
+	}
+	s.consumers = newConsumerRepoMetrics(s.consumers, setting.Type, m)
+	s.tokens = newTokenRepoMetrics(s.tokens, setting.Type, m)
+	return s, nil
+}
+
+func openMemoryStorage(setting store.DataSetting, tokenSettings store.TokenSettings, debugf store.Logf) (*storage, error) {
+	tokens := store.NewTokenMemStore(tokenSettings, debugf)
+	tokens.StartJanitor(time.Duration(tokenSettings().SweepInterval) * time.Second)
+	return &storage{
+		consumers: store.NewConsumerMemStore(),
+		tokens:    tokens,
+	}, nil
+}
+
+func openMongoStorage(setting store.DataSetting, tokenSettings store.TokenSettings, debugf store.Logf) (*storage, error) {
+	dialTimeout := time.Duration(setting.DialTimeout) * time.Second
+	socketTimeout := time.Duration(setting.SocketTimeout) * time.Second
+	s := &storage{}
+	var err error
+	if s.consumers, err = store.NewConsumerMongo(setting.ConnectionString, setting.PoolSize, dialTimeout, socketTimeout, debugf); err != nil {
+		return nil, err
+	}
+	if s.tokens, err = store.NewTokenMongo(setting.ConnectionString, setting.PoolSize, dialTimeout, socketTimeout, tokenSettings, debugf); err != nil {
+		return nil, err
+	}
+	if s.apis, err = newAPIMongo(setting.ConnectionString); err != nil {
+		return nil, err
+	}
+	if s.services, err = store.NewServiceMongo(setting.ConnectionString); err != nil {
+		return nil, err
+	}
+	if s.cors, err = store.NewCORSMongo(setting.ConnectionString); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// openRedisStorage shares one connection pool between the stores.
+func openRedisStorage(setting store.DataSetting, tokenSettings store.TokenSettings, debugf store.Logf) (*storage, error) {
+	client := store.NewRedisClient(setting)
+	s := &storage{}
+	var err error
+	if s.apis, err = newAPIRedis(client); err != nil {
+		return nil, err
+	}
+	if s.services, err = store.NewServiceRedis(client); err != nil {
+		return nil, err
+	}
+	if s.consumers, err = store.NewConsumerRedis(client); err != nil {
+		return nil, err
+	}
+	if s.tokens, err = store.NewTokenRedis(client, tokenSettings); err != nil {
+		return nil, err
+	}
+	if s.cors, err = store.NewCORSRedis(client); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// newConsumerCache reports the size and the hit ratio of the cache, it
+// validates the consumer of every token.
+func (g *Gateway) newConsumerCache(repo store.ConsumerRepository, ttl time.Duration) *store.ConsumerCache {
+	cache := store.NewConsumerCache(repo, ttl)
+	g.metrics.gaugeFunc("bifrost_consumer_cache_entries", "Consumers held by the cache which validates tokens.", func() float64 {
+		return float64(cache.Len())
+	})
+	g.metrics.gaugeFunc("bifrost_consumer_cache_hit_ratio", "Share of the consumer lookups which were answered by the cache.", cache.HitRatio)
+	return cache
+}
@@ -0,0 +1,99 @@
+package gateway
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/jasonsoft/bifrost/internal/store"
+)
+
+var errTestStore = errors.New("store is down")
+
+// unreachableTokenRepo fails every lookup, like a database which is down.
+type unreachableTokenRepo struct {
+	store.TokenRepository
+}
+
+func (r *unreachableTokenRepo) Get(key string) (*store.Token, error) {
+	return nil, errTestStore
+}
+
+// openTestStorage opens the memory backend through the registry, so the
+// repositories are measured like in the gateway.
+func openTestStorage(t *testing.T) *storage {
+	repos, err := newBuiltinStorageRegistry().Open(store.DataSetting{Type: "memory"}, testGateway.currentTokenSetting, testGateway.logger.debugf, testGateway.metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repos
+}
+
+func TestStorageRegistryMeasuresTheMemoryBackend(t *testing.T) {
+	repos := openTestStorage(t)
+	series := []string{
+		`bifrost_token_store_duration_seconds_count{backend="memory",operation="get",outcome="ok"}`,
+		`bifrost_token_store_duration_seconds_count{backend="memory",operation="get",outcome="not_found"}`,
+		`bifrost_consumer_store_duration_seconds_count{backend="memory",operation="get",outcome="ok"}`,
+		`bifrost_consumer_store_duration_seconds_count{backend="memory",operation="get",outcome="not_found"}`,
+	}
+	before := make([]float64, len(series))
+	for i, name := range series {
+		before[i] = metricCount(t, name)
+	}
+
+	consumer := &store.Consumer{App: "shop"}
+	if err := repos.consumers.Insert(consumer); err != nil {
+		t.Fatal(err)
+	}
+	token := testGateway.newToken(consumer.ID)
+	if err := repos.tokens.Insert(token); err != nil {
+		t.Fatal(err)
+	}
+	repos.tokens.Get(token.ID)
+	repos.tokens.Get("missing")
+	repos.consumers.Get(consumer.ID)
+	repos.consumers.Get("missing")
+
+	for i, name := range series {
+		if got := metricCount(t, name); got != before[i]+1 {
+			t.Fatalf("%s = %v, want %v", name, got, before[i]+1)
+		}
+	}
+}
+
+func TestStorageRegistryMeasuresARegisteredBackend(t *testing.T) {
+	registry := newBuiltinStorageRegistry()
+	err := registry.Register("failing", func(setting store.DataSetting, tokenSettings store.TokenSettings, debugf store.Logf) (*storage, error) {
+		return &storage{
+			consumers: store.NewConsumerMemStore(),
+			tokens:    &unreachableTokenRepo{TokenRepository: store.NewTokenMemStore(tokenSettings, debugf)},
+		}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.Register("failing", openMemoryStorage); err == nil {
+		t.Fatal("a data type must not be registered twice")
+	}
+	repos, err := registry.Open(store.DataSetting{Type: "failing"}, testGateway.currentTokenSetting, testGateway.logger.debugf, testGateway.metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	series := `bifrost_token_store_duration_seconds_count{backend="failing",operation="get",outcome="error"}`
+	before := metricCount(t, series)
+	if _, err := repos.tokens.Get("key"); err != errTestStore {
+		t.Fatalf("err = %v, the error of the backend must be returned", err)
+	}
+	if got := metricCount(t, series); got != before+1 {
+		t.Fatalf("%s = %v, want %v", series, got, before+1)
+	}
+}
+
+func TestStorageRegistryRejectsAnUnknownType(t *testing.T) {
+	_, err := newBuiltinStorageRegistry().Open(store.DataSetting{Type: "cassandra"}, testGateway.currentTokenSetting, testGateway.logger.debugf, testGateway.metrics)
+	if err == nil || !strings.Contains(err.Error(), "memory, mongodb, redis") {
+		t.Fatalf("err = %v, the known types must be listed", err)
+	}
+}
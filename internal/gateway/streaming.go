@@ -0,0 +1,170 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	upstream "github.com/jasonsoft/bifrost/internal/proxy"
+	"github.com/jasonsoft/napnap"
+)
+
+const streamChunkSize = 32 * 1024
+
+type responseControllerKey struct{}
+
+// withResponseController puts the controller of the client connection into
+// the request context, the napnap writer hides the original writer.
+func withResponseController(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), responseControllerKey{}, http.NewResponseController(w))
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func responseController(c *napnap.Context) *http.ResponseController {
+	rc, _ := c.Request.Context().Value(responseControllerKey{}).(*http.ResponseController)
+	return rc
+}
+
+// isEventStream reports whether the client asked for server-sent events and
+// the upstream sends them.
+func isEventStream(req *http.Request, resp *http.Response) bool {
+	if !strings.EqualFold(filterContentType(resp.Header.Get("Content-Type")), "text/event-stream") {
+		return false
+	}
+	for _, accept := range strings.Split(req.Header.Get("Accept"), ",") {
+		if strings.EqualFold(filterContentType(strings.TrimSpace(accept)), "text/event-stream") {
+			return true
+		}
+	}
+	return false
+}
+
+// isStreamingResponse reports whether the response must be written while it
+// is read. Apis with stream_response stream every successful response,
+// others only event streams and bodies without a length. Bodies which are
+// transformed by the gateway are always buffered.
+func isStreamingResponse(apiEntry *api, resp *http.Response) bool {
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return false
+	}
+	if apiEntry.FieldEncryption != nil && len(apiEntry.FieldEncryption.ResponseFields) > 0 {
+		return false
+	}
+	if apiEntry.DecompressResponse && isGzipEncoded(resp.Header) {
+		return false
+	}
+	if apiEntry.StreamResponse {
+		return true
+	}
+	contentType := filterContentType(resp.Header.Get("Content-Type"))
+	return strings.EqualFold(contentType, "text/event-stream") || resp.ContentLength < 0
+}
+
+// streamResponse copies the body to the client and flushes after every
+// read, so server-sent events reach the client as soon as they arrive.
+func (p *proxy) streamResponse(c *napnap.Context, apiEntry *api, resp *http.Response, deadline *upstream.Deadline) error {
+	if apiEntry.MaxResponseBytes > 0 && resp.ContentLength > apiEntry.MaxResponseBytes {
+		resp.Body.Close()
+		p.writeResponseTooLarge(c, apiEntry)
+		return errResponseTooLarge
+	}
+	// the status is sent with the first chunk, so a body which is too large
+	// from the start is still answered with 502. An event stream sends it
+	// right away, the client waits for the headers before the first event.
+	committed := false
+	compressed := false
+	commit := func() {
+		p.removeHeader(resp.Header)
+		p.removeCORSHeader(apiEntry, resp.Header)
+		p.copyHeader(c.Writer.Header(), resp.Header)
+		apiEntry.rewriteResponseHeader(c.Writer.Header())
+		// a known length is kept so the client isn't switched to chunked encoding,
+		// unless the gzip middleware compresses the body again
+		compressed = len(c.Writer.Header()["Content-Encoding"]) > len(resp.Header["Content-Encoding"])
+		if resp.ContentLength >= 0 && !compressed {
+			c.Writer.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+		}
+		c.Set("streaming", true)
+		c.SetStatus(resp.StatusCode)
+		committed = true
+	}
+
+	// the napnap writer doesn't implement http.Flusher, the connection is
+	// flushed through its controller. A response which the gzip middleware
+	// compresses isn't flushed, the gzip writer holds the body.
+	conn := responseController(c)
+	flush := func() {
+		if conn != nil && !compressed {
+			conn.Flush()
+		}
+	}
+
+	// an event stream lasts longer than the read and write timeouts of the
+	// server, instead a client which stops reading is dropped after the idle
+	// timeout of the api
+	var rc *http.ResponseController
+	if isEventStream(c.Request, resp) {
+		rc = conn
+		commit()
+		flush()
+	}
+	if rc != nil {
+		rc.SetReadDeadline(time.Time{})
+		rc.SetWriteDeadline(time.Time{})
+	}
+
+	buf := make([]byte, streamChunkSize)
+	var forwarded int64
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			forwarded += int64(n)
+			if apiEntry.MaxResponseBytes > 0 && forwarded > apiEntry.MaxResponseBytes {
+				if !committed {
+					resp.Body.Close()
+					p.writeResponseTooLarge(c, apiEntry)
+					return errResponseTooLarge
+				}
+				p.abortResponseTooLarge(c, apiEntry, resp)
+			}
+			if !committed {
+				commit()
+			}
+			deadline.Extend()
+			if rc != nil && deadline.Timeout() > 0 {
+				rc.SetWriteDeadline(time.Now().Add(deadline.Timeout()))
+			}
+			if _, werr := c.Writer.Write(buf[:n]); werr != nil {
+				// the client went away
+				return nil
+			}
+			flush()
+		}
+		if err != nil {
+			if deadline.IsExpired() {
+				p.gateway.logger.debugf("stream idle timeout: %v", deadline.Timeout())
+				c.Set("upstream_timeout", deadline.Timeout())
+				if !committed {
+					p.gateway.writeError(c, 504, AppError{
+						ErrorCode: "upstream_timeout",
+						Message:   fmt.Sprintf("The upstream didn't respond within %v.", deadline.Timeout()),
+					})
+				}
+				return err
+			}
+			if !committed {
+				commit()
+			}
+			if err == io.EOF {
+				p.copyTrailer(c, resp)
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package gateway
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jasonsoft/napnap"
+)
+
+func TestZeroUpstreamTimeoutWaitsForTheUpstream(t *testing.T) {
+	withConfig(t, func(config *Configuration) {
+		config.UpstreamTimeout = 0
+	})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("slow"))
+	}))
+	defer upstream.Close()
+
+	apiEntry := newTestAPI(t, "slow", upstream.URL)
+	gateway, _ := serveTestGateway(t, []*api{apiEntry})
+
+	resp, err := http.Get(gateway.URL + "/slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || string(body) != "slow" {
+		t.Fatalf("got %d %q, want 200 slow", resp.StatusCode, body)
+	}
+}
+
+func TestZeroUpstreamTimeoutStreamsEvents(t *testing.T) {
+	withConfig(t, func(config *Configuration) {
+		config.UpstreamTimeout = 0
+	})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, event := range []string{"data: 1\n\n", "data: 2\n\n"} {
+			w.Write([]byte(event))
+			w.(http.Flusher).Flush()
+			time.Sleep(20 * time.Millisecond)
+		}
+	}))
+	defer upstream.Close()
+
+	apiEntry := newTestAPI(t, "events", upstream.URL)
+	gateway, _ := serveTestGateway(t, []*api{apiEntry})
+
+	req, _ := http.NewRequest("GET", gateway.URL+"/events", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || string(body) != "data: 1\n\ndata: 2\n\n" {
+		t.Fatalf("got %d %q, want both events", resp.StatusCode, body)
+	}
+}
+
+func TestEventStreamIsFlushedPerEvent(t *testing.T) {
+	received := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: 1\n\n"))
+		w.(http.Flusher).Flush()
+		// the second event is sent once the client got the first one
+		select {
+		case <-received:
+		case <-time.After(2 * time.Second):
+		}
+		w.Write([]byte("data: 2\n\n"))
+	}))
+	defer upstream.Close()
+
+	apiEntry := newTestAPI(t, "events", upstream.URL)
+	gateway, _ := serveTestGateway(t, []*api{apiEntry})
+
+	req, _ := http.NewRequest("GET", gateway.URL+"/events", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	line := make(chan string, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			line <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		first, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		line <- first
+	}()
+	select {
+	case first := <-line:
+		if first != "data: 1\n" {
+			t.Fatalf("first line = %q", first)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the first event wasn't flushed to the client")
+	}
+	close(received)
+}
+
+func TestStreamResponseIsWrittenWhileItIsRead(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10")
+		w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-time.After(2 * time.Second):
+		}
+		w.Write([]byte("-last"))
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	apiEntry := newTestAPI(t, "download", upstream.URL)
+	apiEntry.StreamResponse = true
+	gateway, _ := serveTestGateway(t, []*api{apiEntry})
+
+	resp, err := http.Get(gateway.URL + "/download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ContentLength != 10 {
+		t.Fatalf("content length = %d, a known length must be kept", resp.ContentLength)
+	}
+	first := make([]byte, 5)
+	read := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(resp.Body, first)
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err != nil || string(first) != "first" {
+			t.Fatalf("first = %q, %v", first, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the response was buffered until the upstream finished")
+	}
+}
+
+func TestStreamResponseDropsContentLengthWhenCompressed(t *testing.T) {
+	body := strings.Repeat("compressible ", 100)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(body))
+	}))
+	defer upstream.Close()
+
+	apiEntry := newTestAPI(t, "download", upstream.URL)
+	apiEntry.StreamResponse = true
+	gateway, _ := serveTestGateway(t, []*api{apiEntry}, napnap.NewGzip(napnap.DefaultCompression))
+
+	req, _ := http.NewRequest("GET", gateway.URL+"/download", nil)
+	// the transport doesn't unpack the body when the header is set here
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "gzip" || resp.ContentLength == int64(len(body)) {
+		t.Fatalf("encoding = %q, content length = %d, the plain length must not be sent", resp.Header.Get("Content-Encoding"), resp.ContentLength)
+	}
+	reader, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, _ := ioutil.ReadAll(reader)
+	if string(plain) != body {
+		t.Fatalf("body = %q", plain)
+	}
+}
+
+// BenchmarkProxyLargeResponse compares the memory of a buffered and a
+// streamed 100MB response, see B/op of both.
+func BenchmarkProxyLargeResponse(b *testing.B) {
+	const size = 100 << 20
+	chunk := make([]byte, 32<<10)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		for written := 0; written < size; written += len(chunk) {
+			w.Write(chunk)
+		}
+	}))
+	defer upstream.Close()
+
+	for _, stream := range []bool{false, true} {
+		name := "buffered"
+		if stream {
+			name = "streamed"
+		}
+		b.Run(name, func(b *testing.B) {
+			apiEntry := newTestAPI(b, "download", upstream.URL)
+			apiEntry.StreamResponse = stream
+			gateway, _ := serveTestGateway(b, []*api{apiEntry})
+			b.ReportAllocs()
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				resp, err := http.Get(gateway.URL + "/download")
+				if err != nil {
+					b.Fatal(err)
+				}
+				n, _ := io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+				if n != size {
+					b.Fatalf("read %d bytes, want %d", n, size)
+				}
+			}
+		})
+	}
+}
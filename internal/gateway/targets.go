@@ -0,0 +1,104 @@
+package gateway
+
+import "sync"
+
+// apiTarget is one upstream of an api. Targets with zero weight are only
+// used when all other targets are down.
+type apiTarget struct {
+	URL    string `json:"url" bson:"url"`
+	Weight int    `json:"weight" bson:"weight"`
+}
+
+// balancer keeps the state of smooth weighted round-robin selection.
+type balancer struct {
+	sync.Mutex
+	currentWeights map[string]int
+}
+
+func newBalancer() *balancer {
+	return &balancer{
+		currentWeights: map[string]int{},
+	}
+}
+
+// next picks a target using the smooth weighted round-robin algorithm,
+// so heavy targets are not picked in bursts. Targets which are down are
+// skipped.
+func (b *balancer) next(targets []*apiTarget, health *healthChecker) *apiTarget {
+	candidates := []*apiTarget{}
+	standby := []*apiTarget{}
+	for _, target := range targets {
+		if !health.isUp(target.URL) {
+			continue
+		}
+		if target.Weight > 0 {
+			candidates = append(candidates, target)
+		} else {
+			standby = append(standby, target)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = standby
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	total := 0
+	var result *apiTarget
+	for _, target := range candidates {
+		weight := target.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		b.currentWeights[target.URL] += weight
+		total += weight
+		if result == nil || b.currentWeights[target.URL] > b.currentWeights[result.URL] {
+			result = target
+		}
+	}
+	b.currentWeights[result.URL] -= total
+	return result
+}
+
+// targets returns all targets of the api. target_url and target_urls are
+// still supported and each of them has weight 1.
+func (a *api) targets() []*apiTarget {
+	result := []*apiTarget{}
+	seen := map[string]bool{}
+	add := func(target *apiTarget) {
+		if target == nil || len(target.URL) == 0 || seen[target.URL] {
+			return
+		}
+		seen[target.URL] = true
+		result = append(result, target)
+	}
+
+	add(&apiTarget{URL: a.TargetURL, Weight: 1})
+	for _, targetURL := range a.TargetURLs {
+		add(&apiTarget{URL: targetURL, Weight: 1})
+	}
+	for _, target := range a.Targets {
+		add(target)
+	}
+	return result
+}
+
+// askForTarget picks the next target url of the api.
+func (a *api) askForTarget(health *healthChecker) string {
+	a.Lock()
+	if a.balancer == nil {
+		a.balancer = newBalancer()
+	}
+	b := a.balancer
+	a.Unlock()
+
+	target := b.next(a.targets(), health)
+	if target == nil {
+		return ""
+	}
+	return target.URL
+}
@@ -0,0 +1,63 @@
+package gateway
+
+import (
+	"math"
+	"sync"
+	"testing"
+)
+
+func TestBalancerDistributesByWeight(t *testing.T) {
+	apiEntry := &api{
+		Targets: []*apiTarget{
+			{URL: "http://light:8080", Weight: 1},
+			{URL: "http://heavy:8080", Weight: 3},
+			{URL: "http://standby:8080", Weight: 0},
+		},
+	}
+
+	const picks = 10000
+	counts := map[string]int{}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < picks/10; j++ {
+				targetURL := apiEntry.askForTarget(testGateway.healthChecker)
+				mutex.Lock()
+				counts[targetURL]++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if counts["http://standby:8080"] > 0 {
+		t.Fatalf("the standby target was picked %d times while the others are up", counts["http://standby:8080"])
+	}
+	share := float64(counts["http://heavy:8080"]) / picks
+	if math.Abs(share-0.75) > 0.01 {
+		t.Fatalf("counts = %v, the heavy target has %.3f of the picks, want 0.75 within 0.01", counts, share)
+	}
+}
+
+func TestBalancerInterleavesHeavyTargets(t *testing.T) {
+	targets := []*apiTarget{
+		{URL: "http://light:8080", Weight: 1},
+		{URL: "http://heavy:8080", Weight: 3},
+	}
+	b := newBalancer()
+	// every window of four picks has the light target once
+	for i := 0; i < 100; i++ {
+		light := 0
+		for j := 0; j < 4; j++ {
+			if b.next(targets, testGateway.healthChecker).URL == "http://light:8080" {
+				light++
+			}
+		}
+		if light != 1 {
+			t.Fatalf("window %d has the light target %d times", i, light)
+		}
+	}
+}
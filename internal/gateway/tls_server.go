@@ -0,0 +1,62 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// certificateFile serves the certificate of the tls listener and reads the
+// files again on reload, so a renewed certificate doesn't need a restart.
+type certificateFile struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Value // *tls.Certificate
+}
+
+func newCertificateFile(certFile string, keyFile string) (*certificateFile, error) {
+	cf := &certificateFile{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := cf.reload(); err != nil {
+		return nil, err
+	}
+	return cf, nil
+}
+
+// reload keeps the current certificate when the new files can't be read.
+func (cf *certificateFile) reload() error {
+	cert, err := tls.LoadX509KeyPair(cf.certFile, cf.keyFile)
+	if err != nil {
+		return err
+	}
+	cf.cert.Store(&cert)
+	return nil
+}
+
+func (cf *certificateFile) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, ok := cf.cert.Load().(*tls.Certificate)
+	if !ok {
+		return nil, errors.New("tls: certificate isn't loaded")
+	}
+	return cert, nil
+}
+
+// httpsRedirectHandler sends every plaintext request to the same path and
+// query on the tls listener.
+func httpsRedirectHandler(tlsAddr string) http.Handler {
+	_, tlsPort, _ := net.SplitHostPort(tlsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if name, _, err := net.SplitHostPort(host); err == nil {
+			host = name
+		}
+		if len(tlsPort) > 0 && tlsPort != "443" {
+			host = net.JoinHostPort(host, tlsPort)
+		}
+		http.Redirect(w, req, "https://"+host+req.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,314 @@
+package gateway
+
+import (
+	"container/list"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jasonsoft/bifrost/internal/store"
+	"github.com/jasonsoft/napnap"
+)
+
+const (
+	unmatchedWindowMinutes = 60
+	unmatchedTopSources    = 10
+	maxPathSegments        = 8
+	maxSegmentLength       = 64
+)
+
+var (
+	numericSegment = regexp.MustCompile(`^[0-9]+$`)
+	uuidSegment    = regexp.MustCompile(`^[0-9a-fA-F]{8}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{12}$`)
+	hexSegment     = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+)
+
+// normalizePath collapses ids in the path so the number of signatures stays small.
+func normalizePath(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	result := []string{}
+	for i, segment := range segments {
+		if i == maxPathSegments {
+			result = append(result, ":more")
+			break
+		}
+		switch {
+		case len(segment) == 0:
+			continue
+		case numericSegment.MatchString(segment):
+			segment = ":num"
+		case uuidSegment.MatchString(segment):
+			segment = ":uuid"
+		case hexSegment.MatchString(segment):
+			segment = ":hex"
+		case len(segment) > maxSegmentLength:
+			segment = ":long"
+		}
+		result = append(result, strings.ToLower(segment))
+	}
+	return "/" + strings.Join(result, "/")
+}
+
+type unmatchedSource struct {
+	Name  string `json:"name"`
+	Count uint64 `json:"count"`
+}
+
+type unmatchedEntry struct {
+	Signature string             `json:"signature"`
+	Listener  string             `json:"listener"`
+	Count     uint64             `json:"count"`
+	FirstSeen time.Time          `json:"first_seen"`
+	LastSeen  time.Time          `json:"last_seen"`
+	Sources   []*unmatchedSource `json:"top_sources"`
+	minutes   [unmatchedWindowMinutes]uint64
+	minuteAt  [unmatchedWindowMinutes]int64
+	element   *list.Element
+}
+
+// addSource keeps the top sources with the space-saving algorithm,
+// the least seen source is replaced when the list is full.
+func (e *unmatchedEntry) addSource(name string) {
+	var min *unmatchedSource
+	for _, source := range e.Sources {
+		if source.Name == name {
+			source.Count++
+			return
+		}
+		if min == nil || source.Count < min.Count {
+			min = source
+		}
+	}
+	if len(e.Sources) < unmatchedTopSources {
+		e.Sources = append(e.Sources, &unmatchedSource{Name: name, Count: 1})
+		return
+	}
+	min.Name = name
+	min.Count++
+}
+
+func (e *unmatchedEntry) add(now time.Time) uint64 {
+	minute := now.Unix() / 60
+	i := minute % unmatchedWindowMinutes
+	if e.minuteAt[i] != minute {
+		e.minuteAt[i] = minute
+		e.minutes[i] = 0
+	}
+	e.minutes[i]++
+	return e.minutes[i]
+}
+
+func (e *unmatchedEntry) countWithin(now time.Time, window time.Duration) uint64 {
+	current := now.Unix() / 60
+	oldest := current - int64(window/time.Minute) + 1
+	var result uint64
+	for i := range e.minutes {
+		if e.minuteAt[i] >= oldest && e.minuteAt[i] <= current {
+			result += e.minutes[i]
+		}
+	}
+	return result
+}
+
+// unmatchedReport aggregates requests which don't match any api.
+// The least recently seen signatures are evicted to bound the memory.
+type unmatchedReport struct {
+	sync.Mutex
+	maxEntries     int
+	spikeThreshold uint64
+	entries        map[string]*unmatchedEntry
+	lru            *list.List
+	logger         *logger
+}
+
+func newUnmatchedReport(maxEntries int, spikeThreshold int, logger *logger) *unmatchedReport {
+	return &unmatchedReport{
+		maxEntries:     maxEntries,
+		spikeThreshold: uint64(spikeThreshold),
+		entries:        map[string]*unmatchedEntry{},
+		lru:            list.New(),
+		logger:         logger,
+	}
+}
+
+func (r *unmatchedReport) record(listener string, path string, source string) {
+	signature := normalizePath(path)
+	key := listener + " " + signature
+	now := time.Now().UTC()
+
+	r.Lock()
+	defer r.Unlock()
+
+	entry, ok := r.entries[key]
+	if ok {
+		r.lru.MoveToFront(entry.element)
+	} else {
+		if oldest := r.lru.Back(); oldest != nil && len(r.entries) >= r.maxEntries {
+			r.lru.Remove(oldest)
+			delete(r.entries, oldest.Value.(string))
+		}
+		entry = &unmatchedEntry{
+			Signature: signature,
+			Listener:  listener,
+			FirstSeen: now,
+		}
+		entry.element = r.lru.PushFront(key)
+		r.entries[key] = entry
+	}
+
+	entry.Count++
+	entry.LastSeen = now
+	entry.addSource(source)
+	perMinute := entry.add(now)
+	if r.spikeThreshold > 0 && perMinute == r.spikeThreshold {
+		r.logger.writeEventLog("unmatched.spike", map[string]interface{}{
+			"signature":  signature,
+			"listener":   listener,
+			"per_minute": perMinute,
+		})
+	}
+}
+
+// top returns a copy of the n signatures with the most requests within the window.
+func (r *unmatchedReport) top(n int, window time.Duration) []*unmatchedEntry {
+	now := time.Now().UTC()
+	r.Lock()
+	defer r.Unlock()
+
+	result := []*unmatchedEntry{}
+	for _, entry := range r.entries {
+		count := entry.countWithin(now, window)
+		if count == 0 {
+			continue
+		}
+		sources := []*unmatchedSource{}
+		for _, source := range entry.Sources {
+			sources = append(sources, &unmatchedSource{Name: source.Name, Count: source.Count})
+		}
+		result = append(result, &unmatchedEntry{
+			Signature: entry.Signature,
+			Listener:  entry.Listener,
+			Count:     count,
+			FirstSeen: entry.FirstSeen,
+			LastSeen:  entry.LastSeen,
+			Sources:   sources,
+		})
+	}
+	sort.Sort(byUnmatchedCount(result))
+	if len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
+
+type byUnmatchedCount []*unmatchedEntry
+
+func (source byUnmatchedCount) Len() int {
+	return len(source)
+}
+func (source byUnmatchedCount) Swap(i, j int) {
+	source[i], source[j] = source[j], source[i]
+}
+func (source byUnmatchedCount) Less(i, j int) bool {
+	return source[i].Count > source[j].Count
+}
+
+// summarize writes one gelf message with the top signatures instead of one message per miss.
+func (r *unmatchedReport) summarize(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		for _, entry := range r.top(10, interval) {
+			r.logger.writeEventLog("unmatched.summary", map[string]interface{}{
+				"signature": entry.Signature,
+				"listener":  entry.Listener,
+				"count":     entry.Count,
+			})
+		}
+	}
+}
+
+func listenerOf(c *napnap.Context) string {
+	addr, ok := c.Request.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return ""
+	}
+	return addr.String()
+}
+
+// isIgnoredListener matches listeners by port, so ":10081" ignores every address of the admin port.
+func (g *Gateway) isIgnoredListener(listener string) bool {
+	_, port, err := net.SplitHostPort(listener)
+	if err != nil {
+		return false
+	}
+	for _, ignored := range g.currentConfig().Unmatched.IgnoreListeners {
+		if ignored == listener || strings.TrimPrefix(ignored, ":") == port {
+			return true
+		}
+		if _, ignoredPort, err := net.SplitHostPort(ignored); err == nil && ignoredPort == port {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *Gateway) recordUnmatched(c *napnap.Context) {
+	if g.unmatchedReport == nil {
+		return
+	}
+	listener := listenerOf(c)
+	if g.isIgnoredListener(listener) {
+		return
+	}
+	source := "ip:" + g.clientIP(c)
+	if val, ok := c.Get("consumer"); ok {
+		if consumer, ok := val.(store.Consumer); ok && consumer.IsAuthenticated() {
+			source = "consumer:" + consumer.ID
+		}
+	}
+	g.unmatchedReport.record(listener, c.Request.URL.Path, source)
+}
+
+type unmatchedCollection struct {
+	Count      int               `json:"count"`
+	Window     string            `json:"window"`
+	Signatures []*unmatchedEntry `json:"signatures"`
+}
+
+func (g *Gateway) listUnmatchedEndpoint(c *napnap.Context) {
+	if g.unmatchedReport == nil {
+		c.SetStatus(501)
+		return
+	}
+
+	window := time.Duration(unmatchedWindowMinutes) * time.Minute
+	if val := c.Query("window"); len(val) > 0 {
+		d, err := time.ParseDuration(val)
+		if err != nil || d < time.Minute {
+			panic(AppError{ErrorCode: "invalid_input", Message: "window field is invalid."})
+		}
+		if d < window {
+			window = d
+		}
+	}
+	limit := 20
+	if val := c.Query("limit"); len(val) > 0 {
+		n, err := strconv.Atoi(val)
+		if err != nil || n <= 0 {
+			panic(AppError{ErrorCode: "invalid_input", Message: "limit field is invalid."})
+		}
+		limit = n
+	}
+
+	signatures := g.unmatchedReport.top(limit, window)
+	c.JSON(200, unmatchedCollection{
+		Count:      len(signatures),
+		Window:     window.String(),
+		Signatures: signatures,
+	})
+}
@@ -0,0 +1,37 @@
+package gateway
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUnmatchedMaxSignaturesMustBePositive(t *testing.T) {
+	config := newConfiguration()
+	config.Unmatched.Enable = true
+	config.Unmatched.MaxSignatures = 0
+	if err := config.isValid(); err == nil {
+		t.Fatal("max_signatures 0 must be rejected")
+	}
+}
+
+func TestUnmatchedReportEvictsTheOldestSignature(t *testing.T) {
+	report := newUnmatchedReport(2, 0, testGateway.logger)
+	report.record(":10080", "/a", "client")
+	report.record(":10080", "/b", "client")
+	report.record(":10080", "/a", "client")
+	report.record(":10080", "/c", "client")
+
+	signatures := map[string]bool{}
+	for _, entry := range report.top(10, time.Minute) {
+		signatures[entry.Signature] = true
+	}
+	if len(signatures) != 2 || !signatures["/a"] || !signatures["/c"] {
+		t.Fatalf("signatures = %v, want /a and /c", signatures)
+	}
+}
+
+func TestUnmatchedReportWithoutRoomDoesNotPanic(t *testing.T) {
+	report := newUnmatchedReport(0, 0, testGateway.logger)
+	report.record(":10080", "/a", "client")
+	report.record(":10080", "/b", "client")
+}
@@ -0,0 +1,50 @@
+package gateway
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	upstream "github.com/jasonsoft/bifrost/internal/proxy"
+)
+
+func TestUpstreamTLSVerification(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		setting *upstream.TLS
+		status  int
+	}{
+		{"insecure_skip_verify", &upstream.TLS{InsecureSkipVerify: true}, 200},
+		{"ca_file", &upstream.TLS{CAFile: caFile}, 200},
+		{"system roots", nil, 502},
+	} {
+		apiEntry := newTestAPI(t, "secure", server.URL)
+		apiEntry.UpstreamTLS = test.setting
+		if err := apiEntry.isValid(testGateway.currentConfig()); err != nil {
+			t.Fatal(err)
+		}
+		gateway, _ := serveTestGateway(t, []*api{apiEntry})
+
+		resp, err := http.Get(gateway.URL + "/secure")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: status = %d, want %d", test.name, resp.StatusCode, test.status)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package gateway
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"github.com/jasonsoft/napnap"
+)
+
+// readCloser combines a reader with the closer of the original body.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func respClose(body io.ReadCloser) error {
+	if body == nil {
+		return nil
+	}
+	if _, err := io.Copy(ioutil.Discard, body); err != nil {
+		return err
+	}
+	return body.Close()
+}
+
+func contains(s []string, str string) bool {
+	for _, a := range s {
+		if a == str {
+			return true
+		}
+	}
+	return false
+}
+
+func panicIf(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+func getClientIP(ip string) string {
+	if len(ip) > 0 && ip == "::1" {
+		return "127.0.0.1"
+	}
+	return ip
+}
+
+// peerIP returns the ip of the connection, which unlike RemoteIPAddress
+// can't be changed by the X-Forwarded-For header.
+func peerIP(c *napnap.Context) string {
+	ip := c.Request.RemoteAddr
+	if host, _, err := net.SplitHostPort(strings.TrimSpace(ip)); err == nil {
+		ip = host
+	}
+	return getClientIP(ip)
+}
+
+// clientIP returns the ip of the client. X-Forwarded-For is only read when
+// the peer is a trusted proxy, then it's walked from the right and the first
+// address which isn't a trusted proxy is the client.
+func (g *Gateway) clientIP(c *napnap.Context) string {
+	ip := peerIP(c)
+	trusted := g.currentConfig().TrustedProxies
+	if !ipInCIDRs(ip, trusted) {
+		return ip
+	}
+	hops := []string{}
+	for _, val := range c.Request.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(val, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := getClientIP(strings.TrimSpace(hops[i]))
+		if net.ParseIP(hop) == nil {
+			// the hops before an invalid one can't be trusted
+			break
+		}
+		ip = hop
+		if !ipInCIDRs(hop, trusted) {
+			break
+		}
+	}
+	return ip
+}
+
+// ipInCIDRs reports whether the ip is in one of the cidrs, invalid cidrs
+// are skipped.
+func ipInCIDRs(ip string, cidrs []string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err == nil && network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterContentType returns the media type without parameters like charset.
+func filterContentType(contentType string) string {
+	if i := strings.IndexAny(contentType, "; "); i >= 0 {
+		return contentType[:i]
+	}
+	return contentType
+}
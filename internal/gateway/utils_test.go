@@ -0,0 +1,80 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jasonsoft/napnap"
+)
+
+func TestClientIPBehindTrustedProxies(t *testing.T) {
+	withConfig(t, func(config *Configuration) {
+		config.TrustedProxies = []string{"10.0.0.0/8", "192.168.1.1/32"}
+	})
+	tests := []struct {
+		remoteAddr   string
+		forwardedFor []string
+		want         string
+	}{
+		// without a trusted peer X-Forwarded-For is ignored
+		{"203.0.113.7:5000", []string{"1.1.1.1"}, "203.0.113.7"},
+		{"10.0.0.2:5000", nil, "10.0.0.2"},
+		{"10.0.0.2:5000", []string{"198.51.100.4"}, "198.51.100.4"},
+		// the right-most address which isn't a trusted proxy is the client
+		{"10.0.0.2:5000", []string{"1.1.1.1, 198.51.100.4, 192.168.1.1"}, "198.51.100.4"},
+		{"10.0.0.2:5000", []string{"1.1.1.1", "198.51.100.4, 10.1.2.3"}, "198.51.100.4"},
+		// the hops before an invalid address can't be trusted
+		{"10.0.0.2:5000", []string{"198.51.100.4, garbage, 10.1.2.3"}, "10.1.2.3"},
+		{"10.0.0.2:5000", []string{"10.3.3.3, 10.1.2.3"}, "10.3.3.3"},
+		{"[::1]:5000", []string{"1.1.1.1"}, "127.0.0.1"},
+	}
+	for _, test := range tests {
+		c, _, _ := napnap.CreateTestContext()
+		c.Request = httptest.NewRequest("GET", "/", nil)
+		c.Request.RemoteAddr = test.remoteAddr
+		for _, val := range test.forwardedFor {
+			c.Request.Header.Add("X-Forwarded-For", val)
+		}
+		if ip := testGateway.clientIP(c); ip != test.want {
+			t.Errorf("%s %v: client ip = %s, want %s", test.remoteAddr, test.forwardedFor, ip, test.want)
+		}
+	}
+}
+
+func TestTrustedProxiesAreValidated(t *testing.T) {
+	config := newConfiguration()
+	config.TrustedProxies = []string{"10.0.0.0/8", "10.0.0.1"}
+	if err := config.isValid(); err == nil || !strings.Contains(err.Error(), ErrTrustedProxies.Error()) {
+		t.Fatalf("err = %v, an address without prefix length must be rejected", err)
+	}
+}
+
+func TestForwardedHeadersBehindTrustedProxies(t *testing.T) {
+	withConfig(t, func(config *Configuration) {
+		config.TrustedProxies = []string{"127.0.0.1/32"}
+	})
+	received := make(chan http.Header, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header
+	}))
+	defer upstream.Close()
+	server, _ := serveTestGateway(t, []*api{newTestAPI(t, "orders", upstream.URL)})
+
+	req, _ := http.NewRequest("GET", server.URL+"/orders", nil)
+	req.Header.Set("X-Forwarded-For", "198.51.100.4")
+	req.Header.Set("X-Real-IP", "1.1.1.1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	header := <-received
+	if header.Get("X-Forwarded-For") != "198.51.100.4, 127.0.0.1" {
+		t.Fatalf("X-Forwarded-For = %s", header.Get("X-Forwarded-For"))
+	}
+	if header.Get("X-Real-IP") != "198.51.100.4" {
+		t.Fatalf("X-Real-IP = %s, want the client behind the trusted proxy", header.Get("X-Real-IP"))
+	}
+}
@@ -0,0 +1,146 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"time"
+
+	"github.com/jasonsoft/bifrost/internal/store"
+	"github.com/jasonsoft/napnap"
+)
+
+func isWebSocketRequest(req *http.Request) bool {
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, val := range req.Header["Connection"] {
+		for _, token := range strings.Split(val, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dialUpstream connects to the upstream of a websocket, through the egress
+// proxy unless the host bypasses it.
+func dialUpstream(ctx context.Context, target *neturl.URL, config *tls.Config, egress *egressProxy) (net.Conn, error) {
+	host := target.Host
+	hostname := host
+	secure := target.Scheme == "https" || target.Scheme == "wss"
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		hostname = name
+	} else if secure {
+		host = net.JoinHostPort(host, "443")
+	} else {
+		host = net.JoinHostPort(host, "80")
+	}
+	if secure {
+		if config == nil {
+			config = &tls.Config{}
+		} else {
+			config = config.Clone()
+		}
+		config.ServerName = hostname
+	}
+	var dialer net.Dialer
+	conn, err := dialEgress(ctx, dialer.DialContext, egress, host)
+	if err != nil || !secure {
+		return conn, err
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// tunnelWebSocket sends the upgrade request to the upstream and then copies
+// bytes in both directions until one side closes the connection. The
+// upstream's handshake response goes to the client untouched.
+func (p *proxy) tunnelWebSocket(c *napnap.Context, apiEntry *api, consumer store.Consumer, url string) error {
+	target, err := neturl.Parse(url)
+	if err != nil {
+		panic(err)
+	}
+
+	hijacker, ok := c.Writer.(http.Hijacker)
+	if !ok {
+		p.gateway.writeError(c, 500, AppError{ErrorCode: "unknown_error", Message: "The connection can't be upgraded."})
+		return nil
+	}
+
+	var config *tls.Config
+	if setting := apiEntry.tlsSetting(p.gateway.currentConfig()); setting != nil {
+		config, err = p.gateway.upstreamTransports.TLSConfig(setting)
+		if err != nil {
+			p.writeBadGateway(c, err)
+			return err
+		}
+	}
+
+	ctx := c.Request.Context()
+	if timeout := apiEntry.upstreamTimeout(p.gateway.currentConfig()); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	upstream, err := dialUpstream(ctx, target, config, apiEntry.egressProxySetting(p.gateway.currentConfig()))
+	if err != nil {
+		p.writeBadGateway(c, err)
+		return err
+	}
+	defer upstream.Close()
+
+	outReq, err := http.NewRequest(c.Request.Method, url, nil)
+	if err != nil {
+		panic(err)
+	}
+	if apiEntry.PreserveHost {
+		outReq.Host = c.Request.Host
+	}
+	// Connection and Upgrade are kept, they are needed for the handshake
+	p.copyHeader(outReq.Header, c.Request.Header)
+	p.setUpstreamHeader(c, apiEntry, consumer, outReq.Header)
+	err = outReq.Write(upstream)
+	if err != nil {
+		p.writeBadGateway(c, err)
+		return err
+	}
+
+	client, buf, err := hijacker.Hijack()
+	if err != nil {
+		p.gateway.logger.errorf("websocket hijack failed: %v", err)
+		return nil
+	}
+	defer client.Close()
+	c.Set("websocket", true)
+	// the tunnel lives longer than the read and write timeouts of the server
+	client.SetDeadline(time.Time{})
+
+	// bytes which the client sent right after the handshake
+	if n := buf.Reader.Buffered(); n > 0 {
+		pending, _ := buf.Reader.Peek(n)
+		if _, err := upstream.Write(pending); err != nil {
+			return nil
+		}
+	}
+
+	errc := make(chan error, 2)
+	tunnel := func(dst, src net.Conn) {
+		_, err := io.Copy(dst, src)
+		errc <- err
+	}
+	go tunnel(upstream, client)
+	go tunnel(client, upstream)
+	err = <-errc
+	p.gateway.logger.debugf("websocket closed: %v", err)
+	return nil
+}
@@ -0,0 +1,412 @@
+// Package logging sends log messages to a gelf server over udp, tcp or tcp
+// with tls.
+package logging
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultConnection      = "lan"
+	defaultProtocol        = "udp"
+	defaultMaxChunkSizeWan = 1420
+	defaultMaxChunkSizeLan = 8154
+	minReconnectDelay      = 1 * time.Second
+	maxReconnectDelay      = 30 * time.Second
+	tlsHandshakeTimeout    = 10 * time.Second
+)
+
+// Message is a gelf message, the custom fields are sent with an underscore
+// prefix.
+type Message struct {
+	Version      string
+	Host         string
+	Level        int
+	ShortMessage string
+	FullMessage  string
+	Timestamp    float64
+	Facility     string
+	LoggerName   string
+	CustomFields map[string]interface{}
+	// flushed marks the end of a flush, the queue closes it instead of
+	// sending a message
+	flushed chan struct{}
+}
+
+// NewMessage returns a message of the logger with the current time.
+func NewMessage(host string, appName string, loggerName string, level int) *Message {
+	return &Message{
+		Version:      "1.1",
+		LoggerName:   loggerName,
+		Host:         host,
+		Facility:     appName,
+		Timestamp:    float64(time.Now().UnixNano()) / float64(time.Second),
+		Level:        level,
+		CustomFields: make(map[string]interface{}),
+	}
+}
+
+// Marshal returns the json of the message, a custom field which can't be
+// marshaled fails the whole message.
+func (m *Message) Marshal() ([]byte, error) {
+	items := make(map[string]interface{})
+	items["version"] = m.Version
+	items["host"] = m.Host
+	items["level"] = m.Level
+	items["short_message"] = m.ShortMessage
+	items["full_message"] = m.FullMessage
+	items["timestamp"] = m.Timestamp
+	items["_app_id"] = m.Facility
+	items["_logger_name"] = m.LoggerName
+
+	for k, v := range m.CustomFields {
+		items["_"+k] = v
+	}
+
+	return json.Marshal(items)
+}
+
+// Config is the gelf server and how the messages are sent to it.
+type Config struct {
+	ConnectionString string
+	Protocol         string // udp or tcp
+	Connection       string
+	MaxChunkSizeWan  int
+	MaxChunkSizeLan  int
+	// tcp connections use tls with a client certificate when all three are set
+	TLSCertFile string
+	TLSKeyFile  string
+	TLSCAFile   string
+}
+
+// Writer sends the messages to the gelf server. A tcp connection is
+// established again when it's broken.
+type Writer struct {
+	sync.Mutex
+	conn           net.Conn
+	writer         *gzip.Writer
+	reconnectDelay time.Duration
+	reconnectAt    time.Time
+	tlsConfig      *tls.Config
+	closed         bool
+	Config
+}
+
+// NewWriter connects to the gelf server, messages are dropped while the tcp
+// connection can't be established.
+func NewWriter(config Config) *Writer {
+	gz, err := gzip.NewWriterLevel(ioutil.Discard, gzip.BestSpeed)
+	if err != nil {
+		panic(err)
+	}
+
+	if len(config.ConnectionString) == 0 {
+		config.ConnectionString = "127.0.0.1:12201"
+	}
+	if config.Protocol == "" {
+		config.Protocol = defaultProtocol
+	}
+	if config.Connection == "" {
+		config.Connection = defaultConnection
+	}
+	if config.MaxChunkSizeWan == 0 {
+		config.MaxChunkSizeWan = defaultMaxChunkSizeWan
+	}
+	if config.MaxChunkSizeLan == 0 {
+		config.MaxChunkSizeLan = defaultMaxChunkSizeLan
+	}
+
+	g := &Writer{
+		writer: gz,
+		Config: config,
+	}
+
+	if g.IsTLS() {
+		if err := g.ReloadTLS(); err != nil {
+			log.Printf("gelf: failed to load tls certificates: %v", err)
+		}
+	}
+
+	if g.IsTCP() {
+		// the connection is established again when it's broken
+		g.Lock()
+		err = g.connect()
+		g.Unlock()
+		if err != nil {
+			log.Printf("gelf: failed to connect %s: %v", config.ConnectionString, err)
+		}
+		return g
+	}
+
+	udpConn, err := net.Dial("udp", config.ConnectionString)
+	if err != nil {
+		panic(err)
+	}
+	g.conn = udpConn
+	return g
+}
+
+// IsTCP reports whether the messages are sent over tcp.
+func (g *Writer) IsTCP() bool {
+	return strings.EqualFold(g.Config.Protocol, "tcp")
+}
+
+// IsTLS reports whether the tcp connection uses tls.
+func (g *Writer) IsTLS() bool {
+	return g.IsTCP() && len(g.TLSCertFile) > 0 && len(g.TLSKeyFile) > 0 && len(g.TLSCAFile) > 0
+}
+
+// ReloadTLS reads the certificate files again, the current connection is
+// kept and the next connection uses them. The old certificates are kept
+// when the files can't be read.
+func (g *Writer) ReloadTLS() error {
+	cert, err := tls.LoadX509KeyPair(g.TLSCertFile, g.TLSKeyFile)
+	if err != nil {
+		return err
+	}
+	pem, err := ioutil.ReadFile(g.TLSCAFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return errors.New("gelf tls ca file doesn't contain any certificate")
+	}
+	host, _, err := net.SplitHostPort(g.ConnectionString)
+	if err != nil {
+		return err
+	}
+
+	g.Lock()
+	defer g.Unlock()
+	g.tlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ServerName:   host,
+	}
+	return nil
+}
+
+// connect dials the tcp connection and does the tls handshake. Failures are
+// retried with exponential backoff which is capped at maxReconnectDelay.
+// The caller holds the lock.
+func (g *Writer) connect() error {
+	conn, err := net.Dial("tcp", g.Config.ConnectionString)
+	if err == nil && g.IsTLS() {
+		conn, err = g.handshake(conn, g.tlsConfig)
+	}
+	if err != nil {
+		if g.reconnectDelay == 0 {
+			g.reconnectDelay = minReconnectDelay
+		} else {
+			g.reconnectDelay *= 2
+			if g.reconnectDelay > maxReconnectDelay {
+				g.reconnectDelay = maxReconnectDelay
+			}
+		}
+		g.reconnectAt = time.Now().Add(g.reconnectDelay)
+		return err
+	}
+	g.conn = conn
+	g.reconnectDelay = 0
+	return nil
+}
+
+func (g *Writer) handshake(conn net.Conn, config *tls.Config) (net.Conn, error) {
+	if config == nil {
+		conn.Close()
+		return nil, errors.New("gelf tls certificates aren't loaded")
+	}
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		log.Printf("gelf: tls handshake with %s failed: %v", g.ConnectionString, err)
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// Close closes the connection to the gelf server, it waits for the message
+// which is being written. Later messages are dropped.
+func (g *Writer) Close() error {
+	g.Lock()
+	defer g.Unlock()
+	g.closed = true
+	if g.conn == nil {
+		return nil
+	}
+	err := g.conn.Close()
+	g.conn = nil
+	return err
+}
+
+// Send sends the json of a message. Udp messages are compressed and split
+// into chunks, tcp messages are delimited by a null byte.
+func (g *Writer) Send(data []byte) {
+	// tcp doesn't support chunking and compression, messages are delimited by null byte
+	if g.IsTCP() {
+		g.sendTCP(append(data, 0))
+		return
+	}
+	/*
+		msgJson := g.parseJson(message)
+
+		err := g.testForForbiddenValues(msgJson)
+		if err != nil {
+			log.Printf("Uh oh! %s", err)
+			return
+		}
+	*/
+	compressed, err := g.compress(data)
+	if err != nil {
+		log.Printf("gelf: failed to compress the message: %v", err)
+		return
+	}
+	/*
+		compressed := []byte(message)
+		_logger.debug(compressed)
+		g.send(compressed)
+	*/
+	chunksize := g.Config.MaxChunkSizeLan
+	length := compressed.Len()
+
+	if length > chunksize {
+
+		chunkCountInt := int(math.Ceil(float64(length) / float64(chunksize)))
+
+		id := make([]byte, 8)
+		rand.Read(id)
+
+		for i, index := 0, 0; i < length; i, index = i+chunksize, index+1 {
+			packet := g.createChunkedMessage(index, chunkCountInt, id, &compressed)
+			g.send(packet.Bytes())
+		}
+
+	} else {
+		g.send(compressed.Bytes())
+	}
+
+}
+
+func (g *Writer) createChunkedMessage(index int, chunkCountInt int, id []byte, compressed *bytes.Buffer) bytes.Buffer {
+	var packet bytes.Buffer
+
+	chunksize := g.getChunksize()
+
+	packet.Write(g.intToBytes(30))
+	packet.Write(g.intToBytes(15))
+	packet.Write(id)
+
+	packet.Write(g.intToBytes(index))
+	packet.Write(g.intToBytes(chunkCountInt))
+
+	packet.Write(compressed.Next(chunksize))
+
+	return packet
+}
+
+func (g *Writer) getChunksize() int {
+
+	if g.Config.Connection == "wan" {
+		return g.Config.MaxChunkSizeWan
+	}
+
+	if g.Config.Connection == "lan" {
+		return g.Config.MaxChunkSizeLan
+	}
+
+	return g.Config.MaxChunkSizeWan
+}
+
+func (g *Writer) intToBytes(i int) []byte {
+	buf := new(bytes.Buffer)
+
+	err := binary.Write(buf, binary.LittleEndian, int8(i))
+	if err != nil {
+		log.Printf("Uh oh! %s", err)
+	}
+	return buf.Bytes()
+}
+
+func (g *Writer) compress(b []byte) (bytes.Buffer, error) {
+	var buf bytes.Buffer
+	comp := gzip.NewWriter(&buf)
+
+	if _, err := comp.Write(b); err != nil {
+		return buf, err
+	}
+	if err := comp.Close(); err != nil {
+		return buf, err
+	}
+	return buf, nil
+}
+
+func (g *Writer) parseJson(msg string) map[string]interface{} {
+	var i map[string]interface{}
+	c := []byte(msg)
+
+	json.Unmarshal(c, &i)
+
+	return i
+}
+
+func (g *Writer) testForForbiddenValues(gmap map[string]interface{}) error {
+	if _, err := gmap["_id"]; err {
+		return errors.New("Key _id is forbidden")
+	}
+
+	return nil
+}
+
+func (g *Writer) send(b []byte) {
+	g.Lock()
+	defer g.Unlock()
+	if g.conn == nil {
+		return
+	}
+	g.conn.Write(b)
+}
+
+// sendTCP drops the message while the server can't be reached.
+func (g *Writer) sendTCP(b []byte) {
+	g.Lock()
+	defer g.Unlock()
+
+	if g.closed {
+		return
+	}
+	if g.conn == nil {
+		if time.Now().Before(g.reconnectAt) {
+			return
+		}
+		err := g.connect()
+		if err != nil {
+			log.Printf("gelf: failed to reconnect %s: %v", g.Config.ConnectionString, err)
+			return
+		}
+	}
+
+	_, err := g.conn.Write(b)
+	if err != nil {
+		log.Printf("gelf: failed to write: %v", err)
+		g.conn.Close()
+		g.conn = nil
+		g.connect()
+	}
+}
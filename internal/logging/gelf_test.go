@@ -0,0 +1,161 @@
+package logging
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// acceptGelf reads the null delimited messages of every connection to ln.
+func acceptGelf(ln net.Listener, received chan<- string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+			for {
+				message, err := reader.ReadString(0)
+				if err != nil {
+					return
+				}
+				received <- strings.TrimSuffix(message, "\x00")
+			}
+		}()
+	}
+}
+
+func TestWriterReconnectsOverTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	received := make(chan string, 100)
+	go acceptGelf(ln, received)
+
+	g := NewWriter(Config{ConnectionString: addr, Protocol: "tcp"})
+	defer g.Close()
+	if !g.IsTCP() || g.IsTLS() {
+		t.Fatalf("protocol = %s, want plain tcp", g.Protocol)
+	}
+	g.Send([]byte("first"))
+	select {
+	case message := <-received:
+		if message != "first" {
+			t.Fatalf("message = %q", message)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the first message wasn't received")
+	}
+
+	// the server goes away and comes back on the same address
+	ln.Close()
+	g.Lock()
+	g.conn.Close()
+	g.Unlock()
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("the address can't be reused: %v", err)
+	}
+	defer ln.Close()
+	go acceptGelf(ln, received)
+
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		g.Lock()
+		g.reconnectAt = time.Time{}
+		g.Unlock()
+		g.Send([]byte("again"))
+		select {
+		case message := <-received:
+			if message == "again" {
+				return
+			}
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	t.Fatal("the writer didn't reconnect")
+}
+
+func TestClosedWriterDoesNotReconnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go acceptGelf(ln, make(chan string, 10))
+
+	g := NewWriter(Config{ConnectionString: ln.Addr().String(), Protocol: "tcp"})
+	g.Close()
+	g.Send([]byte("late"))
+	g.Lock()
+	defer g.Unlock()
+	if g.conn != nil {
+		t.Fatal("the closed writer must not reconnect")
+	}
+}
+
+func TestWriterCompressesUDPMessages(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	g := NewWriter(Config{ConnectionString: conn.LocalAddr().String()})
+	defer g.Close()
+	if g.IsTCP() {
+		t.Fatal("udp is the default protocol")
+	}
+	g.Send([]byte(`{"short_message":"hello"}`))
+
+	buf := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(buf[:n]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != `{"short_message":"hello"}` {
+		t.Fatalf("body = %q", body)
+	}
+}
+
+func TestMessageMarshal(t *testing.T) {
+	msg := NewMessage("web-1", "bifrost", "access", 6)
+	msg.ShortMessage = "GET /orders"
+	msg.CustomFields["status"] = 200
+	payload, err := msg.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if fields["version"] != "1.1" || fields["host"] != "web-1" || fields["short_message"] != "GET /orders" ||
+		fields["_app_id"] != "bifrost" || fields["_logger_name"] != "access" || fields["_status"] != float64(200) {
+		t.Fatalf("fields = %v", fields)
+	}
+
+	msg.CustomFields["callback"] = func() {}
+	if _, err := msg.Marshal(); err == nil {
+		t.Fatal("a custom field which can't be marshaled must fail the message")
+	}
+}
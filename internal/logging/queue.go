@@ -0,0 +1,74 @@
+package logging
+
+import (
+	"context"
+	"log"
+)
+
+// Queue keeps the messages until the writer sends them, so logging doesn't
+// wait for the gelf server.
+type Queue struct {
+	messages chan *Message
+}
+
+// NewQueue returns a queue which holds up to size messages.
+func NewQueue(size int) *Queue {
+	return &Queue{
+		messages: make(chan *Message, size),
+	}
+}
+
+// TryPut queues the message, it returns false when the queue is full.
+func (q *Queue) TryPut(message *Message) bool {
+	select {
+	case q.messages <- message:
+		return true
+	default:
+		return false
+	}
+}
+
+// Len returns the number of queued messages.
+func (q *Queue) Len() int {
+	return len(q.messages)
+}
+
+// Flush waits until the messages which were queued before the call are
+// sent.
+func (q *Queue) Flush(ctx context.Context) error {
+	flushed := make(chan struct{})
+	select {
+	case q.messages <- &Message{flushed: flushed}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Run sends the queued messages with the writer until the queue is closed,
+// they are dropped while the server can't be reached.
+func (q *Queue) Run(w *Writer) {
+	for message := range q.messages {
+		if message.flushed != nil {
+			close(message.flushed)
+			continue
+		}
+		payload, err := message.Marshal()
+		if err != nil {
+			log.Printf("gelf: failed to marshal the message: %v", err)
+			continue
+		}
+		w.Send(payload)
+	}
+}
+
+// Close stops Run once the queued messages are sent, nothing can be queued
+// afterwards.
+func (q *Queue) Close() {
+	close(q.messages)
+}
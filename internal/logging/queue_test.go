@@ -0,0 +1,72 @@
+package logging
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueueFlushSendsQueuedMessages(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan string, 10)
+	go acceptGelf(ln, received)
+
+	queue := NewQueue(10)
+	g := NewWriter(Config{ConnectionString: ln.Addr().String(), Protocol: "tcp"})
+	defer g.Close()
+	go queue.Run(g)
+	defer queue.Close()
+
+	for i := 0; i < 3; i++ {
+		msg := NewMessage("test", "bifrost", "application", 6)
+		msg.ShortMessage = "queued"
+		if !queue.TryPut(msg) {
+			t.Fatal("the queue must accept the message")
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := queue.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case message := <-received:
+			if !strings.Contains(message, `"short_message":"queued"`) {
+				t.Fatalf("message = %q", message)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("got %d messages, want 3", i)
+		}
+	}
+}
+
+func TestQueueFlushGivesUpWhenCtxIsDone(t *testing.T) {
+	// nothing sends the queued messages
+	queue := NewQueue(0)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := queue.Flush(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("err = %v, want the deadline of ctx", err)
+	}
+}
+
+func TestQueueDropsMessagesWhenFull(t *testing.T) {
+	queue := NewQueue(1)
+	if !queue.TryPut(NewMessage("test", "bifrost", "application", 6)) {
+		t.Fatal("the first message must be queued")
+	}
+	if queue.TryPut(NewMessage("test", "bifrost", "application", 6)) {
+		t.Fatal("a full queue must not block or accept the message")
+	}
+	if queue.Len() != 1 {
+		t.Fatalf("len = %d, want 1", queue.Len())
+	}
+}
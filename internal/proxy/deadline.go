@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Deadline cancels the upstream request when the timeout passes. It works
+// like context.WithTimeout, except a streamed response can extend it so the
+// timeout becomes an idle timeout between two reads. A timeout of zero never
+// expires.
+type Deadline struct {
+	timeout time.Duration
+	timer   *time.Timer
+	expired int32
+}
+
+func NewDeadline(parent context.Context, timeout time.Duration) (context.Context, *Deadline, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	d := &Deadline{timeout: timeout}
+	if timeout <= 0 {
+		return ctx, d, cancel
+	}
+	d.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&d.expired, 1)
+		cancel()
+	})
+	return ctx, d, func() {
+		d.timer.Stop()
+		cancel()
+	}
+}
+
+func (d *Deadline) Timeout() time.Duration {
+	return d.timeout
+}
+
+// Extend restarts the timeout, it returns false when the timeout already passed.
+func (d *Deadline) Extend() bool {
+	if d.timer == nil {
+		return true
+	}
+	return d.timer.Reset(d.timeout)
+}
+
+func (d *Deadline) IsExpired() bool {
+	return atomic.LoadInt32(&d.expired) == 1
+}
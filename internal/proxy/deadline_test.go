@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeadlineWithoutTimeoutNeverExpires(t *testing.T) {
+	ctx, deadline, cancel := NewDeadline(t.Context(), 0)
+	defer cancel()
+	if !deadline.Extend() {
+		t.Fatal("extend must succeed without a timeout")
+	}
+	select {
+	case <-ctx.Done():
+		t.Fatal("the context must not be canceled")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if deadline.IsExpired() {
+		t.Fatal("the deadline must not expire")
+	}
+}
+
+func TestDeadlineCancelsOnceTheTimeoutPasses(t *testing.T) {
+	ctx, deadline, cancel := NewDeadline(t.Context(), 20*time.Millisecond)
+	defer cancel()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("the context must be canceled by the timeout")
+	}
+	if !deadline.IsExpired() {
+		t.Fatal("the deadline must expire")
+	}
+	if deadline.Extend() {
+		t.Fatal("extend must fail once the timeout passed")
+	}
+}
+
+func TestDeadlineExtendRestartsTheTimeout(t *testing.T) {
+	ctx, deadline, cancel := NewDeadline(t.Context(), 100*time.Millisecond)
+	defer cancel()
+	for i := 0; i < 4; i++ {
+		time.Sleep(40 * time.Millisecond)
+		if !deadline.Extend() {
+			t.Fatal("extend must succeed before the timeout passes")
+		}
+	}
+	if ctx.Err() != nil || deadline.IsExpired() {
+		t.Fatal("the extended deadline must not expire")
+	}
+}
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Logf prints a message of the dns refresher, e.g. the addresses it dropped.
+type Logf func(format string, v ...interface{})
+
+// DNSRefresher resolves the hostnames of the upstream connections again and
+// closes idle connections to addresses which aren't returned anymore. Keep
+// alive would otherwise use the old address after a dns failover forever.
+type DNSRefresher struct {
+	sync.Mutex
+	dialer     *net.Dialer
+	lookupHost func(host string) ([]string, error)
+	transports map[*http.Transport]bool
+	conns      map[*trackedConn]bool
+	infof      Logf
+	errorf     Logf
+}
+
+// trackedConn remembers the hostname the connection was dialed with.
+type trackedConn struct {
+	net.Conn
+	host      string
+	ip        string
+	refresher *DNSRefresher
+}
+
+func (c *trackedConn) Close() error {
+	c.refresher.forget(c)
+	return c.Conn.Close()
+}
+
+// NewDNSRefresher returns a refresher which reports the closed connections
+// to infof and the failed lookups to errorf.
+func NewDNSRefresher(infof Logf, errorf Logf) *DNSRefresher {
+	return &DNSRefresher{
+		dialer: &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		},
+		lookupHost: net.LookupHost,
+		transports: map[*http.Transport]bool{},
+		conns:      map[*trackedConn]bool{},
+		infof:      infof,
+		errorf:     errorf,
+	}
+}
+
+// Watch dials the connections of the transport through the refresher.
+func (r *DNSRefresher) Watch(transport *http.Transport) {
+	transport.DialContext = r.dial
+	r.Lock()
+	defer r.Unlock()
+	r.transports[transport] = true
+}
+
+func (r *DNSRefresher) Unwatch(transport *http.Transport) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.transports, transport)
+}
+
+func (r *DNSRefresher) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := r.dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		// an ip address doesn't change
+		return conn, nil
+	}
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn, nil
+	}
+	tracked := &trackedConn{
+		Conn:      conn,
+		host:      host,
+		ip:        ip,
+		refresher: r,
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.conns[tracked] = true
+	return tracked, nil
+}
+
+func (r *DNSRefresher) forget(conn *trackedConn) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.conns, conn)
+}
+
+// Run refreshes every interval, it never returns.
+func (r *DNSRefresher) Run(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		r.Refresh()
+	}
+}
+
+// Refresh closes the idle connections when a connection uses an address
+// which the hostname doesn't resolve to anymore. Connections in use are
+// closed by a later refresh once they are idle. A failed lookup keeps the
+// connections, the health check decides whether the target is down.
+func (r *DNSRefresher) Refresh() {
+	r.Lock()
+	hosts := map[string]bool{}
+	for conn := range r.conns {
+		hosts[conn.host] = true
+	}
+	r.Unlock()
+
+	resolved := map[string]map[string]bool{}
+	for host := range hosts {
+		addrs, err := r.lookupHost(host)
+		if err != nil {
+			r.errorf("dns refresh of %s failed: %v", host, err)
+			continue
+		}
+		ips := map[string]bool{}
+		for _, addr := range addrs {
+			ips[addr] = true
+		}
+		resolved[host] = ips
+	}
+
+	r.Lock()
+	stale := []string{}
+	for conn := range r.conns {
+		ips, ok := resolved[conn.host]
+		if ok && !ips[conn.ip] {
+			stale = append(stale, conn.host+"="+conn.ip)
+		}
+	}
+	transports := []*http.Transport{}
+	if len(stale) > 0 {
+		for transport := range r.transports {
+			transports = append(transports, transport)
+		}
+	}
+	r.Unlock()
+
+	if len(stale) == 0 {
+		return
+	}
+	r.infof("dns refresh: closing idle connections, stale addresses: %v", stale)
+	for _, transport := range transports {
+		transport.CloseIdleConnections()
+	}
+}
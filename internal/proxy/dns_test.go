@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func testLogf(format string, v ...interface{}) {}
+
+// countingServer counts the connections the upstream accepted.
+func countingServer(t *testing.T) (*httptest.Server, *int32) {
+	var conns int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	server.Start()
+	t.Cleanup(server.Close)
+	return server, &conns
+}
+
+func get(t *testing.T, client *http.Client, url string) {
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+}
+
+func TestDNSRefreshClosesConnectionsToStaleAddresses(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		resolved []string
+		conns    int32
+	}{
+		{"unchanged", []string{"127.0.0.1"}, 1},
+		{"failover", []string{"127.0.0.2"}, 2},
+	} {
+		server, conns := countingServer(t)
+		refresher := NewDNSRefresher(testLogf, testLogf)
+		refresher.lookupHost = func(host string) ([]string, error) {
+			return test.resolved, nil
+		}
+		transport := &http.Transport{}
+		refresher.Watch(transport)
+		client := &http.Client{Transport: transport}
+		// the hostname is tracked, an ip address never changes
+		url := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+
+		get(t, client, url)
+		refresher.Refresh()
+		get(t, client, url)
+		if n := atomic.LoadInt32(conns); n != test.conns {
+			t.Errorf("%s: connections = %d, want %d", test.name, n, test.conns)
+		}
+		transport.CloseIdleConnections()
+	}
+}
+
+func TestDNSRefreshKeepsConnectionsWhenTheLookupFails(t *testing.T) {
+	server, conns := countingServer(t)
+	var failures int32
+	refresher := NewDNSRefresher(testLogf, func(format string, v ...interface{}) {
+		atomic.AddInt32(&failures, 1)
+	})
+	refresher.lookupHost = func(host string) ([]string, error) {
+		return nil, &net.DNSError{Err: "no such host", Name: host}
+	}
+	transport := &http.Transport{}
+	refresher.Watch(transport)
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+	url := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+
+	get(t, client, url)
+	refresher.Refresh()
+	get(t, client, url)
+	if n := atomic.LoadInt32(conns); n != 1 {
+		t.Fatalf("connections = %d, the connection must be kept", n)
+	}
+	if atomic.LoadInt32(&failures) != 1 {
+		t.Fatal("the failed lookup must be reported")
+	}
+}
+
+func TestDNSRefreshForgetsClosedConnections(t *testing.T) {
+	server, _ := countingServer(t)
+	refresher := NewDNSRefresher(testLogf, testLogf)
+	transport := &http.Transport{}
+	refresher.Watch(transport)
+	client := &http.Client{Transport: transport}
+
+	get(t, client, strings.Replace(server.URL, "127.0.0.1", "localhost", 1))
+	transport.CloseIdleConnections()
+	refresher.Lock()
+	n := len(refresher.conns)
+	refresher.Unlock()
+	if n != 0 {
+		t.Fatalf("tracked connections = %d, want 0", n)
+	}
+}
@@ -0,0 +1,128 @@
+// Package proxy holds the connections of the gateway to the upstreams: the
+// transports per tls setting, the dns refresher which moves them to new
+// addresses and the deadline of an upstream request.
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// TLS configures the tls connections to the targets of an api, the setting
+// of the config file applies to apis without their own.
+// CertFile and KeyFile are the client certificate for mutual tls, CAFile
+// verifies the certificate of the upstream instead of the system roots.
+type TLS struct {
+	CertFile           string `json:"cert_file" bson:"cert_file" yaml:"cert_file"`
+	KeyFile            string `json:"key_file" bson:"key_file" yaml:"key_file"`
+	CAFile             string `json:"ca_file" bson:"ca_file" yaml:"ca_file"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify" bson:"insecure_skip_verify" yaml:"insecure_skip_verify"`
+}
+
+func (t *TLS) IsValid() error {
+	if (len(t.CertFile) == 0) != (len(t.KeyFile) == 0) {
+		return errors.New("upstream_tls needs both cert_file and key_file")
+	}
+	_, err := t.Config()
+	return err
+}
+
+// Config reads the files every time, the result is cached by Transports.
+func (t *TLS) Config() (*tls.Config, error) {
+	result := &tls.Config{
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if len(t.CertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		result.Certificates = []tls.Certificate{cert}
+	}
+	if len(t.CAFile) > 0 {
+		pem, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("upstream_tls ca_file doesn't contain any certificate")
+		}
+		result.RootCAs = pool
+	}
+	return result, nil
+}
+
+// ProxyFunc picks the proxy of an upstream request, see http.Transport.Proxy.
+type ProxyFunc func(req *http.Request) (*url.URL, error)
+
+// Transports keeps one transport per tls setting so connections are reused.
+// Reset drops them and the certificates are read again on next use.
+type Transports struct {
+	sync.Mutex
+	transports   map[TLS]*http.Transport
+	dnsRefresher *DNSRefresher
+	proxyFunc    ProxyFunc
+}
+
+// NewTransports returns transports which dial through the refresher and
+// send the requests through the proxy of proxyFunc.
+func NewTransports(refresher *DNSRefresher, proxyFunc ProxyFunc) *Transports {
+	return &Transports{
+		transports:   map[TLS]*http.Transport{},
+		dnsRefresher: refresher,
+		proxyFunc:    proxyFunc,
+	}
+}
+
+func (ts *Transports) Get(setting *TLS) (*http.Transport, error) {
+	ts.Lock()
+	defer ts.Unlock()
+	transport, ok := ts.transports[*setting]
+	if ok {
+		return transport, nil
+	}
+	config, err := setting.Config()
+	if err != nil {
+		return nil, err
+	}
+	transport = &http.Transport{
+		Proxy:               ts.proxyFunc,
+		MaxIdleConnsPerHost: 20,
+		TLSClientConfig:     config,
+		ForceAttemptHTTP2:   true,
+	}
+	ts.dnsRefresher.Watch(transport)
+	ts.transports[*setting] = transport
+	return transport, nil
+}
+
+// TLSConfig returns a copy of the tls config of the setting's transport,
+// the caller sets the server name.
+func (ts *Transports) TLSConfig(setting *TLS) (*tls.Config, error) {
+	transport, err := ts.Get(setting)
+	if err != nil {
+		return nil, err
+	}
+	config := transport.TLSClientConfig
+	return &tls.Config{
+		Certificates:       config.Certificates,
+		RootCAs:            config.RootCAs,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}, nil
+}
+
+func (ts *Transports) Reset() {
+	ts.Lock()
+	defer ts.Unlock()
+	for _, transport := range ts.transports {
+		transport.CloseIdleConnections()
+		ts.dnsRefresher.Unwatch(transport)
+	}
+	ts.transports = map[TLS]*http.Transport{}
+}
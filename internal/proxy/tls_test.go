@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+)
+
+func TestTLSIsValid(t *testing.T) {
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	if err := ioutil.WriteFile(empty, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name    string
+		setting TLS
+		valid   bool
+	}{
+		{"insecure_skip_verify", TLS{InsecureSkipVerify: true}, true},
+		{"cert_file without key_file", TLS{CertFile: "client.pem"}, false},
+		{"missing ca_file", TLS{CAFile: filepath.Join(t.TempDir(), "missing.pem")}, false},
+		{"ca_file without certificate", TLS{CAFile: empty}, false},
+	} {
+		if err := test.setting.IsValid(); (err == nil) != test.valid {
+			t.Errorf("%s: err = %v, valid = %v", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestTransportsAreSharedPerSetting(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var proxied int
+	transports := NewTransports(NewDNSRefresher(testLogf, testLogf), func(req *http.Request) (*url.URL, error) {
+		proxied++
+		return nil, nil
+	})
+	setting := &TLS{CAFile: caFile}
+	transport, err := transports.Get(setting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := transports.Get(&TLS{CAFile: caFile}); again != transport {
+		t.Fatal("an equal setting must get the same transport")
+	}
+	if other, _ := transports.Get(&TLS{InsecureSkipVerify: true}); other == transport {
+		t.Fatal("another setting must get its own transport")
+	}
+
+	resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if proxied != 1 {
+		t.Fatalf("the proxy func was asked %d times, want 1", proxied)
+	}
+
+	config, err := transports.TLSConfig(setting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config == transport.TLSClientConfig || config.RootCAs != transport.TLSClientConfig.RootCAs {
+		t.Fatal("the tls config must be a copy with the roots of the setting")
+	}
+
+	transports.Reset()
+	if again, _ := transports.Get(setting); again == transport {
+		t.Fatal("reset must drop the transports")
+	}
+}
@@ -0,0 +1,136 @@
+package store
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type cachedConsumer struct {
+	consumer *Consumer
+	timer    *time.Timer
+}
+
+// ConsumerCache keeps the consumers found by id for ttl, so the identity of
+// every request doesn't hit the database. Updates and deletes through the
+// cache drop the entry at once; other gateways sharing the database see the
+// change when their entry expires.
+type ConsumerCache struct {
+	repo    ConsumerRepository
+	ttl     time.Duration
+	entries sync.Map // consumer id -> *cachedConsumer
+	// generation changes with every invalidation, a consumer which was read
+	// before it changed may be stale and isn't cached
+	mutex      sync.Mutex
+	generation uint64
+	// hits and misses of Get, updated atomically
+	hits   uint64
+	misses uint64
+}
+
+func NewConsumerCache(repo ConsumerRepository, ttl time.Duration) *ConsumerCache {
+	return &ConsumerCache{
+		repo: repo,
+		ttl:  ttl,
+	}
+}
+
+func (cc *ConsumerCache) Get(id string) (*Consumer, error) {
+	if value, ok := cc.entries.Load(id); ok {
+		atomic.AddUint64(&cc.hits, 1)
+		return copyConsumer(value.(*cachedConsumer).consumer), nil
+	}
+	atomic.AddUint64(&cc.misses, 1)
+	cc.mutex.Lock()
+	generation := cc.generation
+	cc.mutex.Unlock()
+
+	consumer, err := cc.repo.Get(id)
+	if err != nil || consumer == nil {
+		return consumer, err
+	}
+
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	if cc.generation != generation {
+		return consumer, nil
+	}
+	entry := &cachedConsumer{consumer: copyConsumer(consumer)}
+	entry.timer = time.AfterFunc(cc.ttl, func() {
+		cc.entries.CompareAndDelete(id, entry)
+	})
+	if previous, loaded := cc.entries.Swap(id, entry); loaded {
+		previous.(*cachedConsumer).timer.Stop()
+	}
+	return consumer, nil
+}
+
+func (cc *ConsumerCache) GetByUsername(app string, username string) (*Consumer, error) {
+	return cc.repo.GetByUsername(app, username)
+}
+
+func (cc *ConsumerCache) Insert(consumer *Consumer) error {
+	cc.invalidate(consumer.ID)
+	return cc.repo.Insert(consumer)
+}
+
+func (cc *ConsumerCache) Update(consumer *Consumer) error {
+	err := cc.repo.Update(consumer)
+	cc.invalidate(consumer.ID)
+	return err
+}
+
+func (cc *ConsumerCache) Delete(consumer *Consumer) error {
+	err := cc.repo.Delete(consumer)
+	cc.invalidate(consumer.ID)
+	return err
+}
+
+func (cc *ConsumerCache) Count(app string) (int, error) {
+	return cc.repo.Count(app)
+}
+
+func (cc *ConsumerCache) invalidate(id string) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	cc.generation++
+	if value, loaded := cc.entries.LoadAndDelete(id); loaded {
+		value.(*cachedConsumer).timer.Stop()
+	}
+}
+
+// Len returns how many consumers are cached.
+func (cc *ConsumerCache) Len() int {
+	count := 0
+	cc.entries.Range(func(key, value interface{}) bool {
+		count++
+		return true
+	})
+	return count
+}
+
+// HitRatio is the share of the lookups which were answered by the cache,
+// it's zero before the first lookup.
+func (cc *ConsumerCache) HitRatio() float64 {
+	hits := atomic.LoadUint64(&cc.hits)
+	total := hits + atomic.LoadUint64(&cc.misses)
+	if total == 0 {
+		return 0
+	}
+	return float64(hits) / float64(total)
+}
+
+// Close closes the wrapped repository when it holds connections.
+func (cc *ConsumerCache) Close() error {
+	if closer, ok := cc.repo.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// copyConsumer keeps callers from changing the cached consumer without Update.
+func copyConsumer(consumer *Consumer) *Consumer {
+	result := *consumer
+	return &result
+}
@@ -0,0 +1,107 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+// pausedConsumerRepo holds the next Get until it's released, so an update
+// can happen while a cache miss reads the old consumer.
+type pausedConsumerRepo struct {
+	ConsumerRepository
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (r *pausedConsumerRepo) Get(id string) (*Consumer, error) {
+	consumer, err := r.ConsumerRepository.Get(id)
+	if r.reading != nil {
+		close(r.reading)
+		r.reading = nil
+		<-r.release
+	}
+	return consumer, err
+}
+
+func TestConsumerCacheDoesNotKeepStaleMiss(t *testing.T) {
+	store := NewConsumerMemStore()
+	consumer := &Consumer{App: "shop", Username: "old"}
+	store.Insert(consumer)
+	repo := &pausedConsumerRepo{ConsumerRepository: store, reading: make(chan struct{}), release: make(chan struct{})}
+	cache := NewConsumerCache(repo, time.Minute)
+
+	reading := repo.reading
+	done := make(chan struct{})
+	go func() {
+		cache.Get(consumer.ID)
+		close(done)
+	}()
+	<-reading
+	updated := *consumer
+	updated.Username = "new"
+	if err := cache.Update(&updated); err != nil {
+		t.Fatal(err)
+	}
+	close(repo.release)
+	<-done
+
+	got, err := cache.Get(consumer.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Username != "new" {
+		t.Fatalf("username = %s, the miss which read the old consumer must not be cached", got.Username)
+	}
+}
+
+func TestConsumerCacheServesHits(t *testing.T) {
+	store := NewConsumerMemStore()
+	consumer := &Consumer{App: "shop", Username: "mary"}
+	store.Insert(consumer)
+	cache := NewConsumerCache(store, time.Minute)
+
+	if _, err := cache.Get(consumer.ID); err != nil {
+		t.Fatal(err)
+	}
+	// a change which bypasses the cache is seen after the ttl only
+	changed := *consumer
+	changed.Username = "jane"
+	store.Update(&changed)
+	got, _ := cache.Get(consumer.ID)
+	if got.Username != "mary" {
+		t.Fatalf("username = %s, want the cached mary", got.Username)
+	}
+	got.Username = "changed by the caller"
+	if again, _ := cache.Get(consumer.ID); again.Username != "mary" {
+		t.Fatalf("username = %s, callers must get a copy", again.Username)
+	}
+}
+
+func TestConsumerCacheReportsSizeAndHitRatio(t *testing.T) {
+	store := NewConsumerMemStore()
+	consumer := &Consumer{App: "shop", Username: "mary"}
+	store.Insert(consumer)
+	cache := NewConsumerCache(store, time.Minute)
+
+	cache.Get(consumer.ID)
+	cache.Get(consumer.ID)
+	cache.Get("missing")
+	if entries := cache.Len(); entries != 1 {
+		t.Fatalf("entries = %d, want 1", entries)
+	}
+	if ratio := cache.HitRatio(); ratio != 1.0/3 {
+		t.Fatalf("hit ratio = %v, want 1/3", ratio)
+	}
+}
+
+func BenchmarkConsumerCacheGet(b *testing.B) {
+	store := NewConsumerMemStore()
+	consumer := &Consumer{App: "shop", Username: "mary"}
+	store.Insert(consumer)
+	cache := NewConsumerCache(store, time.Minute)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			cache.Get(consumer.ID)
+		}
+	})
+}
@@ -1,4 +1,4 @@
-package main
+package store
 
 import (
 	"encoding/json"
@@ -12,10 +12,6 @@ import (
 	redis "gopkg.in/redis.v4"
 )
 
-type consumerCollection struct {
-	Consumers []*Consumer `json:"consumers"`
-}
-
 type Consumer struct {
 	ID           string            `json:"id" bson:"_id"`
 	App          string            `json:"app" bson:"app"`
@@ -23,11 +19,21 @@ type Consumer struct {
 	Username     string            `json:"username" bson:"username"`
 	CustomID     string            `json:"custom_id" bson:"custom_id"`
 	CustomFields map[string]string `json:"custom_fields" bson:"custom_fields"`
+	HMACSecret   string            `json:"hmac_secret,omitempty" bson:"hmac_secret,omitempty"` // verifies signed requests
+	Revision     int64             `json:"revision" bson:"revision"`
 	UpdatedAt    time.Time         `json:"updated_at" bson:"updated_at"`
 	CreatedAt    time.Time         `json:"created_at" bson:"created_at"`
+
+	// ClientSecret is only read from requests, the hash of it is stored and
+	// checked by the oauth token endpoint. The hash is never written to the
+	// admin api.
+	ClientSecret     string `json:"client_secret,omitempty" bson:"-"`
+	ClientSecretHash string `json:"-" bson:"client_secret_hash,omitempty"`
 }
 
-func (c *Consumer) isAuthenticated() bool {
+// IsAuthenticated reports whether the consumer was found, the anonymous
+// consumer has no id.
+func (c *Consumer) IsAuthenticated() bool {
 	if len(c.ID) > 0 {
 		return true
 	}
@@ -48,7 +54,7 @@ type ConsumerMemStore struct {
 	data map[string]*Consumer
 }
 
-func newConsumerMemStore() *ConsumerMemStore {
+func NewConsumerMemStore() *ConsumerMemStore {
 	return &ConsumerMemStore{
 		data: map[string]*Consumer{},
 	}
@@ -78,6 +84,7 @@ func (cs *ConsumerMemStore) Insert(consumer *Consumer) error {
 		return AppError{ErrorCode: "invalid_input", Message: "app field was invalid."}
 	}
 	consumer.ID = uuid.NewV4().String()
+	consumer.Revision = 1
 	now := time.Now().UTC()
 	consumer.CreatedAt = now
 	consumer.UpdatedAt = now
@@ -95,6 +102,11 @@ func (cs *ConsumerMemStore) Update(consumer *Consumer) error {
 	consumer.UpdatedAt = now
 	cs.Lock()
 	defer cs.Unlock()
+	current := cs.data[consumer.ID]
+	if current != nil && current.Revision != consumer.Revision {
+		return ErrRevisionConflict
+	}
+	consumer.Revision++
 	cs.data[consumer.ID] = consumer
 	return nil
 }
@@ -116,16 +128,18 @@ func (cs *ConsumerMemStore) Count(app string) (int, error) {
 	Mongo Database
 *********************/
 
-type consumerMongo struct {
-	connectionString string
+type ConsumerMongo struct {
+	// every operation copies the session, so the sockets are pooled
+	session *mgo.Session
+	debugf  Logf
 }
 
-func newConsumerMongo(connectionString string) (*consumerMongo, error) {
-	session, err := mgo.Dial(connectionString)
+// NewConsumerMongo dials once, see DialMongo for the pool and the timeouts.
+func NewConsumerMongo(connectionString string, poolSize int, dialTimeout time.Duration, socketTimeout time.Duration, debugf Logf) (*ConsumerMongo, error) {
+	session, err := DialMongo(connectionString, poolSize, dialTimeout, socketTimeout)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	defer session.Close()
 	c := session.DB("bifrost").C("consumers")
 
 	// create index
@@ -138,19 +152,27 @@ func newConsumerMongo(connectionString string) (*consumerMongo, error) {
 	}
 	err = c.EnsureIndex(appUsernameIdx)
 	if err != nil {
+		session.Close()
 		return nil, err
 	}
 
-	return &consumerMongo{
-		connectionString: connectionString,
+	return &ConsumerMongo{
+		session: session,
+		debugf:  debugf,
 	}, nil
 }
 
-func (cm *consumerMongo) newSession() (*mgo.Session, error) {
-	return mgo.Dial(cm.connectionString)
+func (cm *ConsumerMongo) newSession() (*mgo.Session, error) {
+	return cm.session.Copy(), nil
 }
 
-func (cm *consumerMongo) Get(id string) (*Consumer, error) {
+// Close closes the pooled sockets.
+func (cm *ConsumerMongo) Close() error {
+	cm.session.Close()
+	return nil
+}
+
+func (cm *ConsumerMongo) Get(id string) (*Consumer, error) {
 	session, err := cm.newSession()
 	if err != nil {
 		return nil, err
@@ -164,12 +186,12 @@ func (cm *consumerMongo) Get(id string) (*Consumer, error) {
 		if err.Error() == "not found" {
 			return nil, nil
 		}
-		return nil, err
+		return nil, RefreshMongo(cm.session, err, cm.debugf)
 	}
 	return &consumer, nil
 }
 
-func (cm *consumerMongo) GetByUsername(app string, username string) (*Consumer, error) {
+func (cm *ConsumerMongo) GetByUsername(app string, username string) (*Consumer, error) {
 	session, err := cm.newSession()
 	if err != nil {
 		return nil, err
@@ -183,16 +205,17 @@ func (cm *consumerMongo) GetByUsername(app string, username string) (*Consumer,
 		if err.Error() == "not found" {
 			return nil, nil
 		}
-		return nil, err
+		return nil, RefreshMongo(cm.session, err, cm.debugf)
 	}
 	return &consumer, nil
 }
 
-func (cm *consumerMongo) Insert(consumer *Consumer) error {
+func (cm *ConsumerMongo) Insert(consumer *Consumer) error {
 	if len(consumer.App) == 0 {
 		return AppError{ErrorCode: "invalid_input", Message: "app field was invalid."}
 	}
 	consumer.ID = uuid.NewV4().String()
+	consumer.Revision = 1
 	now := time.Now().UTC()
 	consumer.CreatedAt = now
 	consumer.UpdatedAt = now
@@ -209,12 +232,12 @@ func (cm *consumerMongo) Insert(consumer *Consumer) error {
 		if strings.HasPrefix(err.Error(), "E11000") {
 			return AppError{ErrorCode: "invalid_input", Message: "The consumer already exists"}
 		}
-		return err
+		return RefreshMongo(cm.session, err, cm.debugf)
 	}
 	return nil
 }
 
-func (cm *consumerMongo) Update(consumer *Consumer) error {
+func (cm *ConsumerMongo) Update(consumer *Consumer) error {
 	if len(consumer.ID) == 0 {
 		return AppError{ErrorCode: "invalid_input", Message: "consumer id was invalid."}
 	}
@@ -228,15 +251,21 @@ func (cm *consumerMongo) Update(consumer *Consumer) error {
 	defer session.Close()
 
 	c := session.DB("bifrost").C("consumers")
-	colQuerier := bson.M{"_id": consumer.ID}
+	expected := consumer.Revision
+	colQuerier := bson.M{"_id": consumer.ID, "revision": RevisionQuery(expected)}
+	consumer.Revision = expected + 1
 	err = c.Update(colQuerier, consumer)
 	if err != nil {
-		return err
+		consumer.Revision = expected
+		if err == mgo.ErrNotFound {
+			return ErrRevisionConflict
+		}
+		return RefreshMongo(cm.session, err, cm.debugf)
 	}
 	return nil
 }
 
-func (cm *consumerMongo) Delete(consumer *Consumer) error {
+func (cm *ConsumerMongo) Delete(consumer *Consumer) error {
 	session, err := cm.newSession()
 	if err != nil {
 		return err
@@ -247,12 +276,12 @@ func (cm *consumerMongo) Delete(consumer *Consumer) error {
 	colQuerier := bson.M{"_id": consumer.ID}
 	err = c.Remove(colQuerier)
 	if err != nil {
-		return err
+		return RefreshMongo(cm.session, err, cm.debugf)
 	}
 	return nil
 }
 
-func (cm *consumerMongo) Count(app string) (int, error) {
+func (cm *ConsumerMongo) Count(app string) (int, error) {
 	session, err := cm.newSession()
 	if err != nil {
 		return 0, err
@@ -262,7 +291,7 @@ func (cm *consumerMongo) Count(app string) (int, error) {
 	c := session.DB("bifrost").C("consumers")
 	count, err := c.Find(bson.M{"app": app}).Count()
 	if err != nil {
-		return 0, err
+		return 0, RefreshMongo(cm.session, err, cm.debugf)
 	}
 	return count, nil
 }
@@ -271,25 +300,39 @@ func (cm *consumerMongo) Count(app string) (int, error) {
 	Redis Database
 *********************/
 
-type consumerRedis struct {
+type ConsumerRedis struct {
 	client *redis.Client
 }
 
-func newConsumerRedis(addr string, password string, db int) (*consumerRedis, error) {
-	client := redis.NewClient(&redis.Options{
-		Addr:     addr,
-		Password: password,
-		DB:       db,
-	})
+// consumerRecord is how a consumer is kept in redis, with the hash of the
+// client secret which the json of a consumer leaves out.
+type consumerRecord struct {
+	*Consumer
+	ClientSecretHash string `json:"client_secret_hash,omitempty"`
+}
+
+func marshalConsumer(consumer *Consumer) ([]byte, error) {
+	return json.Marshal(consumerRecord{Consumer: consumer, ClientSecretHash: consumer.ClientSecretHash})
+}
 
-	consumerRedis := &consumerRedis{
+func unmarshalConsumer(b []byte, consumer *Consumer) error {
+	record := consumerRecord{Consumer: consumer}
+	if err := json.Unmarshal(b, &record); err != nil {
+		return err
+	}
+	consumer.ClientSecretHash = record.ClientSecretHash
+	return nil
+}
+
+func NewConsumerRedis(client *redis.Client) (*ConsumerRedis, error) {
+	consumerRedis := &ConsumerRedis{
 		client: client,
 	}
 
 	return consumerRedis, nil
 }
 
-func (source *consumerRedis) Get(id string) (*Consumer, error) {
+func (source *ConsumerRedis) Get(id string) (*Consumer, error) {
 	key := "consumer:id:" + id
 	s, err := source.client.Get(key).Result()
 	if err != nil {
@@ -300,13 +343,13 @@ func (source *consumerRedis) Get(id string) (*Consumer, error) {
 	}
 
 	var consumer Consumer
-	err = json.Unmarshal([]byte(s), &consumer)
+	err = unmarshalConsumer([]byte(s), &consumer)
 	panicIf(err)
 
 	return &consumer, nil
 }
 
-func (source *consumerRedis) GetByUsername(app string, username string) (*Consumer, error) {
+func (source *ConsumerRedis) GetByUsername(app string, username string) (*Consumer, error) {
 	key := "consumer:" + app + ":username:" + username
 	consumerID, err := source.client.Get(key).Result()
 	if err != nil {
@@ -323,17 +366,18 @@ func (source *consumerRedis) GetByUsername(app string, username string) (*Consum
 	return consumer, nil
 }
 
-func (source *consumerRedis) Insert(consumer *Consumer) error {
+func (source *ConsumerRedis) Insert(consumer *Consumer) error {
 	if len(consumer.App) == 0 {
 		return AppError{ErrorCode: "invalid_input", Message: "app field was invalid."}
 	}
 	consumer.ID = uuid.NewV4().String()
+	consumer.Revision = 1
 	now := time.Now().UTC()
 	consumer.CreatedAt = now
 	consumer.UpdatedAt = now
 
 	// insert to consumer:id
-	val, err := json.Marshal(consumer)
+	val, err := marshalConsumer(consumer)
 	panicIf(err)
 	key := "consumer:id:" + consumer.ID
 	err = source.client.Set(key, val, 0).Err()
@@ -347,23 +391,54 @@ func (source *consumerRedis) Insert(consumer *Consumer) error {
 	return nil
 }
 
-func (source *consumerRedis) Update(consumer *Consumer) error {
+func (source *ConsumerRedis) Update(consumer *Consumer) error {
 	if len(consumer.ID) == 0 {
 		return AppError{ErrorCode: "invalid_input", Message: "consumer id was invalid."}
 	}
 	now := time.Now().UTC()
 	consumer.UpdatedAt = now
 
-	val, err := json.Marshal(consumer)
-	panicIf(err)
-
+	// check and set the revision in a transaction
 	key := "consumer:id:" + consumer.ID
-	err = source.client.Set(key, val, 0).Err()
-	panicIf(err)
+	expected := consumer.Revision
+	err := source.client.Watch(func(tx *redis.Tx) error {
+		s, err := tx.Get(key).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		var current Consumer
+		if err == nil {
+			err = unmarshalConsumer([]byte(s), &current)
+			if err != nil {
+				return err
+			}
+		}
+		if current.Revision != expected {
+			return ErrRevisionConflict
+		}
+
+		consumer.Revision = expected + 1
+		val, err := marshalConsumer(consumer)
+		if err != nil {
+			return err
+		}
+		_, err = tx.MultiExec(func() error {
+			tx.Set(key, val, 0)
+			return nil
+		})
+		return err
+	}, key)
+	if err != nil {
+		consumer.Revision = expected
+		if err == redis.TxFailedErr {
+			return ErrRevisionConflict
+		}
+		return err
+	}
 	return nil
 }
 
-func (source *consumerRedis) Delete(consumer *Consumer) error {
+func (source *ConsumerRedis) Delete(consumer *Consumer) error {
 	// delete consumer:id
 	key := "consumer:id:" + consumer.ID
 	err := source.client.Del(key).Err()
@@ -376,7 +451,7 @@ func (source *consumerRedis) Delete(consumer *Consumer) error {
 	return nil
 }
 
-func (source *consumerRedis) Count(app string) (int, error) {
+func (source *ConsumerRedis) Count(app string) (int, error) {
 	// TODO: need to implement
 	return 0, nil
 }
@@ -0,0 +1,36 @@
+package store
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConsumerRedisKeepsTheClientSecretHash(t *testing.T) {
+	addr := os.Getenv("BIFROST_TEST_REDIS")
+	if len(addr) == 0 {
+		t.Skip("BIFROST_TEST_REDIS isn't set")
+	}
+	repo, _ := NewConsumerRedis(NewRedisClient(DataSetting{Address: addr, DB: "0"}))
+	// the repository keeps the hash as it is
+	hashed := "$2a$10$abcdefghijklmnopqrstuu"
+	consumer := &Consumer{App: "shop", Username: "redis-" + strings.Replace(time.Now().Format(time.RFC3339Nano), ":", "", -1), ClientSecretHash: hashed}
+	if err := repo.Insert(consumer); err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Delete(consumer)
+
+	if err := repo.Update(consumer); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := repo.Get(consumer.ID)
+	if err != nil || stored == nil || stored.ClientSecretHash != hashed {
+		t.Fatalf("stored = %+v, err = %v, the hash must survive a round trip", stored, err)
+	}
+	b, _ := json.Marshal(stored)
+	if strings.Contains(string(b), "client_secret_hash") {
+		t.Fatalf("json = %s", b)
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package store
 
 import (
 	"encoding/json"
@@ -10,21 +10,21 @@ import (
 	redis "gopkg.in/redis.v4"
 )
 
-type configCORS struct {
+type GlobalCORS struct {
 	Name           string    `json:"-" bson:"name"`
 	AllowedOrigins []string  `json:"allowed_origins"  bson:"allowed_origins"`
 	UpdatedAt      time.Time `json:"updated_at" bson:"updated_at"`
 	CreatedAt      time.Time `json:"created_at" bson:"created_at"`
 }
 
-func newConfigCORS() *configCORS {
-	return &configCORS{
+func NewGlobalCORS() *GlobalCORS {
+	return &GlobalCORS{
 		AllowedOrigins: []string{},
 	}
 }
 
-func (cc *configCORS) verifyOrigin(origin string) bool {
-	_logger.debugf("origin: %v", origin)
+// VerifyOrigin reports whether the origin is allowed, * allows every origin.
+func (cc *GlobalCORS) VerifyOrigin(origin string) bool {
 	if contains(cc.AllowedOrigins, "*") || contains(cc.AllowedOrigins, origin) {
 		return true
 	}
@@ -32,9 +32,9 @@ func (cc *configCORS) verifyOrigin(origin string) bool {
 }
 
 type CORSRepository interface {
-	Get() (*configCORS, error)
-	Insert(*configCORS) error
-	Update(*configCORS) error
+	Get() (*GlobalCORS, error)
+	Insert(*GlobalCORS) error
+	Update(*GlobalCORS) error
 	Delete() error
 }
 
@@ -46,7 +46,7 @@ type CORSMongo struct {
 	connectionString string
 }
 
-func newCORSMongo(connectionString string) (*CORSMongo, error) {
+func NewCORSMongo(connectionString string) (*CORSMongo, error) {
 	session, err := mgo.Dial(connectionString)
 	if err != nil {
 		panic(err)
@@ -75,7 +75,7 @@ func (cm *CORSMongo) newSession() (*mgo.Session, error) {
 	return mgo.Dial(cm.connectionString)
 }
 
-func (cm *CORSMongo) Get() (*configCORS, error) {
+func (cm *CORSMongo) Get() (*GlobalCORS, error) {
 	session, err := cm.newSession()
 	if err != nil {
 		return nil, err
@@ -83,7 +83,7 @@ func (cm *CORSMongo) Get() (*configCORS, error) {
 	defer session.Close()
 
 	c := session.DB("bifrost").C("configs")
-	var result configCORS
+	var result GlobalCORS
 	err = c.Find(bson.M{"name": "cors"}).One(&result)
 	if err != nil {
 		if err.Error() == "not found" {
@@ -94,7 +94,7 @@ func (cm *CORSMongo) Get() (*configCORS, error) {
 	return &result, nil
 }
 
-func (cm *CORSMongo) Insert(source *configCORS) error {
+func (cm *CORSMongo) Insert(source *GlobalCORS) error {
 	now := time.Now().UTC()
 	source.Name = "cors"
 	source.CreatedAt = now
@@ -117,7 +117,7 @@ func (cm *CORSMongo) Insert(source *configCORS) error {
 	return nil
 }
 
-func (cm *CORSMongo) Update(source *configCORS) error {
+func (cm *CORSMongo) Update(source *GlobalCORS) error {
 	now := time.Now().UTC()
 	source.UpdatedAt = now
 
@@ -140,33 +140,23 @@ func (cm *CORSMongo) Delete() error {
 	return nil
 }
 
-func verifyOrigin(origin string) bool {
-	return _cors.verifyOrigin(origin)
-}
-
 /*********************
 	Redis Database
 *********************/
 
-type corsRedis struct {
+type CORSRedis struct {
 	client *redis.Client
 }
 
-func newCorsRedis(addr string, password string, db int) (*corsRedis, error) {
-	client := redis.NewClient(&redis.Options{
-		Addr:     addr,
-		Password: password,
-		DB:       db,
-	})
-
-	corsRedis := &corsRedis{
+func NewCORSRedis(client *redis.Client) (*CORSRedis, error) {
+	corsRedis := &CORSRedis{
 		client: client,
 	}
 
 	return corsRedis, nil
 }
 
-func (cr *corsRedis) Insert(source *configCORS) error {
+func (cr *CORSRedis) Insert(source *GlobalCORS) error {
 	nowUTC := time.Now().UTC()
 	source.Name = "cors"
 	source.CreatedAt = nowUTC
@@ -186,7 +176,7 @@ func (cr *corsRedis) Insert(source *configCORS) error {
 	return nil
 }
 
-func (cr *corsRedis) Get() (*configCORS, error) {
+func (cr *CORSRedis) Get() (*GlobalCORS, error) {
 	key := "config:cors"
 	s, err := cr.client.Get(key).Result()
 	if err != nil {
@@ -196,7 +186,7 @@ func (cr *corsRedis) Get() (*configCORS, error) {
 		return nil, err
 	}
 
-	var result configCORS
+	var result GlobalCORS
 	err = json.Unmarshal([]byte(s), &result)
 	if err != nil {
 		return nil, err
@@ -205,7 +195,7 @@ func (cr *corsRedis) Get() (*configCORS, error) {
 	return &result, nil
 }
 
-func (cr *corsRedis) Update(source *configCORS) error {
+func (cr *CORSRedis) Update(source *GlobalCORS) error {
 	nowUtc := time.Now().UTC()
 	source.UpdatedAt = nowUtc
 
@@ -222,6 +212,6 @@ func (cr *corsRedis) Update(source *configCORS) error {
 	return nil
 }
 
-func (cr *corsRedis) Delete() error {
+func (cr *CORSRedis) Delete() error {
 	return nil
 }
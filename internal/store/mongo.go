@@ -0,0 +1,49 @@
+package store
+
+import (
+	"io"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+// DialMongo dials once, the repositories copy the session for every
+// operation so the sockets are pooled. poolSize limits the sockets per
+// server, dialTimeout how long the first connection may take and
+// socketTimeout how long an operation may wait for the server. Zero keeps
+// the defaults of mgo.
+func DialMongo(connectionString string, poolSize int, dialTimeout time.Duration, socketTimeout time.Duration) (*mgo.Session, error) {
+	info, err := mgo.ParseURL(connectionString)
+	if err != nil {
+		return nil, err
+	}
+	if poolSize > 0 {
+		info.PoolLimit = poolSize
+	}
+	if dialTimeout > 0 {
+		info.Timeout = dialTimeout
+	}
+	session, err := mgo.DialWithInfo(info)
+	if err != nil {
+		return nil, err
+	}
+	if socketTimeout > 0 {
+		session.SetSocketTimeout(socketTimeout)
+	}
+	return session, nil
+}
+
+// RefreshMongo drops the sockets of the session when the connection broke,
+// e.g. after a failover, so the next operation connects to the new primary.
+// It returns err unchanged.
+func RefreshMongo(session *mgo.Session, err error, debugf Logf) error {
+	if err == nil {
+		return nil
+	}
+	if err == io.EOF || strings.Contains(err.Error(), "Closed explicitly") || strings.Contains(err.Error(), "no reachable servers") {
+		debugf("mongodb connection is refreshed: %v", err)
+		session.Refresh()
+	}
+	return err
+}
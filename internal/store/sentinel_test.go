@@ -0,0 +1,201 @@
+package store
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis speaks enough of the redis protocol to act as a master or as a
+// sentinel which names the master.
+type fakeRedis struct {
+	sync.Mutex
+	listener net.Listener
+	conns    []net.Conn
+	data     map[string]string
+	master   string // host:port answered to get-master-addr-by-name
+}
+
+func startFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeRedis{listener: listener, data: map[string]string{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.Lock()
+			server.conns = append(server.conns, conn)
+			server.Unlock()
+			go server.serve(conn)
+		}
+	}()
+	t.Cleanup(server.stop)
+	return server
+}
+
+func (s *fakeRedis) addr() string {
+	return s.listener.Addr().String()
+}
+
+// stop closes the listener and every connection like a crashed server.
+func (s *fakeRedis) stop() {
+	s.listener.Close()
+	s.Lock()
+	defer s.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *fakeRedis) get(key string) string {
+	s.Lock()
+	defer s.Unlock()
+	return s.data[key]
+}
+
+func (s *fakeRedis) setMaster(addr string) {
+	s.Lock()
+	defer s.Unlock()
+	s.master = addr
+}
+
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func bulk(values ...string) string {
+	result := fmt.Sprintf("*%d\r\n", len(values))
+	for _, val := range values {
+		result += fmt.Sprintf("$%d\r\n%s\r\n", len(val), val)
+	}
+	return result
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		reply := "-ERR unknown command\r\n"
+		s.Lock()
+		switch strings.ToUpper(args[0]) {
+		case "PING":
+			reply = "+PONG\r\n"
+		case "SET":
+			s.data[args[1]] = args[2]
+			reply = "+OK\r\n"
+		case "GET":
+			val, ok := s.data[args[1]]
+			reply = "$-1\r\n"
+			if ok {
+				reply = fmt.Sprintf("$%d\r\n%s\r\n", len(val), val)
+			}
+		case "SENTINEL":
+			switch strings.ToLower(args[1]) {
+			case "get-master-addr-by-name":
+				host, port, _ := net.SplitHostPort(s.master)
+				reply = bulk(host, port)
+			case "sentinels":
+				reply = "*0\r\n"
+			}
+		case "SUBSCRIBE":
+			reply = "*3\r\n$9\r\nsubscribe\r\n$" + strconv.Itoa(len(args[1])) + "\r\n" + args[1] + "\r\n:1\r\n"
+		}
+		s.Unlock()
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func TestRedisClientFollowsTheSentinelFailover(t *testing.T) {
+	first := startFakeRedis(t)
+	second := startFakeRedis(t)
+	sentinel := startFakeRedis(t)
+	sentinel.setMaster(first.addr())
+
+	client := NewRedisClient(DataSetting{
+		Sentinel: RedisSentinelConfig{
+			MasterName:    "bifrost",
+			SentinelAddrs: []string{sentinel.addr()},
+		},
+	})
+	defer client.Close()
+	if err := client.Set("token", "first", 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if first.get("token") != "first" {
+		t.Fatal("the write must reach the first master")
+	}
+
+	// the master crashes and the sentinel promotes the second server
+	sentinel.setMaster(second.addr())
+	first.stop()
+
+	var err error
+	for i := 0; i < 5; i++ {
+		// a pooled connection to the old master fails once
+		if err = client.Set("token", "second", 0).Err(); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("writes must work after the failover: %v", err)
+	}
+	val, err := client.Get("token").Result()
+	if err != nil || val != "second" {
+		t.Fatalf("read %q, %v after the failover, want second", val, err)
+	}
+}
+
+func TestRedisClientWithoutSentinel(t *testing.T) {
+	server := startFakeRedis(t)
+	client := NewRedisClient(DataSetting{Address: server.addr(), DB: "0"})
+	defer client.Close()
+	if err := client.Set("key", "val", 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if server.get("key") != "val" {
+		t.Fatal("the client must use data.address")
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package store
 
 import (
 	"strings"
@@ -11,7 +11,7 @@ import (
 	redis "gopkg.in/redis.v4"
 )
 
-type upstream struct {
+type Upstream struct {
 	count         int       `json:"-" bson:"-"`
 	Name          string    `json:"name" bson:"-"`
 	TargetURL     string    `json:"target_url" bson:"-"`
@@ -20,24 +20,17 @@ type upstream struct {
 	State         string    `json:"state" bson:"-"`
 }
 
-type service struct {
+type Service struct {
 	sync.RWMutex `json:"-" bson:"-"`
 	ID           string      `json:"id" bson:"_id"`
 	Name         string      `json:"name" `
 	Port         int         `json:"port" `
-	Upstreams    []*upstream `json:"upstreams"`
+	Upstreams    []*Upstream `json:"upstreams"`
 	CreatedAt    time.Time   `json:"created_at" bson:"created_at"`
 	UpdatedAt    time.Time   `json:"updated_at" bson:"updated_at"`
 }
 
-func newServiceCollection() *serviceCollection {
-	return &serviceCollection{
-		Count:    0,
-		Services: []*service{},
-	}
-}
-
-func (s *service) registerUpstream(source *upstream) {
+func (s *Service) RegisterUpstream(source *Upstream) {
 	s.Lock()
 	defer s.Unlock()
 
@@ -55,7 +48,7 @@ func (s *service) registerUpstream(source *upstream) {
 	s.Upstreams = append(s.Upstreams, source)
 }
 
-func (s *service) unregisterUpstream(source *upstream) {
+func (s *Service) UnregisterUpstream(source *Upstream) {
 	s.Lock()
 	defer s.Unlock()
 
@@ -68,11 +61,12 @@ func (s *service) unregisterUpstream(source *upstream) {
 	}
 }
 
-func (s *service) askForUpstream() *upstream {
+// AskForUpstream picks the upstreams of the service in turn.
+func (s *Service) AskForUpstream() *Upstream {
 	s.Lock()
 	defer s.Unlock()
 
-	var result *upstream
+	var result *Upstream
 	if len(s.Upstreams) == 1 {
 		result = s.Upstreams[0]
 		result.TotalRequests++
@@ -104,17 +98,12 @@ func (s *service) askForUpstream() *upstream {
 	return result
 }
 
-type serviceCollection struct {
-	Count    int        `json:"count"`
-	Services []*service `json:"services"`
-}
-
 type ServiceRepository interface {
-	Get(id string) (*service, error)
-	GetByName(name string) (*service, error)
-	GetAll() ([]*service, error)
-	Insert(source *service) error
-	Update(source *service) error
+	Get(id string) (*Service, error)
+	GetByName(name string) (*Service, error)
+	GetAll() ([]*Service, error)
+	Insert(source *Service) error
+	Update(source *Service) error
 	Delete(id string) error
 }
 
@@ -122,11 +111,11 @@ type ServiceRepository interface {
 	Mongo Database
 *********************/
 
-type serviceMongo struct {
+type ServiceMongo struct {
 	connectionString string
 }
 
-func newServiceMongo(connectionString string) (*serviceMongo, error) {
+func NewServiceMongo(connectionString string) (*ServiceMongo, error) {
 	session, err := mgo.Dial(connectionString)
 	if err != nil {
 		panic(err)
@@ -146,16 +135,16 @@ func newServiceMongo(connectionString string) (*serviceMongo, error) {
 		return nil, err
 	}
 
-	return &serviceMongo{
+	return &ServiceMongo{
 		connectionString: connectionString,
 	}, nil
 }
 
-func (sm *serviceMongo) newSession() (*mgo.Session, error) {
+func (sm *ServiceMongo) newSession() (*mgo.Session, error) {
 	return mgo.Dial(sm.connectionString)
 }
 
-func (sm *serviceMongo) Get(id string) (*service, error) {
+func (sm *ServiceMongo) Get(id string) (*Service, error) {
 	session, err := sm.newSession()
 	if err != nil {
 		return nil, err
@@ -163,7 +152,7 @@ func (sm *serviceMongo) Get(id string) (*service, error) {
 	defer session.Close()
 
 	c := session.DB("bifrost").C("services")
-	service := service{}
+	service := Service{}
 	err = c.FindId(id).One(&service)
 	if err != nil {
 		if err.Error() == "not found" {
@@ -174,7 +163,7 @@ func (sm *serviceMongo) Get(id string) (*service, error) {
 	return &service, nil
 }
 
-func (sm *serviceMongo) GetByName(name string) (*service, error) {
+func (sm *ServiceMongo) GetByName(name string) (*Service, error) {
 	session, err := sm.newSession()
 	if err != nil {
 		return nil, err
@@ -182,7 +171,7 @@ func (sm *serviceMongo) GetByName(name string) (*service, error) {
 	defer session.Close()
 
 	c := session.DB("bifrost").C("services")
-	service := service{}
+	service := Service{}
 	err = c.Find(bson.M{"name": name}).One(&service)
 	if err != nil {
 		if err.Error() == "not found" {
@@ -193,7 +182,7 @@ func (sm *serviceMongo) GetByName(name string) (*service, error) {
 	return &service, nil
 }
 
-func (sm *serviceMongo) GetAll() ([]*service, error) {
+func (sm *ServiceMongo) GetAll() ([]*Service, error) {
 	session, err := sm.newSession()
 	if err != nil {
 		return nil, err
@@ -201,7 +190,7 @@ func (sm *serviceMongo) GetAll() ([]*service, error) {
 	defer session.Close()
 
 	c := session.DB("bifrost").C("services")
-	services := []*service{}
+	services := []*Service{}
 	err = c.Find(bson.M{}).All(&services)
 	if err != nil {
 		if err.Error() == "not found" {
@@ -212,7 +201,7 @@ func (sm *serviceMongo) GetAll() ([]*service, error) {
 	return services, nil
 }
 
-func (sm *serviceMongo) Insert(source *service) error {
+func (sm *ServiceMongo) Insert(source *Service) error {
 	session, err := sm.newSession()
 	if err != nil {
 		return err
@@ -235,7 +224,7 @@ func (sm *serviceMongo) Insert(source *service) error {
 	return nil
 }
 
-func (sm *serviceMongo) Update(source *service) error {
+func (sm *ServiceMongo) Update(source *Service) error {
 	if len(source.ID) == 0 {
 		return AppError{ErrorCode: "invalid_input", Message: "id can't be empty or null."}
 	}
@@ -257,7 +246,7 @@ func (sm *serviceMongo) Update(source *service) error {
 	return nil
 }
 
-func (sm *serviceMongo) Delete(id string) error {
+func (sm *ServiceMongo) Delete(id string) error {
 	session, err := sm.newSession()
 	if err != nil {
 		return err
@@ -277,24 +266,18 @@ func (sm *serviceMongo) Delete(id string) error {
 	Redis Database
 *********************/
 
-type serviceRedis struct {
+type ServiceRedis struct {
 	client *redis.Client
 }
 
-func newServiceRedis(addr string, password string, db int) (*serviceRedis, error) {
-	client := redis.NewClient(&redis.Options{
-		Addr:     addr,
-		Password: password,
-		DB:       db,
-	})
-
-	serviceRedis := &serviceRedis{
+func NewServiceRedis(client *redis.Client) (*ServiceRedis, error) {
+	ServiceRedis := &ServiceRedis{
 		client: client,
 	}
-	return serviceRedis, nil
+	return ServiceRedis, nil
 }
 
-func (source *serviceRedis) Get(id string) (*service, error) {
+func (source *ServiceRedis) Get(id string) (*Service, error) {
 	/*
 		session, err := sm.newSession()
 		if err != nil {
@@ -303,7 +286,7 @@ func (source *serviceRedis) Get(id string) (*service, error) {
 		defer session.Close()
 
 		c := session.DB("bifrost").C("services")
-		service := service{}
+		service := Service{}
 		err = c.FindId(id).One(&service)
 		if err != nil {
 			if err.Error() == "not found" {
@@ -315,7 +298,7 @@ func (source *serviceRedis) Get(id string) (*service, error) {
 	return nil, nil
 }
 
-func (source *serviceRedis) GetByName(name string) (*service, error) {
+func (source *ServiceRedis) GetByName(name string) (*Service, error) {
 	/*
 		session, err := sm.newSession()
 		if err != nil {
@@ -324,7 +307,7 @@ func (source *serviceRedis) GetByName(name string) (*service, error) {
 		defer session.Close()
 
 		c := session.DB("bifrost").C("services")
-		service := service{}
+		service := Service{}
 		err = c.Find(bson.M{"name": name}).One(&service)
 		if err != nil {
 			if err.Error() == "not found" {
@@ -336,7 +319,7 @@ func (source *serviceRedis) GetByName(name string) (*service, error) {
 	return nil, nil
 }
 
-func (source *serviceRedis) GetAll() ([]*service, error) {
+func (source *ServiceRedis) GetAll() ([]*Service, error) {
 	/*
 		session, err := sm.newSession()
 		if err != nil {
@@ -345,7 +328,7 @@ func (source *serviceRedis) GetAll() ([]*service, error) {
 		defer session.Close()
 
 		c := session.DB("bifrost").C("services")
-		services := []*service{}
+		services := []*Service{}
 		err = c.Find(bson.M{}).All(&services)
 		if err != nil {
 			if err.Error() == "not found" {
@@ -357,7 +340,7 @@ func (source *serviceRedis) GetAll() ([]*service, error) {
 	return nil, nil
 }
 
-func (srouce *serviceRedis) Insert(svc *service) error {
+func (srouce *ServiceRedis) Insert(svc *Service) error {
 	/*
 		session, err := sm.newSession()
 		if err != nil {
@@ -382,7 +365,7 @@ func (srouce *serviceRedis) Insert(svc *service) error {
 	return nil
 }
 
-func (source *serviceRedis) Update(svc *service) error {
+func (source *ServiceRedis) Update(svc *Service) error {
 	/*
 		if len(source.ID) == 0 {
 			return AppError{ErrorCode: "invalid_input", Message: "id can't be empty or null."}
@@ -406,7 +389,7 @@ func (source *serviceRedis) Update(svc *service) error {
 	return nil
 }
 
-func (source *serviceRedis) Delete(id string) error {
+func (source *ServiceRedis) Delete(id string) error {
 	/*
 		session, err := sm.newSession()
 		if err != nil {
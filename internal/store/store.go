@@ -0,0 +1,134 @@
+// Package store holds the repositories of the consumers, tokens, services
+// and the cors config with their memory, mongodb and redis backends.
+package store
+
+import (
+	"fmt"
+	"strconv"
+
+	"gopkg.in/mgo.v2/bson"
+	redis "gopkg.in/redis.v4"
+)
+
+// AppError is an error with a code for the client, the repositories return
+// it for invalid input and conflicts.
+type AppError struct {
+	ErrorCode string `json:"error_code" bson:"-"`
+	Message   string `json:"message" bson:"message"`
+	RequestID string `json:"request_id,omitempty" bson:"-"`
+}
+
+func (e AppError) Error() string {
+	return fmt.Sprintf("%s - %s", e.ErrorCode, e.Message)
+}
+
+// ErrRevisionConflict is returned by repositories when the entity was changed
+// by someone else since the caller read it.
+var ErrRevisionConflict = AppError{ErrorCode: "revision_conflict", Message: "The entity was modified by another request."}
+
+// RevisionQuery matches the revision, documents created before revisions
+// existed don't have the field and are treated as revision 0.
+func RevisionQuery(revision int64) interface{} {
+	if revision == 0 {
+		return bson.M{"$in": []interface{}{0, nil}}
+	}
+	return revision
+}
+
+// Logf prints a debug message of a repository, e.g. the expired tokens the
+// janitor removed.
+type Logf func(format string, v ...interface{})
+
+type TokenSetting struct {
+	Timeout           int64 `yaml:"timeout"`
+	VerifyIP          bool  `yaml:"verify_ip"`
+	SlidingExpiration bool  `yaml:"sliding_expiration"` // deprecated: use expiration_mode
+	// ExpirationMode is "sliding", the token is renewed when it's used, or
+	// "absolute". Without it sliding_expiration decides.
+	ExpirationMode string `yaml:"expiration_mode"`
+	// MaxLifetime caps the lifetime of a token in seconds since it was
+	// created, also when it's renewed. Zero means no cap.
+	MaxLifetime int64 `yaml:"max_lifetime"`
+	// RenewThreshold is the fraction of the token's lifetime which must be left
+	// before a sliding token is renewed. Zero renews the token on every request.
+	RenewThreshold float64 `yaml:"renew_threshold"`
+	// MaxPerConsumer limits how many tokens a consumer can own, zero means no limit.
+	MaxPerConsumer int `yaml:"max_per_consumer"`
+	// EvictionPolicy is "reject" or "evict-oldest" and applies when the limit is reached.
+	EvictionPolicy string `yaml:"eviction_policy"`
+	// SweepInterval is how often the memory store removes expired tokens in
+	// seconds.
+	SweepInterval int64 `yaml:"sweep_interval"`
+	// LastUsedInterval is how many seconds last_used_at may lag behind, the
+	// token isn't written again on requests within the interval.
+	LastUsedInterval int64 `yaml:"last_used_interval"`
+}
+
+// Sliding reports whether tokens are renewed when they are used.
+func (s TokenSetting) Sliding() bool {
+	if len(s.ExpirationMode) == 0 {
+		return s.SlidingExpiration
+	}
+	return s.ExpirationMode == "sliding"
+}
+
+// TokenSettings returns the token setting in effect, the token repositories
+// call it for every operation so a reloaded config applies at once.
+type TokenSettings func() TokenSetting
+
+type DataSetting struct {
+	Type             string `yaml:"type"`
+	ConnectionString string `yaml:"connection_string"`
+	Address          string `yaml:"address"`
+	Password         string `yaml:"password"`
+	DB               string `yaml:"db"`
+	PoolSize         int    `yaml:"pool_size"`      // sockets per mongodb server, zero is the default of 4096
+	DialTimeout      int64  `yaml:"dial_timeout"`   // seconds to connect to mongodb
+	SocketTimeout    int64  `yaml:"socket_timeout"` // seconds a mongodb operation may take, zero is the default of 60
+	// Sentinel connects the redis stores to the master of a redis sentinel
+	// deployment when the master name is set, address isn't used then.
+	Sentinel RedisSentinelConfig `yaml:"sentinel"`
+}
+
+// RedisSentinelConfig connects the redis stores to the master of a redis
+// sentinel deployment, so they keep working after a failover.
+type RedisSentinelConfig struct {
+	MasterName    string   `yaml:"master_name"`
+	SentinelAddrs []string `yaml:"sentinel_addrs"`
+	Password      string   `yaml:"password"`
+	DB            int      `yaml:"db"`
+}
+
+// NewRedisClient connects to the master of the sentinel deployment when the
+// master name is set, otherwise to the redis at data.address.
+func NewRedisClient(data DataSetting) *redis.Client {
+	if len(data.Sentinel.MasterName) > 0 {
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    data.Sentinel.MasterName,
+			SentinelAddrs: data.Sentinel.SentinelAddrs,
+			Password:      data.Sentinel.Password,
+			DB:            data.Sentinel.DB,
+		})
+	}
+	db, _ := strconv.Atoi(data.DB)
+	return redis.NewClient(&redis.Options{
+		Addr:     data.Address,
+		Password: data.Password,
+		DB:       db,
+	})
+}
+
+func panicIf(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,1089 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	redis "gopkg.in/redis.v4"
+
+	"github.com/satori/go.uuid"
+)
+
+type Token struct {
+	ID         string    `json:"id" bson:"_id"`
+	Source     string    `json:"source" bson:"source"`
+	ConsumerID string    `json:"consumer_id" bson:"consumer_id"`
+	IPAddress  string    `json:"ip_address" bson:"ip_address"`
+	ExpiresIn  int64     `json:"expires_in" bson:"-"`
+	Expiration time.Time `json:"expiration" bson:"expiration"`
+	CreatedAt  time.Time `json:"created_at" bson:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at" bson:"last_used_at"` // the last successful auth
+	// ids of tokens which were evicted to make room for this token
+	EvictedTokenIDs []string `json:"evicted_token_ids,omitempty" bson:"-"`
+	// AbsoluteExpiration is the latest expiration a renewal can reach, it's
+	// omitted when sliding tokens have no max_lifetime.
+	AbsoluteExpiration *time.Time `json:"absolute_expiration,omitempty" bson:"-"`
+}
+
+// NewToken returns a token which expires after setting.Timeout seconds.
+func NewToken(consumerID string, setting TokenSetting) *Token {
+	now := time.Now().UTC()
+	token := &Token{
+		ConsumerID: consumerID,
+		ID:         uuid.NewV4().String(),
+		Expiration: now.Add(time.Duration(setting.Timeout) * time.Second),
+		CreatedAt:  now,
+	}
+	token.CapExpiration(setting)
+	token.SetExpiresIn(setting)
+	return token
+}
+
+// IsValid reports whether the token neither expired nor reached max_lifetime.
+func (t *Token) IsValid(setting TokenSetting) bool {
+	now := time.Now().UTC()
+	if now.After(t.Expiration) {
+		return false
+	}
+	// tokens issued before max_lifetime was lowered expire as well
+	if lifetimeEnd, ok := t.lifetimeEnd(setting); ok && now.After(lifetimeEnd) {
+		return false
+	}
+	return true
+}
+
+// lifetimeEnd returns the end of max_lifetime since the token was created.
+func (t *Token) lifetimeEnd(setting TokenSetting) (time.Time, bool) {
+	if setting.MaxLifetime <= 0 || t.CreatedAt.IsZero() {
+		return time.Time{}, false
+	}
+	return t.CreatedAt.Add(time.Duration(setting.MaxLifetime) * time.Second), true
+}
+
+// CapExpiration keeps the expiration within max_lifetime.
+func (t *Token) CapExpiration(setting TokenSetting) {
+	if lifetimeEnd, ok := t.lifetimeEnd(setting); ok && t.Expiration.After(lifetimeEnd) {
+		t.Expiration = lifetimeEnd
+	}
+}
+
+// Renew moves the expiration by the token timeout, within max_lifetime.
+func (t *Token) Renew(setting TokenSetting) {
+	t.Expiration = time.Now().UTC().Add(time.Duration(setting.Timeout) * time.Second)
+	t.CapExpiration(setting)
+	t.SetExpiresIn(setting)
+}
+
+// SetExpiresIn fills expires_in and absolute_expiration of the response.
+func (t *Token) SetExpiresIn(setting TokenSetting) {
+	t.ExpiresIn = int64(t.Expiration.Sub(time.Now().UTC()).Seconds())
+	t.AbsoluteExpiration = nil
+	if !setting.Sliding() {
+		absolute := t.Expiration
+		t.AbsoluteExpiration = &absolute
+	} else if lifetimeEnd, ok := t.lifetimeEnd(setting); ok {
+		t.AbsoluteExpiration = &lifetimeEnd
+	}
+}
+
+// ShouldRenew reports whether the token's remaining lifetime dropped below
+// renew_threshold which is a fraction of the configured token timeout. A
+// token which reached max_lifetime isn't renewed anymore.
+func (t *Token) ShouldRenew(setting TokenSetting) bool {
+	if lifetimeEnd, ok := t.lifetimeEnd(setting); ok && !t.Expiration.Before(lifetimeEnd) {
+		return false
+	}
+	if setting.RenewThreshold <= 0 {
+		return true
+	}
+	lifetime := time.Duration(setting.Timeout) * time.Second
+	remaining := t.Expiration.Sub(time.Now().UTC())
+	return remaining < time.Duration(float64(lifetime)*setting.RenewThreshold)
+}
+
+// ErrTokenLimitExceeded is returned when the consumer already owns the maximum number of tokens.
+var ErrTokenLimitExceeded = AppError{ErrorCode: "token_limit_exceeded", Message: "The consumer has reached the maximum number of tokens."}
+
+type byTokenCreatedAt []*Token
+
+func (source byTokenCreatedAt) Len() int {
+	return len(source)
+}
+func (source byTokenCreatedAt) Swap(i, j int) {
+	source[i], source[j] = source[j], source[i]
+}
+func (source byTokenCreatedAt) Less(i, j int) bool {
+	return source[i].CreatedAt.Before(source[j].CreatedAt)
+}
+
+type TokenRepository interface {
+	Get(key string) (*Token, error)
+	GetByConsumerID(consumerID string) ([]*Token, error)
+	Insert(token *Token) error
+	// InsertWithLimit inserts the token unless the consumer already has max tokens.
+	// When evictOldest is true the oldest tokens are removed instead and their ids are returned.
+	InsertWithLimit(token *Token, max int, evictOldest bool) ([]string, error)
+	Update(token *Token) error
+	// Touch only sets last_used_at, a token which was deleted meanwhile
+	// stays deleted.
+	Touch(id string, lastUsedAt time.Time) error
+	DeleteByConsumerID(consumerID string) error
+	Delete(key string) error
+	// DeleteBatch deletes the tokens with the keys and returns the keys which
+	// were deleted, missing keys are ignored.
+	DeleteBatch(keys []string) ([]string, error)
+}
+
+type TokenMemStore struct {
+	sync.RWMutex
+	data     map[string]*Token
+	settings TokenSettings
+	debugf   Logf
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func NewTokenMemStore(settings TokenSettings, debugf Logf) *TokenMemStore {
+	return &TokenMemStore{
+		data:     map[string]*Token{},
+		settings: settings,
+		debugf:   debugf,
+		stop:     make(chan struct{}),
+	}
+}
+
+// StartJanitor removes the expired tokens every interval until Close is
+// called, expired tokens are hidden from Get before they are removed.
+func (ts *TokenMemStore) StartJanitor(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if removed := ts.sweep(); removed > 0 {
+					ts.debugf("token janitor removed %d expired tokens", removed)
+				}
+			case <-ts.stop:
+				return
+			}
+		}
+	}()
+}
+
+// sweep deletes the expired tokens and returns how many were deleted.
+func (ts *TokenMemStore) sweep() int {
+	ts.Lock()
+	defer ts.Unlock()
+	removed := 0
+	setting := ts.settings()
+	for key, token := range ts.data {
+		if !token.IsValid(setting) {
+			delete(ts.data, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Close stops the janitor.
+func (ts *TokenMemStore) Close() error {
+	ts.stopOnce.Do(func() {
+		close(ts.stop)
+	})
+	return nil
+}
+
+func (ts *TokenMemStore) Get(key string) (*Token, error) {
+	ts.RLock()
+	defer ts.RUnlock()
+	result := ts.data[key]
+	if result == nil || !result.IsValid(ts.settings()) {
+		return nil, nil
+	}
+	// return a copy so callers can't change the stored token without Update
+	token := *result
+	return &token, nil
+}
+
+// Count returns how many tokens are held, expired ones included.
+func (ts *TokenMemStore) Count() int {
+	ts.RLock()
+	defer ts.RUnlock()
+	return len(ts.data)
+}
+
+func (ts *TokenMemStore) GetByConsumerID(consumerID string) ([]*Token, error) {
+	var result []*Token
+	setting := ts.settings()
+	ts.RLock()
+	defer ts.RUnlock()
+	for _, token := range ts.data {
+		if token.ConsumerID == consumerID && token.IsValid(setting) {
+			result = append(result, token)
+		}
+	}
+	return result, nil
+}
+
+func (ts *TokenMemStore) Insert(token *Token) error {
+	_, err := ts.InsertWithLimit(token, 0, false)
+	return err
+}
+
+func (ts *TokenMemStore) InsertWithLimit(token *Token, max int, evictOldest bool) ([]string, error) {
+	ts.Lock()
+	defer ts.Unlock()
+	oldToken := ts.data[token.ID]
+	if oldToken != nil {
+		return nil, AppError{ErrorCode: "invalid_input", Message: "The token key already exits."}
+	}
+
+	evicted := []string{}
+	if max > 0 {
+		setting := ts.settings()
+		tokens := []*Token{}
+		for _, t := range ts.data {
+			if t.ConsumerID != token.ConsumerID {
+				continue
+			}
+			if !t.IsValid(setting) {
+				delete(ts.data, t.ID)
+				continue
+			}
+			tokens = append(tokens, t)
+		}
+		sort.Sort(byTokenCreatedAt(tokens))
+		for len(tokens) >= max {
+			if !evictOldest {
+				return nil, ErrTokenLimitExceeded
+			}
+			delete(ts.data, tokens[0].ID)
+			evicted = append(evicted, tokens[0].ID)
+			tokens = tokens[1:]
+		}
+	}
+
+	token.CreatedAt = time.Now().UTC()
+	ts.data[token.ID] = token
+	return evicted, nil
+}
+
+func (ts *TokenMemStore) Update(token *Token) error {
+	ts.Lock()
+	defer ts.Unlock()
+	oldToken := ts.data[token.ID]
+	if oldToken == nil {
+		return AppError{ErrorCode: "invalid_input", Message: "The token was not found."}
+	}
+	newToken := *token
+	ts.data[token.ID] = &newToken
+	return nil
+}
+
+func (ts *TokenMemStore) Touch(id string, lastUsedAt time.Time) error {
+	ts.Lock()
+	defer ts.Unlock()
+	if token := ts.data[id]; token != nil {
+		token.LastUsedAt = lastUsedAt
+	}
+	return nil
+}
+
+func (ts *TokenMemStore) Delete(key string) error {
+	ts.Lock()
+	defer ts.Unlock()
+	delete(ts.data, key)
+	return nil
+}
+
+func (ts *TokenMemStore) DeleteBatch(keys []string) ([]string, error) {
+	ts.Lock()
+	defer ts.Unlock()
+	deleted := []string{}
+	for _, key := range keys {
+		if _, ok := ts.data[key]; ok {
+			delete(ts.data, key)
+			deleted = append(deleted, key)
+		}
+	}
+	return deleted, nil
+}
+
+func (ts *TokenMemStore) DeleteByConsumerID(consumerID string) error {
+	ts.Lock()
+	defer ts.Unlock()
+	for _, token := range ts.data {
+		if token.ConsumerID == consumerID {
+			delete(ts.data, token.ID)
+		}
+	}
+	return nil
+}
+
+/*********************
+	Mongo Database
+*********************/
+
+type TokenMongo struct {
+	// every operation copies the session, so the sockets are pooled
+	session  *mgo.Session
+	settings TokenSettings
+	debugf   Logf
+}
+
+// NewTokenMongo dials once, see DialMongo for the pool and the timeouts.
+func NewTokenMongo(connectionString string, poolSize int, dialTimeout time.Duration, socketTimeout time.Duration, settings TokenSettings, debugf Logf) (*TokenMongo, error) {
+	session, err := DialMongo(connectionString, poolSize, dialTimeout, socketTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := session.DB("bifrost").C("tokens")
+
+	// create index
+	consumerIdx := mgo.Index{
+		Name:       "token_consumer_idx",
+		Key:        []string{"consumer_id"},
+		Background: true,
+		Sparse:     true,
+	}
+	err = c.EnsureIndex(consumerIdx)
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	lastUsedIdx := mgo.Index{
+		Name:       "token_last_used_idx",
+		Key:        []string{"last_used_at"},
+		Background: true,
+	}
+	err = c.EnsureIndex(lastUsedIdx)
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	err = ensureTokenTTLIndex(c)
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	return &TokenMongo{
+		session:  session,
+		settings: settings,
+		debugf:   debugf,
+	}, nil
+}
+
+const tokenTTLIndex = "token_expiration_ttl_idx"
+
+// ensureTokenTTLIndex lets mongodb delete the tokens once they expire. mgo
+// omits an expireAfterSeconds of zero, so the index is created by command.
+// An index with the same name or on the same key but other options is
+// dropped first, as mongodb refuses to create it otherwise.
+func ensureTokenTTLIndex(c *mgo.Collection) error {
+	var list struct {
+		Cursor struct {
+			FirstBatch []bson.M `bson:"firstBatch"`
+		} `bson:"cursor"`
+	}
+	err := c.Database.Run(bson.D{{Name: "listIndexes", Value: c.Name}}, &list)
+	if err != nil {
+		return err
+	}
+	for _, index := range list.Cursor.FirstBatch {
+		name, _ := index["name"].(string)
+		key, _ := index["key"].(bson.M)
+		onExpiration := len(key) == 1 && key["expiration"] != nil
+		if name != tokenTTLIndex && !onExpiration {
+			continue
+		}
+		expireAfter, isTTL := index["expireAfterSeconds"]
+		if name == tokenTTLIndex && onExpiration && isTTL && fmt.Sprint(expireAfter) == "0" {
+			return nil
+		}
+		if err := c.DropIndexName(name); err != nil {
+			return err
+		}
+	}
+	return c.Database.Run(bson.D{
+		{Name: "createIndexes", Value: c.Name},
+		{Name: "indexes", Value: []bson.M{{
+			"name":               tokenTTLIndex,
+			"key":                bson.M{"expiration": 1},
+			"expireAfterSeconds": 0,
+			"background":         true,
+		}}},
+	}, nil)
+}
+
+func (tm *TokenMongo) newSession() (*mgo.Session, error) {
+	return tm.session.Copy(), nil
+}
+
+// Close closes the pooled sockets.
+func (tm *TokenMongo) Close() error {
+	tm.session.Close()
+	return nil
+}
+
+func (tm *TokenMongo) Get(key string) (*Token, error) {
+	session, err := tm.newSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	c := session.DB("bifrost").C("tokens")
+	token := Token{}
+	err = c.Find(bson.M{"_id": key}).One(&token)
+	if err != nil {
+		if err.Error() == "not found" {
+			return nil, nil
+		}
+		return nil, RefreshMongo(tm.session, err, tm.debugf)
+	}
+	// the ttl monitor of mongodb only runs every minute
+	if !token.IsValid(tm.settings()) {
+		return nil, nil
+	}
+	return &token, nil
+}
+
+func (tm *TokenMongo) GetByConsumerID(consumerID string) ([]*Token, error) {
+	session, err := tm.newSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	c := session.DB("bifrost").C("tokens")
+	tokens := []*Token{}
+	err = c.Find(bson.M{"consumer_id": consumerID}).All(&tokens)
+	if err != nil {
+		if err.Error() == "not found" {
+			return nil, nil
+		}
+		return nil, RefreshMongo(tm.session, err, tm.debugf)
+	}
+	return tokens, nil
+}
+
+func (tm *TokenMongo) Insert(token *Token) error {
+	session, err := tm.newSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	c := session.DB("bifrost").C("tokens")
+	token.CreatedAt = time.Now().UTC()
+	err = c.Insert(token)
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "E11000") {
+			return AppError{ErrorCode: "invalid_input", Message: "The token key already exits"}
+		}
+		return RefreshMongo(tm.session, err, tm.debugf)
+	}
+	return nil
+}
+
+func (tm *TokenMongo) InsertWithLimit(token *Token, max int, evictOldest bool) ([]string, error) {
+	if max <= 0 {
+		return []string{}, tm.Insert(token)
+	}
+
+	session, err := tm.newSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	// the token is inserted first and the limit is checked afterwards, so
+	// gateways which insert at the same time see each other's tokens. They
+	// all rank the tokens by created_at and id in the same way, the tokens
+	// beyond max are rejected or the oldest ones are evicted.
+	c := session.DB("bifrost").C("tokens")
+	now := time.Now().UTC()
+	token.CreatedAt = now
+	err = c.Insert(token)
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "E11000") {
+			return nil, AppError{ErrorCode: "invalid_input", Message: "The token key already exits"}
+		}
+		return nil, RefreshMongo(tm.session, err, tm.debugf)
+	}
+
+	tokens := []*Token{}
+	err = c.Find(bson.M{"consumer_id": token.ConsumerID, "expiration": bson.M{"$gt": now}}).Sort("created_at", "_id").All(&tokens)
+	if err != nil {
+		return nil, RefreshMongo(tm.session, err, tm.debugf)
+	}
+	if len(tokens) <= max {
+		return []string{}, nil
+	}
+
+	if !evictOldest {
+		for i, t := range tokens {
+			if t.ID == token.ID && i >= max {
+				if err := c.RemoveId(token.ID); err != nil && err != mgo.ErrNotFound {
+					return nil, RefreshMongo(tm.session, err, tm.debugf)
+				}
+				return nil, ErrTokenLimitExceeded
+			}
+		}
+		return []string{}, nil
+	}
+
+	evicted := []string{}
+	for _, t := range tokens {
+		if len(tokens)-len(evicted) <= max {
+			break
+		}
+		if t.ID == token.ID {
+			continue
+		}
+		err = c.RemoveId(t.ID)
+		if err != nil && err != mgo.ErrNotFound {
+			return nil, RefreshMongo(tm.session, err, tm.debugf)
+		}
+		evicted = append(evicted, t.ID)
+	}
+	return evicted, nil
+}
+
+func (tm *TokenMongo) Update(token *Token) error {
+	session, err := tm.newSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	c := session.DB("bifrost").C("tokens")
+	colQuerier := bson.M{"_id": token.ID}
+	err = c.Update(colQuerier, token)
+	if err != nil {
+		return RefreshMongo(tm.session, err, tm.debugf)
+	}
+	return nil
+}
+
+func (tm *TokenMongo) Touch(id string, lastUsedAt time.Time) error {
+	session, err := tm.newSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	c := session.DB("bifrost").C("tokens")
+	err = c.UpdateId(id, bson.M{"$set": bson.M{"last_used_at": lastUsedAt}})
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return nil
+		}
+		return RefreshMongo(tm.session, err, tm.debugf)
+	}
+	return nil
+}
+
+func (tm *TokenMongo) Delete(key string) error {
+	session, err := tm.newSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	c := session.DB("bifrost").C("tokens")
+	colQuerier := bson.M{"_id": key}
+	err = c.Remove(colQuerier)
+	if err != nil {
+		return RefreshMongo(tm.session, err, tm.debugf)
+	}
+	return nil
+}
+
+func (tm *TokenMongo) DeleteBatch(keys []string) ([]string, error) {
+	deleted := []string{}
+	if len(keys) == 0 {
+		return deleted, nil
+	}
+	session, err := tm.newSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	c := session.DB("bifrost").C("tokens")
+	colQuerier := bson.M{"_id": bson.M{"$in": keys}}
+	// one query finds the existing ids and one removes them
+	var found []struct {
+		ID string `bson:"_id"`
+	}
+	err = c.Find(colQuerier).Select(bson.M{"_id": 1}).All(&found)
+	if err != nil {
+		return nil, RefreshMongo(tm.session, err, tm.debugf)
+	}
+	_, err = c.RemoveAll(colQuerier)
+	if err != nil {
+		return nil, RefreshMongo(tm.session, err, tm.debugf)
+	}
+	for _, token := range found {
+		deleted = append(deleted, token.ID)
+	}
+	return deleted, nil
+}
+
+func (tm *TokenMongo) DeleteByConsumerID(consumerID string) error {
+	session, err := tm.newSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	c := session.DB("bifrost").C("tokens")
+	colQuerier := bson.M{"consumer_id": consumerID}
+	// every token of the consumer is revoked, Remove would only delete the first
+	info, err := c.RemoveAll(colQuerier)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return nil
+		}
+		return RefreshMongo(tm.session, err, tm.debugf)
+	}
+	tm.debugf("%d tokens of consumer %s were deleted", info.Removed, consumerID)
+	return nil
+}
+
+/*********************
+	Redis Database
+*********************/
+
+// token:consumer:<id> used to be a plain set, it's a sorted set scored by
+// created_at in milliseconds now so the oldest token can be evicted. Old sets are migrated
+// the first time they are touched.
+const redisMigrateConsumerTokens = `
+if redis.call('TYPE', KEYS[1]).ok == 'set' then
+	local members = redis.call('SMEMBERS', KEYS[1])
+	redis.call('DEL', KEYS[1])
+	for _, member in ipairs(members) do
+		redis.call('ZADD', KEYS[1], 0, member)
+	end
+end
+`
+
+// KEYS[1] token:consumer:<id>, KEYS[2] token:id:<id>, KEYS[3..] token:id:<member>
+// of every member of the consumer's set
+// ARGV[1] token json, ARGV[2] ttl in ms, ARGV[3] created_at score, ARGV[4] max tokens,
+// ARGV[5] evict oldest (1 or 0), ARGV[6] token id, ARGV[7..] the member of KEYS[3..]
+// returns {-2} when the members changed since they were read, {-1} when the
+// token exists, {0} when the limit is reached, otherwise {1, evicted ids...}
+// redisInsertAttempts limits how often an insert is tried again when the
+// tokens of the consumer change between reading them and the script.
+const redisInsertAttempts = 5
+
+var redisInsertToken = redis.NewScript(redisMigrateConsumerTokens + `
+local keys = {}
+for i = 3, #KEYS do
+	keys[ARGV[i + 4]] = KEYS[i]
+end
+local members = redis.call('ZRANGE', KEYS[1], 0, -1)
+if #members ~= #KEYS - 2 then
+	return {-2}
+end
+for _, member in ipairs(members) do
+	if not keys[member] then
+		return {-2}
+	end
+end
+if redis.call('EXISTS', KEYS[2]) == 1 then
+	return {-1}
+end
+for _, member in ipairs(members) do
+	if redis.call('EXISTS', keys[member]) == 0 then
+		redis.call('ZREM', KEYS[1], member)
+	end
+end
+local result = {1}
+local max = tonumber(ARGV[4])
+if max > 0 then
+	while redis.call('ZCARD', KEYS[1]) >= max do
+		if ARGV[5] ~= '1' then
+			return {0}
+		end
+		local oldest = redis.call('ZRANGE', KEYS[1], 0, 0)[1]
+		redis.call('ZREM', KEYS[1], oldest)
+		redis.call('DEL', keys[oldest])
+		table.insert(result, oldest)
+	end
+end
+redis.call('SET', KEYS[2], ARGV[1], 'PX', ARGV[2])
+redis.call('ZADD', KEYS[1], ARGV[3], ARGV[6])
+if redis.call('PTTL', KEYS[1]) < tonumber(ARGV[2]) then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return result
+`)
+
+var redisMigrateScript = redis.NewScript(redisMigrateConsumerTokens + "return 1")
+
+// KEYS[1] token:consumer:<id>, ARGV[1] ttl in ms
+// the set of token ids lives as long as the consumer's last token, so the
+// set of a consumer who doesn't log in again is removed as well
+var redisExtendConsumerTokens = redis.NewScript(`
+if redis.call('PTTL', KEYS[1]) < tonumber(ARGV[1]) then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return 1
+`)
+
+// KEYS[1] token:id:<id>, ARGV[1] last_used_at
+// only the field is replaced and the ttl is kept, a missing token isn't
+// written again
+var redisTouchToken = redis.NewScript(`
+local val = redis.call('GET', KEYS[1])
+local ttl = redis.call('PTTL', KEYS[1])
+if not val or ttl <= 0 then
+	return 0
+end
+local token = cjson.decode(val)
+token['last_used_at'] = ARGV[1]
+redis.call('SET', KEYS[1], cjson.encode(token), 'PX', ttl)
+return 1
+`)
+
+type TokenRedis struct {
+	client   *redis.Client
+	settings TokenSettings
+}
+
+func NewTokenRedis(client *redis.Client, settings TokenSettings) (*TokenRedis, error) {
+	tokenRedis := &TokenRedis{
+		client:   client,
+		settings: settings,
+	}
+	return tokenRedis, nil
+}
+
+// Close closes the connections to redis.
+func (source *TokenRedis) Close() error {
+	return source.client.Close()
+}
+
+// TokenStoreError is a failed call to the token store, e.g. redis isn't
+// reachable. Requests which need the store are answered with 503.
+type TokenStoreError struct {
+	Op  string
+	Key string
+	Err error
+}
+
+func (e *TokenStoreError) Error() string {
+	return "token store: " + e.Op + " " + e.Key + ": " + e.Err.Error()
+}
+
+func (e *TokenStoreError) Unwrap() error {
+	return e.Err
+}
+
+func redisError(op string, key string, err error) error {
+	// the token id is a credential, only its start goes into the logs
+	if id := strings.TrimPrefix(key, "token:id:"); id != key && len(id) > 6 {
+		key = "token:id:" + id[:6] + "..."
+	}
+	return &TokenStoreError{Op: op, Key: key, Err: err}
+}
+
+// consumerKey returns the key of the consumer's token ids and migrates it when needed.
+func (source *TokenRedis) consumerKey(consumerID string) (string, error) {
+	key := "token:consumer:" + consumerID
+	err := redisMigrateScript.Run(source.client, []string{key}).Err()
+	if err != nil {
+		return "", redisError("migrate", key, err)
+	}
+	return key, nil
+}
+
+func (source *TokenRedis) Get(id string) (*Token, error) {
+	key := "token:id:" + id
+	s, err := source.client.Get(key).Result()
+	if err != nil {
+		if err.Error() == "redis: nil" {
+			return nil, nil
+		}
+		return nil, redisError("get", key, err)
+	}
+
+	var token Token
+	err = json.Unmarshal([]byte(s), &token)
+	if err != nil {
+		return nil, redisError("decode", key, err)
+	}
+
+	token.SetExpiresIn(source.settings())
+	return &token, nil
+}
+
+func (source *TokenRedis) GetByConsumerID(consumerID string) ([]*Token, error) {
+	key, err := source.consumerKey(consumerID)
+	if err != nil {
+		return nil, err
+	}
+	tokenIDs, err := source.client.ZRange(key, 0, -1).Result()
+	if err != nil {
+		if err.Error() == "redis: nil" {
+			return nil, nil
+		}
+		return nil, redisError("zrange", key, err)
+	}
+
+	if len(tokenIDs) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]string, len(tokenIDs))
+	for i, id := range tokenIDs {
+		keys[i] = "token:id:" + id
+	}
+	values, err := source.client.MGet(keys...).Result()
+	if err != nil {
+		return nil, redisError("mget", key, err)
+	}
+
+	// the ids of tokens which expired by their ttl are removed from the set
+	var result []*Token
+	stale := []interface{}{}
+	setting := source.settings()
+	for i, val := range values {
+		s, ok := val.(string)
+		if !ok {
+			stale = append(stale, tokenIDs[i])
+			continue
+		}
+		var token Token
+		err = json.Unmarshal([]byte(s), &token)
+		if err != nil {
+			return nil, redisError("decode", keys[i], err)
+		}
+		token.SetExpiresIn(setting)
+		result = append(result, &token)
+	}
+	if len(stale) > 0 {
+		err = source.client.ZRem(key, stale...).Err()
+		if err != nil {
+			return nil, redisError("zrem", key, err)
+		}
+	}
+	return result, nil
+}
+
+func (source *TokenRedis) Insert(token *Token) error {
+	_, err := source.InsertWithLimit(token, 0, false)
+	return err
+}
+
+// InsertWithLimit checks the limit and inserts the token in one lua script,
+// so concurrent logins can't exceed the limit.
+func (source *TokenRedis) InsertWithLimit(token *Token, max int, evictOldest bool) ([]string, error) {
+	now := time.Now().UTC()
+	token.CreatedAt = now
+
+	key := "token:id:" + token.ID
+	val, err := json.Marshal(token)
+	if err != nil {
+		return nil, redisError("encode", key, err)
+	}
+	exp := token.Expiration.Sub(now)
+	if exp <= 0 {
+		return nil, AppError{ErrorCode: "invalid_input", Message: "The token has expired"}
+	}
+
+	evict := "0"
+	if evictOldest {
+		evict = "1"
+	}
+	// every key the script touches is passed in KEYS, so the members are
+	// read first and the script gives up when they changed meanwhile
+	consumerKey := "token:consumer:" + token.ConsumerID
+	var values []interface{}
+	for attempt := 0; ; attempt++ {
+		members, err := source.consumerTokenIDs(consumerKey)
+		if err != nil {
+			return nil, redisError("insert", key, err)
+		}
+		keys := []string{consumerKey, key}
+		args := []interface{}{val, int64(exp / time.Millisecond), now.UnixMilli(), max, evict, token.ID}
+		for _, member := range members {
+			keys = append(keys, "token:id:"+member)
+			args = append(args, member)
+		}
+		result, err := redisInsertToken.Run(source.client, keys, args...).Result()
+		if err != nil {
+			return nil, redisError("insert", key, err)
+		}
+		values = result.([]interface{})
+		if values[0].(int64) != -2 {
+			break
+		}
+		if attempt == redisInsertAttempts {
+			return nil, redisError("insert", key, errors.New("the tokens of the consumer kept changing"))
+		}
+	}
+
+	switch values[0].(int64) {
+	case -1:
+		return nil, AppError{ErrorCode: "invalid_input", Message: "The token key already exits"}
+	case 0:
+		return nil, ErrTokenLimitExceeded
+	}
+
+	evicted := []string{}
+	for _, id := range values[1:] {
+		evicted = append(evicted, id.(string))
+	}
+	return evicted, nil
+}
+
+// consumerTokenIDs reads the members of the consumer's set, which is a plain
+// set until it's migrated.
+func (source *TokenRedis) consumerTokenIDs(consumerKey string) ([]string, error) {
+	kind, err := source.client.Type(consumerKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	if kind == "set" {
+		return source.client.SMembers(consumerKey).Result()
+	}
+	return source.client.ZRange(consumerKey, 0, -1).Result()
+}
+
+func (source *TokenRedis) Update(token *Token) error {
+	oldToken, err := source.Get(token.ID)
+	if err != nil {
+		return err
+	}
+	consumerKey, err := source.consumerKey(token.ConsumerID)
+	if err != nil {
+		return err
+	}
+
+	// a zero ttl would keep the key forever, so expired tokens are removed instead
+	exp := token.Expiration.Sub(time.Now().UTC())
+	if exp <= 0 {
+		err = source.client.ZRem(consumerKey, token.ID).Err()
+		if err != nil {
+			return redisError("zrem", consumerKey, err)
+		}
+		return source.Delete(token.ID)
+	}
+
+	key := "token:id:" + token.ID
+	val, err := json.Marshal(token)
+	if err != nil {
+		return redisError("encode", key, err)
+	}
+
+	// SetXX keeps a token which was deleted meanwhile from coming back
+	updated, err := source.client.SetXX(key, val, exp).Result()
+	if err != nil {
+		return redisError("set", key, err)
+	}
+	if !updated {
+		return AppError{ErrorCode: "invalid_input", Message: "The token was not found."}
+	}
+
+	// keep token:consumer in sync when the token moved to another consumer
+	if oldToken != nil && oldToken.ConsumerID != token.ConsumerID {
+		oldKey, err := source.consumerKey(oldToken.ConsumerID)
+		if err != nil {
+			return err
+		}
+		err = source.client.ZRem(oldKey, token.ID).Err()
+		if err != nil {
+			return redisError("zrem", oldKey, err)
+		}
+	}
+	member := redis.Z{Score: float64(token.CreatedAt.UnixMilli()), Member: token.ID}
+	err = source.client.ZAdd(consumerKey, member).Err()
+	if err != nil {
+		return redisError("zadd", consumerKey, err)
+	}
+	err = redisExtendConsumerTokens.Run(source.client, []string{consumerKey}, int64(exp/time.Millisecond)).Err()
+	if err != nil {
+		return redisError("expire", consumerKey, err)
+	}
+	return nil
+}
+
+func (source *TokenRedis) Touch(id string, lastUsedAt time.Time) error {
+	key := "token:id:" + id
+	err := redisTouchToken.Run(source.client, []string{key}, lastUsedAt.Format(time.RFC3339Nano)).Err()
+	if err != nil {
+		return redisError("touch", key, err)
+	}
+	return nil
+}
+
+func (source *TokenRedis) Delete(id string) error {
+	key := "token:id:" + id
+	err := source.client.Del(key).Err()
+	if err != nil {
+		return redisError("del", key, err)
+	}
+	return nil
+}
+
+// DeleteBatch sends a DEL per token in one pipeline, so the result of
+// every token is known after one round trip.
+func (source *TokenRedis) DeleteBatch(ids []string) ([]string, error) {
+	deleted := []string{}
+	if len(ids) == 0 {
+		return deleted, nil
+	}
+	cmds, err := source.client.Pipelined(func(pipe *redis.Pipeline) error {
+		for _, id := range ids {
+			pipe.Del("token:id:" + id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, redisError("del", "token:id:"+ids[0], err)
+	}
+	for i, cmd := range cmds {
+		if cmd.(*redis.IntCmd).Val() > 0 {
+			deleted = append(deleted, ids[i])
+		}
+	}
+	return deleted, nil
+}
+
+func (source *TokenRedis) DeleteByConsumerID(consumerID string) error {
+	key, err := source.consumerKey(consumerID)
+	if err != nil {
+		return err
+	}
+	tokenIDs, err := source.client.ZRange(key, 0, -1).Result()
+	if err != nil {
+		if err.Error() == "redis: nil" {
+			return nil
+		}
+		return redisError("zrange", key, err)
+	}
+
+	keys := []string{key}
+	for _, id := range tokenIDs {
+		keys = append(keys, "token:id:"+id)
+	}
+	// the token keys and token:consumer go in one call
+	err = source.client.Del(keys...).Err()
+	if err != nil {
+		return redisError("del", key, err)
+	}
+	return nil
+}
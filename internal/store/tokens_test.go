@@ -0,0 +1,484 @@
+package store
+
+import (
+	"errors"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"gopkg.in/mgo.v2"
+)
+
+// testSettings keeps the tokens of the tests for an hour.
+func testSettings() TokenSetting {
+	return TokenSetting{Timeout: 3600}
+}
+
+func testLogf(format string, v ...interface{}) {}
+
+func newTestToken(consumerID string) *Token {
+	return NewToken(consumerID, testSettings())
+}
+
+// tokenRepos returns the memory store and the stores of BIFROST_TEST_REDIS
+// (host:port) and BIFROST_TEST_MONGODB (connection string) when they are set.
+func tokenRepos(t *testing.T) map[string]TokenRepository {
+	repos := map[string]TokenRepository{"memory": NewTokenMemStore(testSettings, testLogf)}
+	if addr := os.Getenv("BIFROST_TEST_REDIS"); len(addr) > 0 {
+		repo, err := NewTokenRedis(NewRedisClient(DataSetting{Address: addr, DB: "0"}), testSettings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		repos["redis"] = repo
+	}
+	if connectionString := os.Getenv("BIFROST_TEST_MONGODB"); len(connectionString) > 0 {
+		repo, err := NewTokenMongo(connectionString, 10, 5*time.Second, 5*time.Second, testSettings, testLogf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		repos["mongodb"] = repo
+	}
+	return repos
+}
+
+func isTokenLimitExceeded(err error) bool {
+	appErr, ok := err.(AppError)
+	return ok && appErr.ErrorCode == ErrTokenLimitExceeded.ErrorCode
+}
+
+func TestConcurrentInsertsDontExceedTheTokenLimit(t *testing.T) {
+	for name, repo := range tokenRepos(t) {
+		t.Run(name, func(t *testing.T) {
+			consumerID := uuid.NewV4().String()
+			defer repo.DeleteByConsumerID(consumerID)
+
+			var wg sync.WaitGroup
+			var mutex sync.Mutex
+			inserted, rejected := 0, 0
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, err := repo.InsertWithLimit(newTestToken(consumerID), 3, false)
+					mutex.Lock()
+					defer mutex.Unlock()
+					switch {
+					case err == nil:
+						inserted++
+					case isTokenLimitExceeded(err):
+						rejected++
+					default:
+						t.Error(err)
+					}
+				}()
+			}
+			wg.Wait()
+
+			tokens, err := repo.GetByConsumerID(consumerID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if inserted != 3 || rejected != 17 || len(tokens) != 3 {
+				t.Fatalf("inserted %d, rejected %d, stored %d, want 3, 17 and 3", inserted, rejected, len(tokens))
+			}
+		})
+	}
+}
+
+func TestInsertWithLimitEvictsTheOldestTokens(t *testing.T) {
+	for name, repo := range tokenRepos(t) {
+		t.Run(name, func(t *testing.T) {
+			consumerID := uuid.NewV4().String()
+			defer repo.DeleteByConsumerID(consumerID)
+
+			ids := []string{}
+			for i := 0; i < 4; i++ {
+				token := newTestToken(consumerID)
+				ids = append(ids, token.ID)
+				if _, err := repo.InsertWithLimit(token, 3, true); err != nil {
+					t.Fatal(err)
+				}
+				// created_at decides which token is the oldest
+				time.Sleep(time.Millisecond)
+			}
+			token := newTestToken(consumerID)
+			evicted, err := repo.InsertWithLimit(token, 3, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(evicted) != 1 || evicted[0] != ids[1] {
+				t.Fatalf("evicted %v, want the oldest token %s", evicted, ids[1])
+			}
+			if old, _ := repo.Get(ids[1]); old != nil {
+				t.Fatal("the evicted token must be deleted")
+			}
+			if current, _ := repo.Get(token.ID); current == nil {
+				t.Fatal("the new token must be stored")
+			}
+		})
+	}
+}
+
+func TestDeleteBatchDeletesAThousandTokens(t *testing.T) {
+	for name, repo := range tokenRepos(t) {
+		t.Run(name, func(t *testing.T) {
+			consumerID := uuid.NewV4().String()
+			defer repo.DeleteByConsumerID(consumerID)
+
+			ids := []string{}
+			for i := 0; i < 1000; i++ {
+				token := newTestToken(consumerID)
+				if err := repo.Insert(token); err != nil {
+					t.Fatal(err)
+				}
+				ids = append(ids, token.ID)
+			}
+			kept := newTestToken(consumerID)
+			if err := repo.Insert(kept); err != nil {
+				t.Fatal(err)
+			}
+			missing := uuid.NewV4().String()
+
+			deleted, err := repo.DeleteBatch(append(ids, missing))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(deleted) != 1000 {
+				t.Fatalf("%d tokens were deleted, want 1000", len(deleted))
+			}
+			for _, id := range deleted {
+				if id == missing {
+					t.Fatal("a missing token can't be reported as deleted")
+				}
+			}
+			for _, id := range []string{ids[0], ids[999]} {
+				if token, err := repo.Get(id); err != nil || token != nil {
+					t.Fatalf("token %s is still stored, %v", id, err)
+				}
+			}
+			if token, err := repo.Get(kept.ID); err != nil || token == nil {
+				t.Fatalf("the token which wasn't listed must be kept, %v", err)
+			}
+		})
+	}
+}
+
+func TestSetExpiresInReportsTheAbsoluteExpiration(t *testing.T) {
+	now := time.Now().UTC()
+	token := &Token{CreatedAt: now.Add(-time.Minute), Expiration: now.Add(time.Minute)}
+
+	token.SetExpiresIn(TokenSetting{ExpirationMode: "absolute"})
+	if token.AbsoluteExpiration == nil || !token.AbsoluteExpiration.Equal(token.Expiration) {
+		t.Fatalf("absolute mode: absolute_expiration = %v, want the expiration", token.AbsoluteExpiration)
+	}
+	if token.ExpiresIn < 58 || token.ExpiresIn > 60 {
+		t.Fatalf("expires_in = %d, want about 60", token.ExpiresIn)
+	}
+
+	token.SetExpiresIn(TokenSetting{ExpirationMode: "sliding"})
+	if token.AbsoluteExpiration != nil {
+		t.Fatal("sliding mode without max_lifetime has no absolute expiration")
+	}
+
+	token.SetExpiresIn(TokenSetting{ExpirationMode: "sliding", MaxLifetime: 3600})
+	if want := token.CreatedAt.Add(time.Hour); token.AbsoluteExpiration == nil || !token.AbsoluteExpiration.Equal(want) {
+		t.Fatalf("sliding mode with max_lifetime: absolute_expiration = %v, want %v", token.AbsoluteExpiration, want)
+	}
+}
+
+func TestMaxLifetimeCapsTheToken(t *testing.T) {
+	setting := TokenSetting{Timeout: 60, ExpirationMode: "sliding", MaxLifetime: 100}
+	now := time.Now().UTC()
+	token := &Token{CreatedAt: now.Add(-90 * time.Second), Expiration: now.Add(5 * time.Second)}
+
+	if !token.ShouldRenew(setting) {
+		t.Fatal("a token below max_lifetime must be renewed")
+	}
+	token.Renew(setting)
+	if want := token.CreatedAt.Add(100 * time.Second); !token.Expiration.Equal(want) {
+		t.Fatalf("expiration = %v, want the end of max_lifetime %v", token.Expiration, want)
+	}
+	if token.ShouldRenew(setting) {
+		t.Fatal("a token which reached max_lifetime must not be renewed")
+	}
+
+	// a token issued before max_lifetime was lowered
+	old := &Token{CreatedAt: now.Add(-200 * time.Second), Expiration: now.Add(time.Hour)}
+	if old.IsValid(setting) {
+		t.Fatal("a token past max_lifetime must be invalid")
+	}
+	if !old.IsValid(TokenSetting{Timeout: 60}) {
+		t.Fatal("without max_lifetime only the expiration counts")
+	}
+}
+
+func TestNewTokenIsCappedByMaxLifetime(t *testing.T) {
+	token := NewToken("consumer", TokenSetting{Timeout: 3600, MaxLifetime: 60})
+	if want := token.CreatedAt.Add(time.Minute); !token.Expiration.Equal(want) {
+		t.Fatalf("expiration = %v, want %v", token.Expiration, want)
+	}
+}
+
+func TestTokenMemStoreTouchKeepsDeletedTokens(t *testing.T) {
+	store := NewTokenMemStore(testSettings, testLogf)
+	if err := store.Touch("missing", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if token, _ := store.Get("missing"); token != nil {
+		t.Fatal("touch brought back a deleted token")
+	}
+}
+
+func TestTokenMemStoreJanitorRemovesExpiredTokens(t *testing.T) {
+	store := NewTokenMemStore(testSettings, testLogf)
+	valid := newTestToken("consumer")
+	expired := newTestToken("consumer")
+	for _, token := range []*Token{valid, expired} {
+		if err := store.Insert(token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Lock()
+	store.data[expired.ID].Expiration = time.Now().UTC().Add(-time.Second)
+	store.Unlock()
+
+	// expired tokens are hidden before the janitor removes them
+	if token, _ := store.Get(expired.ID); token != nil {
+		t.Fatal("an expired token must not be returned")
+	}
+
+	store.StartJanitor(10 * time.Millisecond)
+	deadline := time.Now().Add(time.Second)
+	for {
+		store.RLock()
+		_, stored := store.data[expired.ID]
+		count := len(store.data)
+		store.RUnlock()
+		if !stored {
+			if count != 1 {
+				t.Fatalf("%d tokens are left, want the valid one", count)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the janitor didn't remove the expired token")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	store.Close()
+	// Close can be called more than once
+	store.Close()
+	if token, _ := store.Get(valid.ID); token == nil {
+		t.Fatal("the valid token must be kept")
+	}
+}
+
+func TestUpdateKeepsTheExpirationOfTheToken(t *testing.T) {
+	for name, repo := range tokenRepos(t) {
+		t.Run(name, func(t *testing.T) {
+			consumerID := uuid.NewV4().String()
+			defer repo.DeleteByConsumerID(consumerID)
+			token := newTestToken(consumerID)
+			token.Expiration = time.Now().UTC().Add(10 * time.Minute)
+			if err := repo.Insert(token); err != nil {
+				t.Fatal(err)
+			}
+
+			token.LastUsedAt = time.Now().UTC()
+			if err := repo.Update(token); err != nil {
+				t.Fatal(err)
+			}
+			stored, err := repo.Get(token.ID)
+			if err != nil || stored == nil {
+				t.Fatalf("get = %v, %v", stored, err)
+			}
+			// mongodb keeps milliseconds
+			if stored.Expiration.Sub(token.Expiration).Abs() > time.Millisecond {
+				t.Fatalf("expiration = %v, want %v", stored.Expiration, token.Expiration)
+			}
+			if redisRepo, ok := repo.(*TokenRedis); ok {
+				ttl, err := redisRepo.client.PTTL("token:id:" + token.ID).Result()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ttl <= 9*time.Minute || ttl > 10*time.Minute {
+					t.Fatalf("ttl = %v, want the time until the expiration", ttl)
+				}
+			}
+
+			// an update to the past removes the token
+			token.Expiration = time.Now().UTC().Add(-time.Second)
+			if err := repo.Update(token); err != nil {
+				t.Fatal(err)
+			}
+			if stored, _ := repo.Get(token.ID); stored != nil {
+				t.Fatal("an expired token must not be returned")
+			}
+
+			missing := newTestToken(consumerID)
+			if err := repo.Update(missing); err == nil {
+				t.Fatal("a missing token must not be created by update")
+			}
+		})
+	}
+}
+
+func TestDeleteByConsumerIDDeletesEveryToken(t *testing.T) {
+	for name, repo := range tokenRepos(t) {
+		t.Run(name, func(t *testing.T) {
+			consumerID := uuid.NewV4().String()
+			otherID := uuid.NewV4().String()
+			defer repo.DeleteByConsumerID(otherID)
+			ids := []string{}
+			for i := 0; i < 5; i++ {
+				token := newTestToken(consumerID)
+				if err := repo.Insert(token); err != nil {
+					t.Fatal(err)
+				}
+				ids = append(ids, token.ID)
+			}
+			other := newTestToken(otherID)
+			if err := repo.Insert(other); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := repo.DeleteByConsumerID(consumerID); err != nil {
+				t.Fatal(err)
+			}
+			for _, id := range ids {
+				if token, _ := repo.Get(id); token != nil {
+					t.Fatalf("token %s of the consumer was kept", id)
+				}
+			}
+			if tokens, _ := repo.GetByConsumerID(consumerID); len(tokens) != 0 {
+				t.Fatalf("%d tokens of the consumer are left", len(tokens))
+			}
+			if token, _ := repo.Get(other.ID); token == nil {
+				t.Fatal("the token of another consumer must be kept")
+			}
+		})
+	}
+}
+
+func TestTokenRedisReturnsStoreErrors(t *testing.T) {
+	// nothing listens on the address
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	client := NewRedisClient(DataSetting{Address: addr, DB: "0"})
+	repo, err := NewTokenRedis(client, testSettings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	token := newTestToken("consumer")
+	calls := map[string]func() error{
+		"get":        func() error { _, err := repo.Get(token.ID); return err },
+		"consumer":   func() error { _, err := repo.GetByConsumerID("consumer"); return err },
+		"insert":     func() error { return repo.Insert(token) },
+		"update":     func() error { return repo.Update(token) },
+		"touch":      func() error { return repo.Touch(token.ID, time.Now()) },
+		"delete":     func() error { return repo.Delete(token.ID) },
+		"batch":      func() error { _, err := repo.DeleteBatch([]string{token.ID}); return err },
+		"byConsumer": func() error { return repo.DeleteByConsumerID("consumer") },
+	}
+	for name, call := range calls {
+		err := call()
+		var storeErr *TokenStoreError
+		if !errors.As(err, &storeErr) {
+			t.Errorf("%s: err = %v, want a token store error", name, err)
+			continue
+		}
+		if strings.Contains(storeErr.Key, token.ID) {
+			t.Errorf("%s: the token id must be masked in %s", name, storeErr.Key)
+		}
+	}
+}
+
+func TestTokenRedisReportsUndecodableTokens(t *testing.T) {
+	addr := os.Getenv("BIFROST_TEST_REDIS")
+	if len(addr) == 0 {
+		t.Skip("BIFROST_TEST_REDIS isn't set")
+	}
+	repo, err := NewTokenRedis(NewRedisClient(DataSetting{Address: addr, DB: "0"}), testSettings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := uuid.NewV4().String()
+	repo.client.Set("token:id:"+id, "{broken", time.Minute)
+	defer repo.client.Del("token:id:" + id)
+
+	_, err = repo.Get(id)
+	var storeErr *TokenStoreError
+	if !errors.As(err, &storeErr) || storeErr.Op != "decode" {
+		t.Fatalf("err = %v, want a decode error", err)
+	}
+}
+
+// BenchmarkTokenMongoPooling compares the pooled sessions of the token
+// repository with a dial per operation under 100 concurrent goroutines.
+// conns/op is how many connections were opened per lookup, the pooled
+// sessions reuse theirs.
+func BenchmarkTokenMongoPooling(b *testing.B) {
+	connectionString := os.Getenv("BIFROST_TEST_MONGODB")
+	if len(connectionString) == 0 {
+		b.Skip("BIFROST_TEST_MONGODB isn't set")
+	}
+	repo, err := NewTokenMongo(connectionString, 100, 5*time.Second, 5*time.Second, testSettings, testLogf)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer repo.Close()
+	token := newTestToken("bench-" + uuid.NewV4().String())
+	if err := repo.Insert(token); err != nil {
+		b.Fatal(err)
+	}
+	defer repo.Delete(token.ID)
+
+	lookups := map[string]func() error{
+		"pooled": func() error {
+			_, err := repo.Get(token.ID)
+			return err
+		},
+		"dial": func() error {
+			session, err := DialMongo(connectionString, 0, 5*time.Second, 5*time.Second)
+			if err != nil {
+				return err
+			}
+			defer session.Close()
+			var result Token
+			return session.DB("bifrost").C("tokens").FindId(token.ID).One(&result)
+		},
+	}
+	mgo.SetStats(true)
+	defer mgo.SetStats(false)
+	for _, name := range []string{"pooled", "dial"} {
+		lookup := lookups[name]
+		b.Run(name, func(b *testing.B) {
+			b.SetParallelism((100 + runtime.GOMAXPROCS(0) - 1) / runtime.GOMAXPROCS(0))
+			mgo.ResetStats()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := lookup(); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+			b.StopTimer()
+			stats := mgo.GetStats()
+			b.ReportMetric(float64(stats.MasterConns+stats.SlaveConns)/float64(b.N), "conns/op")
+		})
+	}
+}